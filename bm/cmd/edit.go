@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/john-cai/book-manager/models"
+	"github.com/john-cai/book-manager/responder"
+	"github.com/spf13/cobra"
+)
+
+var editCmd = &cobra.Command{
+	Use:   "edit book --isbn <isbn> | collection --name <id|name|slug>",
+	Short: "Edit a book or collection, refusing to overwrite changes made since it was read",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 || args[0] != "book" && args[0] != "collection" {
+			return errors.New("must specify either book or collection")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		switch args[0] {
+		case "book":
+			if isbn == "" {
+				fmt.Println("--isbn is required")
+				return
+			}
+			book, err := EditBook(isbn, func(b *models.Book) error {
+				if flags.Changed("title") {
+					b.Title = title
+				}
+				if flags.Changed("author") {
+					b.Author = author
+				}
+				if flags.Changed("description") {
+					b.Description = description
+				}
+				if flags.Changed("genres") {
+					b.Metadata.Genres = genres
+				}
+				if flags.Changed("published") {
+					publishedAt, precision, err := models.ParsePartialDate(published)
+					if err != nil {
+						return responder.ErrorResponse{Errors: []responder.Error{responder.Error{Field: "published", Message: err.Error()}}}
+					}
+					b.PublishedAt, b.PublishedPrecision = publishedAt, precision
+				}
+				return nil
+			})
+			if err != nil {
+				reportEditError("book "+isbn, err)
+				return
+			}
+			fmt.Printf("book %s successfully edited\n", book.Title)
+		case "collection":
+			if collectionName == "" {
+				fmt.Println("--name is required")
+				return
+			}
+			collection, err := EditCollection(collectionName, func(c *models.Collection) {
+				if flags.Changed("new-name") {
+					c.Name = newCollectionName
+				}
+				if flags.Changed("collection-description") {
+					c.Description = collectionDescription
+				}
+			})
+			if err != nil {
+				reportEditError("collection "+collectionName, err)
+				return
+			}
+			fmt.Printf("collection %s successfully edited\n", collection.Name)
+		}
+	},
+}
+
+// reportEditError explains an edit that was refused because what was
+// edited changed in the meantime, and reports any other error as usual
+func reportEditError(what string, err error) {
+	if errResp, ok := err.(responder.ErrorResponse); ok && errResp.Code == responder.CodeVersionConflict {
+		fmt.Printf("%s was changed by someone else while you were editing it, nothing was saved; run the edit again to apply it to the latest version\n", what)
+		return
+	}
+	reportError(err)
+}
+
+// EditBook calls the api to read a book, change it and save it back, as long
+// as nobody else saved it in between
+func EditBook(isbn string, change func(*models.Book) error) (models.Book, error) {
+	var book models.Book
+	bookURL := fmt.Sprintf("http://%s/api/v1/books/%s", bookmanagerURL, url.PathEscape(isbn))
+	tag, err := sendVersionedRequest(bookURL, http.MethodGet, "", nil, &book)
+	if err != nil {
+		return book, err
+	}
+	if err = change(&book); err != nil {
+		return book, err
+	}
+	book.Collections = nil
+	if _, err = sendVersionedRequest(bookURL, http.MethodPut, tag, &book, &book); err != nil {
+		return book, err
+	}
+	return book, nil
+}
+
+// EditCollection calls the api to read a collection, named by its id, name
+// or slug, change it and save it back, as long as nobody else saved it in
+// between
+func EditCollection(ref string, change func(*models.Collection)) (models.Collection, error) {
+	var collection models.Collection
+	collectionURL := fmt.Sprintf("http://%s/api/v1/collections/%s", bookmanagerURL, url.PathEscape(ref))
+	tag, err := sendVersionedRequest(collectionURL, http.MethodGet, "", nil, &collection)
+	if err != nil {
+		return collection, err
+	}
+	change(&collection)
+	collection.Books = nil
+	if _, err = sendVersionedRequest(collectionURL, http.MethodPut, tag, &collection, &collection); err != nil {
+		return collection, err
+	}
+	return collection, nil
+}
+
+var newCollectionName string
+
+func init() {
+	editCmd.Flags().StringVar(&isbn, "isbn", "", "isbn of the book to edit")
+	editCmd.Flags().StringVar(&title, "title", "", "new title of the book")
+	editCmd.Flags().StringVar(&author, "author", "", "new author of the book")
+	editCmd.Flags().StringVar(&description, "description", "", "new description of the book")
+	editCmd.Flags().StringVar(&published, "published", "", "new publication date of the book, as YYYY, YYYY-MM or YYYY-MM-DD")
+	editCmd.Flags().StringSliceVar(&genres, "genres", []string{}, "new genres of the book")
+
+	editCmd.Flags().StringVar(&collectionName, "name", "", "id, name or slug of the collection to edit")
+	editCmd.Flags().StringVar(&newCollectionName, "new-name", "", "new name of the collection")
+	editCmd.Flags().StringVar(&collectionDescription, "collection-description", "", "new description of the collection")
+
+	rootCmd.AddCommand(editCmd)
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/john-cai/book-manager/responder"
+	"github.com/labstack/gommon/log"
+)
+
+// problemHints say what to do about the errors the api reports, by their
+// code
+var problemHints = map[string]string{
+	responder.CodeISBNConflict:         "a book with this isbn is already in the catalog, use edit book to change it",
+	responder.CodeNameConflict:         "a collection with this name already exists, pick another name",
+	responder.CodeNotFound:             "it does not exist; if it was deleted, trash list shows what can be restored",
+	responder.CodeDeleteRestricted:     "it still belongs to collections, remove it from them before deleting it",
+	responder.CodeVersionConflict:      "it was changed by someone else in the meantime, nothing was saved; run the command again",
+	responder.CodePreconditionRequired: "the server only accepts edits of a known version, use edit to change it",
+	responder.CodeNotEmpty:             "a backup can only be restored into an empty catalog",
+	responder.CodeInvalidBackup:        "the file is not a complete backup made with export full",
+	responder.CodeBodyTooLarge:         "the request is larger than the server accepts",
+	responder.CodeInternal:             "the server ran into a problem, nothing was changed",
+	responder.CodeImportIncomplete:     "the import stopped part way, the books reported as created or updated were saved",
+}
+
+// reportError explains an error the api responded with, along with the
+// problems it found with the request's fields
+func reportError(err error) {
+	errResp, ok := err.(responder.ErrorResponse)
+	if !ok {
+		log.Error("Something went horribly wrong and I'm so sorry")
+		return
+	}
+	if hint, ok := problemHints[errResp.Code]; ok {
+		fmt.Println(hint)
+	} else if errResp.Detail != "" && len(errResp.Errors) == 0 {
+		fmt.Println(errResp.Detail)
+	}
+	for _, e := range errResp.Errors {
+		if e.Field == "" {
+			fmt.Println(e.Message)
+			continue
+		}
+		fmt.Printf("problem with %v: %v\n", e.Field, e.Message)
+	}
+	if errResp.Status >= http.StatusInternalServerError && errResp.RequestID != "" {
+		fmt.Printf("the request id to report is %s\n", errResp.RequestID)
+	}
+}
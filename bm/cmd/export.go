@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/john-cai/book-manager/models"
+	"github.com/john-cai/book-manager/responder"
+	"github.com/spf13/cobra"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export books|full",
+	Short: "Export the books as CSV or JSON Lines, or a full backup of the catalog",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 || (args[0] != "books" && args[0] != "full") {
+			return fmt.Errorf("usage: export books|full")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		query := url.Values{}
+		path := "export/full"
+		if args[0] == "books" {
+			path = "books/export"
+			query = exportBooksQuery(exportFormat, title, author, published, genres, genresMatch, sortBy)
+		}
+		if err := Export(path, query, exportOutput); err != nil {
+			reportError(err)
+		}
+	},
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore <backup.jsonl>",
+	Short: "Restore a full backup, made with export full, into an empty catalog",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		summary, err := Restore(args[0], printProgress)
+		if err != nil {
+			reportError(err)
+			return
+		}
+		fmt.Printf("restored %d books, %d collections, %d memberships and %d history events\n", summary.Books, summary.Collections, summary.Memberships, summary.Events)
+	},
+}
+
+// exportBooksQuery builds the query of a books export, which takes the same
+// filters as listing books
+func exportBooksQuery(format, title, author, published string, genres []string, genresMatch, sortBy string) url.Values {
+	query := url.Values{}
+	if format != "" {
+		query.Set("format", format)
+	}
+	if title != "" {
+		query.Set("title", title)
+	}
+	if author != "" {
+		query.Set("author", author)
+	}
+	query = publishedQuery(query, published)
+	if len(genres) > 0 {
+		query.Set("genres", strings.Join(genres, ","))
+	}
+	if genresMatch != "" {
+		query.Set("genres_match", genresMatch)
+	}
+	if sortBy != "" {
+		query.Set("sort", sortBy)
+	}
+	return query
+}
+
+// Export calls the api to export books or a full backup and copies the
+// export, as it arrives, to output, or to stdout when output is empty. The
+// output file is only created once the export has started.
+func Export(path string, query url.Values, output string) error {
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/v1/%s?%s", bookmanagerURL, path, query.Encode()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var errResp responder.ErrorResponse
+		if err = json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+			return err
+		}
+		return errResp
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Restore calls the api to restore the full backup in a file. progress is
+// told how much of the file has been sent as it goes.
+func Restore(path string, progress func(sent, total int64)) (models.BackupSummary, error) {
+	var summary models.BackupSummary
+	f, err := os.Open(path)
+	if err != nil {
+		return summary, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return summary, err
+	}
+
+	body := &progressReader{r: f, total: info.Size(), progress: progress}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/api/v1/import/full", bookmanagerURL), body)
+	if err != nil {
+		return summary, err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", importTypes["jsonl"])
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return summary, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var errResp responder.ErrorResponse
+		if err = json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+			return summary, err
+		}
+		return summary, errResp
+	}
+	err = json.NewDecoder(resp.Body).Decode(&summary)
+	return summary, err
+}
+
+var (
+	exportFormat string
+	exportOutput string
+)
+
+func init() {
+	exportCmd.Flags().StringVar(&exportFormat, "format", "", "format of a books export, csv or jsonl (default)")
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "file to write the export to instead of stdout")
+	exportCmd.Flags().StringVar(&title, "title", "", "only export books with this title")
+	exportCmd.Flags().StringVar(&author, "author", "", "only export books by this author")
+	exportCmd.Flags().StringVar(&published, "published", "", "only export books published on this date or in this from..to range")
+	exportCmd.Flags().StringSliceVar(&genres, "genres", []string{}, "only export books with these genres")
+	exportCmd.Flags().StringVar(&genresMatch, "genres-match", "", "whether books need any (default) or all of --genres")
+	exportCmd.Flags().StringVar(&sortBy, "sort", "", "comma separated fields to sort by, prefix with - for descending (e.g. title,-published_at)")
+
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(restoreCmd)
+}
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/john-cai/book-manager/models"
+	"github.com/john-cai/book-manager/responder"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var importCmd = &cobra.Command{
+	Use:   "import books <file.csv|file.jsonl>",
+	Short: "Add books in bulk from a CSV or JSON Lines file",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 || args[0] != "books" {
+			return fmt.Errorf("usage: import books <file.csv|file.jsonl>")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		report, err := ImportBooks(args[1], importFormat, importMap, onConflict, dryRun, printProgress)
+		if err != nil {
+			reportError(err)
+			if errResp, ok := err.(responder.ErrorResponse); ok && errResp.Code == responder.CodeImportIncomplete {
+				fmt.Printf("%d created and %d updated before it stopped\n", report.Created, report.Updated)
+			}
+			return
+		}
+		if report.DryRun {
+			fmt.Print("dry run, nothing was saved: ")
+		}
+		fmt.Printf("%d created, %d updated, %d skipped, %d failed\n", report.Created, report.Updated, report.Skipped, report.Failed)
+		if report.Failed == 0 {
+			return
+		}
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetHeader([]string{"Line", "ISBN", "Problem"})
+		for _, result := range report.Results {
+			if result.Status != models.ImportFailed {
+				continue
+			}
+			var problems []string
+			for _, e := range result.Errors {
+				if e.Field != "" {
+					problems = append(problems, fmt.Sprintf("%s %s", e.Field, e.Message))
+				} else {
+					problems = append(problems, e.Message)
+				}
+			}
+			table.Append([]string{strconv.Itoa(result.Line), result.ISBN, strings.Join(problems, "; ")})
+		}
+		table.Render()
+	},
+}
+
+// importTypes are the media types of the files that can be imported, by
+// format
+var importTypes = map[string]string{
+	"csv":   "text/csv",
+	"jsonl": "application/x-ndjson",
+}
+
+// ImportBooks calls the api to import the books in a CSV or JSON Lines file.
+// The format is csv or jsonl, or taken from the file's extension when it is
+// empty. progress is told how much of the file has been sent as it goes.
+func ImportBooks(path, format, columns, onConflict string, dryRun bool, progress func(sent, total int64)) (models.ImportReport, error) {
+	var report models.ImportReport
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+		if format == "ndjson" {
+			format = "jsonl"
+		}
+	}
+	contentType, ok := importTypes[format]
+	if !ok {
+		return report, responder.ErrorResponse{Errors: []responder.Error{{Field: "format", Message: "must be csv or jsonl"}}}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return report, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return report, err
+	}
+
+	query := url.Values{}
+	if onConflict != "" {
+		query.Set("on_conflict", onConflict)
+	}
+	if dryRun {
+		query.Set("dry_run", "true")
+	}
+	if columns != "" {
+		query.Set("map", columns)
+	}
+	body := &progressReader{r: f, total: info.Size(), progress: progress}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/api/v1/books/import?%s", bookmanagerURL, query.Encode()), body)
+	if err != nil {
+		return report, err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return report, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// an import that stopped part way reports what it saved along with
+		// the problem
+		var problem struct {
+			responder.ErrorResponse
+			models.ImportReport
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&problem); err != nil {
+			return report, err
+		}
+		return problem.ImportReport, problem.ErrorResponse
+	}
+	err = json.NewDecoder(resp.Body).Decode(&report)
+	return report, err
+}
+
+// progressReader tells progress how much has been read from r so far
+type progressReader struct {
+	r        io.Reader
+	sent     int64
+	total    int64
+	progress func(sent, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.sent += int64(n)
+	if n > 0 && p.progress != nil {
+		p.progress(p.sent, p.total)
+	}
+	return n, err
+}
+
+// printProgress draws a progress bar on stderr, finishing the line once
+// everything has been sent
+func printProgress(sent, total int64) {
+	const width = 40
+	done := int64(width)
+	percent := int64(100)
+	if total > 0 {
+		done, percent = sent*width/total, sent*100/total
+	}
+	fmt.Fprintf(os.Stderr, "\r[%s%s] %3d%%", strings.Repeat("=", int(done)), strings.Repeat(" ", width-int(done)), percent)
+	if sent >= total {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+var (
+	importFormat string
+	importMap    string
+	onConflict   string
+	dryRun       bool
+)
+
+func init() {
+	importCmd.Flags().BoolVar(&dryRun, "dry-run", false, "report what the import would do without saving anything")
+	importCmd.Flags().StringVar(&onConflict, "on-conflict", "skip", "what to do with books that already exist: skip, update or fail")
+	importCmd.Flags().StringVar(&importFormat, "format", "", "csv or jsonl, by default taken from the file extension")
+	importCmd.Flags().StringVar(&importMap, "map", "", "maps CSV headers to fields as header:field pairs (e.g. \"Book Title:title,Writer:author\")")
+
+	rootCmd.AddCommand(importCmd)
+}
@@ -6,9 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
-	"time"
+	"strings"
 
 	"github.com/john-cai/book-manager/models"
 	"github.com/john-cai/book-manager/responder"
@@ -45,28 +46,16 @@ var addCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		switch args[0] {
 		case "book":
-			err := AddBook(isbn, title, author, description, publishedYear, genres)
+			err := AddBook(isbn, title, author, description, published, genres)
 			if err != nil {
-				if errResp, ok := err.(responder.ErrorResponse); ok {
-					for _, e := range errResp.Errors {
-						fmt.Printf("problem with %v: %v\n", e.Field, e.Message)
-					}
-					return
-				}
-				fmt.Println("Something went horribly wrong and I'm so sorry")
+				reportError(err)
 				return
 			}
 			fmt.Printf("%s successfully added to books\n", title)
 		case "collection":
 			collection, err := AddCollection(collectionName, collectionDescription)
 			if err != nil {
-				if errResp, ok := err.(responder.ErrorResponse); ok {
-					for _, e := range errResp.Errors {
-						fmt.Printf("problem with %v: %v\n", e.Field, e.Message)
-					}
-					return
-				}
-				fmt.Println("Something went horribly wrong and I'm so sorry")
+				reportError(err)
 				return
 			}
 			fmt.Printf("collection %s successfully added to collections with id %d\n", collectionName, collection.ID)
@@ -88,48 +77,37 @@ var viewCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		switch args[0] {
 		case "books":
-			books, err := ViewBooks(title, author, description, publishedYear, genres)
+			books, err := ViewBooks(title, author, description, published, genres, genresMatch, limit, cursor, sortBy)
 			if err != nil {
-				if errResp, ok := err.(responder.ErrorResponse); ok {
-					for _, e := range errResp.Errors {
-						fmt.Printf("problem with %v: %v\n", e.Field, e.Message)
-					}
-					return
-				}
-				log.Error("Something went horribly wrong and I'm so sorry")
+				reportError(err)
 				return
 			}
 			table := tablewriter.NewWriter(os.Stdout)
 			table.SetHeader([]string{"ISBN", "Title", "Author", "Description", "Published"})
-			for _, book := range books {
+			for _, book := range books.Results {
 				table.Append([]string{
 					book.ISBN,
 					book.Title,
 					book.Author,
 					book.Description,
-					book.PublishedAt.Format("2006"),
+					book.PublishedDate(),
 				})
 			}
 			table.Render()
+			printPageInfo(len(books.Results), books.Total, books.NextCursor, books.PrevCursor)
 			return
 		case "book":
 			//TODO: implement me
 		case "collections":
 			//TODO: implement me
-			collections, err := ViewCollections()
+			collections, err := ViewCollections(limit, cursor, sortBy)
 			if err != nil {
-				if errResp, ok := err.(responder.ErrorResponse); ok {
-					for _, e := range errResp.Errors {
-						fmt.Printf("problem with %v: %v\n", e.Field, e.Message)
-					}
-					return
-				}
-				log.Error("Something went horribly wrong and I'm so sorry")
+				reportError(err)
 				return
 			}
 			table := tablewriter.NewWriter(os.Stdout)
 			table.SetHeader([]string{"ID", "Name", "Description", "Books"})
-			for _, collection := range collections {
+			for _, collection := range collections.Results {
 				table.Append([]string{
 					strconv.Itoa(collection.ID),
 					collection.Name,
@@ -138,16 +116,136 @@ var viewCmd = &cobra.Command{
 				})
 			}
 			table.Render()
+			printPageInfo(len(collections.Results), collections.Total, collections.NextCursor, collections.PrevCursor)
 			return
 		case "collection":
-			//TODO: implement me
+			if collectionName == "" {
+				log.Error("--name is required")
+				return
+			}
+			collection, err := ViewCollection(collectionName)
+			if err != nil {
+				reportError(err)
+				return
+			}
+			fmt.Printf("%s (id %d)\n", collection.Name, collection.ID)
+			if collection.Description != "" {
+				fmt.Println(collection.Description)
+			}
+			table := tablewriter.NewWriter(os.Stdout)
+			table.SetHeader([]string{"ISBN", "Title", "Author", "Published"})
+			for _, book := range collection.Books {
+				table.Append([]string{
+					book.ISBN,
+					book.Title,
+					book.Author,
+					book.PublishedDate(),
+				})
+			}
+			table.Render()
+			return
 		default:
 			log.Error("unrecognized command")
 		}
 	},
 }
 
+var searchCmd = &cobra.Command{
+	Use:   "search books <query>",
+	Short: "Search books by title, author and description, best match first",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 || args[0] != "books" {
+			return errors.New("usage: search books <query>")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		books, err := SearchBooks(strings.Join(args[1:], " "), title, author, published, limit, cursor)
+		if err != nil {
+			reportError(err)
+			return
+		}
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetHeader([]string{"Rank", "ISBN", "Title", "Author", "Match"})
+		for _, book := range books.Results {
+			table.Append([]string{
+				strconv.FormatFloat(book.Rank, 'f', 2, 64),
+				book.ISBN,
+				book.Title,
+				book.Author,
+				bestHighlight(book.Highlights),
+			})
+		}
+		table.Render()
+		printPageInfo(len(books.Results), books.Total, books.NextCursor, books.PrevCursor)
+	},
+}
+
+// bestHighlight picks the most telling highlighted snippet of a search result
+// and swaps the html markers for brackets
+func bestHighlight(highlights map[string]string) string {
+	for _, field := range []string{"description", "title", "author"} {
+		if h, ok := highlights[field]; ok {
+			return strings.NewReplacer("<mark>", "[", "</mark>", "]").Replace(h)
+		}
+	}
+	return ""
+}
+
+// printPageInfo tells the user how to reach the neighbouring pages of a listing
+func printPageInfo(count, total int, next, prev string) {
+	fmt.Printf("showing %d of %d\n", count, total)
+	if next != "" {
+		fmt.Printf("next page: --cursor %s\n", next)
+	}
+	if prev != "" {
+		fmt.Printf("previous page: --cursor %s\n", prev)
+	}
+}
+
+// publishedQuery adds a --published date, or a from..to range where either
+// end may be left out, to a listing query
+func publishedQuery(query url.Values, published string) url.Values {
+	if published == "" {
+		return query
+	}
+	from, to, isRange := strings.Cut(published, "..")
+	if !isRange {
+		query.Set("published", published)
+		return query
+	}
+	if from != "" {
+		query.Set("published_from", from)
+	}
+	if to != "" {
+		query.Set("published_to", to)
+	}
+	return query
+}
+
+// pageQuery adds the pagination and sort parameters to a listing query
+func pageQuery(query url.Values, limit int, cursor, sortBy string) url.Values {
+	if limit != 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	if sortBy != "" {
+		query.Set("sort", sortBy)
+	}
+	return query
+}
+
 func sendRequest(url string, method string, payload interface{}, response interface{}) error {
+	_, err := sendVersionedRequest(url, method, "", payload, response)
+	return err
+}
+
+// sendVersionedRequest is sendRequest for a single book or collection: it
+// sends ifMatch as the If-Match header, unless it is empty, and returns the
+// ETag of the version in the response
+func sendVersionedRequest(url string, method string, ifMatch string, payload interface{}, response interface{}) (string, error) {
 	client := http.Client{}
 	var b bytes.Buffer
 	var err error
@@ -155,37 +253,41 @@ func sendRequest(url string, method string, payload interface{}, response interf
 
 	if payload != nil {
 		if err = json.NewEncoder(&b).Encode(payload); err != nil {
-			return err
+			return "", err
 		}
 
 	}
 	req, err := http.NewRequest(method, url, &b)
 	if err != nil {
-		return err
+		return "", err
+	}
+	req.Header.Set("Accept", responder.JSONType)
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 		if err = json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
-			return err
+			return "", err
 		}
-		return errResp
+		return "", errResp
 	}
 
 	if response != nil {
 		if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
-			return err
+			return "", err
 		}
 	}
-	return nil
+	return resp.Header.Get("ETag"), nil
 }
 
 // AddBook calls the api to add a book
-func AddBook(isbn, title, author, description string, publishedYear int, genres []string) error {
+func AddBook(isbn, title, author, description, published string, genres []string) error {
 	book := models.Book{
 		ISBN:        isbn,
 		Title:       title,
@@ -193,10 +295,14 @@ func AddBook(isbn, title, author, description string, publishedYear int, genres
 		Description: description,
 		Metadata:    models.Metadata{Genres: genres},
 	}
-	if publishedYear != 0 {
-		book.PublishedAt = time.Date(publishedYear, 0, 0, 0, 0, 0, 0, time.UTC)
+	if published != "" {
+		publishedAt, precision, err := models.ParsePartialDate(published)
+		if err != nil {
+			return responder.ErrorResponse{Errors: []responder.Error{responder.Error{Field: "published", Message: err.Error()}}}
+		}
+		book.PublishedAt, book.PublishedPrecision = publishedAt, precision
 	}
-	if err := sendRequest(fmt.Sprintf("http://%s/books", bookmanagerURL), http.MethodPost, &book, nil); err != nil {
+	if err := sendRequest(fmt.Sprintf("http://%s/api/v1/books", bookmanagerURL), http.MethodPost, &book, nil); err != nil {
 		return err
 	}
 	return nil
@@ -207,21 +313,50 @@ func ViewBook(isbn string, bookManagerURL string) error {
 	return nil
 }
 
-// EditBook calls the api to edit a book
-func EditBook(isbn, title, author, description string, publishedYear int, genres []string) error {
-	return nil
-}
-
 // RemoveBook calls the api to remove a book
 func RemoveBook(isbn string, bookManagerURL string) error {
 	return nil
 }
 
 // ViewBooks calls the api to view book with filter criteria
-func ViewBooks(title, author, description string, publishedYear int, genres []string) ([]models.Book, error) {
-	var books []models.Book
-	if err := sendRequest(fmt.Sprintf("http://%s/books", bookmanagerURL), http.MethodGet, nil, &books); err != nil {
-		return nil, err
+func ViewBooks(title, author, description, published string, genres []string, genresMatch string, limit int, cursor, sortBy string) (models.BookList, error) {
+	var books models.BookList
+	query := url.Values{}
+	if title != "" {
+		query.Set("title", title)
+	}
+	if author != "" {
+		query.Set("author", author)
+	}
+	query = publishedQuery(query, published)
+	if len(genres) > 0 {
+		query.Set("genres", strings.Join(genres, ","))
+	}
+	if genresMatch != "" {
+		query.Set("genres_match", genresMatch)
+	}
+	query = pageQuery(query, limit, cursor, sortBy)
+	if err := sendRequest(fmt.Sprintf("http://%s/api/v1/books?%s", bookmanagerURL, query.Encode()), http.MethodGet, nil, &books); err != nil {
+		return books, err
+	}
+	return books, nil
+}
+
+// SearchBooks calls the api to search books, optionally narrowed by filter criteria
+func SearchBooks(q, title, author, published string, limit int, cursor string) (models.BookList, error) {
+	var books models.BookList
+	query := url.Values{}
+	query.Set("q", q)
+	if title != "" {
+		query.Set("title", title)
+	}
+	if author != "" {
+		query.Set("author", author)
+	}
+	query = publishedQuery(query, published)
+	query = pageQuery(query, limit, cursor, "")
+	if err := sendRequest(fmt.Sprintf("http://%s/api/v1/books?%s", bookmanagerURL, query.Encode()), http.MethodGet, nil, &books); err != nil {
+		return books, err
 	}
 	return books, nil
 }
@@ -232,26 +367,28 @@ func AddCollection(name, description string) (models.Collection, error) {
 		Name:        name,
 		Description: description,
 	}
-	if err := sendRequest(fmt.Sprintf("http://%s/collections", bookmanagerURL), http.MethodPost, &collection, &collection); err != nil {
+	if err := sendRequest(fmt.Sprintf("http://%s/api/v1/collections", bookmanagerURL), http.MethodPost, &collection, &collection); err != nil {
 		return collection, err
 	}
 	return collection, nil
 }
 
-// ViewCollection calls the api get the details of a collection
-func ViewCollection(id int) (models.Collection, error) {
+// ViewCollection calls the api get the details of a collection, named by its
+// id, name or slug
+func ViewCollection(ref string) (models.Collection, error) {
 	var collection models.Collection
-	if err := sendRequest(fmt.Sprintf("http://%s/collections/%d", bookmanagerURL, id), http.MethodGet, &collection, nil); err != nil {
+	if err := sendRequest(fmt.Sprintf("http://%s/api/v1/collections/%s", bookmanagerURL, url.PathEscape(ref)), http.MethodGet, nil, &collection); err != nil {
 		return models.Collection{}, err
 	}
 	return collection, nil
 }
 
 // ViewCollections calls the api get the details of all collections
-func ViewCollections() ([]models.Collection, error) {
-	var collections []models.Collection
-	if err := sendRequest(fmt.Sprintf("http://%s/collections", bookmanagerURL), http.MethodGet, &collections, nil); err != nil {
-		return nil, err
+func ViewCollections(limit int, cursor, sortBy string) (models.CollectionList, error) {
+	var collections models.CollectionList
+	query := pageQuery(url.Values{}, limit, cursor, sortBy)
+	if err := sendRequest(fmt.Sprintf("http://%s/api/v1/collections?%s", bookmanagerURL, query.Encode()), http.MethodGet, nil, &collections); err != nil {
+		return collections, err
 	}
 	return collections, nil
 }
@@ -262,8 +399,12 @@ var (
 	title          string
 	author         string
 	description    string
-	publishedYear  int
+	published      string
 	genres         []string
+	genresMatch    string
+	limit          int
+	cursor         string
+	sortBy         string
 )
 
 var (
@@ -280,7 +421,7 @@ func init() {
 	addCmd.Flags().StringVar(&title, "title", "", "title of the book")
 	addCmd.Flags().StringVar(&author, "author", "", "author of the book")
 	addCmd.Flags().StringVar(&description, "description", "", "description of the book")
-	addCmd.Flags().IntVar(&publishedYear, "published", 0, "year the book was published")
+	addCmd.Flags().StringVar(&published, "published", "", "date the book was published, as YYYY, YYYY-MM or YYYY-MM-DD")
 	addCmd.Flags().StringSliceVar(&genres, "genres", []string{}, "genres of the book")
 
 	addCmd.Flags().StringVar(&collectionName, "name", "", "name of the collection")
@@ -290,12 +431,24 @@ func init() {
 	viewCmd.Flags().StringVar(&title, "title", "", "title of the book")
 	viewCmd.Flags().StringVar(&author, "author", "", "author of the book")
 	viewCmd.Flags().StringVar(&description, "description", "", "description of the book")
-	viewCmd.Flags().IntVar(&publishedYear, "published", 0, "year the book was published")
+	viewCmd.Flags().StringVar(&published, "published", "", "date or from..to range the book was published in (e.g. 1894, 1890..1900, 1901-10..)")
 	viewCmd.Flags().StringSliceVar(&genres, "genres", []string{}, "genres of the book")
+	viewCmd.Flags().StringVar(&genresMatch, "genres-match", "", "whether books need any (default) or all of --genres")
+	viewCmd.Flags().StringVar(&collectionName, "name", "", "id, name or slug of the collection")
+	viewCmd.Flags().IntVar(&limit, "limit", 0, "number of results per page")
+	viewCmd.Flags().StringVar(&cursor, "cursor", "", "cursor of the page to show, as printed after a listing")
+	viewCmd.Flags().StringVar(&sortBy, "sort", "", "comma separated fields to sort by, prefix with - for descending (e.g. title,-published_at)")
+
+	searchCmd.Flags().StringVar(&title, "title", "", "only search books with this title")
+	searchCmd.Flags().StringVar(&author, "author", "", "only search books by this author")
+	searchCmd.Flags().StringVar(&published, "published", "", "only search books published on this date or in this from..to range")
+	searchCmd.Flags().IntVar(&limit, "limit", 0, "number of results per page")
+	searchCmd.Flags().StringVar(&cursor, "cursor", "", "cursor of the page to show, as printed after a listing")
 
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(addCmd)
 	rootCmd.AddCommand(viewCmd)
+	rootCmd.AddCommand(searchCmd)
 }
 
 func Execute() {
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/john-cai/book-manager/models"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var trashCmd = &cobra.Command{
+	Use:   "trash list|restore|purge",
+	Short: "List, restore or permanently delete deleted books and collections",
+}
+
+var trashListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List deleted books and collections, most recently deleted first",
+	Run: func(cmd *cobra.Command, args []string) {
+		trash, err := ViewTrash(deletedFrom, deletedTo)
+		if err != nil {
+			reportError(err)
+			return
+		}
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetHeader([]string{"Type", "ISBN/ID", "Title/Name", "Deleted"})
+		for _, book := range trash.Books {
+			table.Append([]string{"book", book.ISBN, book.Title, book.DeletedAt.Format(time.RFC3339)})
+		}
+		for _, collection := range trash.Collections {
+			table.Append([]string{"collection", strconv.Itoa(collection.ID), collection.Name, collection.DeletedAt.Format(time.RFC3339)})
+		}
+		table.Render()
+	},
+}
+
+// trashTargetArgs checks a restore or purge names a book by isbn or a
+// collection by id
+func trashTargetArgs(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 || args[0] != "book" && args[0] != "collection" {
+		return fmt.Errorf("usage: trash %s book <isbn> | collection <id>", cmd.Name())
+	}
+	return nil
+}
+
+var trashRestoreCmd = &cobra.Command{
+	Use:   "restore book <isbn> | collection <id>",
+	Short: "Take a book or collection out of the trash, along with its memberships",
+	Args:  trashTargetArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		switch args[0] {
+		case "book":
+			book, err := RestoreBook(args[1])
+			if err != nil {
+				reportError(err)
+				return
+			}
+			fmt.Printf("book %s successfully restored\n", book.Title)
+		case "collection":
+			collection, err := RestoreCollection(args[1])
+			if err != nil {
+				reportError(err)
+				return
+			}
+			fmt.Printf("collection %s successfully restored with %d books\n", collection.Name, len(collection.Books))
+		}
+	},
+}
+
+var trashPurgeCmd = &cobra.Command{
+	Use:   "purge book <isbn> | collection <id>",
+	Short: "Permanently delete a book or collection, whether or not it is in the trash",
+	Args:  trashTargetArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+		switch args[0] {
+		case "book":
+			err = Purge("books", args[1])
+		case "collection":
+			err = Purge("collections", args[1])
+		}
+		if err != nil {
+			reportError(err)
+			return
+		}
+		fmt.Printf("%s %s permanently deleted\n", args[0], args[1])
+	},
+}
+
+// ViewTrash calls the api to list deleted books and collections
+func ViewTrash(deletedFrom, deletedTo string) (models.Trash, error) {
+	var trash models.Trash
+	query := url.Values{}
+	if deletedFrom != "" {
+		query.Set("deleted_from", deletedFrom)
+	}
+	if deletedTo != "" {
+		query.Set("deleted_to", deletedTo)
+	}
+	if err := sendRequest(fmt.Sprintf("http://%s/api/v1/trash?%s", bookmanagerURL, query.Encode()), http.MethodGet, nil, &trash); err != nil {
+		return trash, err
+	}
+	return trash, nil
+}
+
+// RestoreBook calls the api to take a book out of the trash
+func RestoreBook(isbn string) (models.Book, error) {
+	var book models.Book
+	if err := sendRequest(fmt.Sprintf("http://%s/api/v1/books/%s/restore", bookmanagerURL, url.PathEscape(isbn)), http.MethodPost, nil, &book); err != nil {
+		return book, err
+	}
+	return book, nil
+}
+
+// RestoreCollection calls the api to take a collection out of the trash
+func RestoreCollection(id string) (models.Collection, error) {
+	var collection models.Collection
+	if err := sendRequest(fmt.Sprintf("http://%s/api/v1/collections/%s/restore", bookmanagerURL, url.PathEscape(id)), http.MethodPost, nil, &collection); err != nil {
+		return collection, err
+	}
+	return collection, nil
+}
+
+// Purge calls the api to permanently delete the book or collection at
+// /resource/key
+func Purge(resource, key string) error {
+	return sendRequest(fmt.Sprintf("http://%s/api/v1/%s/%s?purge=true", bookmanagerURL, resource, url.PathEscape(key)), http.MethodDelete, nil, nil)
+}
+
+var (
+	deletedFrom string
+	deletedTo   string
+)
+
+func init() {
+	trashListCmd.Flags().StringVar(&deletedFrom, "deleted-from", "", "only list things deleted at or after this RFC3339 time or YYYY[-MM[-DD]] date")
+	trashListCmd.Flags().StringVar(&deletedTo, "deleted-to", "", "only list things deleted before this RFC3339 time, or up to the end of this YYYY[-MM[-DD]] date")
+
+	trashCmd.AddCommand(trashListCmd)
+	trashCmd.AddCommand(trashRestoreCmd)
+	trashCmd.AddCommand(trashPurgeCmd)
+	rootCmd.AddCommand(trashCmd)
+}
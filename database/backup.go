@@ -0,0 +1,57 @@
+package database
+
+import (
+	"errors"
+	"io"
+
+	"github.com/john-cai/book-manager/models"
+)
+
+// ErrNotEmpty is returned when a backup is restored into a store that
+// already has books or collections
+var ErrNotEmpty = errors.New("the store is not empty")
+
+// restoreTx is what restoring a backup needs from a backend, all within one
+// transaction. The inserts write rows as they are, keys, versions and
+// timestamps included.
+type restoreTx interface {
+	isEmpty() (bool, error)
+	insertBook(b *models.Book) error
+	insertCollection(c *models.Collection) error
+	insertMembership(m *models.BookCollection) error
+	insertEvent(e *models.CollectionEvent) error
+}
+
+// restoreRecords inserts the records next returns until io.EOF, as long as
+// the store is empty to begin with
+func restoreRecords(tx restoreTx, next func() (models.BackupRecord, error)) error {
+	empty, err := tx.isEmpty()
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return ErrNotEmpty
+	}
+	for {
+		record, err := next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case record.Book != nil:
+			err = tx.insertBook(record.Book)
+		case record.Collection != nil:
+			err = tx.insertCollection(record.Collection)
+		case record.Membership != nil:
+			err = tx.insertMembership(record.Membership)
+		case record.Event != nil:
+			err = tx.insertEvent(record.Event)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
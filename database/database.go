@@ -1,9 +1,7 @@
 package database
 
 import (
-	"bytes"
 	"errors"
-	"fmt"
 	"strings"
 	"time"
 
@@ -40,60 +38,269 @@ func ignoreSoftDeletedBookCollections(q *orm.Query) (*orm.Query, error) {
 
 func (d *Database) GetBookByISBN(isbn string) (*models.Book, error) {
 	var book models.Book
-	if err := d.db.Model(&book).Where("isbn = ?", isbn).Relation("Collections").First(); err != nil {
+	if err := d.db.Model(&book).Where("isbn = ?", isbn).Relation("Collections", ignoreSoftDeletedBookCollections).First(); err != nil {
 		return nil, err
 	}
 	return &book, nil
 }
 
-func sliceToPGArray(s []string) string {
-	var b bytes.Buffer
-	b.WriteString("array[")
-	for i, v := range s {
-		s[i] = fmt.Sprint("'%s'", v)
+func applyBookFilter(q *orm.Query, filter BookFilter) *orm.Query {
+	if filter.ISBN != "" {
+		q = q.Where("isbn = ?", filter.ISBN)
 	}
-	b.WriteString(strings.Join(s, ","))
-	b.WriteString("]")
-	return b.String()
+	if filter.Title != "" {
+		q = q.Where("title = ?", filter.Title)
+	}
+	if filter.Author != "" {
+		q = q.Where("author = ?", filter.Author)
+	}
+	if !filter.PublishedFrom.IsZero() {
+		q = q.Where("published_at >= ?", filter.PublishedFrom)
+	}
+	if !filter.PublishedTo.IsZero() {
+		q = q.Where("published_at < ?", filter.PublishedTo)
+	}
+
+	if len(filter.Genres) > 0 {
+		// ?| and ?& are escaped so go-pg leaves them alone, and can use the
+		// GIN index on metadata->'genres'
+		if filter.GenresMatch == MatchAllGenres {
+			q = q.Where(`metadata->'genres' \?& ?`, pg.Array(filter.Genres))
+		} else {
+			q = q.Where(`metadata->'genres' \?| ?`, pg.Array(filter.Genres))
+		}
+	}
+	return q
 }
 
-func (d *Database) GetBooks(isbn, title, author string, publishedYear int, genres []string) ([]models.Book, error) {
+func (d *Database) GetBooks(filter BookFilter, page Page) (*models.BookList, error) {
+	keys := sortKeys(page.Sort, "isbn")
+	c, err := decodeCursor(page.Cursor, keys, bookSortColumns)
+	if err != nil {
+		return nil, err
+	}
+
 	var books []models.Book
-	q := d.db.Model(&books)
-	if isbn != "" {
-		q = q.Where("isbn = ?", isbn)
+	q := applyBookFilter(d.db.Model(&books), filter)
+	total, err := q.Copy().Count()
+	if err != nil {
+		return nil, err
+	}
+
+	order, cond, args, err := postgresDialect.keyset(keys, bookSortColumns, c)
+	if err != nil {
+		return nil, err
+	}
+	if cond != "" {
+		q = q.Where(cond, args...)
+	}
+	for _, o := range order {
+		q = q.OrderExpr(o)
+	}
+	if page.Limit > 0 {
+		q = q.Limit(page.Limit + 1)
+	}
+	if err := q.Relation("Collections", ignoreSoftDeletedBookCollections).Select(); err != nil {
+		return nil, err
+	}
+
+	hasMore := page.Limit > 0 && len(books) > page.Limit
+	if hasMore {
+		books = books[:page.Limit]
+	}
+	if c.backward() {
+		for i, j := 0, len(books)-1; i < j; i, j = i+1, j-1 {
+			books[i], books[j] = books[j], books[i]
+		}
+	}
+	list := &models.BookList{
+		Total:   total,
+		Results: books,
+	}
+	if page.Limit > 0 {
+		list.NextCursor, list.PrevCursor = pageCursors(len(books), hasMore, c, keys, func(i int) []string {
+			return bookSortKey(books[i], keys)
+		})
 	}
-	if title != "" {
-		q = q.Where("title = ?", title)
+	return list, nil
+}
+
+// searchHit is a book matched by a full text search, before the book itself
+// is loaded
+type searchHit struct {
+	ISBN                 string
+	Rank                 float64
+	TitleHighlight       string
+	AuthorHighlight      string
+	DescriptionHighlight string
+}
+
+const (
+	searchRankExpr        = "ts_rank_cd(book.search, search_query)::float8"
+	searchHeadlineOptions = "StartSel=" + highlightStart + ", StopSel=" + highlightStop + ", HighlightAll=true"
+	searchSnippetOptions  = "StartSel=" + highlightStart + ", StopSel=" + highlightStop + ", MaxWords=30, MinWords=10"
+)
+
+// SearchBooks runs a ranked full text search over title, author and
+// description, using the books.search tsvector column
+func (d *Database) SearchBooks(query string, filter BookFilter, page Page) (*models.BookList, error) {
+	if len(searchTerms(query)) == 0 {
+		return nil, ErrEmptySearch
 	}
-	if author != "" {
-		q = q.Where("author = ?", author)
+	c, err := decodeCursor(page.Cursor, searchKeys, searchSortColumns)
+	if err != nil {
+		return nil, err
 	}
-	if publishedYear != 0 {
-		q = q.Where("published_at = ?", time.Date(publishedYear, 0, 0, 0, 0, 0, 0, time.UTC))
+
+	q := d.db.Model((*models.Book)(nil)).
+		TableExpr("websearch_to_tsquery('english', ?) AS search_query", query).
+		Where("book.search @@ search_query")
+	q = applyBookFilter(q, filter)
+	total, err := q.Copy().Count()
+	if err != nil {
+		return nil, err
 	}
 
-	if genres != nil && len(genres) > 0 {
-		q = q.Where(fmt.Sprintf("metadata->'genres' ?| %s", sliceToPGArray(genres)))
+	order, cond, args, err := postgresDialect.keysetOn([]string{searchRankExpr, "book.isbn"}, searchKeys, searchSortColumns, c)
+	if err != nil {
+		return nil, err
+	}
+	if cond != "" {
+		q = q.Where(cond, args...)
+	}
+	for _, o := range order {
+		q = q.OrderExpr(o)
 	}
-	if err := q.Relation("Collections").Select(); err != nil {
+	if page.Limit > 0 {
+		q = q.Limit(page.Limit + 1)
+	}
+	var hits []searchHit
+	err = q.Column("book.isbn").
+		ColumnExpr(searchRankExpr+" AS rank").
+		ColumnExpr("ts_headline('english', book.title, search_query, ?) AS title_highlight", searchHeadlineOptions).
+		ColumnExpr("ts_headline('english', book.author, search_query, ?) AS author_highlight", searchHeadlineOptions).
+		ColumnExpr("ts_headline('english', coalesce(book.description, ''), search_query, ?) AS description_highlight", searchSnippetOptions).
+		Select(&hits)
+	if err != nil {
 		return nil, err
 	}
-	return books, nil
+
+	hasMore := page.Limit > 0 && len(hits) > page.Limit
+	if hasMore {
+		hits = hits[:page.Limit]
+	}
+	if c.backward() {
+		for i, j := 0, len(hits)-1; i < j; i, j = i+1, j-1 {
+			hits[i], hits[j] = hits[j], hits[i]
+		}
+	}
+
+	books := make([]models.Book, 0, len(hits))
+	if len(hits) > 0 {
+		isbns := make([]string, len(hits))
+		for i, hit := range hits {
+			isbns[i] = hit.ISBN
+		}
+		var found []models.Book
+		if err := d.db.Model(&found).Where("isbn IN (?)", pg.In(isbns)).Relation("Collections", ignoreSoftDeletedBookCollections).Select(); err != nil {
+			return nil, err
+		}
+		byISBN := make(map[string]models.Book)
+		for _, b := range found {
+			byISBN[b.ISBN] = b
+		}
+		for _, hit := range hits {
+			book := byISBN[hit.ISBN]
+			book.Rank = hit.Rank
+			book.Highlights = make(map[string]string)
+			for field, h := range map[string]string{
+				"title":       hit.TitleHighlight,
+				"author":      hit.AuthorHighlight,
+				"description": hit.DescriptionHighlight,
+			} {
+				if strings.Contains(h, highlightStart) {
+					book.Highlights[field] = h
+				}
+			}
+			books = append(books, book)
+		}
+	}
+
+	list := &models.BookList{
+		Total:   total,
+		Results: books,
+	}
+	if page.Limit > 0 {
+		list.NextCursor, list.PrevCursor = pageCursors(len(books), hasMore, c, searchKeys, func(i int) []string {
+			return searchSortKey(books[i])
+		})
+	}
+	return list, nil
 }
 
 func (d *Database) AddBook(b *models.Book) error {
-	return d.db.Insert(b)
+	err := d.db.Insert(b)
+	// the primary key still covers soft deleted rows
+	if pgErr, ok := err.(pg.Error); ok && pgErr.IntegrityViolation() && pgErr.Field('n') == "books_pkey" {
+		return ErrDuplicateISBN
+	}
+	return err
 }
 
 func (d *Database) UpdateBook(b *models.Book) error {
-	return d.db.Update(b)
+	return d.PatchBook(b, BookPatchColumns)
+}
+
+func (d *Database) PatchBook(b *models.Book, columns []string) error {
+	return d.db.RunInTransaction(func(tx *pg.Tx) error {
+		var current models.Book
+		if err := tx.Model(&current).Column("version").Where("isbn = ?", b.ISBN).For("UPDATE").Select(); err != nil {
+			return err
+		}
+		if b.Version != 0 && b.Version != current.Version {
+			return ErrVersionConflict
+		}
+		if err := checkPatchColumns(columns, BookPatchColumns); err != nil {
+			return err
+		}
+		b.Version = current.Version + 1
+		// updated_at is set by the BeforeUpdate hook
+		_, err := tx.Model(b).Column(append(columns[:len(columns):len(columns)], "version", "updated_at")...).WherePK().Update()
+		return err
+	})
 }
 
-func (d *Database) DeleteBookByISBN(isbn string) error {
-	return d.db.Delete(&models.Book{
-		ISBN: isbn,
+func (d *Database) DeleteBookByISBN(isbn string, policy CascadePolicy) ([]models.Collection, error) {
+	affected := []models.Collection{}
+	err := d.db.RunInTransaction(func(tx *pg.Tx) error {
+		// the lock keeps memberships from being added underneath us
+		var book models.Book
+		if err := tx.Model(&book).Column("isbn").Where("isbn = ?", isbn).For("UPDATE").Select(); err != nil {
+			return err
+		}
+		err := tx.Model(&affected).
+			Join("JOIN book_collections AS book_collection ON book_collection.collection_id = collection.id").
+			Where("book_collection.book_isbn = ?", isbn).
+			Where("book_collection.deleted_at IS NULL").
+			Order("collection.id").
+			Select()
+		if err != nil {
+			return err
+		}
+		if policy == RestrictDelete && len(affected) > 0 {
+			return ErrDeleteRestricted
+		}
+
+		now := time.Now()
+		if _, err = tx.Model(&models.Book{}).Set("deleted_at = ?", now).Where("isbn = ?", isbn).Update(); err != nil {
+			return err
+		}
+		return deletePGMemberships(tx, "book_isbn", isbn, now, policy)
 	})
+	if err != nil && err != ErrDeleteRestricted {
+		return nil, err
+	}
+	return affected, err
 }
 
 func (d *Database) GetCollectionByID(id int) (*models.Collection, error) {
@@ -103,23 +310,209 @@ func (d *Database) GetCollectionByID(id int) (*models.Collection, error) {
 	}
 	return &collection, nil
 }
-func (d *Database) GetAllCollections() ([]models.Collection, error) {
+func (d *Database) GetAllCollections(page Page) (*models.CollectionList, error) {
+	keys := sortKeys(page.Sort, "id")
+	c, err := decodeCursor(page.Cursor, keys, collectionSortColumns)
+	if err != nil {
+		return nil, err
+	}
+
 	var collections []models.Collection
-	if err := d.db.Model(&collections).Relation("Books", ignoreSoftDeletedBookCollections).Select(); err != nil {
+	q := d.db.Model(&collections)
+	total, err := q.Copy().Count()
+	if err != nil {
+		return nil, err
+	}
+
+	order, cond, args, err := postgresDialect.keyset(keys, collectionSortColumns, c)
+	if err != nil {
+		return nil, err
+	}
+	if cond != "" {
+		q = q.Where(cond, args...)
+	}
+	for _, o := range order {
+		q = q.OrderExpr(o)
+	}
+	if page.Limit > 0 {
+		q = q.Limit(page.Limit + 1)
+	}
+	if err := q.Relation("Books", ignoreSoftDeletedBookCollections).Select(); err != nil {
+		return nil, err
+	}
+
+	hasMore := page.Limit > 0 && len(collections) > page.Limit
+	if hasMore {
+		collections = collections[:page.Limit]
+	}
+	if c.backward() {
+		for i, j := 0, len(collections)-1; i < j; i, j = i+1, j-1 {
+			collections[i], collections[j] = collections[j], collections[i]
+		}
+	}
+	list := &models.CollectionList{
+		Total:   total,
+		Results: collections,
+	}
+	if page.Limit > 0 {
+		list.NextCursor, list.PrevCursor = pageCursors(len(collections), hasMore, c, keys, func(i int) []string {
+			return collectionSortKey(collections[i], keys)
+		})
+	}
+	return list, nil
+}
+
+// collectionNameMatch matches a collection by name, ignoring case, or by slug
+const collectionNameMatch = "lower(name) = lower(?0) OR lower(replace(name, ' ', '-')) = lower(?0)"
+
+func (d *Database) GetCollectionByName(name string) (*models.Collection, error) {
+	var collection models.Collection
+	// an exact name beats a slug that happens to match
+	err := d.db.Model(&collection).
+		Where(collectionNameMatch, name).
+		OrderExpr("lower(name) = lower(?) DESC", name).
+		Relation("Books", ignoreSoftDeletedBookCollections).
+		First()
+	if err != nil {
 		return nil, err
 	}
-	return collections, nil
+	return &collection, nil
+}
+
+// pgDuplicateCollectionName maps a violation of the unique index on collection
+// names to ErrDuplicateCollectionName
+func pgDuplicateCollectionName(err error) error {
+	if pgErr, ok := err.(pg.Error); ok && pgErr.IntegrityViolation() && pgErr.Field('n') == "collections_name_idx" {
+		return ErrDuplicateCollectionName
+	}
+	return err
 }
+
 func (d *Database) AddCollection(c *models.Collection) error {
-	return d.db.Insert(c)
+	return pgDuplicateCollectionName(d.db.Insert(c))
 }
 
 func (d *Database) UpdateCollection(c *models.Collection) error {
-	return d.db.Update(c)
+	return d.PatchCollection(c, CollectionPatchColumns)
+}
+
+func (d *Database) PatchCollection(c *models.Collection, columns []string) error {
+	return d.db.RunInTransaction(func(tx *pg.Tx) error {
+		var current models.Collection
+		if err := tx.Model(&current).Column("version").Where("id = ?", c.ID).For("UPDATE").Select(); err != nil {
+			return err
+		}
+		if c.Version != 0 && c.Version != current.Version {
+			return ErrVersionConflict
+		}
+		if err := checkPatchColumns(columns, CollectionPatchColumns); err != nil {
+			return err
+		}
+		c.Version = current.Version + 1
+		_, err := tx.Model(c).Column(append(columns[:len(columns):len(columns)], "version", "updated_at")...).WherePK().Update()
+		return pgDuplicateCollectionName(err)
+	})
+}
+
+func (d *Database) DeleteCollectionByID(id int, policy CascadePolicy) ([]models.Book, error) {
+	affected := []models.Book{}
+	err := d.db.RunInTransaction(func(tx *pg.Tx) error {
+		var collection models.Collection
+		if err := tx.Model(&collection).Column("id").Where("id = ?", id).For("UPDATE").Select(); err != nil {
+			return err
+		}
+		err := tx.Model(&affected).
+			Join("JOIN book_collections AS book_collection ON book_collection.book_isbn = book.isbn").
+			Where("book_collection.collection_id = ?", id).
+			Where("book_collection.deleted_at IS NULL").
+			Order("book.isbn").
+			Select()
+		if err != nil {
+			return err
+		}
+		if policy == RestrictDelete && len(affected) > 0 {
+			return ErrDeleteRestricted
+		}
+
+		now := time.Now()
+		if _, err = tx.Model(&models.Collection{}).Set("deleted_at = ?", now).Where("id = ?", id).Update(); err != nil {
+			return err
+		}
+		return deletePGMemberships(tx, "collection_id", id, now, policy)
+	})
+	if err != nil && err != ErrDeleteRestricted {
+		return nil, err
+	}
+	return affected, err
+}
+
+// deletePGMemberships deals with the live memberships whose column is value,
+// of a book or collection deleted at deletedAt. Under DetachDelete they are
+// removed and recorded in their collections' history, otherwise they are
+// soft deleted at deletedAt so that they can be restored with what they were
+// deleted with.
+func deletePGMemberships(tx *pg.Tx, column string, value interface{}, deletedAt time.Time, policy CascadePolicy) error {
+	if policy != DetachDelete {
+		_, err := tx.Model(&models.BookCollection{}).Set("deleted_at = ?", deletedAt).Where("? = ?", pg.Q(column), value).Update()
+		return err
+	}
+	_, err := tx.Exec(
+		`INSERT INTO collection_events (collection_id, book_isbn, action, created_at)
+		SELECT collection_id, book_isbn, ?, ? FROM book_collections
+		WHERE ? = ? AND deleted_at IS NULL
+		ORDER BY collection_id, book_isbn`,
+		string(models.MembershipRemoved), deletedAt, pg.Q(column), value,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM book_collections WHERE ? = ? AND deleted_at IS NULL`, pg.Q(column), value)
+	return err
+}
+
+func (d *Database) ImportBooks(books []models.Book, onConflict ImportConflict, dryRun bool) ([]models.ImportResult, error) {
+	var results []models.ImportResult
+	err := d.db.RunInTransaction(func(tx *pg.Tx) error {
+		var err error
+		if results, err = importBooks(&pgImportTx{tx: tx}, books, onConflict); err == nil && dryRun {
+			return errRollback
+		}
+		return err
+	})
+	if err != nil && err != errRollback {
+		return nil, err
+	}
+	return results, nil
+}
+
+type pgImportTx struct {
+	tx *pg.Tx
+}
+
+func (tx *pgImportTx) getBook(isbn string) (*models.Book, error) {
+	var b models.Book
+	err := tx.tx.Model(&b).Where("isbn = ?", isbn).For("UPDATE").Select()
+	if err == nil {
+		return &b, nil
+	}
+	if err != pg.ErrNoRows {
+		return nil, err
+	}
+	err = tx.tx.Model(&b).Deleted().Where("isbn = ?", isbn).For("UPDATE").Select()
+	if err == pg.ErrNoRows {
+		return nil, nil
+	}
+	return &b, err
 }
 
-func (d *Database) DeleteCollectionByID(id int) error {
-	return d.db.Delete(&models.Collection{ID: id})
+func (tx *pgImportTx) insert(b *models.Book) error {
+	return tx.tx.Insert(b)
+}
+
+func (tx *pgImportTx) update(b *models.Book) error {
+	// updated_at is set by the BeforeUpdate hook
+	_, err := tx.tx.Model(b).Column(append(BookPatchColumns[:len(BookPatchColumns):len(BookPatchColumns)], "version", "updated_at")...).WherePK().Update()
+	return err
 }
 
 func (d *Database) AddBookToCollection(b *models.Book, c *models.Collection) error {
@@ -129,10 +522,7 @@ func (d *Database) AddBookToCollection(b *models.Book, c *models.Collection) err
 	if c.ID == 0 {
 		return errors.New("collection id missing")
 	}
-	return d.db.Insert(&models.BookCollection{
-		BookISBN:     b.ISBN,
-		CollectionID: c.ID,
-	})
+	return singleMembership(d.changeMemberships(c, []string{b.ISBN}, true, true))
 }
 
 func (d *Database) RemoveBookFromCollection(b *models.Book, c *models.Collection) error {
@@ -142,8 +532,281 @@ func (d *Database) RemoveBookFromCollection(b *models.Book, c *models.Collection
 	if c.ID == 0 {
 		return errors.New("collection id missing")
 	}
-	return d.db.Delete(&models.BookCollection{
-		BookISBN:     b.ISBN,
-		CollectionID: c.ID,
+	return singleMembership(d.changeMemberships(c, []string{b.ISBN}, false, true))
+}
+
+func (d *Database) AddBooksToCollection(c *models.Collection, isbns []string, atomic bool) (*models.MembershipReport, error) {
+	return d.changeMemberships(c, isbns, true, atomic)
+}
+
+func (d *Database) RemoveBooksFromCollection(c *models.Collection, isbns []string, atomic bool) (*models.MembershipReport, error) {
+	return d.changeMemberships(c, isbns, false, atomic)
+}
+
+func (d *Database) changeMemberships(c *models.Collection, isbns []string, adding, atomic bool) (*models.MembershipReport, error) {
+	var report *models.MembershipReport
+	err := d.db.RunInTransaction(func(tx *pg.Tx) error {
+		// the lock keeps the collection from being deleted underneath us
+		var collection models.Collection
+		err := tx.Model(&collection).Column("id").Where("id = ?", c.ID).For("UPDATE").Select()
+		if err != nil {
+			return err
+		}
+		report, err = changeMemberships(&pgMembershipTx{tx: tx, collectionID: c.ID, now: time.Now()}, isbns, adding, atomic)
+		if err == nil && !report.Applied {
+			return errRollback
+		}
+		return err
+	})
+	if err == errRollback {
+		return report, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+type pgMembershipTx struct {
+	tx           *pg.Tx
+	collectionID int
+	now          time.Time
+}
+
+func (tx *pgMembershipTx) record(isbn string, action models.MembershipStatus) error {
+	return tx.tx.Insert(&models.CollectionEvent{
+		CollectionID: tx.collectionID,
+		BookISBN:     isbn,
+		Action:       action,
+		CreatedAt:    tx.now,
+	})
+}
+
+func (tx *pgMembershipTx) bookExists(isbn string) (bool, error) {
+	return tx.tx.Model((*models.Book)(nil)).Where("isbn = ?", isbn).Exists()
+}
+
+func (tx *pgMembershipTx) isMember(isbn string) (bool, error) {
+	return tx.tx.Model((*models.BookCollection)(nil)).
+		Where("book_isbn = ? AND collection_id = ?", isbn, tx.collectionID).
+		Exists()
+}
+
+func (tx *pgMembershipTx) add(isbn string) error {
+	// the unique index still covers soft deleted rows, so a removed
+	// membership is brought back rather than added again
+	_, err := tx.tx.Model(&models.BookCollection{BookISBN: isbn, CollectionID: tx.collectionID, CreatedAt: tx.now}).
+		OnConflict("(book_isbn, collection_id) DO UPDATE").
+		Set("deleted_at = NULL, updated_at = ?", tx.now).
+		Insert()
+	if err != nil {
+		return err
+	}
+	return tx.record(isbn, models.MembershipAdded)
+}
+
+func (tx *pgMembershipTx) remove(isbn string) error {
+	_, err := tx.tx.Model(&models.BookCollection{}).
+		Set("deleted_at = ?", tx.now).
+		Where("book_isbn = ? AND collection_id = ?", isbn, tx.collectionID).
+		Update()
+	if err != nil {
+		return err
+	}
+	return tx.record(isbn, models.MembershipRemoved)
+}
+
+func (tx *pgMembershipTx) bumpVersions(isbns []string) error {
+	_, err := tx.tx.Model((*models.Book)(nil)).
+		Set("version = version + 1").
+		Where("isbn IN (?)", pg.In(isbns)).
+		Update()
+	if err != nil {
+		return err
+	}
+	_, err = tx.tx.Model((*models.Collection)(nil)).
+		Set("version = version + 1").
+		Where("id = ?", tx.collectionID).
+		Update()
+	return err
+}
+
+func (d *Database) GetCollectionHistory(id int) (*models.CollectionHistory, error) {
+	history := models.CollectionHistory{Results: []models.CollectionEvent{}}
+	if err := d.db.Model(&history.Results).Where("collection_id = ?", id).Order("id").Select(); err != nil {
+		return nil, err
+	}
+	return &history, nil
+}
+
+// pgAffectedOne turns the result of a query that affected no rows into
+// pg.ErrNoRows
+func pgAffectedOne(res orm.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return pg.ErrNoRows
+	}
+	return nil
+}
+
+// applyTrashFilter narrows a query of soft deleted rows by filter
+func applyTrashFilter(q *orm.Query, filter TrashFilter) *orm.Query {
+	q = q.Deleted()
+	if !filter.DeletedFrom.IsZero() {
+		q = q.Where("deleted_at >= ?", filter.DeletedFrom)
+	}
+	if !filter.DeletedTo.IsZero() {
+		q = q.Where("deleted_at < ?", filter.DeletedTo)
+	}
+	return q.Order("deleted_at DESC")
+}
+
+func (d *Database) GetTrash(filter TrashFilter) (*models.Trash, error) {
+	trash := models.Trash{Books: []models.Book{}, Collections: []models.Collection{}}
+	if err := applyTrashFilter(d.db.Model(&trash.Books), filter).Select(); err != nil {
+		return nil, err
+	}
+	if err := applyTrashFilter(d.db.Model(&trash.Collections), filter).Select(); err != nil {
+		return nil, err
+	}
+	return &trash, nil
+}
+
+func (d *Database) RestoreBook(isbn string) error {
+	return d.db.RunInTransaction(func(tx *pg.Tx) error {
+		// memberships deleted along with the book share its deleted_at
+		_, err := tx.Model(&models.BookCollection{}).Deleted().
+			Set("deleted_at = NULL").
+			Where("book_isbn = ?", isbn).
+			Where("deleted_at = (SELECT deleted_at FROM books WHERE isbn = ?)", isbn).
+			Update()
+		if err != nil {
+			return err
+		}
+		return pgAffectedOne(tx.Model(&models.Book{}).Deleted().Set("deleted_at = NULL").Where("isbn = ?", isbn).Update())
+	})
+}
+
+func (d *Database) RestoreCollection(id int) error {
+	return pgDuplicateCollectionName(d.db.RunInTransaction(func(tx *pg.Tx) error {
+		_, err := tx.Model(&models.BookCollection{}).Deleted().
+			Set("deleted_at = NULL").
+			Where("collection_id = ?", id).
+			Where("deleted_at = (SELECT deleted_at FROM collections WHERE id = ?)", id).
+			Update()
+		if err != nil {
+			return err
+		}
+		return pgAffectedOne(tx.Model(&models.Collection{}).Deleted().Set("deleted_at = NULL").Where("id = ?", id).Update())
+	}))
+}
+
+func (d *Database) PurgeBook(isbn string) error {
+	return d.db.RunInTransaction(func(tx *pg.Tx) error {
+		// ForceDelete only matches soft deleted rows, so purge with plain
+		// deletes that take live rows too
+		if _, err := tx.Exec(`DELETE FROM book_collections WHERE book_isbn = ?`, isbn); err != nil {
+			return err
+		}
+		return pgAffectedOne(tx.Exec(`DELETE FROM books WHERE isbn = ?`, isbn))
+	})
+}
+
+func (d *Database) PurgeCollection(id int) error {
+	return d.db.RunInTransaction(func(tx *pg.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM book_collections WHERE collection_id = ?`, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM collection_events WHERE collection_id = ?`, id); err != nil {
+			return err
+		}
+		return pgAffectedOne(tx.Exec(`DELETE FROM collections WHERE id = ?`, id))
+	})
+}
+
+func (d *Database) Backup(fn func(models.BackupRecord) error) error {
+	return d.db.RunInTransaction(func(tx *pg.Tx) error {
+		if _, err := tx.Exec(`SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY`); err != nil {
+			return err
+		}
+		err := pgBackupRows(func() *orm.Query { return tx.Model((*models.Book)(nil)).Order("isbn") }, func(b *models.Book) error {
+			return fn(models.BackupRecord{Book: b})
+		})
+		if err != nil {
+			return err
+		}
+		err = pgBackupRows(func() *orm.Query { return tx.Model((*models.Collection)(nil)).Order("id") }, func(c *models.Collection) error {
+			return fn(models.BackupRecord{Collection: c})
+		})
+		if err != nil {
+			return err
+		}
+		err = pgBackupRows(func() *orm.Query {
+			return tx.Model((*models.BookCollection)(nil)).Order("collection_id", "book_isbn")
+		}, func(m *models.BookCollection) error {
+			return fn(models.BackupRecord{Membership: m})
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Model((*models.CollectionEvent)(nil)).Order("id").ForEach(func(e *models.CollectionEvent) error {
+			return fn(models.BackupRecord{Event: e})
+		})
+	})
+}
+
+// pgBackupRows calls fn with each row of a soft deleted table, the live ones
+// and then those in the trash
+func pgBackupRows(query func() *orm.Query, fn interface{}) error {
+	if err := query().ForEach(fn); err != nil {
+		return err
+	}
+	return query().Deleted().ForEach(fn)
+}
+
+func (d *Database) Restore(next func() (models.BackupRecord, error)) error {
+	return d.db.RunInTransaction(func(tx *pg.Tx) error {
+		if err := restoreRecords(&pgRestoreTx{tx: tx}, next); err != nil {
+			return err
+		}
+		// new rows carry on after the restored ids
+		for _, table := range []string{"collections", "collection_events"} {
+			_, err := tx.Exec(`SELECT setval(pg_get_serial_sequence(?, 'id'), COALESCE(MAX(id), 0) + 1, false) FROM ?`, table, pg.Q(table))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 }
+
+type pgRestoreTx struct {
+	tx *pg.Tx
+}
+
+func (tx *pgRestoreTx) isEmpty() (bool, error) {
+	var empty bool
+	_, err := tx.tx.QueryOne(pg.Scan(&empty), `SELECT NOT EXISTS (SELECT 1 FROM books) AND NOT EXISTS (SELECT 1 FROM collections)`)
+	return empty, err
+}
+
+func (tx *pgRestoreTx) insertBook(b *models.Book) error {
+	// the version would otherwise be reset by the BeforeInsert hook
+	_, err := tx.tx.Model(b).Value("version", "?", b.Version).Insert()
+	return err
+}
+
+func (tx *pgRestoreTx) insertCollection(c *models.Collection) error {
+	_, err := tx.tx.Model(c).Value("version", "?", c.Version).Insert()
+	return err
+}
+
+func (tx *pgRestoreTx) insertMembership(m *models.BookCollection) error {
+	return tx.tx.Insert(m)
+}
+
+func (tx *pgRestoreTx) insertEvent(e *models.CollectionEvent) error {
+	return tx.tx.Insert(e)
+}
@@ -9,9 +9,19 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func TestGetBookByISBN(t *testing.T) {
+// setUpTestDB connects to the bookmanager_test database, skipping the test
+// when postgres is not reachable
+func setUpTestDB(t *testing.T) *Database {
 	db, err := NewTestDB()
 	require.NoError(t, err)
+	if _, err := db.db.Exec("SELECT 1"); err != nil {
+		t.Skipf("postgres not available: %v", err)
+	}
+	return db
+}
+
+func TestGetBookByISBN(t *testing.T) {
+	db := setUpTestDB(t)
 	// insert a book and collection
 
 	book := models.Book{
@@ -19,7 +29,7 @@ func TestGetBookByISBN(t *testing.T) {
 		Title:  "1",
 		Author: "abc",
 	}
-	collection := models.Collection{Name: "collection1"}
+	collection := models.Collection{Name: "collection " + uuid.New()}
 	values := []interface{}{
 		&book,
 		&collection,
@@ -39,15 +49,14 @@ func TestGetBookByISBN(t *testing.T) {
 }
 
 func TestGetCollectionByID(t *testing.T) {
-	db, err := NewTestDB()
-	require.NoError(t, err)
+	db := setUpTestDB(t)
 	// insert a book and collection
 	book := models.Book{
 		ISBN:   uuid.New(),
 		Title:  "1",
 		Author: "abc",
 	}
-	collection := models.Collection{Name: "collection1"}
+	collection := models.Collection{Name: "collection " + uuid.New()}
 	values := []interface{}{
 		&book,
 		&collection,
@@ -65,3 +74,32 @@ func TestGetCollectionByID(t *testing.T) {
 	assert.Equal(t, book.Title, c.Books[0].Title)
 
 }
+
+func TestGetBooksIgnoresRemovedMemberships(t *testing.T) {
+	db := setUpTestDB(t)
+	book := models.Book{ISBN: uuid.New(), Title: "Nostromo", Author: "Joseph Conrad"}
+	kept := models.Collection{Name: "collection " + uuid.New()}
+	removed := models.Collection{Name: "collection " + uuid.New()}
+	require.NoError(t, db.AddBook(&book))
+	require.NoError(t, db.AddCollection(&kept))
+	require.NoError(t, db.AddCollection(&removed))
+	for _, c := range []*models.Collection{&kept, &removed} {
+		_, err := db.AddBooksToCollection(c, []string{book.ISBN}, true)
+		require.NoError(t, err)
+	}
+	_, err := db.RemoveBooksFromCollection(&removed, []string{book.ISBN}, true)
+	require.NoError(t, err)
+
+	filter := BookFilter{ISBN: book.ISBN}
+	list, err := db.GetBooks(filter, Page{})
+	require.NoError(t, err)
+	require.Len(t, list.Results, 1)
+	require.Len(t, list.Results[0].Collections, 1)
+	assert.Equal(t, kept.ID, list.Results[0].Collections[0].ID)
+
+	list, err = db.SearchBooks("nostromo", filter, Page{})
+	require.NoError(t, err)
+	require.Len(t, list.Results, 1)
+	require.Len(t, list.Results[0].Collections, 1)
+	assert.Equal(t, kept.ID, list.Results[0].Collections[0].ID)
+}
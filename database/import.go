@@ -0,0 +1,106 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/john-cai/book-manager/models"
+	"github.com/john-cai/book-manager/responder"
+)
+
+// ImportConflict says what a bulk import does with a book whose isbn is
+// already taken
+type ImportConflict string
+
+const (
+	// SkipExisting leaves the stored book as it is
+	SkipExisting ImportConflict = "skip"
+	// UpdateExisting saves the imported book over the stored one, as its
+	// next version
+	UpdateExisting ImportConflict = "update"
+	// FailExisting fails the line
+	FailExisting ImportConflict = "fail"
+)
+
+// ParseImportConflict parses an on_conflict parameter. An empty value means
+// skip.
+func ParseImportConflict(s string) (ImportConflict, error) {
+	switch ImportConflict(s) {
+	case "", SkipExisting:
+		return SkipExisting, nil
+	case UpdateExisting, FailExisting:
+		return ImportConflict(s), nil
+	}
+	return "", fmt.Errorf("must be %q, %q or %q", SkipExisting, UpdateExisting, FailExisting)
+}
+
+// importTx is what importing books needs from a backend, all within one
+// transaction
+type importTx interface {
+	// getBook finds the book with isbn, whether or not it is in the trash,
+	// returning nil when there is none
+	getBook(isbn string) (*models.Book, error)
+	insert(b *models.Book) error
+	// update saves the BookPatchColumns of b, which is already at its next
+	// version, over the stored book
+	update(b *models.Book) error
+}
+
+// importBooks adds or updates each book in turn, reporting what happened to
+// each of them. The results have no line numbers, those are up to the
+// caller.
+func importBooks(tx importTx, books []models.Book, onConflict ImportConflict) ([]models.ImportResult, error) {
+	results := make([]models.ImportResult, 0, len(books))
+	for _, book := range books {
+		b := copyBook(book)
+		result, err := importBook(tx, &b, onConflict)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func importBook(tx importTx, b *models.Book, onConflict ImportConflict) (models.ImportResult, error) {
+	result := models.ImportResult{ISBN: b.ISBN}
+	existing, err := tx.getBook(b.ISBN)
+	if err != nil {
+		return result, err
+	}
+	switch {
+	case existing == nil:
+		result.Status = models.ImportCreated
+		return result, tx.insert(b)
+	case !existing.DeletedAt.IsZero():
+		// the isbn is still taken until the book is purged
+		result.Status = models.ImportFailed
+		result.Errors = []responder.Error{{Field: "isbn", Code: models.CodeDuplicate, Message: "belongs to a book in the trash"}}
+	case onConflict == FailExisting:
+		result.Status = models.ImportFailed
+		result.Errors = []responder.Error{{Field: "isbn", Code: models.CodeDuplicate, Message: "this isbn already exists"}}
+	case onConflict == SkipExisting:
+		result.Status, result.Message = models.ImportSkipped, "already exists"
+	case sameBook(existing, b):
+		result.Status, result.Message = models.ImportSkipped, "unchanged"
+	default:
+		b.Version = existing.Version + 1
+		result.Status = models.ImportUpdated
+		return result, tx.update(b)
+	}
+	return result, nil
+}
+
+// sameBook reports whether an update would leave a book as it is
+func sameBook(a, b *models.Book) bool {
+	if a.Title != b.Title || a.Author != b.Author || a.Description != b.Description ||
+		!a.PublishedAt.Equal(b.PublishedAt) || a.PublishedPrecision != b.PublishedPrecision ||
+		len(a.Metadata.Genres) != len(b.Metadata.Genres) {
+		return false
+	}
+	for i := range a.Metadata.Genres {
+		if a.Metadata.Genres[i] != b.Metadata.Genres[i] {
+			return false
+		}
+	}
+	return true
+}
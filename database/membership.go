@@ -0,0 +1,94 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/go-pg/pg"
+	"github.com/john-cai/book-manager/models"
+)
+
+// errRollback aborts a transaction whose changes should not be kept
+var errRollback = errors.New("rollback")
+
+// membershipTx is what a change of a collection's books needs from a backend,
+// all within one transaction. add revives a membership that was removed
+// before, and both add and remove record the change in the collection's
+// history. bumpVersions moves on the version of the collection and of the
+// books given, whose representations list each other.
+type membershipTx interface {
+	bookExists(isbn string) (bool, error)
+	isMember(isbn string) (bool, error)
+	add(isbn string) error
+	remove(isbn string) error
+	bumpVersions(isbns []string) error
+}
+
+// changeMemberships adds (or removes) each isbn in turn, reporting what
+// happened to each of them once. The report is marked applied unless the
+// change is atomic and an isbn failed, in which case the caller has to roll
+// the transaction back. The versions of the collection and of the books that
+// joined or left it move on when the change is applied.
+func changeMemberships(tx membershipTx, isbns []string, adding, atomic bool) (*models.MembershipReport, error) {
+	report := &models.MembershipReport{Results: []models.MembershipResult{}}
+	seen := make(map[string]bool)
+	var changed []string
+	for _, isbn := range isbns {
+		if seen[isbn] {
+			continue
+		}
+		seen[isbn] = true
+
+		status, err := changeMembership(tx, isbn, adding)
+		if err != nil {
+			return nil, err
+		}
+		if status == models.MembershipAdded || status == models.MembershipRemoved {
+			changed = append(changed, isbn)
+		}
+		report.Results = append(report.Results, models.MembershipResult{ISBN: isbn, Status: status})
+	}
+	report.Applied = !atomic || !report.Failed()
+	if report.Applied && len(changed) > 0 {
+		if err := tx.bumpVersions(changed); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+func changeMembership(tx membershipTx, isbn string, adding bool) (models.MembershipStatus, error) {
+	exists, err := tx.bookExists(isbn)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return models.MembershipNotFound, nil
+	}
+	member, err := tx.isMember(isbn)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case adding && member:
+		return models.MembershipAlreadyPresent, nil
+	case adding:
+		return models.MembershipAdded, tx.add(isbn)
+	case !member:
+		return models.MembershipNotMember, nil
+	default:
+		return models.MembershipRemoved, tx.remove(isbn)
+	}
+}
+
+// singleMembership turns the report of adding or removing one book into the
+// error of AddBookToCollection or RemoveBookFromCollection: pg.ErrNoRows when
+// the book does not exist or is not in the collection
+func singleMembership(report *models.MembershipReport, err error) error {
+	if err != nil {
+		return err
+	}
+	if report.Failed() {
+		return pg.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,954 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/john-cai/book-manager/models"
+)
+
+var errDuplicateBook = errors.New("duplicate key value violates unique constraint \"books_pkey\"")
+
+type membershipKey struct {
+	isbn         string
+	collectionID int
+}
+
+// Memory is an in-memory Store. It mirrors the postgres backend, including
+// soft deletes, and is meant for tests and local demos.
+type Memory struct {
+	mu               sync.RWMutex
+	books            map[string]models.Book
+	collections      map[int]models.Collection
+	memberships      map[membershipKey]models.BookCollection
+	history          []models.CollectionEvent
+	nextCollectionID int
+	nextEventID      int
+}
+
+// NewMemory creates an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{
+		books:            make(map[string]models.Book),
+		collections:      make(map[int]models.Collection),
+		memberships:      make(map[membershipKey]models.BookCollection),
+		nextCollectionID: 1,
+		nextEventID:      1,
+	}
+}
+
+func copyBook(b models.Book) models.Book {
+	b.Collections = nil
+	if b.Metadata.Genres != nil {
+		b.Metadata.Genres = append([]string(nil), b.Metadata.Genres...)
+	}
+	return b
+}
+
+func copyCollection(c models.Collection) models.Collection {
+	c.Books = nil
+	return c
+}
+
+func (m *Memory) bookWithCollections(b models.Book) models.Book {
+	book := copyBook(b)
+	for key, membership := range m.memberships {
+		if key.isbn != b.ISBN || !membership.DeletedAt.IsZero() {
+			continue
+		}
+		if c, ok := m.collections[key.collectionID]; ok && c.DeletedAt.IsZero() {
+			book.Collections = append(book.Collections, copyCollection(c))
+		}
+	}
+	sort.Slice(book.Collections, func(i, j int) bool {
+		return book.Collections[i].ID < book.Collections[j].ID
+	})
+	return book
+}
+
+func (m *Memory) collectionWithBooks(c models.Collection) models.Collection {
+	collection := copyCollection(c)
+	for key, membership := range m.memberships {
+		if key.collectionID != c.ID || !membership.DeletedAt.IsZero() {
+			continue
+		}
+		if b, ok := m.books[key.isbn]; ok && b.DeletedAt.IsZero() {
+			collection.Books = append(collection.Books, copyBook(b))
+		}
+	}
+	sort.Slice(collection.Books, func(i, j int) bool {
+		return collection.Books[i].ISBN < collection.Books[j].ISBN
+	})
+	return collection
+}
+
+func hasGenre(book models.Book, genre string) bool {
+	for _, have := range book.Metadata.Genres {
+		if have == genre {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesGenres(book models.Book, genres []string, match GenreMatch) bool {
+	for _, genre := range genres {
+		found := hasGenre(book, genre)
+		if found && match != MatchAllGenres {
+			return true
+		}
+		if !found && match == MatchAllGenres {
+			return false
+		}
+	}
+	return match == MatchAllGenres
+}
+
+func matchesFilter(b models.Book, filter BookFilter) bool {
+	if filter.ISBN != "" && b.ISBN != filter.ISBN {
+		return false
+	}
+	if filter.Title != "" && b.Title != filter.Title {
+		return false
+	}
+	if filter.Author != "" && b.Author != filter.Author {
+		return false
+	}
+	if !filter.PublishedFrom.IsZero() && (b.PublishedAt.IsZero() || b.PublishedAt.Before(filter.PublishedFrom)) {
+		return false
+	}
+	if !filter.PublishedTo.IsZero() && (b.PublishedAt.IsZero() || !b.PublishedAt.Before(filter.PublishedTo)) {
+		return false
+	}
+	if len(filter.Genres) > 0 && !matchesGenres(b, filter.Genres, filter.GenresMatch) {
+		return false
+	}
+	return true
+}
+
+func (m *Memory) GetBookByISBN(isbn string) (*models.Book, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	b, ok := m.books[isbn]
+	if !ok || !b.DeletedAt.IsZero() {
+		return nil, pg.ErrNoRows
+	}
+	book := m.bookWithCollections(b)
+	return &book, nil
+}
+
+func (m *Memory) GetBooks(filter BookFilter, page Page) (*models.BookList, error) {
+	keys := sortKeys(page.Sort, "isbn")
+	c, err := decodeCursor(page.Cursor, keys, bookSortColumns)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var books []models.Book
+	for _, b := range m.books {
+		if b.DeletedAt.IsZero() && matchesFilter(b, filter) {
+			books = append(books, b)
+		}
+	}
+	total := len(books)
+
+	// walk the rows in fetch direction, keeping the ones past the cursor
+	sort.Slice(books, func(i, j int) bool {
+		cmp := compareKeys(bookSortKey(books[i], keys), bookSortKey(books[j], keys), keys, bookSortColumns)
+		return cmp < 0 != c.backward()
+	})
+	var window []models.Book
+	for _, b := range books {
+		if c != nil {
+			cmp := compareKeys(bookSortKey(b, keys), c.Key, keys, bookSortColumns)
+			if c.backward() && cmp >= 0 || !c.backward() && cmp <= 0 {
+				continue
+			}
+		}
+		window = append(window, m.bookWithCollections(b))
+		if page.Limit > 0 && len(window) > page.Limit {
+			break
+		}
+	}
+
+	hasMore := page.Limit > 0 && len(window) > page.Limit
+	if hasMore {
+		window = window[:page.Limit]
+	}
+	if c.backward() {
+		for i, j := 0, len(window)-1; i < j; i, j = i+1, j-1 {
+			window[i], window[j] = window[j], window[i]
+		}
+	}
+	list := &models.BookList{
+		Total:   total,
+		Results: window,
+	}
+	if page.Limit > 0 {
+		list.NextCursor, list.PrevCursor = pageCursors(len(window), hasMore, c, keys, func(i int) []string {
+			return bookSortKey(window[i], keys)
+		})
+	}
+	return list, nil
+}
+
+func (m *Memory) SearchBooks(query string, filter BookFilter, page Page) (*models.BookList, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil, ErrEmptySearch
+	}
+	c, err := decodeCursor(page.Cursor, searchKeys, searchSortColumns)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var books []models.Book
+	for _, b := range m.books {
+		if !b.DeletedAt.IsZero() || !matchesFilter(b, filter) {
+			continue
+		}
+		book := m.bookWithCollections(b)
+		if scoreBook(&book, terms) {
+			books = append(books, book)
+		}
+	}
+	return rankedPage(books, c, page.Limit), nil
+}
+
+func (m *Memory) AddBook(b *models.Book) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// the primary key still covers soft deleted rows
+	if _, ok := m.books[b.ISBN]; ok {
+		return ErrDuplicateISBN
+	}
+	if err := b.BeforeInsert(nil); err != nil {
+		return err
+	}
+	m.books[b.ISBN] = copyBook(*b)
+	return nil
+}
+
+func (m *Memory) UpdateBook(b *models.Book) error {
+	return m.PatchBook(b, BookPatchColumns)
+}
+
+func (m *Memory) PatchBook(b *models.Book, columns []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.books[b.ISBN]
+	if !ok || !existing.DeletedAt.IsZero() {
+		return pg.ErrNoRows
+	}
+	if b.Version != 0 && b.Version != existing.Version {
+		return ErrVersionConflict
+	}
+	for _, column := range columns {
+		switch column {
+		case "title":
+			existing.Title = b.Title
+		case "author":
+			existing.Author = b.Author
+		case "description":
+			existing.Description = b.Description
+		case "published_at":
+			existing.PublishedAt = b.PublishedAt
+		case "published_precision":
+			existing.PublishedPrecision = b.PublishedPrecision
+		case "metadata":
+			existing.Metadata = b.Metadata
+		default:
+			return fmt.Errorf("cannot patch column %q", column)
+		}
+	}
+	if err := b.BeforeUpdate(nil); err != nil {
+		return err
+	}
+	existing.Version++
+	existing.UpdatedAt = b.UpdatedAt
+	b.Version, b.CreatedAt = existing.Version, existing.CreatedAt
+	m.books[b.ISBN] = copyBook(existing)
+	return nil
+}
+
+func (m *Memory) ImportBooks(books []models.Book, onConflict ImportConflict, dryRun bool) ([]models.ImportResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx := &memoryImportTx{m: m, staged: make(map[string]models.Book)}
+	results, err := importBooks(tx, books, onConflict)
+	if err != nil || dryRun {
+		return results, err
+	}
+	for isbn, b := range tx.staged {
+		m.books[isbn] = b
+	}
+	return results, nil
+}
+
+// memoryImportTx stages imported books until they are known to be kept. The
+// caller holds the lock.
+type memoryImportTx struct {
+	m      *Memory
+	staged map[string]models.Book
+}
+
+func (tx *memoryImportTx) getBook(isbn string) (*models.Book, error) {
+	b, ok := tx.staged[isbn]
+	if !ok {
+		if b, ok = tx.m.books[isbn]; !ok {
+			return nil, nil
+		}
+	}
+	b = copyBook(b)
+	return &b, nil
+}
+
+func (tx *memoryImportTx) insert(b *models.Book) error {
+	if err := b.BeforeInsert(nil); err != nil {
+		return err
+	}
+	tx.staged[b.ISBN] = copyBook(*b)
+	return nil
+}
+
+func (tx *memoryImportTx) update(b *models.Book) error {
+	existing, _ := tx.getBook(b.ISBN)
+	if err := b.BeforeUpdate(nil); err != nil {
+		return err
+	}
+	b.CreatedAt = existing.CreatedAt
+	tx.staged[b.ISBN] = copyBook(*b)
+	return nil
+}
+
+func (m *Memory) DeleteBookByISBN(isbn string, policy CascadePolicy) ([]models.Collection, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.books[isbn]
+	if !ok || !b.DeletedAt.IsZero() {
+		return nil, pg.ErrNoRows
+	}
+	match := func(key membershipKey) bool { return key.isbn == isbn }
+	affected := []models.Collection{}
+	for _, key := range m.liveMemberships(match) {
+		if c := m.collections[key.collectionID]; c.DeletedAt.IsZero() {
+			affected = append(affected, copyCollection(c))
+		}
+	}
+	if policy == RestrictDelete && len(affected) > 0 {
+		return affected, ErrDeleteRestricted
+	}
+	b.DeletedAt = time.Now()
+	m.books[isbn] = b
+	m.deleteMemberships(match, b.DeletedAt, policy)
+	return affected, nil
+}
+
+func (m *Memory) GetCollectionByID(id int) (*models.Collection, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	c, ok := m.collections[id]
+	if !ok || !c.DeletedAt.IsZero() {
+		return nil, pg.ErrNoRows
+	}
+	collection := m.collectionWithBooks(c)
+	return &collection, nil
+}
+
+func (m *Memory) GetAllCollections(page Page) (*models.CollectionList, error) {
+	keys := sortKeys(page.Sort, "id")
+	c, err := decodeCursor(page.Cursor, keys, collectionSortColumns)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var collections []models.Collection
+	for _, collection := range m.collections {
+		if collection.DeletedAt.IsZero() {
+			collections = append(collections, collection)
+		}
+	}
+	total := len(collections)
+
+	// walk the rows in fetch direction, keeping the ones past the cursor
+	sort.Slice(collections, func(i, j int) bool {
+		cmp := compareKeys(collectionSortKey(collections[i], keys), collectionSortKey(collections[j], keys), keys, collectionSortColumns)
+		return cmp < 0 != c.backward()
+	})
+	var window []models.Collection
+	for _, collection := range collections {
+		if c != nil {
+			cmp := compareKeys(collectionSortKey(collection, keys), c.Key, keys, collectionSortColumns)
+			if c.backward() && cmp >= 0 || !c.backward() && cmp <= 0 {
+				continue
+			}
+		}
+		window = append(window, m.collectionWithBooks(collection))
+		if page.Limit > 0 && len(window) > page.Limit {
+			break
+		}
+	}
+
+	hasMore := page.Limit > 0 && len(window) > page.Limit
+	if hasMore {
+		window = window[:page.Limit]
+	}
+	if c.backward() {
+		for i, j := 0, len(window)-1; i < j; i, j = i+1, j-1 {
+			window[i], window[j] = window[j], window[i]
+		}
+	}
+	list := &models.CollectionList{
+		Total:   total,
+		Results: window,
+	}
+	if page.Limit > 0 {
+		list.NextCursor, list.PrevCursor = pageCursors(len(window), hasMore, c, keys, func(i int) []string {
+			return collectionSortKey(window[i], keys)
+		})
+	}
+	return list, nil
+}
+
+func (m *Memory) GetCollectionByName(name string) (*models.Collection, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// an exact name beats a slug that happens to match
+	var found *models.Collection
+	for _, c := range m.collections {
+		if !c.DeletedAt.IsZero() {
+			continue
+		}
+		if strings.EqualFold(c.Name, name) {
+			found = &c
+			break
+		}
+		if strings.EqualFold(c.Slug(), name) && (found == nil || c.ID < found.ID) {
+			c := c
+			found = &c
+		}
+	}
+	if found == nil {
+		return nil, pg.ErrNoRows
+	}
+	collection := m.collectionWithBooks(*found)
+	return &collection, nil
+}
+
+// nameTaken reports whether a live collection other than id has name,
+// ignoring case
+func (m *Memory) nameTaken(name string, id int) bool {
+	for _, c := range m.collections {
+		if c.ID != id && c.DeletedAt.IsZero() && strings.EqualFold(c.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Memory) AddCollection(c *models.Collection) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.nameTaken(c.Name, 0) {
+		return ErrDuplicateCollectionName
+	}
+
+	if err := c.BeforeInsert(nil); err != nil {
+		return err
+	}
+	c.ID = m.nextCollectionID
+	m.nextCollectionID++
+	m.collections[c.ID] = copyCollection(*c)
+	return nil
+}
+
+func (m *Memory) UpdateCollection(c *models.Collection) error {
+	return m.PatchCollection(c, CollectionPatchColumns)
+}
+
+func (m *Memory) PatchCollection(c *models.Collection, columns []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.collections[c.ID]
+	if !ok || !existing.DeletedAt.IsZero() {
+		return pg.ErrNoRows
+	}
+	if c.Version != 0 && c.Version != existing.Version {
+		return ErrVersionConflict
+	}
+	for _, column := range columns {
+		switch column {
+		case "name":
+			if m.nameTaken(c.Name, c.ID) {
+				return ErrDuplicateCollectionName
+			}
+			existing.Name = c.Name
+		case "description":
+			existing.Description = c.Description
+		default:
+			return fmt.Errorf("cannot patch column %q", column)
+		}
+	}
+	if err := c.BeforeUpdate(nil); err != nil {
+		return err
+	}
+	existing.Version++
+	existing.UpdatedAt = c.UpdatedAt
+	c.Version, c.CreatedAt = existing.Version, existing.CreatedAt
+	m.collections[c.ID] = copyCollection(existing)
+	return nil
+}
+
+func (m *Memory) DeleteCollectionByID(id int, policy CascadePolicy) ([]models.Book, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.collections[id]
+	if !ok || !c.DeletedAt.IsZero() {
+		return nil, pg.ErrNoRows
+	}
+	match := func(key membershipKey) bool { return key.collectionID == id }
+	affected := []models.Book{}
+	for _, key := range m.liveMemberships(match) {
+		if b := m.books[key.isbn]; b.DeletedAt.IsZero() {
+			affected = append(affected, copyBook(b))
+		}
+	}
+	if policy == RestrictDelete && len(affected) > 0 {
+		return affected, ErrDeleteRestricted
+	}
+	c.DeletedAt = time.Now()
+	m.collections[id] = c
+	m.deleteMemberships(match, c.DeletedAt, policy)
+	return affected, nil
+}
+
+func (m *Memory) AddBookToCollection(b *models.Book, c *models.Collection) error {
+	if b.ISBN == "" {
+		return errors.New("book isbn missing")
+	}
+	if c.ID == 0 {
+		return errors.New("collection id missing")
+	}
+	return singleMembership(m.changeMemberships(c, []string{b.ISBN}, true, true))
+}
+
+func (m *Memory) RemoveBookFromCollection(b *models.Book, c *models.Collection) error {
+	if b.ISBN == "" {
+		return errors.New("book isbn missing")
+	}
+	if c.ID == 0 {
+		return errors.New("collection id missing")
+	}
+	return singleMembership(m.changeMemberships(c, []string{b.ISBN}, false, true))
+}
+
+func (m *Memory) AddBooksToCollection(c *models.Collection, isbns []string, atomic bool) (*models.MembershipReport, error) {
+	return m.changeMemberships(c, isbns, true, atomic)
+}
+
+func (m *Memory) RemoveBooksFromCollection(c *models.Collection, isbns []string, atomic bool) (*models.MembershipReport, error) {
+	return m.changeMemberships(c, isbns, false, atomic)
+}
+
+func (m *Memory) changeMemberships(c *models.Collection, isbns []string, adding, atomic bool) (*models.MembershipReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, ok := m.collections[c.ID]; !ok || !existing.DeletedAt.IsZero() {
+		return nil, pg.ErrNoRows
+	}
+	tx := &memoryMembershipTx{m: m, collectionID: c.ID, now: time.Now(), staged: make(map[membershipKey]models.BookCollection)}
+	report, err := changeMemberships(tx, isbns, adding, atomic)
+	if err != nil || !report.Applied {
+		return report, err
+	}
+	for key, membership := range tx.staged {
+		m.memberships[key] = membership
+	}
+	for _, event := range tx.events {
+		event.ID = m.nextEventID
+		m.nextEventID++
+		m.history = append(m.history, event)
+	}
+	return report, nil
+}
+
+// memoryMembershipTx stages membership changes until they are known to be
+// kept. The caller holds the lock.
+type memoryMembershipTx struct {
+	m            *Memory
+	collectionID int
+	now          time.Time
+	staged       map[membershipKey]models.BookCollection
+	events       []models.CollectionEvent
+}
+
+func (tx *memoryMembershipTx) record(isbn string, action models.MembershipStatus) {
+	tx.events = append(tx.events, models.CollectionEvent{
+		CollectionID: tx.collectionID,
+		BookISBN:     isbn,
+		Action:       action,
+		CreatedAt:    tx.now,
+	})
+}
+
+func (tx *memoryMembershipTx) membership(isbn string) (models.BookCollection, bool) {
+	key := membershipKey{isbn: isbn, collectionID: tx.collectionID}
+	if membership, ok := tx.staged[key]; ok {
+		return membership, true
+	}
+	membership, ok := tx.m.memberships[key]
+	return membership, ok
+}
+
+func (tx *memoryMembershipTx) bookExists(isbn string) (bool, error) {
+	b, ok := tx.m.books[isbn]
+	return ok && b.DeletedAt.IsZero(), nil
+}
+
+func (tx *memoryMembershipTx) isMember(isbn string) (bool, error) {
+	membership, ok := tx.membership(isbn)
+	return ok && membership.DeletedAt.IsZero(), nil
+}
+
+func (tx *memoryMembershipTx) add(isbn string) error {
+	// the unique index still covers soft deleted rows, so a removed
+	// membership is brought back rather than added again
+	membership, ok := tx.membership(isbn)
+	if ok {
+		membership.DeletedAt = time.Time{}
+		membership.UpdatedAt = tx.now
+	} else {
+		membership = models.BookCollection{
+			BookISBN:     isbn,
+			CollectionID: tx.collectionID,
+			CreatedAt:    tx.now,
+		}
+	}
+	tx.staged[membershipKey{isbn: isbn, collectionID: tx.collectionID}] = membership
+	tx.record(isbn, models.MembershipAdded)
+	return nil
+}
+
+func (tx *memoryMembershipTx) remove(isbn string) error {
+	membership, _ := tx.membership(isbn)
+	membership.DeletedAt = tx.now
+	tx.staged[membershipKey{isbn: isbn, collectionID: tx.collectionID}] = membership
+	tx.record(isbn, models.MembershipRemoved)
+	return nil
+}
+
+func (tx *memoryMembershipTx) bumpVersions(isbns []string) error {
+	for _, isbn := range isbns {
+		b := tx.m.books[isbn]
+		b.Version++
+		tx.m.books[isbn] = b
+	}
+	c := tx.m.collections[tx.collectionID]
+	c.Version++
+	tx.m.collections[tx.collectionID] = c
+	return nil
+}
+
+func (m *Memory) GetCollectionHistory(id int) (*models.CollectionHistory, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	history := models.CollectionHistory{Results: []models.CollectionEvent{}}
+	for _, event := range m.history {
+		if event.CollectionID == id {
+			history.Results = append(history.Results, event)
+		}
+	}
+	return &history, nil
+}
+
+// liveMemberships lists the keys of the live memberships matching match, by
+// collection and then isbn. The caller holds the lock.
+func (m *Memory) liveMemberships(match func(membershipKey) bool) []membershipKey {
+	var keys []membershipKey
+	for key, membership := range m.memberships {
+		if match(key) && membership.DeletedAt.IsZero() {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].collectionID != keys[j].collectionID {
+			return keys[i].collectionID < keys[j].collectionID
+		}
+		return keys[i].isbn < keys[j].isbn
+	})
+	return keys
+}
+
+// deleteMemberships deals with the live memberships matching match of a book
+// or collection deleted at deletedAt. Under DetachDelete they are removed
+// and recorded in their collections' history, otherwise they are soft
+// deleted at deletedAt so that they can be restored with what they were
+// deleted with. The caller holds the lock.
+func (m *Memory) deleteMemberships(match func(membershipKey) bool, deletedAt time.Time, policy CascadePolicy) {
+	for _, key := range m.liveMemberships(match) {
+		if policy == DetachDelete {
+			delete(m.memberships, key)
+			m.history = append(m.history, models.CollectionEvent{
+				ID:           m.nextEventID,
+				CollectionID: key.collectionID,
+				BookISBN:     key.isbn,
+				Action:       models.MembershipRemoved,
+				CreatedAt:    deletedAt,
+			})
+			m.nextEventID++
+			continue
+		}
+		membership := m.memberships[key]
+		membership.DeletedAt = deletedAt
+		m.memberships[key] = membership
+	}
+}
+
+// restoreMemberships brings back the memberships matching match that were
+// deleted at deletedAt. The caller holds the lock.
+func (m *Memory) restoreMemberships(match func(membershipKey) bool, deletedAt time.Time) {
+	for key, membership := range m.memberships {
+		if match(key) && membership.DeletedAt.Equal(deletedAt) {
+			membership.DeletedAt = time.Time{}
+			m.memberships[key] = membership
+		}
+	}
+}
+
+func (m *Memory) GetTrash(filter TrashFilter) (*models.Trash, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	trash := models.Trash{Books: []models.Book{}, Collections: []models.Collection{}}
+	for _, b := range m.books {
+		if inTrash(b.DeletedAt, filter) {
+			trash.Books = append(trash.Books, copyBook(b))
+		}
+	}
+	for _, c := range m.collections {
+		if inTrash(c.DeletedAt, filter) {
+			trash.Collections = append(trash.Collections, copyCollection(c))
+		}
+	}
+	sort.Slice(trash.Books, func(i, j int) bool {
+		return trash.Books[i].DeletedAt.After(trash.Books[j].DeletedAt)
+	})
+	sort.Slice(trash.Collections, func(i, j int) bool {
+		return trash.Collections[i].DeletedAt.After(trash.Collections[j].DeletedAt)
+	})
+	return &trash, nil
+}
+
+// inTrash reports whether something deleted at deletedAt is in the trash and
+// matches filter
+func inTrash(deletedAt time.Time, filter TrashFilter) bool {
+	if deletedAt.IsZero() {
+		return false
+	}
+	if !filter.DeletedFrom.IsZero() && deletedAt.Before(filter.DeletedFrom) {
+		return false
+	}
+	if !filter.DeletedTo.IsZero() && !deletedAt.Before(filter.DeletedTo) {
+		return false
+	}
+	return true
+}
+
+func (m *Memory) RestoreBook(isbn string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.books[isbn]
+	if !ok || b.DeletedAt.IsZero() {
+		return pg.ErrNoRows
+	}
+	m.restoreMemberships(func(key membershipKey) bool { return key.isbn == isbn }, b.DeletedAt)
+	b.DeletedAt = time.Time{}
+	m.books[isbn] = b
+	return nil
+}
+
+func (m *Memory) RestoreCollection(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.collections[id]
+	if !ok || c.DeletedAt.IsZero() {
+		return pg.ErrNoRows
+	}
+	if m.nameTaken(c.Name, id) {
+		return ErrDuplicateCollectionName
+	}
+	m.restoreMemberships(func(key membershipKey) bool { return key.collectionID == id }, c.DeletedAt)
+	c.DeletedAt = time.Time{}
+	m.collections[id] = c
+	return nil
+}
+
+func (m *Memory) PurgeBook(isbn string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.books[isbn]; !ok {
+		return pg.ErrNoRows
+	}
+	delete(m.books, isbn)
+	for key := range m.memberships {
+		if key.isbn == isbn {
+			delete(m.memberships, key)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) PurgeCollection(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.collections[id]; !ok {
+		return pg.ErrNoRows
+	}
+	delete(m.collections, id)
+	for key := range m.memberships {
+		if key.collectionID == id {
+			delete(m.memberships, key)
+		}
+	}
+	history := m.history[:0]
+	for _, event := range m.history {
+		if event.CollectionID != id {
+			history = append(history, event)
+		}
+	}
+	m.history = history
+	return nil
+}
+
+func (m *Memory) Backup(fn func(models.BackupRecord) error) error {
+	// the snapshot is taken under the lock, fn is called without it
+	m.mu.RLock()
+	var records []models.BackupRecord
+	isbns := make([]string, 0, len(m.books))
+	for isbn := range m.books {
+		isbns = append(isbns, isbn)
+	}
+	sort.Strings(isbns)
+	for _, isbn := range isbns {
+		b := copyBook(m.books[isbn])
+		records = append(records, models.BackupRecord{Book: &b})
+	}
+	ids := make([]int, 0, len(m.collections))
+	for id := range m.collections {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		c := copyCollection(m.collections[id])
+		records = append(records, models.BackupRecord{Collection: &c})
+	}
+	keys := make([]membershipKey, 0, len(m.memberships))
+	for key := range m.memberships {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].collectionID != keys[j].collectionID {
+			return keys[i].collectionID < keys[j].collectionID
+		}
+		return keys[i].isbn < keys[j].isbn
+	})
+	for _, key := range keys {
+		membership := m.memberships[key]
+		records = append(records, models.BackupRecord{Membership: &membership})
+	}
+	for _, event := range m.history {
+		event := event
+		records = append(records, models.BackupRecord{Event: &event})
+	}
+	m.mu.RUnlock()
+
+	for _, record := range records {
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Restore(next func() (models.BackupRecord, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx := &memoryRestoreTx{m: m, restored: NewMemory()}
+	if err := restoreRecords(tx, next); err != nil {
+		return err
+	}
+	m.books, m.collections, m.memberships, m.history = tx.restored.books, tx.restored.collections, tx.restored.memberships, tx.restored.history
+	m.nextCollectionID, m.nextEventID = tx.restored.nextCollectionID, tx.restored.nextEventID
+	return nil
+}
+
+// memoryRestoreTx restores into a store of its own, which replaces the empty
+// one once everything has been read. The caller holds the lock.
+type memoryRestoreTx struct {
+	m        *Memory
+	restored *Memory
+}
+
+func (tx *memoryRestoreTx) isEmpty() (bool, error) {
+	return len(tx.m.books) == 0 && len(tx.m.collections) == 0, nil
+}
+
+func (tx *memoryRestoreTx) insertBook(b *models.Book) error {
+	if _, ok := tx.restored.books[b.ISBN]; ok {
+		return errDuplicateBook
+	}
+	tx.restored.books[b.ISBN] = copyBook(*b)
+	return nil
+}
+
+func (tx *memoryRestoreTx) insertCollection(c *models.Collection) error {
+	if _, ok := tx.restored.collections[c.ID]; ok || c.ID < 1 {
+		return fmt.Errorf("collection id %d is taken or invalid", c.ID)
+	}
+	tx.restored.collections[c.ID] = copyCollection(*c)
+	if c.ID >= tx.restored.nextCollectionID {
+		tx.restored.nextCollectionID = c.ID + 1
+	}
+	return nil
+}
+
+func (tx *memoryRestoreTx) insertMembership(membership *models.BookCollection) error {
+	tx.restored.memberships[membershipKey{isbn: membership.BookISBN, collectionID: membership.CollectionID}] = *membership
+	return nil
+}
+
+func (tx *memoryRestoreTx) insertEvent(e *models.CollectionEvent) error {
+	tx.restored.history = append(tx.restored.history, *e)
+	if e.ID >= tx.restored.nextEventID {
+		tx.restored.nextEventID = e.ID + 1
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/john-cai/book-manager/models"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBookCollections(t *testing.T) {
+	m := NewMemory()
+	book := models.Book{ISBN: uuid.New(), Title: "1", Author: "abc"}
+	collection := models.Collection{Name: "collection1"}
+	require.NoError(t, m.AddBook(&book))
+	require.NoError(t, m.AddCollection(&collection))
+	require.NotZero(t, collection.ID)
+	require.NoError(t, m.AddBookToCollection(&book, &collection))
+
+	b, err := m.GetBookByISBN(book.ISBN)
+	require.NoError(t, err)
+	assert.False(t, b.CreatedAt.IsZero())
+	require.Len(t, b.Collections, 1)
+	assert.Equal(t, collection.Name, b.Collections[0].Name)
+
+	c, err := m.GetCollectionByID(collection.ID)
+	require.NoError(t, err)
+	require.Len(t, c.Books, 1)
+	assert.Equal(t, book.Title, c.Books[0].Title)
+
+	require.NoError(t, m.RemoveBookFromCollection(&book, &collection))
+	assert.Equal(t, pg.ErrNoRows, m.RemoveBookFromCollection(&book, &collection))
+	c, err = m.GetCollectionByID(collection.ID)
+	require.NoError(t, err)
+	assert.Len(t, c.Books, 0)
+}
+
+func TestMemorySoftDelete(t *testing.T) {
+	m := NewMemory()
+	book := models.Book{ISBN: uuid.New(), Title: "1", Author: "abc"}
+	require.NoError(t, m.AddBook(&book))
+	_, err := m.DeleteBookByISBN(book.ISBN, CascadeDelete)
+	require.NoError(t, err)
+
+	_, err = m.GetBookByISBN(book.ISBN)
+	assert.Equal(t, pg.ErrNoRows, err)
+	_, err = m.DeleteBookByISBN(book.ISBN, CascadeDelete)
+	assert.Equal(t, pg.ErrNoRows, err)
+	assert.Equal(t, pg.ErrNoRows, m.UpdateBook(&book))
+	// the isbn is still taken by the soft deleted row
+	assert.Error(t, m.AddBook(&book))
+
+	collection := models.Collection{Name: "collection1"}
+	require.NoError(t, m.AddCollection(&collection))
+	_, err = m.DeleteCollectionByID(collection.ID, CascadeDelete)
+	require.NoError(t, err)
+	_, err = m.GetCollectionByID(collection.ID)
+	assert.Equal(t, pg.ErrNoRows, err)
+	collections, err := m.GetAllCollections(Page{})
+	require.NoError(t, err)
+	assert.Len(t, collections.Results, 0)
+}
+
+func TestMemoryGetBooks(t *testing.T) {
+	m := NewMemory()
+	books := []models.Book{
+		{ISBN: uuid.New(), Title: "Jungle Book", Author: "Rudyard Kipling", PublishedAt: time.Date(1894, 1, 1, 0, 0, 0, 0, time.UTC), PublishedPrecision: models.PrecisionYear, Metadata: models.Metadata{Genres: []string{"adventure"}}},
+		{ISBN: uuid.New(), Title: "Kim", Author: "Rudyard Kipling", PublishedAt: time.Date(1901, 10, 1, 0, 0, 0, 0, time.UTC), PublishedPrecision: models.PrecisionMonth},
+		{ISBN: uuid.New(), Title: "A Wrinkle in Time", Author: "Madeline L'engle", Metadata: models.Metadata{Genres: []string{"fantasy"}}},
+	}
+	for i := range books {
+		require.NoError(t, m.AddBook(&books[i]))
+	}
+
+	testCases := []struct {
+		title         string
+		author        string
+		publishedFrom time.Time
+		publishedTo   time.Time
+		genres        []string
+		genresMatch   GenreMatch
+		count         int
+	}{
+		{count: 3},
+		{author: "Rudyard Kipling", count: 2},
+		{title: "Kim", author: "Rudyard Kipling", count: 1},
+		{publishedFrom: time.Date(1894, 1, 1, 0, 0, 0, 0, time.UTC), publishedTo: time.Date(1895, 1, 1, 0, 0, 0, 0, time.UTC), count: 1},
+		{publishedFrom: time.Date(1890, 1, 1, 0, 0, 0, 0, time.UTC), publishedTo: time.Date(1902, 1, 1, 0, 0, 0, 0, time.UTC), count: 2},
+		{publishedFrom: time.Date(1901, 10, 1, 0, 0, 0, 0, time.UTC), count: 1},
+		{publishedTo: time.Date(1901, 10, 1, 0, 0, 0, 0, time.UTC), count: 1},
+		{genres: []string{"fantasy", "adventure"}, count: 2},
+		{genres: []string{"horror"}, count: 0},
+		{genres: []string{"fantasy"}, genresMatch: MatchAllGenres, count: 1},
+		{genres: []string{"fantasy", "adventure"}, genresMatch: MatchAllGenres, count: 0},
+	}
+	for _, testCase := range testCases {
+		result, err := m.GetBooks(BookFilter{
+			Title:         testCase.title,
+			Author:        testCase.author,
+			PublishedFrom: testCase.publishedFrom,
+			PublishedTo:   testCase.publishedTo,
+			Genres:        testCase.genres,
+			GenresMatch:   testCase.genresMatch,
+		}, Page{})
+		require.NoError(t, err)
+		assert.Len(t, result.Results, testCase.count)
+		assert.Equal(t, testCase.count, result.Total)
+	}
+}
+
+func TestMemoryPagination(t *testing.T) {
+	testPagination(t, NewMemory())
+}
+
+func TestMemorySorting(t *testing.T) {
+	testSorting(t, NewMemory())
+}
+
+func TestMemorySearch(t *testing.T) {
+	testSearch(t, NewMemory())
+}
+
+func TestMemoryCollectionNames(t *testing.T) {
+	testCollectionNames(t, NewMemory())
+}
+
+func TestMemoryBulkMemberships(t *testing.T) {
+	testBulkMemberships(t, NewMemory())
+}
+
+func TestMemoryTrash(t *testing.T) {
+	testTrash(t, NewMemory())
+}
+
+func TestMemoryMembershipHistory(t *testing.T) {
+	testMembershipHistory(t, NewMemory())
+}
+
+func TestMemoryCascadePolicies(t *testing.T) {
+	testCascadePolicies(t, NewMemory())
+}
+
+func TestMemoryVersions(t *testing.T) {
+	testVersions(t, NewMemory())
+}
+
+func TestMemoryPatch(t *testing.T) {
+	testPatch(t, NewMemory())
+}
+
+func TestMemoryTimestamps(t *testing.T) {
+	testTimestamps(t, NewMemory())
+}
+
+func TestMemoryImport(t *testing.T) {
+	testImport(t, NewMemory())
+}
+
+func TestMemoryBackup(t *testing.T) {
+	testBackup(t, NewMemory(), NewMemory())
+}
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"database/sql"
+
+	"github.com/go-pg/pg"
+	"github.com/john-cai/book-manager/database/migration"
+)
+
+// migrationLockID is the postgres advisory lock key held while migrating
+const migrationLockID = 7245601
+
+// Migratable is implemented by stores that have a versioned schema
+type Migratable interface {
+	Migrator() (*migration.Runner, error)
+}
+
+var (
+	_ Migratable = (*Database)(nil)
+	_ Migratable = (*SQLite)(nil)
+)
+
+type pgMigrationDriver struct {
+	db *pg.DB
+}
+
+type pgMigrationTx struct {
+	tx *pg.Tx
+}
+
+func (d pgMigrationDriver) Transaction(fn func(tx migration.Tx) error) error {
+	return d.db.RunInTransaction(func(tx *pg.Tx) error {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLockID); err != nil {
+			return err
+		}
+		return fn(pgMigrationTx{tx: tx})
+	})
+}
+
+func (t pgMigrationTx) Exec(query string, params ...interface{}) error {
+	_, err := t.tx.Exec(query, params...)
+	return err
+}
+
+func (t pgMigrationTx) Versions() ([]int, error) {
+	var versions []int
+	if _, err := t.tx.Query(&versions, "SELECT version FROM schema_migrations ORDER BY version"); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// Migrator returns a runner for the embedded postgres migrations
+func (d *Database) Migrator() (*migration.Runner, error) {
+	migrations, err := migration.Postgres()
+	if err != nil {
+		return nil, err
+	}
+	return migration.NewRunner(pgMigrationDriver{db: d.db}, migrations), nil
+}
+
+type sqliteMigrationDriver struct {
+	db *sql.DB
+}
+
+type sqliteMigrationTx struct {
+	tx *sql.Tx
+}
+
+// Transaction relies on the connection's _txlock=immediate setting, which
+// takes the database write lock as soon as the transaction begins
+func (d sqliteMigrationDriver) Transaction(fn func(tx migration.Tx) error) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(sqliteMigrationTx{tx: tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (t sqliteMigrationTx) Exec(query string, params ...interface{}) error {
+	_, err := t.tx.Exec(query, params...)
+	return err
+}
+
+func (t sqliteMigrationTx) Versions() ([]int, error) {
+	rows, err := t.tx.Query("SELECT version FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []int
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// Migrator returns a runner for the embedded sqlite migrations
+func (s *SQLite) Migrator() (*migration.Runner, error) {
+	migrations, err := migration.SQLite()
+	if err != nil {
+		return nil, err
+	}
+	return migration.NewRunner(sqliteMigrationDriver{db: s.db}, migrations), nil
+}
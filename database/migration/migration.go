@@ -0,0 +1,236 @@
+package migration
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+//go:embed postgres/*.sql sqlite/*.sql
+var files embed.FS
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+const createVersionTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
+
+// Migration is a single numbered schema change
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status reports whether a migration has been applied
+type Status struct {
+	Migration
+	Applied bool
+}
+
+// Tx is a transaction on the database being migrated
+type Tx interface {
+	Exec(query string, params ...interface{}) error
+	Versions() ([]int, error)
+}
+
+// Driver gives the runner access to a database
+type Driver interface {
+	// Transaction runs fn in a single transaction holding an exclusive
+	// migration lock, so concurrent replicas never migrate at the same time
+	Transaction(fn func(tx Tx) error) error
+}
+
+// Postgres returns the embedded postgres migrations
+func Postgres() ([]Migration, error) {
+	return Load(files, "postgres")
+}
+
+// SQLite returns the embedded sqlite migrations
+func SQLite() ([]Migration, error) {
+	return Load(files, "sqlite")
+}
+
+// Load reads <version>_<name>.up.sql and <version>_<name>.down.sql files
+// from dir, sorted by version
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Runner applies and rolls back migrations through a Driver
+type Runner struct {
+	driver     Driver
+	migrations []Migration
+}
+
+// NewRunner creates a runner for the given migrations
+func NewRunner(driver Driver, migrations []Migration) *Runner {
+	return &Runner{
+		driver:     driver,
+		migrations: migrations,
+	}
+}
+
+func appliedSet(tx Tx) (map[int]bool, error) {
+	if err := tx.Exec(createVersionTable); err != nil {
+		return nil, err
+	}
+	versions, err := tx.Versions()
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]bool)
+	for _, v := range versions {
+		applied[v] = true
+	}
+	return applied, nil
+}
+
+// Up applies every pending migration and returns the ones it applied
+func (r *Runner) Up() ([]Migration, error) {
+	var done []Migration
+	err := r.driver.Transaction(func(tx Tx) error {
+		done = nil
+		applied, err := appliedSet(tx)
+		if err != nil {
+			return err
+		}
+		for _, m := range r.migrations {
+			if applied[m.Version] {
+				continue
+			}
+			if err := tx.Exec(m.Up); err != nil {
+				return fmt.Errorf("migration %d_%s: %v", m.Version, m.Name, err)
+			}
+			if err := tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name); err != nil {
+				return err
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+// Down rolls back the most recently applied migration. It returns nil when
+// nothing has been applied.
+func (r *Runner) Down() (*Migration, error) {
+	var done *Migration
+	err := r.driver.Transaction(func(tx Tx) error {
+		done = nil
+		applied, err := appliedSet(tx)
+		if err != nil {
+			return err
+		}
+		for i := len(r.migrations) - 1; i >= 0; i-- {
+			m := r.migrations[i]
+			if !applied[m.Version] {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %d_%s cannot be rolled back", m.Version, m.Name)
+			}
+			if err := tx.Exec(m.Down); err != nil {
+				return fmt.Errorf("migration %d_%s: %v", m.Version, m.Name, err)
+			}
+			if err := tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.Version); err != nil {
+				return err
+			}
+			done = &m
+			return nil
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+// Status lists every known migration and whether it has been applied
+func (r *Runner) Status() ([]Status, error) {
+	var statuses []Status
+	err := r.driver.Transaction(func(tx Tx) error {
+		statuses = nil
+		applied, err := appliedSet(tx)
+		if err != nil {
+			return err
+		}
+		for _, m := range r.migrations {
+			statuses = append(statuses, Status{Migration: m, Applied: applied[m.Version]})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// Pending returns the migrations that have not been applied yet
+func (r *Runner) Pending() ([]Migration, error) {
+	statuses, err := r.Status()
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, s := range statuses {
+		if !s.Applied {
+			pending = append(pending, s.Migration)
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,42 @@
+package migration
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"m/0002_second.up.sql":   {Data: []byte("up 2")},
+		"m/0001_first.up.sql":    {Data: []byte("up 1")},
+		"m/0001_first.down.sql":  {Data: []byte("down 1")},
+		"m/README.md":            {Data: []byte("ignored")},
+		"m/0003_third.down.sql":  {Data: []byte("down 3")},
+		"other/0009_x.up.sql":    {Data: []byte("ignored")},
+		"m/0010_tenth.up.sql":    {Data: []byte("up 10")},
+		"m/0010_tenth.down.sql":  {Data: []byte("down 10")},
+		"m/0002_second.down.sql": {Data: []byte("down 2")},
+	}
+	_, err := Load(fsys, "m")
+	assert.Error(t, err, "migration 3 has no up script")
+
+	delete(fsys, "m/0003_third.down.sql")
+	migrations, err := Load(fsys, "m")
+	require.NoError(t, err)
+	require.Len(t, migrations, 3)
+	assert.Equal(t, Migration{Version: 1, Name: "first", Up: "up 1", Down: "down 1"}, migrations[0])
+	assert.Equal(t, 2, migrations[1].Version)
+	assert.Equal(t, 10, migrations[2].Version)
+}
+
+func TestEmbedded(t *testing.T) {
+	for _, load := range []func() ([]Migration, error){Postgres, SQLite} {
+		migrations, err := load()
+		require.NoError(t, err)
+		require.NotEmpty(t, migrations)
+		assert.Equal(t, 1, migrations[0].Version)
+	}
+}
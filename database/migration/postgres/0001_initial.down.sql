@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS book_collections;
+DROP TABLE IF EXISTS collections;
+DROP TABLE IF EXISTS books;
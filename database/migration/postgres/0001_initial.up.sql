@@ -1,4 +1,4 @@
-CREATE TABLE books (
+CREATE TABLE IF NOT EXISTS books (
     isbn uuid PRIMARY KEY,
     title TEXT NOT NULL,
     author TEXT NOT NULL,
@@ -10,7 +10,7 @@ CREATE TABLE books (
     deleted_at TIMESTAMP
 );
 
-CREATE TABLE collections (
+CREATE TABLE IF NOT EXISTS collections (
     id SERIAL PRIMARY KEY,
     name TEXT,
     description TEXT,
@@ -19,7 +19,7 @@ CREATE TABLE collections (
     deleted_at TIMESTAMP
 );
 
-CREATE TABLE book_collections (
+CREATE TABLE IF NOT EXISTS book_collections (
     book_isbn UUID,
     collection_id INTEGER,
     created_at TIMESTAMP NOT NULL DEFAULT NOW(),
@@ -27,5 +27,5 @@ CREATE TABLE book_collections (
     deleted_at TIMESTAMP
 );
 
-CREATE UNIQUE INDEX book_collections_primary_idx ON book_collections (book_isbn, collection_id);
+CREATE UNIQUE INDEX IF NOT EXISTS book_collections_primary_idx ON book_collections (book_isbn, collection_id);
 
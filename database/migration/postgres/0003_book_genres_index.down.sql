@@ -0,0 +1 @@
+DROP INDEX IF EXISTS books_genres_idx;
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS books_genres_idx ON books USING GIN ((metadata->'genres'));
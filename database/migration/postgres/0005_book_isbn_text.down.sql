@@ -0,0 +1,4 @@
+-- only possible while no book is keyed by a real isbn, the normalized isbns
+-- themselves are kept
+ALTER TABLE book_collections ALTER COLUMN book_isbn TYPE UUID USING book_isbn::uuid;
+ALTER TABLE books ALTER COLUMN isbn TYPE UUID USING isbn::uuid;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS collections_name_idx;
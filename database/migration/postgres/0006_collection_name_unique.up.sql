@@ -0,0 +1,9 @@
+-- names that already clash, ignoring case, keep the oldest collection's name
+-- and have the id of the others appended
+UPDATE collections SET name = name || ' (' || id || ')'
+WHERE deleted_at IS NULL AND EXISTS (
+    SELECT 1 FROM collections o
+    WHERE o.deleted_at IS NULL AND lower(o.name) = lower(collections.name) AND o.id < collections.id
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS collections_name_idx ON collections (lower(name)) WHERE deleted_at IS NULL;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS collection_events (
+    id SERIAL PRIMARY KEY,
+    collection_id INTEGER NOT NULL,
+    book_isbn TEXT NOT NULL,
+    action TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS collection_events_collection_idx ON collection_events (collection_id, id);
@@ -0,0 +1,2 @@
+-- existing dates are full dates; they are left as they are
+ALTER TABLE books ADD COLUMN published_precision TEXT DEFAULT 'day';
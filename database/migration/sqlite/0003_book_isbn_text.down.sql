@@ -0,0 +1,2 @@
+-- the normalized isbns are kept, there is no schema change to undo
+SELECT 1;
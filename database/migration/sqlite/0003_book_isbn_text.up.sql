@@ -0,0 +1,55 @@
+-- isbn is already TEXT on sqlite, only the existing keys are normalized
+CREATE TEMPORARY TABLE isbn_map (old_isbn TEXT, digits TEXT);
+INSERT INTO isbn_map SELECT isbn, upper(replace(replace(isbn, '-', ''), ' ', '')) FROM books;
+
+-- leave anything that is not a valid ISBN-10 or ISBN-13 alone
+DELETE FROM isbn_map WHERE NOT (length(digits) = 10 AND substr(digits, 1, 9) NOT GLOB '*[^0-9]*' AND substr(digits, 10, 1) GLOB '[0-9X]')
+    AND NOT (length(digits) = 13 AND digits NOT GLOB '*[^0-9]*' AND substr(digits, 1, 3) IN ('978', '979'));
+DELETE FROM isbn_map WHERE length(digits) = 10 AND (10 * CAST(substr(digits, 1, 1) AS INTEGER) +
+    9 * CAST(substr(digits, 2, 1) AS INTEGER) +
+    8 * CAST(substr(digits, 3, 1) AS INTEGER) +
+    7 * CAST(substr(digits, 4, 1) AS INTEGER) +
+    6 * CAST(substr(digits, 5, 1) AS INTEGER) +
+    5 * CAST(substr(digits, 6, 1) AS INTEGER) +
+    4 * CAST(substr(digits, 7, 1) AS INTEGER) +
+    3 * CAST(substr(digits, 8, 1) AS INTEGER) +
+    2 * CAST(substr(digits, 9, 1) AS INTEGER) +
+    CASE substr(digits, 10, 1) WHEN 'X' THEN 10 ELSE CAST(substr(digits, 10, 1) AS INTEGER) END) % 11 <> 0;
+DELETE FROM isbn_map WHERE length(digits) = 13 AND (CAST(substr(digits, 1, 1) AS INTEGER) +
+    3 * CAST(substr(digits, 2, 1) AS INTEGER) +
+    CAST(substr(digits, 3, 1) AS INTEGER) +
+    3 * CAST(substr(digits, 4, 1) AS INTEGER) +
+    CAST(substr(digits, 5, 1) AS INTEGER) +
+    3 * CAST(substr(digits, 6, 1) AS INTEGER) +
+    CAST(substr(digits, 7, 1) AS INTEGER) +
+    3 * CAST(substr(digits, 8, 1) AS INTEGER) +
+    CAST(substr(digits, 9, 1) AS INTEGER) +
+    3 * CAST(substr(digits, 10, 1) AS INTEGER) +
+    CAST(substr(digits, 11, 1) AS INTEGER) +
+    3 * CAST(substr(digits, 12, 1) AS INTEGER) +
+    CAST(substr(digits, 13, 1) AS INTEGER)) % 10 <> 0;
+
+-- ISBN-10s become 978 prefixed ISBN-13s with a new check digit
+UPDATE isbn_map SET digits = '978' || substr(digits, 1, 9) WHERE length(digits) = 10;
+UPDATE isbn_map SET digits = digits || CAST((10 - (CAST(substr(digits, 1, 1) AS INTEGER) +
+    3 * CAST(substr(digits, 2, 1) AS INTEGER) +
+    CAST(substr(digits, 3, 1) AS INTEGER) +
+    3 * CAST(substr(digits, 4, 1) AS INTEGER) +
+    CAST(substr(digits, 5, 1) AS INTEGER) +
+    3 * CAST(substr(digits, 6, 1) AS INTEGER) +
+    CAST(substr(digits, 7, 1) AS INTEGER) +
+    3 * CAST(substr(digits, 8, 1) AS INTEGER) +
+    CAST(substr(digits, 9, 1) AS INTEGER) +
+    3 * CAST(substr(digits, 10, 1) AS INTEGER) +
+    CAST(substr(digits, 11, 1) AS INTEGER) +
+    3 * CAST(substr(digits, 12, 1) AS INTEGER)) % 10) % 10 AS TEXT) WHERE length(digits) = 12;
+DELETE FROM isbn_map WHERE digits = old_isbn;
+
+UPDATE book_collections
+SET book_isbn = (SELECT digits FROM isbn_map WHERE old_isbn = book_collections.book_isbn)
+WHERE book_isbn IN (SELECT old_isbn FROM isbn_map);
+UPDATE books
+SET isbn = (SELECT digits FROM isbn_map WHERE old_isbn = books.isbn)
+WHERE isbn IN (SELECT old_isbn FROM isbn_map);
+
+DROP TABLE isbn_map;
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// ErrInvalidCursor is returned when a page cursor cannot be decoded, or was
+// issued for a different sort order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Page selects an ordered window of a listing. A zero Limit returns every
+// row. Rows are ordered by Sort, then by primary key.
+type Page struct {
+	Limit  int
+	Cursor string
+	Sort   []SortField
+}
+
+// cursor is the decoded form of an opaque page cursor: the sort key of the
+// row it points at, and whether the page continues after or before that row
+type cursor struct {
+	Sort     string   `json:"s"`
+	Key      []string `json:"k"`
+	Backward bool     `json:"b,omitempty"`
+}
+
+func encodeCursor(keys []SortField, key []string, backward bool) string {
+	b, _ := json.Marshal(&cursor{Sort: sortSpec(keys), Key: key, Backward: backward})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string, keys []SortField, columns map[string]columnKind) (*cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c cursor
+	if err = json.Unmarshal(b, &c); err != nil || c.Sort != sortSpec(keys) || len(c.Key) != len(keys) {
+		return nil, ErrInvalidCursor
+	}
+	for i, k := range keys {
+		switch columns[k.Name] {
+		case intColumn:
+			_, err = strconv.Atoi(c.Key[i])
+		case floatColumn:
+			_, err = strconv.ParseFloat(c.Key[i], 64)
+		case timeColumn:
+			if c.Key[i] != "" {
+				_, err = time.Parse(cursorTimeFormat, c.Key[i])
+			}
+		}
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+	}
+	return &c, nil
+}
+
+func (c *cursor) backward() bool {
+	return c != nil && c.Backward
+}
+
+// pageCursors works out the cursors of the pages around a page of count rows
+// (already in display order) fetched with cursor c. hasMore reports whether
+// the lookahead row past the end of the page in fetch direction was found.
+func pageCursors(count int, hasMore bool, c *cursor, keys []SortField, key func(i int) []string) (next, prev string) {
+	if count == 0 {
+		return "", ""
+	}
+	if c.backward() {
+		// we came here from the page after this one
+		next = encodeCursor(keys, key(count-1), false)
+		if hasMore {
+			prev = encodeCursor(keys, key(0), true)
+		}
+		return next, prev
+	}
+	if hasMore {
+		next = encodeCursor(keys, key(count-1), false)
+	}
+	if c != nil {
+		prev = encodeCursor(keys, key(0), true)
+	}
+	return next, prev
+}
@@ -0,0 +1,207 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/john-cai/book-manager/models"
+)
+
+// ErrEmptySearch is returned when a search query has no searchable words
+var ErrEmptySearch = errors.New("search query has no words")
+
+const (
+	highlightStart = "<mark>"
+	highlightStop  = "</mark>"
+	// snippetWords is how many words of a long field a highlight keeps
+	snippetWords = 30
+)
+
+// searchKeys orders search results, best match first
+var searchKeys = []SortField{{Name: "rank", Desc: true}, {Name: "isbn"}}
+
+var searchSortColumns = map[string]columnKind{
+	"rank": floatColumn,
+	"isbn": textColumn,
+}
+
+// searchFieldWeights mirror the postgres setweight classes A, B and C used
+// for title, author and description
+var searchFieldWeights = []struct {
+	name   string
+	weight float64
+	value  func(b models.Book) string
+}{
+	{"title", 1.0, func(b models.Book) string { return b.Title }},
+	{"author", 0.4, func(b models.Book) string { return b.Author }},
+	{"description", 0.2, func(b models.Book) string { return b.Description }},
+}
+
+func searchSortKey(b models.Book) []string {
+	return []string{strconv.FormatFloat(b.Rank, 'g', -1, 64), b.ISBN}
+}
+
+// searchTerms splits a query into lower cased words
+func searchTerms(query string) []string {
+	return strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+type word struct {
+	start, end int
+}
+
+func splitWords(text string) []word {
+	var words []word
+	start := -1
+	for i, r := range text {
+		isWordRune := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWordRune && start < 0 {
+			start = i
+		} else if !isWordRune && start >= 0 {
+			words = append(words, word{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, word{start, len(text)})
+	}
+	return words
+}
+
+// matchesTerm treats a term as a word prefix, a rough stand-in for stemming
+func matchesTerm(w string, terms []string) bool {
+	w = strings.ToLower(w)
+	for _, term := range terms {
+		if strings.HasPrefix(w, term) {
+			return true
+		}
+	}
+	return false
+}
+
+// highlight marks the words of text that match terms, trimming long text to
+// a window around the first match. It returns "" when nothing matches.
+func highlight(text string, terms []string) string {
+	words := splitWords(text)
+	first := -1
+	for i, w := range words {
+		if matchesTerm(text[w.start:w.end], terms) {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return ""
+	}
+
+	from, to := 0, len(words)
+	if len(words) > snippetWords {
+		from = first - snippetWords/3
+		if from < 0 {
+			from = 0
+		}
+		to = from + snippetWords
+		if to > len(words) {
+			to = len(words)
+		}
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("... ")
+	}
+	pos := words[from].start
+	for _, w := range words[from:to] {
+		b.WriteString(text[pos:w.start])
+		if matchesTerm(text[w.start:w.end], terms) {
+			b.WriteString(highlightStart + text[w.start:w.end] + highlightStop)
+		} else {
+			b.WriteString(text[w.start:w.end])
+		}
+		pos = w.end
+	}
+	if to < len(words) {
+		b.WriteString(" ...")
+	} else {
+		b.WriteString(text[pos:])
+	}
+	return b.String()
+}
+
+// scoreBook ranks a book against the terms of a search, requiring every term
+// to appear in at least one field. It returns false for books that do not match.
+func scoreBook(b *models.Book, terms []string) bool {
+	var rank float64
+	for _, term := range terms {
+		found := false
+		for _, field := range searchFieldWeights {
+			text := field.value(*b)
+			for _, w := range splitWords(text) {
+				if matchesTerm(text[w.start:w.end], []string{term}) {
+					rank += field.weight
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	b.Rank = rank
+	b.Highlights = make(map[string]string)
+	for _, field := range searchFieldWeights {
+		if h := highlight(field.value(*b), terms); h != "" {
+			b.Highlights[field.name] = h
+		}
+	}
+	return true
+}
+
+// rankedPage orders scored books by rank and cuts out the page after (or
+// before) cursor c. It is shared by the backends that rank in Go.
+func rankedPage(books []models.Book, c *cursor, limit int) *models.BookList {
+	total := len(books)
+	sort.Slice(books, func(i, j int) bool {
+		cmp := compareKeys(searchSortKey(books[i]), searchSortKey(books[j]), searchKeys, searchSortColumns)
+		return cmp < 0 != c.backward()
+	})
+
+	var window []models.Book
+	for _, b := range books {
+		if c != nil {
+			cmp := compareKeys(searchSortKey(b), c.Key, searchKeys, searchSortColumns)
+			if c.backward() && cmp >= 0 || !c.backward() && cmp <= 0 {
+				continue
+			}
+		}
+		window = append(window, b)
+		if limit > 0 && len(window) > limit {
+			break
+		}
+	}
+
+	hasMore := limit > 0 && len(window) > limit
+	if hasMore {
+		window = window[:limit]
+	}
+	if c.backward() {
+		for i, j := 0, len(window)-1; i < j; i, j = i+1, j-1 {
+			window[i], window[j] = window[j], window[i]
+		}
+	}
+	list := &models.BookList{
+		Total:   total,
+		Results: window,
+	}
+	if limit > 0 {
+		list.NextCursor, list.PrevCursor = pageCursors(len(window), hasMore, c, searchKeys, func(i int) []string {
+			return searchSortKey(window[i])
+		})
+	}
+	return list
+}
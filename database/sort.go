@@ -0,0 +1,292 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/john-cai/book-manager/models"
+)
+
+// SortField orders a listing by one column
+type SortField struct {
+	Name string
+	Desc bool
+}
+
+type columnKind int
+
+const (
+	textColumn columnKind = iota
+	intColumn
+	floatColumn
+	timeColumn
+)
+
+// cursorTimeFormat is fixed width so encoded times compare as strings
+const cursorTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+var bookSortColumns = map[string]columnKind{
+	"isbn":         textColumn,
+	"title":        textColumn,
+	"author":       textColumn,
+	"published_at": timeColumn,
+	"created_at":   timeColumn,
+	"updated_at":   timeColumn,
+}
+
+var collectionSortColumns = map[string]columnKind{
+	"id":         intColumn,
+	"name":       textColumn,
+	"created_at": timeColumn,
+	"updated_at": timeColumn,
+}
+
+// ParseBookSort parses a sort parameter such as "title,-published_at" for a
+// book listing
+func ParseBookSort(spec string) ([]SortField, error) {
+	return parseSort(spec, bookSortColumns)
+}
+
+// ParseCollectionSort parses a sort parameter for a collection listing
+func ParseCollectionSort(spec string) ([]SortField, error) {
+	return parseSort(spec, collectionSortColumns)
+}
+
+func parseSort(spec string, columns map[string]columnKind) ([]SortField, error) {
+	var fields []SortField
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		field := SortField{Name: part}
+		if strings.HasPrefix(part, "-") {
+			field = SortField{Name: part[1:], Desc: true}
+		} else if strings.HasPrefix(part, "+") {
+			field.Name = part[1:]
+		}
+		if _, ok := columns[field.Name]; !ok {
+			return nil, fmt.Errorf("cannot sort by %q", field.Name)
+		}
+		if seen[field.Name] {
+			return nil, fmt.Errorf("%q is sorted on more than once", field.Name)
+		}
+		seen[field.Name] = true
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// sortKeys appends the primary key to the sort so every row has a unique
+// position, which keyset pagination relies on
+func sortKeys(fields []SortField, pk string) []SortField {
+	for _, f := range fields {
+		if f.Name == pk {
+			return fields
+		}
+	}
+	return append(append([]SortField(nil), fields...), SortField{Name: pk})
+}
+
+func sortSpec(keys []SortField) string {
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k.Name
+		if k.Desc {
+			parts[i] = "-" + k.Name
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func encodeTimeKey(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(cursorTimeFormat)
+}
+
+func bookSortKey(b models.Book, keys []SortField) []string {
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		switch k.Name {
+		case "isbn":
+			values[i] = b.ISBN
+		case "title":
+			values[i] = b.Title
+		case "author":
+			values[i] = b.Author
+		case "published_at":
+			values[i] = encodeTimeKey(b.PublishedAt)
+		case "created_at":
+			values[i] = encodeTimeKey(b.CreatedAt)
+		case "updated_at":
+			values[i] = encodeTimeKey(b.UpdatedAt)
+		}
+	}
+	return values
+}
+
+func collectionSortKey(c models.Collection, keys []SortField) []string {
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		switch k.Name {
+		case "id":
+			values[i] = strconv.Itoa(c.ID)
+		case "name":
+			values[i] = c.Name
+		case "created_at":
+			values[i] = encodeTimeKey(c.CreatedAt)
+		case "updated_at":
+			values[i] = encodeTimeKey(c.UpdatedAt)
+		}
+	}
+	return values
+}
+
+// compareKeys orders two encoded sort keys, honouring each field's direction
+func compareKeys(a, b []string, keys []SortField, columns map[string]columnKind) int {
+	for i, k := range keys {
+		var cmp int
+		switch columns[k.Name] {
+		case intColumn:
+			x, _ := strconv.Atoi(a[i])
+			y, _ := strconv.Atoi(b[i])
+			cmp = compareInts(x, y)
+		case floatColumn:
+			x, _ := strconv.ParseFloat(a[i], 64)
+			y, _ := strconv.ParseFloat(b[i], 64)
+			cmp = compareFloats(x, y)
+		default:
+			cmp = strings.Compare(a[i], b[i])
+		}
+		if k.Desc {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
+
+func compareInts(x, y int) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func compareFloats(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// sqlDialect describes how a SQL backend sorts and compares key columns
+type sqlDialect struct {
+	// nullTime is the literal standing in for NULL timestamps, sorting first
+	nullTime string
+}
+
+var (
+	postgresDialect = sqlDialect{nullTime: "'-infinity'::timestamp"}
+	sqliteDialect   = sqlDialect{nullTime: "''"}
+)
+
+func (d sqlDialect) expr(name string, kind columnKind) string {
+	switch kind {
+	case timeColumn:
+		return fmt.Sprintf("COALESCE(%s, %s)", name, d.nullTime)
+	case textColumn:
+		return fmt.Sprintf("COALESCE(%s, '')", name)
+	}
+	return name
+}
+
+// param turns an encoded key value back into a query argument
+func (d sqlDialect) param(value string, kind columnKind) (interface{}, error) {
+	switch kind {
+	case intColumn:
+		return strconv.Atoi(value)
+	case floatColumn:
+		return strconv.ParseFloat(value, 64)
+	case timeColumn:
+		if value == "" {
+			return nil, nil
+		}
+		return time.Parse(cursorTimeFormat, value)
+	}
+	return value, nil
+}
+
+// keyset returns the ORDER BY terms for keys, plus the WHERE condition and its
+// arguments selecting the rows past cursor c in fetch direction
+func (d sqlDialect) keyset(keys []SortField, columns map[string]columnKind, c *cursor) (order []string, cond string, args []interface{}, err error) {
+	exprs := make([]string, len(keys))
+	for i, k := range keys {
+		exprs[i] = d.expr(k.Name, columns[k.Name])
+	}
+	return d.keysetOn(exprs, keys, columns, c)
+}
+
+// keysetOn is keyset for keys computed by the given SQL expressions
+func (d sqlDialect) keysetOn(exprs []string, keys []SortField, columns map[string]columnKind, c *cursor) (order []string, cond string, args []interface{}, err error) {
+	for i, k := range keys {
+		desc := k.Desc != c.backward()
+		if desc {
+			order = append(order, exprs[i]+" DESC")
+		} else {
+			order = append(order, exprs[i]+" ASC")
+		}
+	}
+	if c == nil {
+		return order, "", nil, nil
+	}
+
+	params := make([]string, len(keys))
+	values := make([]interface{}, len(keys))
+	for i, k := range keys {
+		kind := columns[k.Name]
+		v, err := d.param(c.Key[i], kind)
+		if err != nil {
+			return nil, "", nil, ErrInvalidCursor
+		}
+		params[i], values[i] = "?", v
+		if kind == timeColumn && v == nil {
+			params[i], values[i] = d.nullTime, nil
+		}
+	}
+
+	// (a > x) OR (a = x AND b > y) OR ...
+	var terms []string
+	for i, k := range keys {
+		var parts []string
+		for j := 0; j < i; j++ {
+			parts = append(parts, exprs[j]+" = "+params[j])
+			if values[j] != nil {
+				args = append(args, values[j])
+			}
+		}
+		op := ">"
+		if k.Desc != c.backward() {
+			op = "<"
+		}
+		parts = append(parts, exprs[i]+" "+op+" "+params[i])
+		if values[i] != nil {
+			args = append(args, values[i])
+		}
+		terms = append(terms, "("+strings.Join(parts, " AND ")+")")
+	}
+	return order, strings.Join(terms, " OR "), args, nil
+}
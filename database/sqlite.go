@@ -0,0 +1,1157 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/john-cai/book-manager/models"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	sqliteBookColumns       = "books.isbn, books.title, books.author, books.description, books.metadata, books.published_at, books.published_precision, books.version, books.created_at, books.updated_at, books.deleted_at"
+	sqliteCollectionColumns = "collections.id, collections.name, collections.description, collections.version, collections.created_at, collections.updated_at, collections.deleted_at"
+)
+
+// SQLite is a Store backed by an embedded sqlite database file
+type SQLite struct {
+	db *sql.DB
+}
+
+// NewSQLite opens (creating if needed) the sqlite database at path. The
+// schema is managed through Migrator.
+func NewSQLite(path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=1&_busy_timeout=5000&_txlock=immediate", path))
+	if err != nil {
+		return nil, err
+	}
+	// sqlite only allows a single writer at a time
+	db.SetMaxOpenConns(1)
+	return &SQLite{
+		db: db,
+	}, nil
+}
+
+// sqliteTime scans nullable timestamp columns into a time.Time, leaving the
+// zero time for NULL the way go-pg does
+type sqliteTime struct {
+	t *time.Time
+}
+
+func (s sqliteTime) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*s.t = time.Time{}
+	case time.Time:
+		*s.t = v
+	case string:
+		return s.parse(v)
+	case []byte:
+		return s.parse(string(v))
+	default:
+		return fmt.Errorf("cannot scan %T into time", value)
+	}
+	return nil
+}
+
+func (s sqliteTime) parse(v string) error {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999-07:00", "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			*s.t = t
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot parse %q as time", v)
+}
+
+// timeValue converts a time into a query argument, storing the zero time as
+// NULL and everything else in UTC so text comparisons stay consistent
+func timeValue(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+// stringValue stores the empty string as NULL
+func stringValue(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// sqliteExecer is a *sql.DB or a *sql.Tx
+type sqliteExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func scanSQLiteBook(row scanner) (models.Book, error) {
+	var book models.Book
+	var description, metadata, precision sql.NullString
+	if err := row.Scan(
+		&book.ISBN,
+		&book.Title,
+		&book.Author,
+		&description,
+		&metadata,
+		sqliteTime{&book.PublishedAt},
+		&precision,
+		&book.Version,
+		sqliteTime{&book.CreatedAt},
+		sqliteTime{&book.UpdatedAt},
+		sqliteTime{&book.DeletedAt},
+	); err != nil {
+		return book, err
+	}
+	book.Description = description.String
+	book.PublishedPrecision = models.DatePrecision(precision.String)
+	if metadata.Valid && metadata.String != "" {
+		if err := json.Unmarshal([]byte(metadata.String), &book.Metadata); err != nil {
+			return book, err
+		}
+	}
+	return book, nil
+}
+
+func scanSQLiteCollection(row scanner) (models.Collection, error) {
+	var collection models.Collection
+	var name, description sql.NullString
+	if err := row.Scan(
+		&collection.ID,
+		&name,
+		&description,
+		&collection.Version,
+		sqliteTime{&collection.CreatedAt},
+		sqliteTime{&collection.UpdatedAt},
+		sqliteTime{&collection.DeletedAt},
+	); err != nil {
+		return collection, err
+	}
+	collection.Name = name.String
+	collection.Description = description.String
+	return collection, nil
+}
+
+func (s *SQLite) queryBooks(query string, args ...interface{}) ([]models.Book, error) {
+	return scanSQLiteBooks(s.db.Query(query, args...))
+}
+
+func scanSQLiteBooks(rows *sql.Rows, err error) ([]models.Book, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var books []models.Book
+	for rows.Next() {
+		book, err := scanSQLiteBook(rows)
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, book)
+	}
+	return books, rows.Err()
+}
+
+func (s *SQLite) queryCollections(query string, args ...interface{}) ([]models.Collection, error) {
+	return scanSQLiteCollections(s.db.Query(query, args...))
+}
+
+func scanSQLiteCollections(rows *sql.Rows, err error) ([]models.Collection, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var collections []models.Collection
+	for rows.Next() {
+		collection, err := scanSQLiteCollection(rows)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, collection)
+	}
+	return collections, rows.Err()
+}
+
+func (s *SQLite) bookCollections(isbn string) ([]models.Collection, error) {
+	return s.queryCollections(
+		`SELECT `+sqliteCollectionColumns+` FROM collections
+		JOIN book_collections ON book_collections.collection_id = collections.id
+		WHERE book_collections.book_isbn = ?
+		AND book_collections.deleted_at IS NULL
+		AND collections.deleted_at IS NULL
+		ORDER BY collections.id`,
+		isbn,
+	)
+}
+
+func (s *SQLite) collectionBooks(id int) ([]models.Book, error) {
+	return s.queryBooks(
+		`SELECT `+sqliteBookColumns+` FROM books
+		JOIN book_collections ON book_collections.book_isbn = books.isbn
+		WHERE book_collections.collection_id = ?
+		AND book_collections.deleted_at IS NULL
+		AND books.deleted_at IS NULL
+		ORDER BY books.isbn`,
+		id,
+	)
+}
+
+// sqliteAffectedOne turns the result of a statement that affected no rows
+// into pg.ErrNoRows
+func sqliteAffectedOne(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return pg.ErrNoRows
+	}
+	return nil
+}
+
+func (s *SQLite) GetBookByISBN(isbn string) (*models.Book, error) {
+	book, err := scanSQLiteBook(s.db.QueryRow(
+		`SELECT `+sqliteBookColumns+` FROM books WHERE isbn = ? AND deleted_at IS NULL`,
+		isbn,
+	))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, pg.ErrNoRows
+		}
+		return nil, err
+	}
+	if book.Collections, err = s.bookCollections(book.ISBN); err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+func distinctCount(values []string) int {
+	seen := make(map[string]bool)
+	for _, v := range values {
+		seen[v] = true
+	}
+	return len(seen)
+}
+
+// sqliteBookFilter returns the WHERE conditions and arguments selecting the
+// live books matching filter
+func sqliteBookFilter(filter BookFilter) ([]string, []interface{}) {
+	where := []string{"deleted_at IS NULL"}
+	var args []interface{}
+	if filter.ISBN != "" {
+		where = append(where, "isbn = ?")
+		args = append(args, filter.ISBN)
+	}
+	if filter.Title != "" {
+		where = append(where, "title = ?")
+		args = append(args, filter.Title)
+	}
+	if filter.Author != "" {
+		where = append(where, "author = ?")
+		args = append(args, filter.Author)
+	}
+	if !filter.PublishedFrom.IsZero() {
+		where = append(where, "published_at >= ?")
+		args = append(args, timeValue(filter.PublishedFrom))
+	}
+	if !filter.PublishedTo.IsZero() {
+		where = append(where, "published_at < ?")
+		args = append(args, timeValue(filter.PublishedTo))
+	}
+	if len(filter.Genres) > 0 {
+		placeholders := make([]string, len(filter.Genres))
+		for i, genre := range filter.Genres {
+			placeholders[i] = "?"
+			args = append(args, genre)
+		}
+		matching := fmt.Sprintf(
+			"SELECT DISTINCT json_each.value FROM json_each(books.metadata, '$.genres') WHERE json_each.value IN (%s)",
+			strings.Join(placeholders, ","),
+		)
+		if filter.GenresMatch == MatchAllGenres {
+			where = append(where, fmt.Sprintf("(SELECT COUNT(*) FROM (%s)) = ?", matching))
+			args = append(args, distinctCount(filter.Genres))
+		} else {
+			where = append(where, "EXISTS ("+matching+")")
+		}
+	}
+	return where, args
+}
+
+func (s *SQLite) GetBooks(filter BookFilter, page Page) (*models.BookList, error) {
+	keys := sortKeys(page.Sort, "isbn")
+	c, err := decodeCursor(page.Cursor, keys, bookSortColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	where, args := sqliteBookFilter(filter)
+	var total int
+	if err = s.db.QueryRow(`SELECT COUNT(*) FROM books WHERE `+strings.Join(where, " AND "), args...).Scan(&total); err != nil {
+		return nil, err
+	}
+
+	order, cond, keyArgs, err := sqliteDialect.keyset(keys, bookSortColumns, c)
+	if err != nil {
+		return nil, err
+	}
+	if cond != "" {
+		where = append(where, "("+cond+")")
+		args = append(args, keyArgs...)
+	}
+	query := `SELECT ` + sqliteBookColumns + ` FROM books WHERE ` + strings.Join(where, " AND ") + ` ORDER BY ` + strings.Join(order, ", ")
+	if page.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", page.Limit+1)
+	}
+	books, err := s.queryBooks(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	hasMore := page.Limit > 0 && len(books) > page.Limit
+	if hasMore {
+		books = books[:page.Limit]
+	}
+	if c.backward() {
+		for i, j := 0, len(books)-1; i < j; i, j = i+1, j-1 {
+			books[i], books[j] = books[j], books[i]
+		}
+	}
+	for i := range books {
+		if books[i].Collections, err = s.bookCollections(books[i].ISBN); err != nil {
+			return nil, err
+		}
+	}
+	list := &models.BookList{
+		Total:   total,
+		Results: books,
+	}
+	if page.Limit > 0 {
+		list.NextCursor, list.PrevCursor = pageCursors(len(books), hasMore, c, keys, func(i int) []string {
+			return bookSortKey(books[i], keys)
+		})
+	}
+	return list, nil
+}
+
+// SearchBooks narrows the books down with LIKE, then ranks and highlights the
+// candidates in Go, as the bundled sqlite has no FTS5
+func (s *SQLite) SearchBooks(query string, filter BookFilter, page Page) (*models.BookList, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil, ErrEmptySearch
+	}
+	c, err := decodeCursor(page.Cursor, searchKeys, searchSortColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	where, args := sqliteBookFilter(filter)
+	for _, term := range terms {
+		where = append(where, "(title LIKE ? OR author LIKE ? OR description LIKE ?)")
+		pattern := "%" + term + "%"
+		args = append(args, pattern, pattern, pattern)
+	}
+	candidates, err := s.queryBooks(`SELECT `+sqliteBookColumns+` FROM books WHERE `+strings.Join(where, " AND "), args...)
+	if err != nil {
+		return nil, err
+	}
+	var books []models.Book
+	for _, b := range candidates {
+		if scoreBook(&b, terms) {
+			books = append(books, b)
+		}
+	}
+
+	list := rankedPage(books, c, page.Limit)
+	for i := range list.Results {
+		if list.Results[i].Collections, err = s.bookCollections(list.Results[i].ISBN); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func (s *SQLite) AddBook(b *models.Book) error {
+	if err := b.BeforeInsert(nil); err != nil {
+		return err
+	}
+	err := sqliteInsertBook(s.db, b)
+	// the primary key still covers soft deleted rows
+	if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+		return ErrDuplicateISBN
+	}
+	return err
+}
+
+// sqliteInsertBook writes every column of b, as it is, through db, which is
+// the database or a transaction
+func sqliteInsertBook(db sqliteExecer, b *models.Book) error {
+	metadata, err := json.Marshal(b.Metadata)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		`INSERT INTO books (isbn, title, author, description, metadata, published_at, published_precision, version, created_at, updated_at, deleted_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		b.ISBN, b.Title, b.Author, b.Description, string(metadata),
+		timeValue(b.PublishedAt), stringValue(string(b.PublishedPrecision)), b.Version,
+		timeValue(b.CreatedAt), timeValue(b.UpdatedAt), timeValue(b.DeletedAt),
+	)
+	return err
+}
+
+func (s *SQLite) UpdateBook(b *models.Book) error {
+	return s.PatchBook(b, BookPatchColumns)
+}
+
+func (s *SQLite) PatchBook(b *models.Book, columns []string) error {
+	values, err := sqliteBookValues(b)
+	if err != nil {
+		return err
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		version, err := sqliteVersion(tx, `SELECT version FROM books WHERE isbn = ? AND deleted_at IS NULL`, b.ISBN, b.Version)
+		if err != nil {
+			return err
+		}
+		if err = b.BeforeUpdate(nil); err != nil {
+			return err
+		}
+		if err = sqlitePatch(tx, "books", "isbn", b.ISBN, columns, values, version, b.UpdatedAt); err != nil {
+			return err
+		}
+		b.Version = version
+		return nil
+	})
+}
+
+// sqliteBookValues are the values of the BookPatchColumns of b
+func sqliteBookValues(b *models.Book) (map[string]interface{}, error) {
+	metadata, err := json.Marshal(b.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"title":               b.Title,
+		"author":              b.Author,
+		"description":         b.Description,
+		"published_at":        timeValue(b.PublishedAt),
+		"published_precision": stringValue(string(b.PublishedPrecision)),
+		"metadata":            string(metadata),
+	}, nil
+}
+
+func (s *SQLite) ImportBooks(books []models.Book, onConflict ImportConflict, dryRun bool) ([]models.ImportResult, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results, err := importBooks(&sqliteImportTx{tx: tx}, books, onConflict)
+	if err != nil || dryRun {
+		return results, err
+	}
+	return results, tx.Commit()
+}
+
+type sqliteImportTx struct {
+	tx *sql.Tx
+}
+
+func (tx *sqliteImportTx) getBook(isbn string) (*models.Book, error) {
+	b, err := scanSQLiteBook(tx.tx.QueryRow(`SELECT `+sqliteBookColumns+` FROM books WHERE isbn = ?`, isbn))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (tx *sqliteImportTx) insert(b *models.Book) error {
+	if err := b.BeforeInsert(nil); err != nil {
+		return err
+	}
+	return sqliteInsertBook(tx.tx, b)
+}
+
+func (tx *sqliteImportTx) update(b *models.Book) error {
+	values, err := sqliteBookValues(b)
+	if err != nil {
+		return err
+	}
+	if err = b.BeforeUpdate(nil); err != nil {
+		return err
+	}
+	return sqlitePatch(tx.tx, "books", "isbn", b.ISBN, BookPatchColumns, values, b.Version, b.UpdatedAt)
+}
+
+func (s *SQLite) DeleteBookByISBN(isbn string, policy CascadePolicy) ([]models.Collection, error) {
+	affected := []models.Collection{}
+	err := s.inTx(func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM books WHERE isbn = ? AND deleted_at IS NULL)`, isbn).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return pg.ErrNoRows
+		}
+		collections, err := scanSQLiteCollections(tx.Query(
+			`SELECT `+sqliteCollectionColumns+` FROM collections
+			JOIN book_collections ON book_collections.collection_id = collections.id
+			WHERE book_collections.book_isbn = ?
+			AND book_collections.deleted_at IS NULL
+			AND collections.deleted_at IS NULL
+			ORDER BY collections.id`,
+			isbn,
+		))
+		if err != nil {
+			return err
+		}
+		affected = append(affected, collections...)
+		if policy == RestrictDelete && len(affected) > 0 {
+			return ErrDeleteRestricted
+		}
+
+		now := time.Now().UTC()
+		if _, err = tx.Exec(`UPDATE books SET deleted_at = ? WHERE isbn = ?`, now, isbn); err != nil {
+			return err
+		}
+		return deleteSQLiteMemberships(tx, "book_isbn", isbn, now, policy)
+	})
+	if err != nil && err != ErrDeleteRestricted {
+		return nil, err
+	}
+	return affected, err
+}
+
+func (s *SQLite) GetCollectionByID(id int) (*models.Collection, error) {
+	collection, err := scanSQLiteCollection(s.db.QueryRow(
+		`SELECT `+sqliteCollectionColumns+` FROM collections WHERE id = ? AND deleted_at IS NULL`,
+		id,
+	))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, pg.ErrNoRows
+		}
+		return nil, err
+	}
+	if collection.Books, err = s.collectionBooks(collection.ID); err != nil {
+		return nil, err
+	}
+	return &collection, nil
+}
+
+func (s *SQLite) GetAllCollections(page Page) (*models.CollectionList, error) {
+	keys := sortKeys(page.Sort, "id")
+	c, err := decodeCursor(page.Cursor, keys, collectionSortColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int
+	if err = s.db.QueryRow(`SELECT COUNT(*) FROM collections WHERE deleted_at IS NULL`).Scan(&total); err != nil {
+		return nil, err
+	}
+
+	where := "deleted_at IS NULL"
+	order, cond, args, err := sqliteDialect.keyset(keys, collectionSortColumns, c)
+	if err != nil {
+		return nil, err
+	}
+	if cond != "" {
+		where += " AND (" + cond + ")"
+	}
+	query := `SELECT ` + sqliteCollectionColumns + ` FROM collections WHERE ` + where + ` ORDER BY ` + strings.Join(order, ", ")
+	if page.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", page.Limit+1)
+	}
+	collections, err := s.queryCollections(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	hasMore := page.Limit > 0 && len(collections) > page.Limit
+	if hasMore {
+		collections = collections[:page.Limit]
+	}
+	if c.backward() {
+		for i, j := 0, len(collections)-1; i < j; i, j = i+1, j-1 {
+			collections[i], collections[j] = collections[j], collections[i]
+		}
+	}
+	for i := range collections {
+		if collections[i].Books, err = s.collectionBooks(collections[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	list := &models.CollectionList{
+		Total:   total,
+		Results: collections,
+	}
+	if page.Limit > 0 {
+		list.NextCursor, list.PrevCursor = pageCursors(len(collections), hasMore, c, keys, func(i int) []string {
+			return collectionSortKey(collections[i], keys)
+		})
+	}
+	return list, nil
+}
+
+func (s *SQLite) GetCollectionByName(name string) (*models.Collection, error) {
+	// an exact name beats a slug that happens to match
+	collection, err := scanSQLiteCollection(s.db.QueryRow(
+		`SELECT `+sqliteCollectionColumns+` FROM collections
+		WHERE (lower(name) = lower(?1) OR lower(replace(name, ' ', '-')) = lower(?1)) AND deleted_at IS NULL
+		ORDER BY lower(name) = lower(?1) DESC, id LIMIT 1`,
+		name,
+	))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, pg.ErrNoRows
+		}
+		return nil, err
+	}
+	if collection.Books, err = s.collectionBooks(collection.ID); err != nil {
+		return nil, err
+	}
+	return &collection, nil
+}
+
+// sqliteDuplicateCollectionName maps a violation of the unique index on collection
+// names to ErrDuplicateCollectionName
+func sqliteDuplicateCollectionName(err error) error {
+	if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique && strings.Contains(sqliteErr.Error(), "collections_name_idx") {
+		return ErrDuplicateCollectionName
+	}
+	return err
+}
+
+func (s *SQLite) AddCollection(c *models.Collection) error {
+	if err := c.BeforeInsert(nil); err != nil {
+		return err
+	}
+	res, err := s.db.Exec(
+		`INSERT INTO collections (name, description, version, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`,
+		c.Name, c.Description, c.Version, timeValue(c.CreatedAt), timeValue(c.UpdatedAt),
+	)
+	if err != nil {
+		return sqliteDuplicateCollectionName(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	c.ID = int(id)
+	return nil
+}
+
+func (s *SQLite) UpdateCollection(c *models.Collection) error {
+	return s.PatchCollection(c, CollectionPatchColumns)
+}
+
+// sqliteVersion reads the version of the live row that query selects by key,
+// and returns the version an update based on expected moves it to.
+// ErrVersionConflict is returned when the row has moved past expected, unless
+// expected is zero.
+func sqliteVersion(tx *sql.Tx, query string, key interface{}, expected int) (int, error) {
+	var current int
+	if err := tx.QueryRow(query, key).Scan(&current); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, pg.ErrNoRows
+		}
+		return 0, err
+	}
+	if expected != 0 && expected != current {
+		return 0, ErrVersionConflict
+	}
+	return current + 1, nil
+}
+
+func (s *SQLite) PatchCollection(c *models.Collection, columns []string) error {
+	values := map[string]interface{}{
+		"name":        c.Name,
+		"description": c.Description,
+	}
+	return s.inTx(func(tx *sql.Tx) error {
+		version, err := sqliteVersion(tx, `SELECT version FROM collections WHERE id = ? AND deleted_at IS NULL`, c.ID, c.Version)
+		if err != nil {
+			return err
+		}
+		if err = c.BeforeUpdate(nil); err != nil {
+			return err
+		}
+		if err = sqliteDuplicateCollectionName(sqlitePatch(tx, "collections", "id", c.ID, columns, values, version, c.UpdatedAt)); err != nil {
+			return err
+		}
+		c.Version = version
+		return nil
+	})
+}
+
+// sqlitePatch sets the given columns of the row of table whose key column
+// is key to their values, moving it on to version as of updatedAt
+func sqlitePatch(tx *sql.Tx, table, keyColumn string, key interface{}, columns []string, values map[string]interface{}, version int, updatedAt time.Time) error {
+	assignments := []string{"version = ?", "updated_at = ?"}
+	args := []interface{}{version, timeValue(updatedAt)}
+	for _, column := range columns {
+		value, ok := values[column]
+		if !ok {
+			return fmt.Errorf("cannot patch column %q", column)
+		}
+		assignments = append(assignments, column+" = ?")
+		args = append(args, value)
+	}
+	_, err := tx.Exec(`UPDATE `+table+` SET `+strings.Join(assignments, ", ")+` WHERE `+keyColumn+` = ?`, append(args, key)...)
+	return err
+}
+
+func (s *SQLite) DeleteCollectionByID(id int, policy CascadePolicy) ([]models.Book, error) {
+	affected := []models.Book{}
+	err := s.inTx(func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM collections WHERE id = ? AND deleted_at IS NULL)`, id).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return pg.ErrNoRows
+		}
+		books, err := scanSQLiteBooks(tx.Query(
+			`SELECT `+sqliteBookColumns+` FROM books
+			JOIN book_collections ON book_collections.book_isbn = books.isbn
+			WHERE book_collections.collection_id = ?
+			AND book_collections.deleted_at IS NULL
+			AND books.deleted_at IS NULL
+			ORDER BY books.isbn`,
+			id,
+		))
+		if err != nil {
+			return err
+		}
+		affected = append(affected, books...)
+		if policy == RestrictDelete && len(affected) > 0 {
+			return ErrDeleteRestricted
+		}
+
+		now := time.Now().UTC()
+		if _, err = tx.Exec(`UPDATE collections SET deleted_at = ? WHERE id = ?`, now, id); err != nil {
+			return err
+		}
+		return deleteSQLiteMemberships(tx, "collection_id", id, now, policy)
+	})
+	if err != nil && err != ErrDeleteRestricted {
+		return nil, err
+	}
+	return affected, err
+}
+
+// deleteSQLiteMemberships deals with the live memberships whose column is
+// value, of a book or collection deleted at deletedAt. Under DetachDelete
+// they are removed and recorded in their collections' history, otherwise
+// they are soft deleted at deletedAt so that they can be restored with what
+// they were deleted with.
+func deleteSQLiteMemberships(tx *sql.Tx, column string, value interface{}, deletedAt time.Time, policy CascadePolicy) error {
+	if policy != DetachDelete {
+		_, err := tx.Exec(`UPDATE book_collections SET deleted_at = ? WHERE `+column+` = ? AND deleted_at IS NULL`, deletedAt, value)
+		return err
+	}
+	_, err := tx.Exec(
+		`INSERT INTO collection_events (collection_id, book_isbn, action, created_at)
+		SELECT collection_id, book_isbn, ?, ? FROM book_collections
+		WHERE `+column+` = ? AND deleted_at IS NULL
+		ORDER BY collection_id, book_isbn`,
+		string(models.MembershipRemoved), deletedAt, value,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM book_collections WHERE `+column+` = ? AND deleted_at IS NULL`, value)
+	return err
+}
+
+func (s *SQLite) AddBookToCollection(b *models.Book, c *models.Collection) error {
+	if b.ISBN == "" {
+		return errors.New("book isbn missing")
+	}
+	if c.ID == 0 {
+		return errors.New("collection id missing")
+	}
+	return singleMembership(s.changeMemberships(c, []string{b.ISBN}, true, true))
+}
+
+func (s *SQLite) RemoveBookFromCollection(b *models.Book, c *models.Collection) error {
+	if b.ISBN == "" {
+		return errors.New("book isbn missing")
+	}
+	if c.ID == 0 {
+		return errors.New("collection id missing")
+	}
+	return singleMembership(s.changeMemberships(c, []string{b.ISBN}, false, true))
+}
+
+func (s *SQLite) AddBooksToCollection(c *models.Collection, isbns []string, atomic bool) (*models.MembershipReport, error) {
+	return s.changeMemberships(c, isbns, true, atomic)
+}
+
+func (s *SQLite) RemoveBooksFromCollection(c *models.Collection, isbns []string, atomic bool) (*models.MembershipReport, error) {
+	return s.changeMemberships(c, isbns, false, atomic)
+}
+
+func (s *SQLite) changeMemberships(c *models.Collection, isbns []string, adding, atomic bool) (*models.MembershipReport, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM collections WHERE id = ? AND deleted_at IS NULL)`, c.ID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, pg.ErrNoRows
+	}
+	report, err := changeMemberships(&sqliteMembershipTx{tx: tx, collectionID: c.ID, now: time.Now().UTC()}, isbns, adding, atomic)
+	if err != nil || !report.Applied {
+		return report, err
+	}
+	return report, tx.Commit()
+}
+
+type sqliteMembershipTx struct {
+	tx           *sql.Tx
+	collectionID int
+	now          time.Time
+}
+
+func (tx *sqliteMembershipTx) record(isbn string, action models.MembershipStatus) error {
+	_, err := tx.tx.Exec(
+		`INSERT INTO collection_events (collection_id, book_isbn, action, created_at) VALUES (?, ?, ?, ?)`,
+		tx.collectionID, isbn, string(action), tx.now,
+	)
+	return err
+}
+
+func (tx *sqliteMembershipTx) exists(query string, args ...interface{}) (bool, error) {
+	var exists bool
+	err := tx.tx.QueryRow(`SELECT EXISTS (`+query+`)`, args...).Scan(&exists)
+	return exists, err
+}
+
+func (tx *sqliteMembershipTx) bookExists(isbn string) (bool, error) {
+	return tx.exists(`SELECT 1 FROM books WHERE isbn = ? AND deleted_at IS NULL`, isbn)
+}
+
+func (tx *sqliteMembershipTx) isMember(isbn string) (bool, error) {
+	return tx.exists(
+		`SELECT 1 FROM book_collections WHERE book_isbn = ? AND collection_id = ? AND deleted_at IS NULL`,
+		isbn, tx.collectionID,
+	)
+}
+
+func (tx *sqliteMembershipTx) add(isbn string) error {
+	// the unique index still covers soft deleted rows, so a removed
+	// membership is brought back rather than added again
+	_, err := tx.tx.Exec(
+		`INSERT INTO book_collections (book_isbn, collection_id, created_at) VALUES (?1, ?2, ?3)
+		ON CONFLICT (book_isbn, collection_id) DO UPDATE SET deleted_at = NULL, updated_at = ?3`,
+		isbn, tx.collectionID, tx.now,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.record(isbn, models.MembershipAdded)
+}
+
+func (tx *sqliteMembershipTx) remove(isbn string) error {
+	_, err := tx.tx.Exec(
+		`UPDATE book_collections SET deleted_at = ? WHERE book_isbn = ? AND collection_id = ? AND deleted_at IS NULL`,
+		tx.now, isbn, tx.collectionID,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.record(isbn, models.MembershipRemoved)
+}
+
+func (tx *sqliteMembershipTx) bumpVersions(isbns []string) error {
+	for _, isbn := range isbns {
+		if _, err := tx.tx.Exec(`UPDATE books SET version = version + 1 WHERE isbn = ?`, isbn); err != nil {
+			return err
+		}
+	}
+	_, err := tx.tx.Exec(`UPDATE collections SET version = version + 1 WHERE id = ?`, tx.collectionID)
+	return err
+}
+
+func (s *SQLite) GetCollectionHistory(id int) (*models.CollectionHistory, error) {
+	rows, err := s.db.Query(
+		`SELECT id, collection_id, book_isbn, action, created_at FROM collection_events
+		WHERE collection_id = ? ORDER BY id`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := models.CollectionHistory{Results: []models.CollectionEvent{}}
+	for rows.Next() {
+		var event models.CollectionEvent
+		if err = rows.Scan(&event.ID, &event.CollectionID, &event.BookISBN, &event.Action, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		history.Results = append(history.Results, event)
+	}
+	return &history, rows.Err()
+}
+
+// inTx runs fn in a transaction, committing it when fn succeeds
+func (s *SQLite) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLite) GetTrash(filter TrashFilter) (*models.Trash, error) {
+	where := []string{"deleted_at IS NOT NULL"}
+	var args []interface{}
+	if !filter.DeletedFrom.IsZero() {
+		where = append(where, "deleted_at >= ?")
+		args = append(args, timeValue(filter.DeletedFrom))
+	}
+	if !filter.DeletedTo.IsZero() {
+		where = append(where, "deleted_at < ?")
+		args = append(args, timeValue(filter.DeletedTo))
+	}
+	conditions := strings.Join(where, " AND ")
+
+	trash := models.Trash{Books: []models.Book{}, Collections: []models.Collection{}}
+	books, err := s.queryBooks(
+		`SELECT `+sqliteBookColumns+` FROM books WHERE `+conditions+` ORDER BY deleted_at DESC`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	collections, err := s.queryCollections(
+		`SELECT `+sqliteCollectionColumns+` FROM collections WHERE `+conditions+` ORDER BY deleted_at DESC`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	trash.Books = append(trash.Books, books...)
+	trash.Collections = append(trash.Collections, collections...)
+	return &trash, nil
+}
+
+func (s *SQLite) RestoreBook(isbn string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		// memberships deleted along with the book share its deleted_at
+		_, err := tx.Exec(
+			`UPDATE book_collections SET deleted_at = NULL
+			WHERE book_isbn = ?1 AND deleted_at = (SELECT deleted_at FROM books WHERE isbn = ?1)`,
+			isbn,
+		)
+		if err != nil {
+			return err
+		}
+		return sqliteAffectedOne(tx.Exec(`UPDATE books SET deleted_at = NULL WHERE isbn = ? AND deleted_at IS NOT NULL`, isbn))
+	})
+}
+
+func (s *SQLite) RestoreCollection(id int) error {
+	return sqliteDuplicateCollectionName(s.inTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`UPDATE book_collections SET deleted_at = NULL
+			WHERE collection_id = ?1 AND deleted_at = (SELECT deleted_at FROM collections WHERE id = ?1)`,
+			id,
+		)
+		if err != nil {
+			return err
+		}
+		return sqliteAffectedOne(tx.Exec(`UPDATE collections SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL`, id))
+	}))
+}
+
+func (s *SQLite) PurgeBook(isbn string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM book_collections WHERE book_isbn = ?`, isbn); err != nil {
+			return err
+		}
+		return sqliteAffectedOne(tx.Exec(`DELETE FROM books WHERE isbn = ?`, isbn))
+	})
+}
+
+func (s *SQLite) PurgeCollection(id int) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM book_collections WHERE collection_id = ?`, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM collection_events WHERE collection_id = ?`, id); err != nil {
+			return err
+		}
+		return sqliteAffectedOne(tx.Exec(`DELETE FROM collections WHERE id = ?`, id))
+	})
+}
+
+func (s *SQLite) Backup(fn func(models.BackupRecord) error) error {
+	// the store's only connection is also its writer, so the snapshot is read
+	// in full before fn sees any of it, rather than holding the write lock for
+	// as long as fn, and whoever fn writes to, takes
+	records, err := s.backupRecords()
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupRecords reads everything in the store in the order Backup gives it
+func (s *SQLite) backupRecords() ([]models.BackupRecord, error) {
+	// a transaction keeps the tables from changing between the queries
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var records []models.BackupRecord
+	fn := func(record models.BackupRecord) error {
+		records = append(records, record)
+		return nil
+	}
+	err = sqliteEachRow(tx, `SELECT `+sqliteBookColumns+` FROM books ORDER BY deleted_at IS NOT NULL, isbn`, func(row scanner) error {
+		b, err := scanSQLiteBook(row)
+		if err != nil {
+			return err
+		}
+		return fn(models.BackupRecord{Book: &b})
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = sqliteEachRow(tx, `SELECT `+sqliteCollectionColumns+` FROM collections ORDER BY deleted_at IS NOT NULL, id`, func(row scanner) error {
+		c, err := scanSQLiteCollection(row)
+		if err != nil {
+			return err
+		}
+		return fn(models.BackupRecord{Collection: &c})
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = sqliteEachRow(tx,
+		`SELECT book_isbn, collection_id, created_at, updated_at, deleted_at FROM book_collections
+		ORDER BY deleted_at IS NOT NULL, collection_id, book_isbn`,
+		func(row scanner) error {
+			var m models.BookCollection
+			if err := row.Scan(&m.BookISBN, &m.CollectionID, sqliteTime{&m.CreatedAt}, sqliteTime{&m.UpdatedAt}, sqliteTime{&m.DeletedAt}); err != nil {
+				return err
+			}
+			return fn(models.BackupRecord{Membership: &m})
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = sqliteEachRow(tx, `SELECT id, collection_id, book_isbn, action, created_at FROM collection_events ORDER BY id`, func(row scanner) error {
+		var e models.CollectionEvent
+		if err := row.Scan(&e.ID, &e.CollectionID, &e.BookISBN, &e.Action, sqliteTime{&e.CreatedAt}); err != nil {
+			return err
+		}
+		return fn(models.BackupRecord{Event: &e})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// sqliteEachRow calls fn with each row query returns, as it is read
+func sqliteEachRow(tx *sql.Tx, query string, fn func(row scanner) error) error {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLite) Restore(next func() (models.BackupRecord, error)) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		return restoreRecords(&sqliteRestoreTx{tx: tx}, next)
+	})
+}
+
+type sqliteRestoreTx struct {
+	tx *sql.Tx
+}
+
+func (tx *sqliteRestoreTx) isEmpty() (bool, error) {
+	var empty bool
+	err := tx.tx.QueryRow(`SELECT NOT EXISTS (SELECT 1 FROM books) AND NOT EXISTS (SELECT 1 FROM collections)`).Scan(&empty)
+	return empty, err
+}
+
+func (tx *sqliteRestoreTx) insertBook(b *models.Book) error {
+	return sqliteInsertBook(tx.tx, b)
+}
+
+func (tx *sqliteRestoreTx) insertCollection(c *models.Collection) error {
+	_, err := tx.tx.Exec(
+		`INSERT INTO collections (id, name, description, version, created_at, updated_at, deleted_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		c.ID, c.Name, c.Description, c.Version, timeValue(c.CreatedAt), timeValue(c.UpdatedAt), timeValue(c.DeletedAt),
+	)
+	return err
+}
+
+func (tx *sqliteRestoreTx) insertMembership(m *models.BookCollection) error {
+	_, err := tx.tx.Exec(
+		`INSERT INTO book_collections (book_isbn, collection_id, created_at, updated_at, deleted_at) VALUES (?, ?, ?, ?, ?)`,
+		m.BookISBN, m.CollectionID, timeValue(m.CreatedAt), timeValue(m.UpdatedAt), timeValue(m.DeletedAt),
+	)
+	return err
+}
+
+func (tx *sqliteRestoreTx) insertEvent(e *models.CollectionEvent) error {
+	_, err := tx.tx.Exec(
+		`INSERT INTO collection_events (id, collection_id, book_isbn, action, created_at) VALUES (?, ?, ?, ?, ?)`,
+		e.ID, e.CollectionID, e.BookISBN, string(e.Action), timeValue(e.CreatedAt),
+	)
+	return err
+}
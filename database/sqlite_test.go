@@ -0,0 +1,347 @@
+package database
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/john-cai/book-manager/database/migration"
+	"github.com/john-cai/book-manager/models"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setUpTestSQLite(t *testing.T) *SQLite {
+	dir, err := ioutil.TempDir("", "bookmanager")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s, err := NewSQLite(filepath.Join(dir, "books.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.db.Close() })
+
+	migrator, err := s.Migrator()
+	require.NoError(t, err)
+	_, err = migrator.Up()
+	require.NoError(t, err)
+	return s
+}
+
+func TestSQLiteBookCollections(t *testing.T) {
+	s := setUpTestSQLite(t)
+	book := models.Book{
+		ISBN:               uuid.New(),
+		Title:              "Jungle Book",
+		Author:             "Rudyard Kipling",
+		PublishedAt:        time.Date(1894, 1, 1, 0, 0, 0, 0, time.UTC),
+		PublishedPrecision: models.PrecisionYear,
+		Metadata:           models.Metadata{Genres: []string{"adventure"}},
+	}
+	collection := models.Collection{Name: "collection1"}
+	require.NoError(t, s.AddBook(&book))
+	require.Error(t, s.AddBook(&book))
+	require.NoError(t, s.AddCollection(&collection))
+	require.NotZero(t, collection.ID)
+	require.NoError(t, s.AddBookToCollection(&book, &collection))
+
+	b, err := s.GetBookByISBN(book.ISBN)
+	require.NoError(t, err)
+	assert.Equal(t, book.Title, b.Title)
+	assert.Equal(t, book.Metadata.Genres, b.Metadata.Genres)
+	assert.True(t, book.PublishedAt.Equal(b.PublishedAt))
+	assert.Equal(t, models.PrecisionYear, b.PublishedPrecision)
+	require.Len(t, b.Collections, 1)
+	assert.Equal(t, collection.Name, b.Collections[0].Name)
+
+	c, err := s.GetCollectionByID(collection.ID)
+	require.NoError(t, err)
+	require.Len(t, c.Books, 1)
+	assert.Equal(t, book.Title, c.Books[0].Title)
+
+	require.NoError(t, s.RemoveBookFromCollection(&book, &collection))
+	assert.Equal(t, pg.ErrNoRows, s.RemoveBookFromCollection(&book, &collection))
+
+	_, err = s.DeleteBookByISBN(book.ISBN, CascadeDelete)
+	require.NoError(t, err)
+	_, err = s.GetBookByISBN(book.ISBN)
+	assert.Equal(t, pg.ErrNoRows, err)
+	assert.Equal(t, pg.ErrNoRows, s.UpdateBook(&book))
+
+	_, err = s.DeleteCollectionByID(collection.ID, CascadeDelete)
+	require.NoError(t, err)
+	_, err = s.GetCollectionByID(collection.ID)
+	assert.Equal(t, pg.ErrNoRows, err)
+}
+
+func TestSQLiteGetBooks(t *testing.T) {
+	s := setUpTestSQLite(t)
+	books := []models.Book{
+		{ISBN: uuid.New(), Title: "Jungle Book", Author: "Rudyard Kipling", PublishedAt: time.Date(1894, 1, 1, 0, 0, 0, 0, time.UTC), PublishedPrecision: models.PrecisionYear, Metadata: models.Metadata{Genres: []string{"adventure"}}},
+		{ISBN: uuid.New(), Title: "Kim", Author: "Rudyard Kipling", PublishedAt: time.Date(1901, 10, 1, 0, 0, 0, 0, time.UTC), PublishedPrecision: models.PrecisionMonth},
+		{ISBN: uuid.New(), Title: "A Wrinkle in Time", Author: "Madeline L'engle", Metadata: models.Metadata{Genres: []string{"fantasy", "science fiction"}}},
+	}
+	for i := range books {
+		require.NoError(t, s.AddBook(&books[i]))
+	}
+
+	testCases := []struct {
+		title         string
+		author        string
+		publishedFrom time.Time
+		publishedTo   time.Time
+		genres        []string
+		genresMatch   GenreMatch
+		count         int
+	}{
+		{count: 3},
+		{author: "Rudyard Kipling", count: 2},
+		{title: "Kim", author: "Rudyard Kipling", count: 1},
+		{publishedFrom: time.Date(1894, 1, 1, 0, 0, 0, 0, time.UTC), publishedTo: time.Date(1895, 1, 1, 0, 0, 0, 0, time.UTC), count: 1},
+		{publishedFrom: time.Date(1890, 1, 1, 0, 0, 0, 0, time.UTC), publishedTo: time.Date(1902, 1, 1, 0, 0, 0, 0, time.UTC), count: 2},
+		{publishedFrom: time.Date(1901, 10, 1, 0, 0, 0, 0, time.UTC), count: 1},
+		{publishedTo: time.Date(1901, 10, 1, 0, 0, 0, 0, time.UTC), count: 1},
+		{genres: []string{"science fiction", "adventure"}, count: 2},
+		{genres: []string{"horror"}, count: 0},
+		{genres: []string{"fantasy", "science fiction"}, genresMatch: MatchAllGenres, count: 1},
+		{genres: []string{"fantasy", "fantasy"}, genresMatch: MatchAllGenres, count: 1},
+		{genres: []string{"fantasy", "adventure"}, genresMatch: MatchAllGenres, count: 0},
+		{genres: []string{"x') OR 1=1 --"}, count: 0},
+	}
+	for _, testCase := range testCases {
+		result, err := s.GetBooks(BookFilter{
+			Title:         testCase.title,
+			Author:        testCase.author,
+			PublishedFrom: testCase.publishedFrom,
+			PublishedTo:   testCase.publishedTo,
+			Genres:        testCase.genres,
+			GenresMatch:   testCase.genresMatch,
+		}, Page{})
+		require.NoError(t, err)
+		assert.Len(t, result.Results, testCase.count)
+		assert.Equal(t, testCase.count, result.Total)
+	}
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	s := setUpTestSQLite(t)
+	migrator, err := s.Migrator()
+	require.NoError(t, err)
+
+	pending, err := migrator.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	applied, err := migrator.Up()
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+
+	statuses, err := migrator.Status()
+	require.NoError(t, err)
+	last := statuses[len(statuses)-1]
+	assert.True(t, last.Applied)
+
+	rolledBack, err := migrator.Down()
+	require.NoError(t, err)
+	require.NotNil(t, rolledBack)
+	assert.Equal(t, last.Version, rolledBack.Version)
+	pending, err = migrator.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, last.Version, pending[0].Version)
+
+	applied, err = migrator.Up()
+	require.NoError(t, err)
+	assert.Len(t, applied, 1)
+}
+
+func TestSQLitePagination(t *testing.T) {
+	testPagination(t, setUpTestSQLite(t))
+}
+
+func TestSQLiteSorting(t *testing.T) {
+	testSorting(t, setUpTestSQLite(t))
+}
+
+func TestSQLiteSearch(t *testing.T) {
+	testSearch(t, setUpTestSQLite(t))
+}
+
+func TestSQLiteCollectionNames(t *testing.T) {
+	testCollectionNames(t, setUpTestSQLite(t))
+}
+
+func TestSQLiteBulkMemberships(t *testing.T) {
+	testBulkMemberships(t, setUpTestSQLite(t))
+}
+
+func TestSQLiteTrash(t *testing.T) {
+	testTrash(t, setUpTestSQLite(t))
+}
+
+func TestSQLiteMembershipHistory(t *testing.T) {
+	testMembershipHistory(t, setUpTestSQLite(t))
+}
+
+func TestSQLiteCascadePolicies(t *testing.T) {
+	testCascadePolicies(t, setUpTestSQLite(t))
+}
+
+func TestSQLiteVersions(t *testing.T) {
+	testVersions(t, setUpTestSQLite(t))
+}
+
+func TestSQLitePatch(t *testing.T) {
+	testPatch(t, setUpTestSQLite(t))
+}
+
+func TestSQLiteTimestamps(t *testing.T) {
+	testTimestamps(t, setUpTestSQLite(t))
+}
+
+func TestSQLiteImport(t *testing.T) {
+	testImport(t, setUpTestSQLite(t))
+}
+
+func TestSQLiteBackup(t *testing.T) {
+	testBackup(t, setUpTestSQLite(t), setUpTestSQLite(t))
+}
+
+func TestSQLiteWriteDuringBackup(t *testing.T) {
+	s := setUpTestSQLite(t)
+	require.NoError(t, s.AddBook(&models.Book{ISBN: "isbn-a", Title: "Kim", Author: "Rudyard Kipling"}))
+
+	// a backup is streamed to a slow client while the catalog is edited
+	var isbns []string
+	err := s.Backup(func(record models.BackupRecord) error {
+		if record.Book == nil {
+			return nil
+		}
+		isbns = append(isbns, record.Book.ISBN)
+		done := make(chan error, 1)
+		go func() {
+			done <- s.AddBook(&models.Book{ISBN: "isbn-b", Title: "Nostromo", Author: "Joseph Conrad"})
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(5 * time.Second):
+			return fmt.Errorf("the write waited for the backup")
+		}
+	})
+	require.NoError(t, err)
+	// the backup is of the catalog as it was when it started
+	assert.Equal(t, []string{"isbn-a"}, isbns)
+	_, err = s.GetBookByISBN("isbn-b")
+	assert.NoError(t, err)
+}
+
+// rollBackTo rolls migrations back until the one called name is undone
+func rollBackTo(t *testing.T, s *SQLite, name string) *migration.Runner {
+	migrator, err := s.Migrator()
+	require.NoError(t, err)
+	for {
+		rolledBack, err := migrator.Down()
+		require.NoError(t, err)
+		require.NotNil(t, rolledBack, "%s was never applied", name)
+		if rolledBack.Name == name {
+			return migrator
+		}
+	}
+}
+
+// insertOldCollection adds a collection with only the columns every version
+// of the schema has, for migrations to work on
+func insertOldCollection(t *testing.T, s *SQLite, name string) models.Collection {
+	res, err := s.db.Exec(`INSERT INTO collections (name) VALUES (?)`, name)
+	require.NoError(t, err)
+	id, err := res.LastInsertId()
+	require.NoError(t, err)
+	return models.Collection{ID: int(id), Name: name}
+}
+
+func TestSQLitePublishedPrecisionMigration(t *testing.T) {
+	s := setUpTestSQLite(t)
+	migrator := rollBackTo(t, s, "book_published_precision")
+
+	// a year only date as older versions of bm stored it
+	_, err := s.db.Exec(
+		`INSERT INTO books (isbn, title, author, published_at) VALUES (?, ?, ?, ?)`,
+		"isbn-a", "Jungle Book", "Rudyard Kipling", time.Date(1894, 0, 0, 0, 0, 0, 0, time.UTC),
+	)
+	require.NoError(t, err)
+	_, err = s.db.Exec(
+		`INSERT INTO books (isbn, title, author, published_at) VALUES (?, ?, ?, ?)`,
+		"isbn-b", "Kim", "Rudyard Kipling", time.Date(1901, 10, 1, 0, 0, 0, 0, time.UTC),
+	)
+	require.NoError(t, err)
+	_, err = migrator.Up()
+	require.NoError(t, err)
+
+	// dates are never rewritten, not even those that look like the year only
+	// dates of older versions, since a book may well be published on
+	// November 30th
+	b, err := s.GetBookByISBN("isbn-a")
+	require.NoError(t, err)
+	assert.True(t, time.Date(1894, 0, 0, 0, 0, 0, 0, time.UTC).Equal(b.PublishedAt), b.PublishedAt)
+	assert.Equal(t, models.PrecisionDay, b.PublishedPrecision)
+	b, err = s.GetBookByISBN("isbn-b")
+	require.NoError(t, err)
+	assert.True(t, time.Date(1901, 10, 1, 0, 0, 0, 0, time.UTC).Equal(b.PublishedAt), b.PublishedAt)
+	assert.Equal(t, models.PrecisionDay, b.PublishedPrecision)
+}
+
+func TestSQLiteISBNMigration(t *testing.T) {
+	s := setUpTestSQLite(t)
+	migrator := rollBackTo(t, s, "book_isbn_text")
+
+	for _, isbn := range []string{"0-14-118280-6", "978-0-8044-2957-3", "3f2504e0-4f89-11d3-9a0c-0305e82c3301", "0-14-118280-1"} {
+		_, err := s.db.Exec(`INSERT INTO books (isbn, title, author) VALUES (?, ?, ?)`, isbn, "title", "author")
+		require.NoError(t, err)
+	}
+	collection := insertOldCollection(t, s, "collection1")
+	_, err := s.db.Exec(`INSERT INTO book_collections (book_isbn, collection_id) VALUES (?, ?)`, "0-14-118280-6", collection.ID)
+	require.NoError(t, err)
+	_, err = migrator.Up()
+	require.NoError(t, err)
+
+	list, err := s.GetBooks(BookFilter{}, Page{})
+	require.NoError(t, err)
+	var isbns []string
+	for _, b := range list.Results {
+		isbns = append(isbns, b.ISBN)
+	}
+	// invalid isbns are left for someone to fix by hand
+	assert.ElementsMatch(t, []string{"9780141182803", "9780804429573", "3f2504e0-4f89-11d3-9a0c-0305e82c3301", "0-14-118280-1"}, isbns)
+
+	c, err := s.GetCollectionByID(collection.ID)
+	require.NoError(t, err)
+	require.Len(t, c.Books, 1)
+	assert.Equal(t, "9780141182803", c.Books[0].ISBN)
+}
+
+func TestSQLiteCollectionNameMigration(t *testing.T) {
+	s := setUpTestSQLite(t)
+	migrator := rollBackTo(t, s, "collection_name_unique")
+
+	var collections []models.Collection
+	for _, name := range []string{"Classics", "classics", "CLASSICS"} {
+		collections = append(collections, insertOldCollection(t, s, name))
+	}
+	_, err := migrator.Up()
+	require.NoError(t, err)
+
+	// the oldest collection keeps its name
+	c, err := s.GetCollectionByName("classics")
+	require.NoError(t, err)
+	assert.Equal(t, collections[0].ID, c.ID)
+	assert.Equal(t, "Classics", c.Name)
+	for _, collection := range collections[1:] {
+		c, err := s.GetCollectionByID(collection.ID)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("%s (%d)", collection.Name, collection.ID), c.Name)
+	}
+}
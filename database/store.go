@@ -0,0 +1,239 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/john-cai/book-manager/models"
+)
+
+// Store is the set of operations the server needs from a storage backend.
+// Lookups of rows that do not exist (or have been soft deleted) return
+// pg.ErrNoRows regardless of the backend.
+type Store interface {
+	GetBookByISBN(isbn string) (*models.Book, error)
+	GetBooks(filter BookFilter, page Page) (*models.BookList, error)
+	// SearchBooks ranks the books matching filter by how well their title,
+	// author and description match query, best match first
+	SearchBooks(query string, filter BookFilter, page Page) (*models.BookList, error)
+	AddBook(b *models.Book) error
+	// UpdateBook saves b over the book as long as it is still at b.Version,
+	// and moves b on to the next version. created_at is never changed and
+	// updated_at is set to now. It returns ErrVersionConflict when
+	// the book has been updated since; a zero b.Version updates whatever
+	// version the book is at.
+	UpdateBook(b *models.Book) error
+	// PatchBook saves only the given columns of b, which are among
+	// BookPatchColumns, along with updated_at, checking b.Version like
+	// UpdateBook
+	PatchBook(b *models.Book, columns []string) error
+	// DeleteBookByISBN moves a book to the trash, dealing with its
+	// memberships as policy says, and returns the collections it was in.
+	// Under RestrictDelete a book that is in any collection is not deleted;
+	// those collections are returned along with ErrDeleteRestricted.
+	DeleteBookByISBN(isbn string, policy CascadePolicy) ([]models.Collection, error)
+	// ImportBooks adds books, which have been validated and normalized, in
+	// one transaction and reports what happened to each of them, in order.
+	// Books whose isbn is taken are skipped, updated or failed as onConflict
+	// says. A dry run reports the same without keeping anything.
+	ImportBooks(books []models.Book, onConflict ImportConflict, dryRun bool) ([]models.ImportResult, error)
+
+	GetCollectionByID(id int) (*models.Collection, error)
+	// GetCollectionByName finds a collection by its name, ignoring case, or
+	// by its slug
+	GetCollectionByName(name string) (*models.Collection, error)
+	GetAllCollections(page Page) (*models.CollectionList, error)
+	AddCollection(c *models.Collection) error
+	// UpdateCollection saves c like UpdateBook, checking c.Version. The
+	// version only covers the collection's own fields, not its books.
+	UpdateCollection(c *models.Collection) error
+	// PatchCollection saves only the given columns of c, which are among
+	// CollectionPatchColumns, like PatchBook
+	PatchCollection(c *models.Collection, columns []string) error
+	// DeleteCollectionByID moves a collection to the trash like
+	// DeleteBookByISBN, returning the books that were in it
+	DeleteCollectionByID(id int, policy CascadePolicy) ([]models.Book, error)
+
+	// AddBookToCollection adds a book to a collection, bringing back its
+	// membership if it was removed before. Adding a book that is already in
+	// the collection does nothing.
+	AddBookToCollection(b *models.Book, c *models.Collection) error
+	RemoveBookFromCollection(b *models.Book, c *models.Collection) error
+	// AddBooksToCollection and RemoveBooksFromCollection change a
+	// collection's books in one transaction, reporting what happened to each
+	// isbn. An atomic change is rolled back entirely when any isbn fails.
+	AddBooksToCollection(c *models.Collection, isbns []string, atomic bool) (*models.MembershipReport, error)
+	RemoveBooksFromCollection(c *models.Collection, isbns []string, atomic bool) (*models.MembershipReport, error)
+	// GetCollectionHistory lists every book added to or removed from a
+	// collection, oldest first
+	GetCollectionHistory(id int) (*models.CollectionHistory, error)
+
+	GetTrash(filter TrashFilter) (*models.Trash, error)
+	// RestoreBook and RestoreCollection take a book or collection out of the
+	// trash, bringing back the memberships that were deleted with it
+	RestoreBook(isbn string) error
+	RestoreCollection(id int) error
+	// PurgeBook and PurgeCollection permanently delete a book or collection,
+	// whether or not it is in the trash, and all of its memberships
+	PurgeBook(isbn string) error
+	PurgeCollection(id int) error
+
+	// Backup calls fn with everything in the store, the trash included:
+	// books first, then collections, memberships and collection events. It
+	// reads one consistent snapshot, and stops at the first error fn returns.
+	// Writes are never held up while fn runs.
+	Backup(fn func(models.BackupRecord) error) error
+	// Restore loads the records next returns, until io.EOF, into a store
+	// that has no books or collections yet, all in one transaction. Rows
+	// keep their keys, versions and timestamps. ErrNotEmpty is returned when
+	// the store already has data.
+	Restore(next func() (models.BackupRecord, error)) error
+}
+
+// TrashFilter narrows down the trash by when things were deleted, from
+// inclusive and to exclusive. Zero fields are ignored.
+type TrashFilter struct {
+	DeletedFrom time.Time
+	DeletedTo   time.Time
+}
+
+// ErrDuplicateCollectionName is returned when a collection is given the name
+// of another live collection, ignoring case
+var ErrDuplicateCollectionName = errors.New("a collection with this name already exists")
+
+// ErrDuplicateISBN is returned when a book is added with the isbn of another
+// book, including one in the trash
+var ErrDuplicateISBN = errors.New("a book with this isbn already exists")
+
+// ErrDeleteRestricted is returned when the RestrictDelete policy stops a book
+// or collection that still has memberships from being deleted
+var ErrDeleteRestricted = errors.New("cannot delete while it has memberships")
+
+// BookPatchColumns and CollectionPatchColumns are the columns a patch can
+// change
+var (
+	BookPatchColumns       = []string{"title", "author", "description", "published_at", "published_precision", "metadata"}
+	CollectionPatchColumns = []string{"name", "description"}
+)
+
+// checkPatchColumns makes sure a patch only names columns it can change
+func checkPatchColumns(columns, allowed []string) error {
+	for _, column := range columns {
+		found := false
+		for _, a := range allowed {
+			found = found || a == column
+		}
+		if !found {
+			return fmt.Errorf("cannot patch column %q", column)
+		}
+	}
+	return nil
+}
+
+// ErrVersionConflict is returned when a book or collection has been updated
+// since the version that an update was based on
+var ErrVersionConflict = errors.New("has been changed since it was read")
+
+// CascadePolicy says what happens to the memberships of a book or collection
+// when it is deleted
+type CascadePolicy string
+
+const (
+	// RestrictDelete refuses to delete a book that is in a live collection,
+	// or a collection that has live books
+	RestrictDelete CascadePolicy = "restrict"
+	// CascadeDelete moves the memberships to the trash along with the book
+	// or collection, to be restored with it
+	CascadeDelete CascadePolicy = "cascade"
+	// DetachDelete removes the memberships for good, recording each of them
+	// as removed in its collection's history
+	DetachDelete CascadePolicy = "detach"
+)
+
+// ParseCascadePolicy parses a cascade policy. An empty value means cascade.
+func ParseCascadePolicy(s string) (CascadePolicy, error) {
+	switch CascadePolicy(s) {
+	case "", CascadeDelete:
+		return CascadeDelete, nil
+	case RestrictDelete, DetachDelete:
+		return CascadePolicy(s), nil
+	}
+	return "", fmt.Errorf("must be %q, %q or %q", RestrictDelete, CascadeDelete, DetachDelete)
+}
+
+// BookFilter narrows down a book listing. Zero fields are ignored.
+type BookFilter struct {
+	ISBN   string
+	Title  string
+	Author string
+	// PublishedFrom and PublishedTo bound the publication date, from
+	// inclusive and to exclusive. Books without a publication date never
+	// match a bound.
+	PublishedFrom time.Time
+	PublishedTo   time.Time
+	// Genres keeps books tagged with any (or, with GenresMatch set to
+	// MatchAllGenres, every one) of the genres
+	Genres      []string
+	GenresMatch GenreMatch
+}
+
+// GenreMatch says how a book's genres have to match BookFilter.Genres
+type GenreMatch string
+
+const (
+	MatchAnyGenre  GenreMatch = "any"
+	MatchAllGenres GenreMatch = "all"
+)
+
+// ParseGenreMatch parses a genres_match parameter. An empty value means any.
+func ParseGenreMatch(s string) (GenreMatch, error) {
+	switch GenreMatch(s) {
+	case "", MatchAnyGenre:
+		return MatchAnyGenre, nil
+	case MatchAllGenres:
+		return MatchAllGenres, nil
+	}
+	return "", fmt.Errorf("must be %q or %q", MatchAnyGenre, MatchAllGenres)
+}
+
+var (
+	_ Store = (*Database)(nil)
+	_ Store = (*Memory)(nil)
+	_ Store = (*SQLite)(nil)
+)
+
+// Open creates the Store described by databaseURL. Supported forms are
+// postgres://user@host:port/db, sqlite:///path/to/books.db and memory://
+func Open(databaseURL string) (Store, error) {
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "postgres", "postgresql":
+		opts, err := pg.ParseURL(databaseURL)
+		if err != nil {
+			return nil, err
+		}
+		return &Database{
+			db: pg.Connect(opts),
+		}, nil
+	case "sqlite", "sqlite3":
+		path := u.Host + u.Path
+		if path == "" {
+			return nil, fmt.Errorf("sqlite database url %q has no path", databaseURL)
+		}
+		s, err := NewSQLite(path)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "memory":
+		return NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unsupported database url scheme %q", u.Scheme)
+	}
+}
@@ -0,0 +1,772 @@
+package database
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/john-cai/book-manager/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPagination walks a store's book and collection listings forwards and
+// backwards a page at a time
+func testPagination(t *testing.T, store Store) {
+	for i := 0; i < 7; i++ {
+		require.NoError(t, store.AddBook(&models.Book{ISBN: fmt.Sprintf("isbn-%d", i), Title: "title", Author: "author"}))
+		require.NoError(t, store.AddCollection(&models.Collection{Name: fmt.Sprintf("collection%d", i)}))
+	}
+
+	var pages [][]string
+	page := Page{Limit: 3}
+	for {
+		list, err := store.GetBooks(BookFilter{}, page)
+		require.NoError(t, err)
+		assert.Equal(t, 7, list.Total)
+		var isbns []string
+		for _, b := range list.Results {
+			isbns = append(isbns, b.ISBN)
+		}
+		pages = append(pages, isbns)
+		if list.NextCursor == "" {
+			break
+		}
+		page.Cursor = list.NextCursor
+	}
+	require.Equal(t, [][]string{
+		{"isbn-0", "isbn-1", "isbn-2"},
+		{"isbn-3", "isbn-4", "isbn-5"},
+		{"isbn-6"},
+	}, pages)
+
+	// and back again from the last page
+	list, err := store.GetBooks(BookFilter{}, page)
+	require.NoError(t, err)
+	require.NotEmpty(t, list.PrevCursor)
+	list, err = store.GetBooks(BookFilter{}, Page{Limit: 3, Cursor: list.PrevCursor})
+	require.NoError(t, err)
+	require.Len(t, list.Results, 3)
+	assert.Equal(t, "isbn-3", list.Results[0].ISBN)
+	assert.NotEmpty(t, list.NextCursor)
+	list, err = store.GetBooks(BookFilter{}, Page{Limit: 3, Cursor: list.PrevCursor})
+	require.NoError(t, err)
+	require.Len(t, list.Results, 3)
+	assert.Equal(t, "isbn-0", list.Results[0].ISBN)
+	assert.Empty(t, list.PrevCursor)
+
+	collections, err := store.GetAllCollections(Page{Limit: 5})
+	require.NoError(t, err)
+	assert.Equal(t, 7, collections.Total)
+	require.Len(t, collections.Results, 5)
+	collections, err = store.GetAllCollections(Page{Limit: 5, Cursor: collections.NextCursor})
+	require.NoError(t, err)
+	require.Len(t, collections.Results, 2)
+	assert.Equal(t, "collection5", collections.Results[0].Name)
+	assert.Empty(t, collections.NextCursor)
+	assert.NotEmpty(t, collections.PrevCursor)
+
+	_, err = store.GetBooks(BookFilter{}, Page{Limit: 3, Cursor: "not a cursor"})
+	assert.Equal(t, ErrInvalidCursor, err)
+	_, err = store.GetAllCollections(Page{Limit: 3, Cursor: encodeCursor([]SortField{{Name: "id"}}, []string{"abc"}, false)})
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+// testSorting checks that sorted listings page through every row in order,
+// including rows without a published date
+func testSorting(t *testing.T, store Store) {
+	books := []models.Book{
+		{ISBN: "isbn-a", Title: "Kim", Author: "Rudyard Kipling", PublishedAt: time.Date(1901, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ISBN: "isbn-b", Title: "Jungle Book", Author: "Rudyard Kipling", PublishedAt: time.Date(1894, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ISBN: "isbn-c", Title: "A Wrinkle in Time", Author: "Madeline L'engle", PublishedAt: time.Date(1962, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ISBN: "isbn-d", Title: "Beowulf", Author: "Unknown"},
+		{ISBN: "isbn-e", Title: "Captains Courageous", Author: "Rudyard Kipling", PublishedAt: time.Date(1894, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for i := range books {
+		require.NoError(t, store.AddBook(&books[i]))
+	}
+
+	testCases := []struct {
+		sort     string
+		expected []string
+	}{
+		{sort: "title", expected: []string{"isbn-c", "isbn-d", "isbn-e", "isbn-b", "isbn-a"}},
+		{sort: "-published_at,title", expected: []string{"isbn-c", "isbn-a", "isbn-e", "isbn-b", "isbn-d"}},
+		{sort: "author,-title", expected: []string{"isbn-c", "isbn-a", "isbn-b", "isbn-e", "isbn-d"}},
+		{sort: "published_at", expected: []string{"isbn-d", "isbn-b", "isbn-e", "isbn-a", "isbn-c"}},
+	}
+	for _, testCase := range testCases {
+		fields, err := ParseBookSort(testCase.sort)
+		require.NoError(t, err)
+
+		var isbns []string
+		page := Page{Limit: 2, Sort: fields}
+		var last *models.BookList
+		for {
+			list, err := store.GetBooks(BookFilter{}, page)
+			require.NoError(t, err)
+			for _, b := range list.Results {
+				isbns = append(isbns, b.ISBN)
+			}
+			last = list
+			if list.NextCursor == "" {
+				break
+			}
+			page.Cursor = list.NextCursor
+		}
+		assert.Equal(t, testCase.expected, isbns, testCase.sort)
+
+		// one page back from the last page
+		list, err := store.GetBooks(BookFilter{}, Page{Limit: 2, Sort: fields, Cursor: last.PrevCursor})
+		require.NoError(t, err)
+		require.Len(t, list.Results, 2)
+		assert.Equal(t, testCase.expected[2:4], []string{list.Results[0].ISBN, list.Results[1].ISBN}, testCase.sort)
+
+		// a cursor only works with the sort it was issued for
+		_, err = store.GetBooks(BookFilter{}, Page{Limit: 2, Cursor: last.PrevCursor})
+		assert.Equal(t, ErrInvalidCursor, err)
+	}
+
+	fields, err := ParseBookSort("-title")
+	require.NoError(t, err)
+	list, err := store.GetBooks(BookFilter{Author: "Rudyard Kipling"}, Page{Sort: fields})
+	require.NoError(t, err)
+	require.Len(t, list.Results, 3)
+	assert.Equal(t, "Kim", list.Results[0].Title)
+}
+
+func TestParseSort(t *testing.T) {
+	fields, err := ParseBookSort("title, -published_at,+author")
+	require.NoError(t, err)
+	assert.Equal(t, []SortField{{Name: "title"}, {Name: "published_at", Desc: true}, {Name: "author"}}, fields)
+
+	for _, spec := range []string{"description", "title,-title", "-"} {
+		_, err := ParseBookSort(spec)
+		assert.Error(t, err, spec)
+	}
+
+	fields, err = ParseCollectionSort("-name")
+	require.NoError(t, err)
+	assert.Equal(t, []SortField{{Name: "name", Desc: true}, {Name: "id"}}, sortKeys(fields, "id"))
+}
+
+// testSearch checks that searches rank title matches first, highlight the
+// matched words and page by rank
+func testSearch(t *testing.T, store Store) {
+	books := []models.Book{
+		{ISBN: "isbn-a", Title: "The Jungle Book", Author: "Rudyard Kipling", Description: "Stories of Mowgli, raised by wolves in the jungle."},
+		{ISBN: "isbn-b", Title: "Kim", Author: "Rudyard Kipling", Description: "An orphan boy roams the jungle of the Great Game."},
+		{ISBN: "isbn-c", Title: "The Jungle", Author: "Upton Sinclair", Description: "Meatpacking in Chicago."},
+		{ISBN: "isbn-d", Title: "Beowulf", Author: "Unknown"},
+	}
+	for i := range books {
+		require.NoError(t, store.AddBook(&books[i]))
+	}
+
+	list, err := store.SearchBooks("jungle", BookFilter{}, Page{Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 3, list.Total)
+	require.Len(t, list.Results, 2)
+	assert.Equal(t, "isbn-a", list.Results[0].ISBN)
+	assert.Equal(t, "isbn-c", list.Results[1].ISBN)
+	assert.True(t, list.Results[0].Rank > list.Results[1].Rank)
+	assert.Equal(t, "The <mark>Jungle</mark> Book", list.Results[0].Highlights["title"])
+	assert.Contains(t, list.Results[0].Highlights["description"], "<mark>jungle</mark>")
+	assert.NotContains(t, list.Results[0].Highlights, "author")
+
+	list, err = store.SearchBooks("jungle", BookFilter{}, Page{Limit: 2, Cursor: list.NextCursor})
+	require.NoError(t, err)
+	require.Len(t, list.Results, 1)
+	assert.Equal(t, "isbn-b", list.Results[0].ISBN)
+	assert.Empty(t, list.NextCursor)
+	list, err = store.SearchBooks("jungle", BookFilter{}, Page{Limit: 2, Cursor: list.PrevCursor})
+	require.NoError(t, err)
+	require.Len(t, list.Results, 2)
+	assert.Equal(t, "isbn-a", list.Results[0].ISBN)
+
+	// every word has to match somewhere
+	list, err = store.SearchBooks("jungle kipling", BookFilter{}, Page{})
+	require.NoError(t, err)
+	require.Len(t, list.Results, 2)
+	assert.Equal(t, "isbn-a", list.Results[0].ISBN)
+
+	list, err = store.SearchBooks("jungle", BookFilter{Author: "Upton Sinclair"}, Page{})
+	require.NoError(t, err)
+	require.Len(t, list.Results, 1)
+	assert.Equal(t, "isbn-c", list.Results[0].ISBN)
+
+	_, err = store.DeleteBookByISBN("isbn-c", CascadeDelete)
+	require.NoError(t, err)
+	list, err = store.SearchBooks("jungle", BookFilter{}, Page{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, list.Total)
+
+	_, err = store.SearchBooks(" ?! ", BookFilter{}, Page{})
+	assert.Equal(t, ErrEmptySearch, err)
+	_, err = store.SearchBooks("jungle", BookFilter{}, Page{Limit: 2, Cursor: encodeCursor(searchKeys, []string{"high", "isbn-a"}, false)})
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+// testCollectionNames checks collection names are unique ignoring case among
+// live collections, and that collections can be found by name or slug
+func testCollectionNames(t *testing.T, store Store) {
+	collection := models.Collection{Name: "Summer Reading"}
+	require.NoError(t, store.AddCollection(&collection))
+	assert.Equal(t, ErrDuplicateCollectionName, store.AddCollection(&models.Collection{Name: "summer reading"}))
+
+	other := models.Collection{Name: "Winter Reading"}
+	require.NoError(t, store.AddCollection(&other))
+	other.Name = "SUMMER READING"
+	assert.Equal(t, ErrDuplicateCollectionName, store.UpdateCollection(&other))
+	// renaming a collection to a different case of its own name is fine
+	collection.Name = "summer reading"
+	require.NoError(t, store.UpdateCollection(&collection))
+
+	for _, name := range []string{"Summer Reading", "SUMMER READING", "summer-reading"} {
+		c, err := store.GetCollectionByName(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, collection.ID, c.ID, name)
+	}
+	// an exact name wins over another collection's slug
+	hyphenated := models.Collection{Name: "summer-reading"}
+	require.NoError(t, store.AddCollection(&hyphenated))
+	c, err := store.GetCollectionByName("summer-reading")
+	require.NoError(t, err)
+	assert.Equal(t, hyphenated.ID, c.ID)
+
+	_, err = store.GetCollectionByName("autumn reading")
+	assert.Equal(t, pg.ErrNoRows, err)
+
+	// the name is free again once the collection is deleted
+	_, err = store.DeleteCollectionByID(collection.ID, CascadeDelete)
+	require.NoError(t, err)
+	_, err = store.GetCollectionByName("summer reading")
+	assert.Equal(t, pg.ErrNoRows, err)
+	require.NoError(t, store.AddCollection(&models.Collection{Name: "Summer Reading"}))
+}
+
+// testBulkMemberships adds and removes books from a collection in bulk,
+// atomically and not
+func testBulkMemberships(t *testing.T, store Store) {
+	collection := models.Collection{Name: "collection1"}
+	require.NoError(t, store.AddCollection(&collection))
+	for _, isbn := range []string{"isbn-a", "isbn-b", "isbn-c"} {
+		require.NoError(t, store.AddBook(&models.Book{ISBN: isbn, Title: "title", Author: "author"}))
+	}
+	members := func() []string {
+		c, err := store.GetCollectionByID(collection.ID)
+		require.NoError(t, err)
+		var isbns []string
+		for _, b := range c.Books {
+			isbns = append(isbns, b.ISBN)
+		}
+		return isbns
+	}
+
+	report, err := store.AddBooksToCollection(&collection, []string{"isbn-a"}, true)
+	require.NoError(t, err)
+	assert.Equal(t, &models.MembershipReport{Applied: true, Results: []models.MembershipResult{
+		{ISBN: "isbn-a", Status: models.MembershipAdded},
+	}}, report)
+
+	// a missing book rolls the whole atomic change back
+	report, err = store.AddBooksToCollection(&collection, []string{"isbn-a", "isbn-b", "isbn-missing", "isbn-b"}, true)
+	require.NoError(t, err)
+	assert.Equal(t, &models.MembershipReport{Applied: false, Results: []models.MembershipResult{
+		{ISBN: "isbn-a", Status: models.MembershipAlreadyPresent},
+		{ISBN: "isbn-b", Status: models.MembershipAdded},
+		{ISBN: "isbn-missing", Status: models.MembershipNotFound},
+	}}, report)
+	assert.Equal(t, []string{"isbn-a"}, members())
+
+	// unless the change is not atomic
+	report, err = store.AddBooksToCollection(&collection, []string{"isbn-b", "isbn-missing"}, false)
+	require.NoError(t, err)
+	assert.True(t, report.Applied)
+	assert.True(t, report.Failed())
+	assert.Equal(t, []string{"isbn-a", "isbn-b"}, members())
+
+	report, err = store.RemoveBooksFromCollection(&collection, []string{"isbn-a", "isbn-c"}, true)
+	require.NoError(t, err)
+	assert.Equal(t, &models.MembershipReport{Applied: false, Results: []models.MembershipResult{
+		{ISBN: "isbn-a", Status: models.MembershipRemoved},
+		{ISBN: "isbn-c", Status: models.MembershipNotMember},
+	}}, report)
+	assert.Equal(t, []string{"isbn-a", "isbn-b"}, members())
+
+	report, err = store.RemoveBooksFromCollection(&collection, []string{"isbn-a", "isbn-b"}, true)
+	require.NoError(t, err)
+	assert.True(t, report.Applied)
+	assert.Empty(t, members())
+
+	_, err = store.DeleteCollectionByID(collection.ID, CascadeDelete)
+	require.NoError(t, err)
+	_, err = store.AddBooksToCollection(&collection, []string{"isbn-c"}, true)
+	assert.Equal(t, pg.ErrNoRows, err)
+}
+
+// testTrash deletes, lists, restores and purges books and collections
+func testTrash(t *testing.T, store Store) {
+	book := models.Book{ISBN: "isbn-a", Title: "Kim", Author: "Rudyard Kipling"}
+	other := models.Book{ISBN: "isbn-b", Title: "Jungle Book", Author: "Rudyard Kipling"}
+	collection := models.Collection{Name: "collection1"}
+	require.NoError(t, store.AddBook(&book))
+	require.NoError(t, store.AddBook(&other))
+	require.NoError(t, store.AddCollection(&collection))
+	_, err := store.AddBooksToCollection(&collection, []string{book.ISBN, other.ISBN}, true)
+	require.NoError(t, err)
+	// a membership removed before the book was deleted stays removed
+	_, err = store.RemoveBooksFromCollection(&collection, []string{other.ISBN}, true)
+	require.NoError(t, err)
+
+	before := time.Now()
+	_, err = store.DeleteBookByISBN(book.ISBN, CascadeDelete)
+	require.NoError(t, err)
+	_, err = store.DeleteCollectionByID(collection.ID, CascadeDelete)
+	require.NoError(t, err)
+	_, err = store.DeleteBookByISBN(book.ISBN, CascadeDelete)
+	assert.Equal(t, pg.ErrNoRows, err)
+	// the trashed book still holds its isbn
+	assert.Equal(t, ErrDuplicateISBN, store.AddBook(&models.Book{ISBN: book.ISBN, Title: "Kim", Author: "Rudyard Kipling"}))
+
+	trash, err := store.GetTrash(TrashFilter{})
+	require.NoError(t, err)
+	require.Len(t, trash.Books, 1)
+	assert.Equal(t, book.ISBN, trash.Books[0].ISBN)
+	assert.False(t, trash.Books[0].DeletedAt.IsZero())
+	require.Len(t, trash.Collections, 1)
+	assert.Equal(t, collection.ID, trash.Collections[0].ID)
+	trash, err = store.GetTrash(TrashFilter{DeletedTo: before})
+	require.NoError(t, err)
+	assert.Empty(t, trash.Books)
+	assert.Empty(t, trash.Collections)
+	trash, err = store.GetTrash(TrashFilter{DeletedFrom: before})
+	require.NoError(t, err)
+	assert.Len(t, trash.Books, 1)
+
+	// the membership comes back once both sides are restored
+	require.NoError(t, store.RestoreCollection(collection.ID))
+	c, err := store.GetCollectionByID(collection.ID)
+	require.NoError(t, err)
+	assert.Empty(t, c.Books)
+	require.NoError(t, store.RestoreBook(book.ISBN))
+	assert.Equal(t, pg.ErrNoRows, store.RestoreBook(book.ISBN))
+	c, err = store.GetCollectionByID(collection.ID)
+	require.NoError(t, err)
+	require.Len(t, c.Books, 1)
+	assert.Equal(t, book.ISBN, c.Books[0].ISBN)
+	b, err := store.GetBookByISBN(book.ISBN)
+	require.NoError(t, err)
+	require.Len(t, b.Collections, 1)
+
+	// a collection cannot come back under a name that has since been taken
+	_, err = store.DeleteCollectionByID(collection.ID, CascadeDelete)
+	require.NoError(t, err)
+	require.NoError(t, store.AddCollection(&models.Collection{Name: "Collection1"}))
+	assert.Equal(t, ErrDuplicateCollectionName, store.RestoreCollection(collection.ID))
+
+	require.NoError(t, store.PurgeCollection(collection.ID))
+	assert.Equal(t, pg.ErrNoRows, store.PurgeCollection(collection.ID))
+	require.NoError(t, store.PurgeBook(book.ISBN))
+	assert.Equal(t, pg.ErrNoRows, store.RestoreBook(book.ISBN))
+	trash, err = store.GetTrash(TrashFilter{})
+	require.NoError(t, err)
+	assert.Empty(t, trash.Books)
+	assert.Empty(t, trash.Collections)
+	// a purged isbn can be used again
+	require.NoError(t, store.AddBook(&book))
+}
+
+// testMembershipHistory removes a book from a collection and adds it back,
+// checking each change is kept in the collection's history
+func testMembershipHistory(t *testing.T, store Store) {
+	book := models.Book{ISBN: "isbn-a", Title: "Kim", Author: "Rudyard Kipling"}
+	collection := models.Collection{Name: "collection1"}
+	require.NoError(t, store.AddBook(&book))
+	require.NoError(t, store.AddCollection(&collection))
+
+	require.NoError(t, store.AddBookToCollection(&book, &collection))
+	// adding it again changes nothing
+	require.NoError(t, store.AddBookToCollection(&book, &collection))
+	require.NoError(t, store.RemoveBookFromCollection(&book, &collection))
+	assert.Equal(t, pg.ErrNoRows, store.RemoveBookFromCollection(&book, &collection))
+	require.NoError(t, store.AddBookToCollection(&book, &collection))
+	report, err := store.RemoveBooksFromCollection(&collection, []string{book.ISBN}, true)
+	require.NoError(t, err)
+	require.True(t, report.Applied)
+	report, err = store.AddBooksToCollection(&collection, []string{book.ISBN}, true)
+	require.NoError(t, err)
+	assert.Equal(t, models.MembershipAdded, report.Results[0].Status)
+	assert.Equal(t, pg.ErrNoRows, store.AddBookToCollection(&models.Book{ISBN: "isbn-missing"}, &collection))
+
+	c, err := store.GetCollectionByID(collection.ID)
+	require.NoError(t, err)
+	require.Len(t, c.Books, 1)
+
+	history, err := store.GetCollectionHistory(collection.ID)
+	require.NoError(t, err)
+	var actions []models.MembershipStatus
+	for _, event := range history.Results {
+		assert.Equal(t, collection.ID, event.CollectionID)
+		assert.Equal(t, book.ISBN, event.BookISBN)
+		assert.False(t, event.CreatedAt.IsZero())
+		actions = append(actions, event.Action)
+	}
+	assert.Equal(t, []models.MembershipStatus{
+		models.MembershipAdded, models.MembershipRemoved,
+		models.MembershipAdded, models.MembershipRemoved,
+		models.MembershipAdded,
+	}, actions)
+
+	history, err = store.GetCollectionHistory(collection.ID + 1)
+	require.NoError(t, err)
+	assert.Empty(t, history.Results)
+}
+
+func testCascadePolicies(t *testing.T, store Store) {
+	kim := models.Book{ISBN: "isbn-a", Title: "Kim", Author: "Rudyard Kipling"}
+	jungle := models.Book{ISBN: "isbn-b", Title: "The Jungle", Author: "Upton Sinclair"}
+	loose := models.Book{ISBN: "isbn-c", Title: "Walden", Author: "Henry David Thoreau"}
+	first := models.Collection{Name: "collection1"}
+	second := models.Collection{Name: "collection2"}
+	for _, book := range []*models.Book{&kim, &jungle, &loose} {
+		require.NoError(t, store.AddBook(book))
+	}
+	require.NoError(t, store.AddCollection(&first))
+	require.NoError(t, store.AddCollection(&second))
+	require.NoError(t, store.AddBookToCollection(&kim, &first))
+	require.NoError(t, store.AddBookToCollection(&kim, &second))
+	require.NoError(t, store.AddBookToCollection(&jungle, &first))
+
+	// restrict refuses while there are memberships, naming them
+	collections, err := store.DeleteBookByISBN(kim.ISBN, RestrictDelete)
+	assert.Equal(t, ErrDeleteRestricted, err)
+	require.Len(t, collections, 2)
+	assert.Equal(t, first.ID, collections[0].ID)
+	assert.Equal(t, second.ID, collections[1].ID)
+	_, err = store.GetBookByISBN(kim.ISBN)
+	require.NoError(t, err)
+	books, err := store.DeleteCollectionByID(first.ID, RestrictDelete)
+	assert.Equal(t, ErrDeleteRestricted, err)
+	require.Len(t, books, 2)
+	assert.Equal(t, kim.ISBN, books[0].ISBN)
+	collections, err = store.DeleteBookByISBN(loose.ISBN, RestrictDelete)
+	require.NoError(t, err)
+	assert.Empty(t, collections)
+
+	// detach drops the memberships for good, recording their removal
+	collections, err = store.DeleteBookByISBN(kim.ISBN, DetachDelete)
+	require.NoError(t, err)
+	assert.Len(t, collections, 2)
+	c, err := store.GetCollectionByID(first.ID)
+	require.NoError(t, err)
+	require.Len(t, c.Books, 1)
+	assert.Equal(t, jungle.ISBN, c.Books[0].ISBN)
+	history, err := store.GetCollectionHistory(second.ID)
+	require.NoError(t, err)
+	require.Len(t, history.Results, 2)
+	assert.Equal(t, models.MembershipRemoved, history.Results[1].Action)
+	require.NoError(t, store.RestoreBook(kim.ISBN))
+	book, err := store.GetBookByISBN(kim.ISBN)
+	require.NoError(t, err)
+	assert.Empty(t, book.Collections)
+
+	// cascade takes the memberships to the trash with the collection
+	books, err = store.DeleteCollectionByID(first.ID, CascadeDelete)
+	require.NoError(t, err)
+	require.Len(t, books, 1)
+	assert.Equal(t, jungle.ISBN, books[0].ISBN)
+	book, err = store.GetBookByISBN(jungle.ISBN)
+	require.NoError(t, err)
+	assert.Empty(t, book.Collections)
+	require.NoError(t, store.RestoreCollection(first.ID))
+	c, err = store.GetCollectionByID(first.ID)
+	require.NoError(t, err)
+	assert.Len(t, c.Books, 1)
+
+	_, err = store.DeleteCollectionByID(first.ID+second.ID, CascadeDelete)
+	assert.Equal(t, pg.ErrNoRows, err)
+}
+
+func testVersions(t *testing.T, store Store) {
+	book := models.Book{ISBN: "isbn-a", Title: "Kim", Author: "Rudyard Kipling", Version: 5}
+	require.NoError(t, store.AddBook(&book))
+	assert.Equal(t, 1, book.Version)
+
+	first, second := book, book
+	first.Title = "Kim, edited"
+	require.NoError(t, store.UpdateBook(&first))
+	assert.Equal(t, 2, first.Version)
+	second.Title = "Kim, edited too"
+	assert.Equal(t, ErrVersionConflict, store.UpdateBook(&second))
+	b, err := store.GetBookByISBN(book.ISBN)
+	require.NoError(t, err)
+	assert.Equal(t, first.Title, b.Title)
+	assert.Equal(t, 2, b.Version)
+	// no version overwrites whatever is there
+	second.Version = 0
+	require.NoError(t, store.UpdateBook(&second))
+	assert.Equal(t, 3, second.Version)
+	assert.Equal(t, pg.ErrNoRows, store.UpdateBook(&models.Book{ISBN: "isbn-missing", Title: "t", Author: "a"}))
+
+	collection := models.Collection{Name: "collection1"}
+	require.NoError(t, store.AddCollection(&collection))
+	assert.Equal(t, 1, collection.Version)
+	// changing the books is a new version of the collection and of the book
+	require.NoError(t, store.AddBookToCollection(&book, &collection))
+	stale := collection
+	stale.Description = "stale"
+	assert.Equal(t, ErrVersionConflict, store.UpdateCollection(&stale))
+	b, err = store.GetBookByISBN(book.ISBN)
+	require.NoError(t, err)
+	assert.Equal(t, 4, b.Version)
+	c, err := store.GetCollectionByID(collection.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, c.Version)
+	c.Description = "edited"
+	require.NoError(t, store.UpdateCollection(c))
+	assert.Equal(t, 3, c.Version)
+
+	// asking for a change that changes nothing is not
+	report, err := store.AddBooksToCollection(c, []string{book.ISBN, "isbn-missing"}, false)
+	require.NoError(t, err)
+	assert.True(t, report.Applied)
+	c, err = store.GetCollectionByID(collection.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 3, c.Version)
+	assert.Equal(t, "edited", c.Description)
+}
+
+func testPatch(t *testing.T, store Store) {
+	published := time.Date(1901, 10, 1, 0, 0, 0, 0, time.UTC)
+	book := models.Book{
+		ISBN:        "isbn-a",
+		Title:       "Kim",
+		Author:      "Rudyard Kipling",
+		Description: "a spy novel",
+		PublishedAt: published,
+		Metadata:    models.Metadata{Genres: []string{"adventure"}},
+	}
+	require.NoError(t, store.AddBook(&book))
+
+	// only the named columns are written, whatever else b says
+	patch := models.Book{ISBN: book.ISBN, Title: "Kim (Penguin Classics)", Version: book.Version}
+	require.NoError(t, store.PatchBook(&patch, []string{"title"}))
+	assert.Equal(t, 2, patch.Version)
+	assert.False(t, patch.UpdatedAt.IsZero())
+	b, err := store.GetBookByISBN(book.ISBN)
+	require.NoError(t, err)
+	assert.Equal(t, "Kim (Penguin Classics)", b.Title)
+	assert.Equal(t, book.Author, b.Author)
+	assert.Equal(t, book.Description, b.Description)
+	assert.True(t, published.Equal(b.PublishedAt), b.PublishedAt)
+	assert.Equal(t, []string{"adventure"}, b.Metadata.Genres)
+	assert.False(t, b.UpdatedAt.IsZero())
+
+	patch = models.Book{ISBN: book.ISBN, Metadata: models.Metadata{Genres: []string{"adventure", "spy"}}}
+	require.NoError(t, store.PatchBook(&patch, []string{"metadata", "description"}))
+	b, err = store.GetBookByISBN(book.ISBN)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"adventure", "spy"}, b.Metadata.Genres)
+	assert.Empty(t, b.Description)
+	assert.Equal(t, 3, b.Version)
+
+	patch.Version = 2
+	assert.Equal(t, ErrVersionConflict, store.PatchBook(&patch, []string{"title"}))
+	patch.Version = 0
+	assert.Error(t, store.PatchBook(&patch, []string{"isbn"}))
+	assert.Equal(t, pg.ErrNoRows, store.PatchBook(&models.Book{ISBN: "isbn-missing"}, []string{"title"}))
+
+	collection := models.Collection{Name: "collection1", Description: "the first"}
+	other := models.Collection{Name: "collection2"}
+	require.NoError(t, store.AddCollection(&collection))
+	require.NoError(t, store.AddCollection(&other))
+	require.NoError(t, store.PatchCollection(&models.Collection{ID: collection.ID, Name: "renamed"}, []string{"name"}))
+	c, err := store.GetCollectionByID(collection.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "renamed", c.Name)
+	assert.Equal(t, "the first", c.Description)
+	assert.Equal(t, 2, c.Version)
+	assert.Equal(t, ErrDuplicateCollectionName, store.PatchCollection(&models.Collection{ID: other.ID, Name: "Renamed"}, []string{"name"}))
+}
+
+func testTimestamps(t *testing.T, store Store) {
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	book := models.Book{ISBN: "isbn-a", Title: "Kim", Author: "Rudyard Kipling", CreatedAt: created}
+	require.NoError(t, store.AddBook(&book))
+	b, err := store.GetBookByISBN(book.ISBN)
+	require.NoError(t, err)
+	assert.True(t, created.Equal(b.CreatedAt), b.CreatedAt)
+	assert.True(t, b.UpdatedAt.IsZero(), b.UpdatedAt)
+
+	// whatever the update says, created_at stays and updated_at is now
+	before := time.Now().Add(-time.Second)
+	update := models.Book{ISBN: book.ISBN, Title: "Kim, edited", Author: book.Author, CreatedAt: time.Now()}
+	require.NoError(t, store.UpdateBook(&update))
+	b, err = store.GetBookByISBN(book.ISBN)
+	require.NoError(t, err)
+	assert.True(t, created.Equal(b.CreatedAt), b.CreatedAt)
+	assert.True(t, b.UpdatedAt.After(before), b.UpdatedAt)
+
+	firstUpdate := b.UpdatedAt
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, store.PatchBook(&models.Book{ISBN: book.ISBN, Title: "Kim"}, []string{"title"}))
+	b, err = store.GetBookByISBN(book.ISBN)
+	require.NoError(t, err)
+	assert.True(t, b.UpdatedAt.After(firstUpdate), b.UpdatedAt)
+
+	collection := models.Collection{Name: "collection1", CreatedAt: created}
+	require.NoError(t, store.AddCollection(&collection))
+	require.NoError(t, store.UpdateCollection(&models.Collection{ID: collection.ID, Name: "collection1", Description: "edited"}))
+	c, err := store.GetCollectionByID(collection.ID)
+	require.NoError(t, err)
+	assert.True(t, created.Equal(c.CreatedAt), c.CreatedAt)
+	assert.True(t, c.UpdatedAt.After(before), c.UpdatedAt)
+}
+
+func testImport(t *testing.T, store Store) {
+	existing := models.Book{ISBN: "isbn-a", Title: "Kim", Author: "Rudyard Kipling"}
+	trashed := models.Book{ISBN: "isbn-t", Title: "Trashed", Author: "Someone"}
+	require.NoError(t, store.AddBook(&existing))
+	require.NoError(t, store.AddBook(&trashed))
+	_, err := store.DeleteBookByISBN(trashed.ISBN, CascadeDelete)
+	require.NoError(t, err)
+
+	books := []models.Book{
+		{ISBN: "isbn-a", Title: "Kim", Author: "Rudyard Kipling", Description: "a spy novel"},
+		{ISBN: "isbn-b", Title: "Nostromo", Author: "Joseph Conrad"},
+		{ISBN: "isbn-t", Title: "Trashed", Author: "Someone"},
+		{ISBN: "isbn-b", Title: "Nostromo", Author: "Joseph Conrad"},
+	}
+	statuses := func(results []models.ImportResult) []models.ImportStatus {
+		var s []models.ImportStatus
+		for _, result := range results {
+			s = append(s, result.Status)
+		}
+		return s
+	}
+
+	// a dry run says what would happen but keeps nothing
+	results, err := store.ImportBooks(books, UpdateExisting, true)
+	require.NoError(t, err)
+	assert.Equal(t, []models.ImportStatus{models.ImportUpdated, models.ImportCreated, models.ImportFailed, models.ImportSkipped}, statuses(results))
+	assert.Equal(t, "isbn-t", results[2].ISBN)
+	_, err = store.GetBookByISBN("isbn-b")
+	assert.Equal(t, pg.ErrNoRows, err)
+	b, err := store.GetBookByISBN("isbn-a")
+	require.NoError(t, err)
+	assert.Empty(t, b.Description)
+
+	results, err = store.ImportBooks(books, SkipExisting, false)
+	require.NoError(t, err)
+	assert.Equal(t, []models.ImportStatus{models.ImportSkipped, models.ImportCreated, models.ImportFailed, models.ImportSkipped}, statuses(results))
+	b, err = store.GetBookByISBN("isbn-b")
+	require.NoError(t, err)
+	assert.Equal(t, 1, b.Version)
+
+	results, err = store.ImportBooks(books[:2], FailExisting, false)
+	require.NoError(t, err)
+	assert.Equal(t, []models.ImportStatus{models.ImportFailed, models.ImportFailed}, statuses(results))
+	assert.Equal(t, models.CodeDuplicate, results[0].Errors[0].Code)
+
+	results, err = store.ImportBooks(books[:2], UpdateExisting, false)
+	require.NoError(t, err)
+	assert.Equal(t, []models.ImportStatus{models.ImportUpdated, models.ImportSkipped}, statuses(results))
+	b, err = store.GetBookByISBN("isbn-a")
+	require.NoError(t, err)
+	assert.Equal(t, "a spy novel", b.Description)
+	assert.Equal(t, 2, b.Version)
+	assert.True(t, existing.CreatedAt.Equal(b.CreatedAt), b.CreatedAt)
+	assert.False(t, b.UpdatedAt.IsZero())
+}
+
+func testBackup(t *testing.T, store, restored Store) {
+	published := time.Date(1901, 10, 1, 0, 0, 0, 0, time.UTC)
+	kim := models.Book{ISBN: "isbn-a", Title: "Kim", Author: "Rudyard Kipling", PublishedAt: published, PublishedPrecision: models.PrecisionMonth,
+		Metadata: models.Metadata{Genres: []string{"adventure"}}}
+	nostromo := models.Book{ISBN: "isbn-b", Title: "Nostromo", Author: "Joseph Conrad"}
+	trashed := models.Book{ISBN: "isbn-t", Title: "Trashed", Author: "Someone"}
+	for _, b := range []*models.Book{&kim, &nostromo, &trashed} {
+		require.NoError(t, store.AddBook(b))
+	}
+	kim.Description = "a spy novel"
+	require.NoError(t, store.UpdateBook(&kim))
+	_, err := store.DeleteBookByISBN(trashed.ISBN, CascadeDelete)
+	require.NoError(t, err)
+
+	shelf := models.Collection{Name: "shelf"}
+	old := models.Collection{Name: "old"}
+	require.NoError(t, store.AddCollection(&shelf))
+	require.NoError(t, store.AddCollection(&old))
+	require.NoError(t, store.AddBookToCollection(&kim, &shelf))
+	require.NoError(t, store.AddBookToCollection(&nostromo, &shelf))
+	require.NoError(t, store.RemoveBookFromCollection(&nostromo, &shelf))
+	require.NoError(t, store.AddBookToCollection(&nostromo, &old))
+	_, err = store.DeleteCollectionByID(old.ID, CascadeDelete)
+	require.NoError(t, err)
+
+	var records []models.BackupRecord
+	require.NoError(t, store.Backup(func(record models.BackupRecord) error {
+		records = append(records, record)
+		return nil
+	}))
+	var summary models.BackupSummary
+	for _, record := range records {
+		summary.Add(record)
+	}
+	assert.Equal(t, models.BackupSummary{Books: 3, Collections: 2, Memberships: 3, Events: 4}, summary)
+
+	next := func(records []models.BackupRecord) func() (models.BackupRecord, error) {
+		return func() (models.BackupRecord, error) {
+			if len(records) == 0 {
+				return models.BackupRecord{}, io.EOF
+			}
+			record := records[0]
+			records = records[1:]
+			return record, nil
+		}
+	}
+	assert.Equal(t, ErrNotEmpty, store.Restore(next(records)))
+	require.NoError(t, restored.Restore(next(records)))
+
+	b, err := restored.GetBookByISBN(kim.ISBN)
+	require.NoError(t, err)
+	// added, edited and put on the shelf
+	assert.Equal(t, 3, b.Version)
+	assert.Equal(t, "a spy novel", b.Description)
+	assert.True(t, published.Equal(b.PublishedAt), b.PublishedAt)
+	assert.Equal(t, models.PrecisionMonth, b.PublishedPrecision)
+	assert.Equal(t, []string{"adventure"}, b.Metadata.Genres)
+	assert.False(t, b.UpdatedAt.IsZero())
+	_, err = restored.GetBookByISBN(trashed.ISBN)
+	assert.Equal(t, pg.ErrNoRows, err)
+
+	c, err := restored.GetCollectionByID(shelf.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "shelf", c.Name)
+	require.Len(t, c.Books, 1)
+	assert.Equal(t, kim.ISBN, c.Books[0].ISBN)
+	history, err := restored.GetCollectionHistory(shelf.ID)
+	require.NoError(t, err)
+	assert.Len(t, history.Results, 3)
+
+	// the trash comes back whole, memberships included
+	require.NoError(t, restored.RestoreCollection(old.ID))
+	c, err = restored.GetCollectionByID(old.ID)
+	require.NoError(t, err)
+	require.Len(t, c.Books, 1)
+	assert.Equal(t, nostromo.ISBN, c.Books[0].ISBN)
+	require.NoError(t, restored.RestoreBook(trashed.ISBN))
+
+	// new rows carry on after the restored ids
+	added := models.Collection{Name: "added"}
+	require.NoError(t, restored.AddCollection(&added))
+	assert.Greater(t, added.ID, old.ID)
+	require.NoError(t, restored.AddBookToCollection(&kim, &added))
+	history, err = restored.GetCollectionHistory(added.ID)
+	require.NoError(t, err)
+	require.Len(t, history.Results, 1)
+	assert.Greater(t, history.Results[0].ID, 4)
+}
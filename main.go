@@ -1,19 +1,91 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 
+	"github.com/john-cai/book-manager/database"
 	"github.com/john-cai/book-manager/server"
 )
 
 func main() {
-	s := server.NewServer()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	s, err := server.NewServer()
+	if err != nil {
+		log.Fatal(err)
+	}
 	httpServer := http.Server{
 		Addr:    fmt.Sprintf(":%s", os.Getenv("PORT")),
 		Handler: s,
 	}
 	log.Fatal(httpServer.ListenAndServe())
 }
+
+const migrateUsage = "usage: bookmanager migrate up|down|status"
+
+// migrate runs the `bookmanager migrate` subcommands against the configured store
+func migrate(args []string) error {
+	if len(args) != 1 {
+		return errors.New(migrateUsage)
+	}
+	store, err := server.OpenStore()
+	if err != nil {
+		return err
+	}
+	migratable, ok := store.(database.Migratable)
+	if !ok {
+		return errors.New("this database does not use migrations")
+	}
+	migrator, err := migratable.Migrator()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up()
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+		for _, m := range applied {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+	case "down":
+		rolledBack, err := migrator.Down()
+		if err != nil {
+			return err
+		}
+		if rolledBack == nil {
+			fmt.Println("no migrations to roll back")
+			return nil
+		}
+		fmt.Printf("rolled back %04d_%s\n", rolledBack.Version, rolledBack.Name)
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied"
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, state)
+		}
+	default:
+		return errors.New(migrateUsage)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrInvalidISBN is returned for an isbn that is neither a valid ISBN-10
+	// nor a valid ISBN-13
+	ErrInvalidISBN = errors.New("not a valid ISBN-10 or ISBN-13")
+	// ErrISBNCheckDigit is returned for an isbn of the right shape whose
+	// check digit does not match
+	ErrISBNCheckDigit = errors.New("isbn check digit does not match")
+)
+
+// NormalizeISBN validates an ISBN-10 or ISBN-13, ignoring hyphens and spaces,
+// and returns it as a canonical ISBN-13 of digits only
+func NormalizeISBN(isbn string) (string, error) {
+	digits := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, isbn)
+
+	switch len(digits) {
+	case 10:
+		if !allDigits(digits[:9]) || !allDigits(digits[9:]) && digits[9] != 'X' && digits[9] != 'x' {
+			return "", ErrInvalidISBN
+		}
+		if isbn10CheckDigit(digits[:9]) != strings.ToUpper(digits[9:]) {
+			return "", ErrISBNCheckDigit
+		}
+		isbn13 := "978" + digits[:9]
+		return isbn13 + isbn13CheckDigit(isbn13), nil
+	case 13:
+		if !allDigits(digits) || !strings.HasPrefix(digits, "978") && !strings.HasPrefix(digits, "979") {
+			return "", ErrInvalidISBN
+		}
+		if isbn13CheckDigit(digits[:12]) != digits[12:] {
+			return "", ErrISBNCheckDigit
+		}
+		return digits, nil
+	}
+	return "", ErrInvalidISBN
+}
+
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isbn10CheckDigit computes the check digit of the first 9 digits of an
+// ISBN-10, which is X for 10
+func isbn10CheckDigit(digits string) string {
+	sum := 0
+	for i, r := range digits {
+		sum += (10 - i) * int(r-'0')
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return "X"
+	}
+	return string(rune('0' + check))
+}
+
+// isbn13CheckDigit computes the check digit of the first 12 digits of an
+// ISBN-13
+func isbn13CheckDigit(digits string) string {
+	sum := 0
+	for i, r := range digits {
+		weight := 1
+		if i%2 == 1 {
+			weight = 3
+		}
+		sum += weight * int(r-'0')
+	}
+	return string(rune('0' + (10-sum%10)%10))
+}
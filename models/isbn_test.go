@@ -0,0 +1,35 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeISBN(t *testing.T) {
+	testCases := []struct {
+		isbn     string
+		expected string
+		err      error
+	}{
+		{isbn: "978-0-14-118280-3", expected: "9780141182803"},
+		{isbn: "9780141182803", expected: "9780141182803"},
+		{isbn: "978 0 14 118280 3", expected: "9780141182803"},
+		{isbn: "0-14-118280-6", expected: "9780141182803"},
+		{isbn: "0-8044-2957-X", expected: "9780804429573"},
+		{isbn: "080442957x", expected: "9780804429573"},
+		{isbn: "979-10-90636-07-1", expected: "9791090636071"},
+		{isbn: "978-0-14-118280-4", err: ErrISBNCheckDigit},
+		{isbn: "0-14-118280-1", err: ErrISBNCheckDigit},
+		{isbn: "977-0-14-118280-3", err: ErrInvalidISBN},
+		{isbn: "X-14-118280-0", err: ErrInvalidISBN},
+		{isbn: "0-14-11828", err: ErrInvalidISBN},
+		{isbn: "3f2504e0-4f89-11d3-9a0c-0305e82c3301", err: ErrInvalidISBN},
+		{isbn: "", err: ErrInvalidISBN},
+	}
+	for _, testCase := range testCases {
+		isbn, err := NormalizeISBN(testCase.isbn)
+		assert.Equal(t, testCase.err, err, testCase.isbn)
+		assert.Equal(t, testCase.expected, isbn, testCase.isbn)
+	}
+}
@@ -1,9 +1,14 @@
 package models
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-pg/pg/orm"
+
+	"github.com/john-cai/book-manager/responder"
 )
 
 func init() {
@@ -13,50 +18,421 @@ func init() {
 }
 
 type Book struct {
-	ISBN        string       `sql:"isbn,pk",json:"isbn"`
-	Title       string       `json:"title"`
-	Author      string       `json:"author"`
-	Description string       `json:"description"`
-	PublishedAt time.Time    `json:"published_at"`
-	Metadata    Metadata     `json:"metadata"`
-	Collections []Collection `pg:"many2many:book_collections,joinFK:collection_id", json:"collections"`
-	CreatedAt   time.Time    `json:"created_at"`
-	UpdatedAt   time.Time    `json:"updated_at"`
-	DeletedAt   time.Time    `pg:",soft_delete" json:"deleted_at"`
+	ISBN               string        `sql:"isbn,pk" json:"isbn"`
+	Title              string        `json:"title"`
+	Author             string        `json:"author"`
+	Description        string        `json:"description"`
+	PublishedAt        time.Time     `json:"published_at"`
+	PublishedPrecision DatePrecision `json:"published_precision,omitempty"`
+	Metadata           Metadata      `json:"metadata"`
+	Collections        []Collection  `pg:"many2many:book_collections,joinFK:collection_id" json:"collections"`
+	Version            int           `json:"version"`
+	CreatedAt          time.Time     `json:"created_at"`
+	UpdatedAt          time.Time     `json:"updated_at"`
+	DeletedAt          time.Time     `pg:",soft_delete" json:"deleted_at"`
+
+	// Rank and Highlights are only filled in on search results
+	Rank       float64           `sql:"-" json:"rank,omitempty"`
+	Highlights map[string]string `sql:"-" json:"highlights,omitempty"`
 }
 
+// PublishedDate formats PublishedAt to its precision, or returns "" when
+// the publication date is unknown
+func (b *Book) PublishedDate() string {
+	if b.PublishedAt.IsZero() {
+		return ""
+	}
+	return b.PublishedPrecision.Format(b.PublishedAt)
+}
+
+// TruncatePublished drops the part of PublishedAt finer than its precision,
+// so a year only date is always stored as January 1st
+func (b *Book) TruncatePublished() {
+	if b.PublishedPrecision != "" && !b.PublishedAt.IsZero() {
+		b.PublishedAt = b.PublishedPrecision.Truncate(b.PublishedAt)
+	}
+}
+
+// Normalize puts a validated book into its stored form: text trimmed, isbn
+// as ISBN-13 and the publication date truncated to its precision
+func (b *Book) Normalize() {
+	if isbn, err := NormalizeISBN(b.ISBN); err == nil {
+		b.ISBN = isbn
+	}
+	b.Title = strings.TrimSpace(b.Title)
+	b.Author = strings.TrimSpace(b.Author)
+	b.Description = strings.TrimSpace(b.Description)
+	b.TruncatePublished()
+}
+
+// BeforeInsert starts a new book at version 1; every update moves it on by
+// one
 func (b *Book) BeforeInsert(db orm.DB) error {
 	if b.CreatedAt.IsZero() {
 		b.CreatedAt = time.Now()
 	}
+	b.Version = 1
 	return nil
 }
 
+// BeforeUpdate stamps the book as updated now; updated_at is only ever set
+// by the server
+func (b *Book) BeforeUpdate(db orm.DB) error {
+	b.UpdatedAt = time.Now()
+	return nil
+}
+
+// ClearReadOnly drops whatever a client sent for the fields only the server
+// writes
+func (b *Book) ClearReadOnly() {
+	b.Version = 0
+	b.CreatedAt, b.UpdatedAt, b.DeletedAt = time.Time{}, time.Time{}, time.Time{}
+}
+
+// MarshalJSON writes timestamps that are not set as null rather than as the
+// zero time
+func (b Book) MarshalJSON() ([]byte, error) {
+	type book Book
+	return json.Marshal(struct {
+		book
+		PublishedAt *time.Time `json:"published_at"`
+		CreatedAt   *time.Time `json:"created_at"`
+		UpdatedAt   *time.Time `json:"updated_at"`
+		DeletedAt   *time.Time `json:"deleted_at"`
+	}{book(b), timestamp(b.PublishedAt), timestamp(b.CreatedAt), timestamp(b.UpdatedAt), timestamp(b.DeletedAt)})
+}
+
+// timestamp is t for json, nil when it is not set
+func timestamp(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
 type Collection struct {
 	ID          int       `json:"id"`
 	Name        string    `json:"name"`
 	Description string    `json:"description"`
-	Books       []Book    `pg:"many2many:book_collections,joinFK:book_isbn", json:"books"`
+	Books       []Book    `pg:"many2many:book_collections,joinFK:book_isbn" json:"books"`
+	Version     int       `json:"version"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 	DeletedAt   time.Time `pg:",soft_delete" json:"deleted_at"`
 }
 
+// Slug is the collection's name as it can be used in a url: lower cased,
+// with spaces as hyphens
+func (c Collection) Slug() string {
+	return strings.ToLower(strings.Replace(c.Name, " ", "-", -1))
+}
+
+// Normalize puts a validated collection into its stored form
+func (c *Collection) Normalize() {
+	c.Name = strings.TrimSpace(c.Name)
+	c.Description = strings.TrimSpace(c.Description)
+}
+
 func (c *Collection) BeforeInsert(db orm.DB) error {
 	if c.CreatedAt.IsZero() {
 		c.CreatedAt = time.Now()
 	}
+	c.Version = 1
 	return nil
 }
 
+// BeforeUpdate stamps the collection as updated now
+func (c *Collection) BeforeUpdate(db orm.DB) error {
+	c.UpdatedAt = time.Now()
+	return nil
+}
+
+// ClearReadOnly drops whatever a client sent for the fields only the server
+// writes
+func (c *Collection) ClearReadOnly() {
+	c.Version = 0
+	c.CreatedAt, c.UpdatedAt, c.DeletedAt = time.Time{}, time.Time{}, time.Time{}
+}
+
+// MarshalJSON writes timestamps that are not set as null, like Book's
+func (c Collection) MarshalJSON() ([]byte, error) {
+	type collection Collection
+	return json.Marshal(struct {
+		collection
+		CreatedAt *time.Time `json:"created_at"`
+		UpdatedAt *time.Time `json:"updated_at"`
+		DeletedAt *time.Time `json:"deleted_at"`
+	}{collection(c), timestamp(c.CreatedAt), timestamp(c.UpdatedAt), timestamp(c.DeletedAt)})
+}
+
 type BookCollection struct {
-	BookISBN     string    `sql:"book_isbn,pk"`
-	CollectionID int       `sql:"collection_id,pk"`
+	BookISBN     string    `sql:"book_isbn,pk" json:"book_isbn"`
+	CollectionID int       `sql:"collection_id,pk" json:"collection_id"`
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 	DeletedAt    time.Time `pg:",soft_delete" json:"deleted_at"`
 }
 
+// CollectionEvent records a book being added to or removed from a collection
+type CollectionEvent struct {
+	ID           int              `json:"id"`
+	CollectionID int              `json:"collection_id"`
+	BookISBN     string           `json:"book_isbn"`
+	Action       MembershipStatus `json:"action"`
+	CreatedAt    time.Time        `json:"created_at"`
+}
+
+// CollectionHistory is every change made to a collection's books, oldest
+// first
+type CollectionHistory struct {
+	Results []CollectionEvent `json:"results"`
+}
+
+// MembershipStatus is what a bulk add or remove did with one isbn
+type MembershipStatus string
+
+const (
+	MembershipAdded          MembershipStatus = "added"
+	MembershipAlreadyPresent MembershipStatus = "already_present"
+	MembershipRemoved        MembershipStatus = "removed"
+	MembershipNotMember      MembershipStatus = "not_member"
+	MembershipNotFound       MembershipStatus = "not_found"
+)
+
+// Failed reports whether the isbn could not be added or removed
+func (s MembershipStatus) Failed() bool {
+	return s == MembershipNotFound || s == MembershipNotMember
+}
+
+// MembershipResult is the outcome of a bulk add or remove for one isbn
+type MembershipResult struct {
+	ISBN   string           `json:"isbn"`
+	Status MembershipStatus `json:"status"`
+}
+
+// MembershipReport is the outcome of adding or removing books from a
+// collection in bulk. Applied is false when nothing was changed because an
+// atomic request had isbns that failed.
+type MembershipReport struct {
+	Applied bool               `json:"applied"`
+	Results []MembershipResult `json:"results"`
+}
+
+// Failed reports whether any isbn could not be added or removed
+func (r MembershipReport) Failed() bool {
+	for _, result := range r.Results {
+		if result.Status.Failed() {
+			return true
+		}
+	}
+	return false
+}
+
+// Trash lists the books and collections that have been deleted but not
+// purged, most recently deleted first
+type Trash struct {
+	Books       []Book       `json:"books"`
+	Collections []Collection `json:"collections"`
+}
+
+// DeleteReport is the outcome of deleting a book or a collection: the
+// collections the book was in, or the books the collection had, and what
+// the policy did to those memberships
+type DeleteReport struct {
+	Policy      string       `json:"policy"`
+	Collections []Collection `json:"collections,omitempty"`
+	Books       []Book       `json:"books,omitempty"`
+}
+
+// ImportStatus is what a bulk import did with one line
+type ImportStatus string
+
+const (
+	ImportCreated ImportStatus = "created"
+	ImportUpdated ImportStatus = "updated"
+	ImportSkipped ImportStatus = "skipped"
+	ImportFailed  ImportStatus = "failed"
+)
+
+// ImportResult is the outcome of a bulk import for one line of the upload.
+// Errors says why a line failed and Message why it was skipped.
+type ImportResult struct {
+	Line    int               `json:"line"`
+	ISBN    string            `json:"isbn,omitempty"`
+	Status  ImportStatus      `json:"status"`
+	Message string            `json:"message,omitempty"`
+	Errors  []responder.Error `json:"errors,omitempty"`
+}
+
+// ImportReport is the outcome of importing books in bulk, line by line.
+// Nothing is kept from a dry run, which reports what an import would do.
+type ImportReport struct {
+	DryRun  bool           `json:"dry_run"`
+	Created int            `json:"created"`
+	Updated int            `json:"updated"`
+	Skipped int            `json:"skipped"`
+	Failed  int            `json:"failed"`
+	Results []ImportResult `json:"results"`
+}
+
+// Add records the outcome of a line
+func (r *ImportReport) Add(result ImportResult) {
+	switch result.Status {
+	case ImportCreated:
+		r.Created++
+	case ImportUpdated:
+		r.Updated++
+	case ImportSkipped:
+		r.Skipped++
+	default:
+		r.Failed++
+	}
+	r.Results = append(r.Results, result)
+}
+
+// BackupFormat names the format of a full backup, and BackupVersion is the
+// version of it this code writes and the newest it can read
+const (
+	BackupFormat  = "book-manager-backup"
+	BackupVersion = 1
+)
+
+// BackupHeader starts a full backup
+type BackupHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BackupRecord is one row of a full backup, or the End that closes it.
+// Exactly one of its fields is set.
+type BackupRecord struct {
+	Book       *Book            `json:"book,omitempty"`
+	Collection *Collection      `json:"collection,omitempty"`
+	Membership *BookCollection  `json:"membership,omitempty"`
+	Event      *CollectionEvent `json:"event,omitempty"`
+	End        *BackupEnd       `json:"end,omitempty"`
+}
+
+// BackupEnd closes a full backup, so that one that was cut short can be
+// told apart from a complete one
+type BackupEnd struct {
+	Records int `json:"records"`
+}
+
+// BackupSummary counts what a full backup restored
+type BackupSummary struct {
+	Books       int `json:"books"`
+	Collections int `json:"collections"`
+	Memberships int `json:"memberships"`
+	Events      int `json:"events"`
+}
+
+// Add counts a restored record
+func (s *BackupSummary) Add(record BackupRecord) {
+	switch {
+	case record.Book != nil:
+		s.Books++
+	case record.Collection != nil:
+		s.Collections++
+	case record.Membership != nil:
+		s.Memberships++
+	case record.Event != nil:
+		s.Events++
+	}
+}
+
+// BookList is one page of a book listing
+type BookList struct {
+	Total      int    `json:"total"`
+	Results    []Book `json:"results"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
+}
+
+// CollectionList is one page of a collection listing
+type CollectionList struct {
+	Total      int          `json:"total"`
+	Results    []Collection `json:"results"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+	PrevCursor string       `json:"prev_cursor,omitempty"`
+}
+
 type Metadata struct {
 	Genres []string `json:"genres"`
 }
+
+// DatePrecision is how much of a partial date is known. A book with an
+// empty PublishedPrecision has a full publication date.
+type DatePrecision string
+
+const (
+	PrecisionYear  DatePrecision = "year"
+	PrecisionMonth DatePrecision = "month"
+	PrecisionDay   DatePrecision = "day"
+)
+
+var precisionLayouts = []struct {
+	precision DatePrecision
+	layout    string
+}{
+	{PrecisionYear, "2006"},
+	{PrecisionMonth, "2006-01"},
+	{PrecisionDay, "2006-01-02"},
+}
+
+// ParsePartialDate parses a YYYY, YYYY-MM or YYYY-MM-DD date into the first
+// day it covers and its precision
+func ParsePartialDate(s string) (time.Time, DatePrecision, error) {
+	for _, p := range precisionLayouts {
+		if len(s) != len(p.layout) {
+			continue
+		}
+		if t, err := time.Parse(p.layout, s); err == nil {
+			return t, p.precision, nil
+		}
+	}
+	return time.Time{}, "", fmt.Errorf("%q is not a YYYY, YYYY-MM or YYYY-MM-DD date", s)
+}
+
+// Valid reports whether p is a known precision. Empty counts as day.
+func (p DatePrecision) Valid() bool {
+	switch p {
+	case "", PrecisionYear, PrecisionMonth, PrecisionDay:
+		return true
+	}
+	return false
+}
+
+// Format formats t to precision p
+func (p DatePrecision) Format(t time.Time) string {
+	switch p {
+	case PrecisionYear:
+		return t.Format("2006")
+	case PrecisionMonth:
+		return t.Format("2006-01")
+	}
+	return t.Format("2006-01-02")
+}
+
+// Truncate returns the first instant of the year, month or day t falls in
+func (p DatePrecision) Truncate(t time.Time) time.Time {
+	switch p {
+	case PrecisionYear:
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location())
+	case PrecisionMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// End returns the first instant after the year, month or day starting at t
+func (p DatePrecision) End(t time.Time) time.Time {
+	switch p {
+	case PrecisionYear:
+		return t.AddDate(1, 0, 0)
+	case PrecisionMonth:
+		return t.AddDate(0, 1, 0)
+	}
+	return t.AddDate(0, 0, 1)
+}
@@ -1,32 +1,167 @@
 package models
 
-import "github.com/john-cai/book-manager/responder"
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
 
-func ValidateBook(book Book) []responder.Error {
-	var errs []responder.Error
-	if book.ISBN == "" {
-		errs = append(errs, responder.Error{
-			Field:   "isbn",
-			Message: "required",
-		})
+	"github.com/john-cai/book-manager/responder"
+)
+
+// Limits on the length of text fields, in characters
+const (
+	MaxTitleLength       = 512
+	MaxAuthorLength      = 512
+	MaxDescriptionLength = 512
+	MaxNameLength        = 512
+)
+
+// Codes of validation errors, for clients to act on without parsing messages
+const (
+	CodeRequired     = "required"
+	CodeTooLong      = "too_long"
+	CodeInvalid      = "invalid"
+	CodeInvalidISBN  = "invalid_isbn"
+	CodeISBNCheck    = "isbn_check_digit"
+	CodeFutureDate   = "future_date"
+	CodeUnknownGenre = "unknown_genre"
+	CodeDuplicate    = "duplicate"
+	CodeRestricted   = "restricted"
+	CodeConflict     = "version_conflict"
+	CodeIfMatch      = "if_match_required"
+	CodePatchFailed  = "patch_failed"
+	CodeUnknownField = "unknown_field"
+	CodeInvalidType  = "invalid_type"
+)
+
+// Genres is the vocabulary books can be tagged with
+var Genres = []string{
+	"adventure",
+	"biography",
+	"children",
+	"classic",
+	"comics",
+	"crime",
+	"drama",
+	"fantasy",
+	"historical fiction",
+	"history",
+	"horror",
+	"humor",
+	"mystery",
+	"non-fiction",
+	"philosophy",
+	"poetry",
+	"romance",
+	"science",
+	"science fiction",
+	"self-help",
+	"thriller",
+	"travel",
+	"young adult",
+}
+
+var knownGenres = make(map[string]bool)
+
+func init() {
+	for _, genre := range Genres {
+		knownGenres[genre] = true
 	}
-	if book.Title == "" {
-		errs = append(errs, responder.Error{
-			Field:   "title",
-			Message: "required",
-		})
+}
+
+// validation collects every violation found in a payload
+type validation struct {
+	errs []responder.Error
+}
+
+func (v *validation) add(field, code, message string) {
+	v.errs = append(v.errs, responder.Error{Field: field, Code: code, Message: message})
+}
+
+// text checks a text field is set, ignoring surrounding whitespace, when
+// required, and is at most max characters long
+func (v *validation) text(field, value string, required bool, max int) {
+	trimmed := strings.TrimSpace(value)
+	if trimmed == "" {
+		if required {
+			v.add(field, CodeRequired, "required")
+		}
+		return
 	}
-	if book.Author == "" {
-		errs = append(errs, responder.Error{
-			Field:   "author",
-			Message: "required",
-		})
+	if utf8.RuneCountInString(trimmed) > max {
+		v.add(field, CodeTooLong, fmt.Sprintf("exceeds maximum %d characters", max))
 	}
-	//TODO: rest of logic
-	return errs
 }
 
+// isbn checks field holds a valid ISBN-10 or ISBN-13
+func (v *validation) isbn(field, isbn string) {
+	if strings.TrimSpace(isbn) == "" {
+		v.add(field, CodeRequired, "required")
+		return
+	}
+	switch _, err := NormalizeISBN(isbn); err {
+	case nil:
+	case ErrISBNCheckDigit:
+		v.add(field, CodeISBNCheck, err.Error())
+	default:
+		v.add(field, CodeInvalidISBN, err.Error())
+	}
+}
+
+// ValidateBook returns every problem with a book sent to be created or edited
+func ValidateBook(book Book) []responder.Error {
+	var v validation
+	v.isbn("isbn", book.ISBN)
+	v.text("title", book.Title, true, MaxTitleLength)
+	v.text("author", book.Author, true, MaxAuthorLength)
+	v.text("description", book.Description, false, MaxDescriptionLength)
+
+	switch {
+	case !book.PublishedPrecision.Valid():
+		v.add("published_precision", CodeInvalid, "must be year, month or day")
+	case book.PublishedPrecision != "" && book.PublishedAt.IsZero():
+		v.add("published_precision", CodeRequired, "requires published_at")
+	case !book.PublishedAt.IsZero() && book.PublishedPrecision.Truncate(book.PublishedAt).After(time.Now()):
+		v.add("published_at", CodeFutureDate, "cannot be in the future")
+	}
+
+	seen := make(map[string]bool)
+	for i, genre := range book.Metadata.Genres {
+		field := fmt.Sprintf("metadata.genres[%d]", i)
+		switch {
+		case !knownGenres[genre]:
+			v.add(field, CodeUnknownGenre, fmt.Sprintf("%q is not a known genre", genre))
+		case seen[genre]:
+			v.add(field, CodeDuplicate, fmt.Sprintf("%q is listed more than once", genre))
+		}
+		seen[genre] = true
+	}
+	return v.errs
+}
+
+// ValidateCollection returns every problem with a collection sent to be
+// created or edited
 func ValidateCollection(collection Collection) []responder.Error {
-	//TODO: implement me
-	return []responder.Error{}
+	var v validation
+	v.text("name", collection.Name, true, MaxNameLength)
+	// collections are addressed by id or name, so a name cannot look like an id
+	if name := strings.TrimSpace(collection.Name); name != "" && allDigits(name) {
+		v.add("name", CodeInvalid, "cannot be only digits")
+	}
+	v.text("description", collection.Description, false, MaxDescriptionLength)
+	return v.errs
+}
+
+// ValidateISBNs checks every isbn of a bulk payload, reporting problems
+// against field[i]
+func ValidateISBNs(field string, isbns []string) []responder.Error {
+	var v validation
+	if len(isbns) == 0 {
+		v.add(field, CodeRequired, "at least one isbn is required")
+	}
+	for i, isbn := range isbns {
+		v.isbn(fmt.Sprintf("%s[%d]", field, i), isbn)
+	}
+	return v.errs
 }
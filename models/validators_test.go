@@ -0,0 +1,105 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateBook(t *testing.T) {
+	valid := Book{ISBN: "978-0-14-118280-3", Title: "The Jungle Book", Author: "Rudyard Kipling"}
+	testCases := []struct {
+		name   string
+		edit   func(b *Book)
+		fields []string
+		codes  []string
+	}{
+		{name: "valid", edit: func(b *Book) {}},
+		{
+			name:   "blank",
+			edit:   func(b *Book) { *b = Book{Title: "  ", Author: "\t"} },
+			fields: []string{"isbn", "title", "author"},
+			codes:  []string{CodeRequired, CodeRequired, CodeRequired},
+		},
+		{
+			name:   "isbn",
+			edit:   func(b *Book) { b.ISBN = "978-0-14-118280-4" },
+			fields: []string{"isbn"},
+			codes:  []string{CodeISBNCheck},
+		},
+		{
+			name: "too long",
+			edit: func(b *Book) {
+				b.Title = strings.Repeat("a", MaxTitleLength+1)
+				b.Description = strings.Repeat("é", MaxDescriptionLength+1)
+			},
+			fields: []string{"title", "description"},
+			codes:  []string{CodeTooLong, CodeTooLong},
+		},
+		{
+			name:   "limits count characters",
+			edit:   func(b *Book) { b.Description = strings.Repeat("é", MaxDescriptionLength) },
+			fields: nil,
+		},
+		{
+			name:   "future",
+			edit:   func(b *Book) { b.PublishedAt = time.Now().AddDate(1, 0, 0) },
+			fields: []string{"published_at"},
+			codes:  []string{CodeFutureDate},
+		},
+		{
+			name: "this year",
+			edit: func(b *Book) {
+				b.PublishedAt, b.PublishedPrecision = time.Now().AddDate(0, 0, 1), PrecisionYear
+			},
+		},
+		{
+			name:   "precision",
+			edit:   func(b *Book) { b.PublishedPrecision = "decade" },
+			fields: []string{"published_precision"},
+			codes:  []string{CodeInvalid},
+		},
+		{
+			name:   "genres",
+			edit:   func(b *Book) { b.Metadata.Genres = []string{"fantasy", "cooking", "fantasy"} },
+			fields: []string{"metadata.genres[1]", "metadata.genres[2]"},
+			codes:  []string{CodeUnknownGenre, CodeDuplicate},
+		},
+	}
+	for _, testCase := range testCases {
+		book := valid
+		testCase.edit(&book)
+		var fields, codes []string
+		for _, err := range ValidateBook(book) {
+			fields = append(fields, err.Field)
+			codes = append(codes, err.Code)
+		}
+		assert.Equal(t, testCase.fields, fields, testCase.name)
+		assert.Equal(t, testCase.codes, codes, testCase.name)
+	}
+}
+
+func TestValidateCollection(t *testing.T) {
+	assert.Empty(t, ValidateCollection(Collection{Name: "favourites"}))
+
+	errs := ValidateCollection(Collection{Name: " ", Description: strings.Repeat("a", MaxDescriptionLength+1)})
+	if assert.Len(t, errs, 2) {
+		assert.Equal(t, "name", errs[0].Field)
+		assert.Equal(t, CodeRequired, errs[0].Code)
+		assert.Equal(t, "description", errs[1].Field)
+		assert.Equal(t, CodeTooLong, errs[1].Code)
+	}
+}
+
+func TestValidateISBNs(t *testing.T) {
+	errs := ValidateISBNs("books_to_add", []string{"9780141182803", "abc", ""})
+	if assert.Len(t, errs, 2) {
+		assert.Equal(t, "books_to_add[1]", errs[0].Field)
+		assert.Equal(t, CodeInvalidISBN, errs[0].Code)
+		assert.Equal(t, "books_to_add[2]", errs[1].Field)
+		assert.Equal(t, CodeRequired, errs[1].Code)
+	}
+	assert.Len(t, ValidateISBNs("books_to_add", nil), 1)
+}
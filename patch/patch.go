@@ -0,0 +1,393 @@
+// Package patch applies JSON Merge Patch (RFC 7396) and JSON Patch
+// (RFC 6902) documents to JSON documents.
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Media types of the two kinds of patch
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+// Merge applies a JSON merge patch to doc: members of the patch replace
+// those of doc, objects are merged recursively and null removes a member
+func Merge(doc, mergePatch []byte) ([]byte, error) {
+	var target, p interface{}
+	if err := unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+	if err := unmarshal(mergePatch, &p); err != nil {
+		return nil, fmt.Errorf("invalid merge patch: %v", err)
+	}
+	return json.Marshal(merge(target, p))
+}
+
+func merge(target, p interface{}) interface{} {
+	patchObject, ok := p.(map[string]interface{})
+	if !ok {
+		return p
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = merge(targetObject[key], value)
+	}
+	return targetObject
+}
+
+// Operation is one step of a JSON patch
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// OpError is an operation of a well formed JSON patch that cannot be applied
+// to the document, such as a failed test or a path that does not exist
+type OpError struct {
+	Index   int
+	Op      Operation
+	Message string
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("operation %d (%s %s): %s", e.Index, e.Op.Op, e.Op.Path, e.Message)
+}
+
+// Apply applies a JSON patch to doc, one operation after the other. A patch
+// that is not well formed is reported with a plain error, an operation that
+// cannot be applied with an *OpError; either way doc is left as it was.
+func Apply(doc, jsonPatch []byte) ([]byte, error) {
+	var ops []Operation
+	if err := json.Unmarshal(jsonPatch, &ops); err != nil {
+		return nil, fmt.Errorf("invalid json patch: %v", err)
+	}
+	steps := make([]step, len(ops))
+	for i, op := range ops {
+		var err error
+		if steps[i], err = parseOperation(op); err != nil {
+			return nil, fmt.Errorf("invalid json patch: operation %d: %v", i, err)
+		}
+	}
+
+	var target interface{}
+	if err := unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+	for i, s := range steps {
+		var err error
+		if target, err = s.apply(target); err != nil {
+			return nil, &OpError{Index: i, Op: ops[i], Message: err.Error()}
+		}
+	}
+	return json.Marshal(target)
+}
+
+// step is a parsed Operation
+type step struct {
+	op    string
+	path  []string
+	from  []string
+	value interface{}
+}
+
+func parseOperation(op Operation) (step, error) {
+	s := step{op: op.Op}
+	var err error
+	if s.path, err = parsePointer(op.Path); err != nil {
+		return s, fmt.Errorf("path: %v", err)
+	}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return s, fmt.Errorf("%s needs a value", op.Op)
+		}
+		if err = unmarshal(op.Value, &s.value); err != nil {
+			return s, fmt.Errorf("value: %v", err)
+		}
+	case "move", "copy":
+		if s.from, err = parsePointer(op.From); err != nil {
+			return s, fmt.Errorf("from: %v", err)
+		}
+	case "remove":
+	default:
+		return s, fmt.Errorf("unknown op %q", op.Op)
+	}
+	return s, nil
+}
+
+func (s step) apply(doc interface{}) (interface{}, error) {
+	switch s.op {
+	case "add":
+		return set(doc, s.path, s.value, true)
+	case "remove":
+		return remove(doc, s.path)
+	case "replace":
+		return set(doc, s.path, s.value, false)
+	case "move":
+		if isPrefix(s.from, s.path) {
+			if len(s.from) == len(s.path) {
+				return doc, nil
+			}
+			return nil, fmt.Errorf("cannot move a value into itself")
+		}
+		value, err := get(doc, s.from)
+		if err != nil {
+			return nil, err
+		}
+		if doc, err = remove(doc, s.from); err != nil {
+			return nil, err
+		}
+		return set(doc, s.path, value, true)
+	case "copy":
+		value, err := get(doc, s.from)
+		if err != nil {
+			return nil, err
+		}
+		return set(doc, s.path, deepCopy(value), true)
+	default:
+		value, err := get(doc, s.path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(value, s.value) {
+			return nil, fmt.Errorf("value does not match")
+		}
+		return doc, nil
+	}
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into its unescaped tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%q does not start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+func isPrefix(prefix, tokens []string) bool {
+	if len(prefix) > len(tokens) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != tokens[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// index reads an array index token, which has to be below n
+func index(token string, n int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || strconv.Itoa(i) != token {
+		return 0, fmt.Errorf("%q is not an array index", token)
+	}
+	if i >= n {
+		return 0, fmt.Errorf("index %d is out of range", i)
+	}
+	return i, nil
+}
+
+func get(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch container := doc.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("%q does not exist", token)
+			}
+			doc = value
+		case []interface{}:
+			i, err := index(token, len(container))
+			if err != nil {
+				return nil, err
+			}
+			doc = container[i]
+		default:
+			return nil, fmt.Errorf("%q is not in an object or array", token)
+		}
+	}
+	return doc, nil
+}
+
+// set puts value at path and returns the changed doc. With insert a member
+// may be added, or an array element inserted, otherwise it must already be
+// there to be replaced.
+func set(doc interface{}, path []string, value interface{}, insert bool) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	token, last := path[0], len(path) == 1
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		child, ok := container[token]
+		if !ok && (!last || !insert) {
+			return nil, fmt.Errorf("%q does not exist", token)
+		}
+		if last {
+			container[token] = value
+			return container, nil
+		}
+		child, err := set(child, path[1:], value, insert)
+		if err != nil {
+			return nil, err
+		}
+		container[token] = child
+		return container, nil
+	case []interface{}:
+		if last && insert {
+			i := len(container)
+			if token != "-" {
+				var err error
+				if i, err = index(token, len(container)+1); err != nil {
+					return nil, err
+				}
+			}
+			container = append(container, nil)
+			copy(container[i+1:], container[i:])
+			container[i] = value
+			return container, nil
+		}
+		i, err := index(token, len(container))
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			container[i] = value
+			return container, nil
+		}
+		if container[i], err = set(container[i], path[1:], value, insert); err != nil {
+			return nil, err
+		}
+		return container, nil
+	}
+	return nil, fmt.Errorf("%q is not in an object or array", token)
+}
+
+// remove takes the value at path out of doc and returns the changed doc
+func remove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("cannot remove the whole document")
+	}
+	token, last := path[0], len(path) == 1
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		child, ok := container[token]
+		if !ok {
+			return nil, fmt.Errorf("%q does not exist", token)
+		}
+		if last {
+			delete(container, token)
+			return container, nil
+		}
+		child, err := remove(child, path[1:])
+		if err != nil {
+			return nil, err
+		}
+		container[token] = child
+		return container, nil
+	case []interface{}:
+		i, err := index(token, len(container))
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			return append(container[:i], container[i+1:]...), nil
+		}
+		if container[i], err = remove(container[i], path[1:]); err != nil {
+			return nil, err
+		}
+		return container, nil
+	}
+	return nil, fmt.Errorf("%q is not in an object or array", token)
+}
+
+// equal compares two decoded JSON values, numbers by value
+func equal(a, b interface{}) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, errA := a.Float64()
+		y, errB := b.Float64()
+		if errA != nil || errB != nil {
+			return a == b
+		}
+		return x == y
+	default:
+		return a == b
+	}
+}
+
+func deepCopy(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(value))
+		for key, v := range value {
+			c[key] = deepCopy(v)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(value))
+		for i, v := range value {
+			c[i] = deepCopy(v)
+		}
+		return c
+	default:
+		return value
+	}
+}
+
+// unmarshal decodes JSON keeping numbers as they were written
+func unmarshal(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
@@ -0,0 +1,85 @@
+package patch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerge(t *testing.T) {
+	testCases := []struct {
+		doc      string
+		patch    string
+		expected string
+	}{
+		{doc: `{"a":"b"}`, patch: `{"a":"c"}`, expected: `{"a":"c"}`},
+		{doc: `{"a":"b"}`, patch: `{"b":"c"}`, expected: `{"a":"b","b":"c"}`},
+		{doc: `{"a":"b"}`, patch: `{"a":null}`, expected: `{}`},
+		{doc: `{"a":"b","b":"c"}`, patch: `{"a":null}`, expected: `{"b":"c"}`},
+		{doc: `{"a":["b"]}`, patch: `{"a":"c"}`, expected: `{"a":"c"}`},
+		{doc: `{"a":"c"}`, patch: `{"a":["b"]}`, expected: `{"a":["b"]}`},
+		{doc: `{"a":{"b":"c"}}`, patch: `{"a":{"b":"d","c":null}}`, expected: `{"a":{"b":"d"}}`},
+		{doc: `{"a":[{"b":"c"}]}`, patch: `{"a":[1]}`, expected: `{"a":[1]}`},
+		{doc: `{"e":null}`, patch: `{"a":1}`, expected: `{"a":1,"e":null}`},
+		{doc: `[1,2]`, patch: `{"a":"b","c":null}`, expected: `{"a":"b"}`},
+		{doc: `{}`, patch: `{"a":{"bb":{"ccc":null}}}`, expected: `{"a":{"bb":{}}}`},
+	}
+	for _, testCase := range testCases {
+		merged, err := Merge([]byte(testCase.doc), []byte(testCase.patch))
+		require.NoError(t, err, testCase.patch)
+		assert.JSONEq(t, testCase.expected, string(merged), testCase.patch)
+	}
+
+	_, err := Merge([]byte(`{}`), []byte(`{"a":`))
+	assert.Error(t, err)
+}
+
+func TestApply(t *testing.T) {
+	testCases := []struct {
+		doc      string
+		patch    string
+		expected string
+		opError  bool
+		invalid  bool
+	}{
+		{doc: `{"foo":"bar"}`, patch: `[{"op":"add","path":"/baz","value":"qux"}]`, expected: `{"baz":"qux","foo":"bar"}`},
+		{doc: `{"foo":["bar","baz"]}`, patch: `[{"op":"add","path":"/foo/1","value":"qux"}]`, expected: `{"foo":["bar","qux","baz"]}`},
+		{doc: `{"foo":["bar"]}`, patch: `[{"op":"add","path":"/foo/-","value":["abc"]}]`, expected: `{"foo":["bar",["abc"]]}`},
+		{doc: `{"baz":"qux","foo":"bar"}`, patch: `[{"op":"remove","path":"/baz"}]`, expected: `{"foo":"bar"}`},
+		{doc: `{"foo":["bar","qux","baz"]}`, patch: `[{"op":"remove","path":"/foo/1"}]`, expected: `{"foo":["bar","baz"]}`},
+		{doc: `{"baz":"qux","foo":"bar"}`, patch: `[{"op":"replace","path":"/baz","value":"boo"}]`, expected: `{"baz":"boo","foo":"bar"}`},
+		{doc: `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, patch: `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, expected: `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{doc: `{"foo":["all","grass","cows","eat"]}`, patch: `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, expected: `{"foo":["all","cows","eat","grass"]}`},
+		{doc: `{"foo":{"bar":1}}`, patch: `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"replace","path":"/baz/bar","value":2}]`, expected: `{"foo":{"bar":1},"baz":{"bar":2}}`},
+		{doc: `{"baz":"qux","foo":["a",2,"c"]}`, patch: `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`, expected: `{"baz":"qux","foo":["a",2,"c"]}`},
+		{doc: `{"/":9,"~1":10}`, patch: `[{"op":"test","path":"/~01","value":10},{"op":"replace","path":"/~1","value":8}]`, expected: `{"/":8,"~1":10}`},
+		{doc: `{"foo":"bar"}`, patch: `[{"op":"replace","path":"","value":[1]}]`, expected: `[1]`},
+		{doc: `{"baz":"qux"}`, patch: `[{"op":"test","path":"/baz","value":"bar"}]`, opError: true},
+		{doc: `{"foo":"bar"}`, patch: `[{"op":"add","path":"/baz/bat","value":"qux"}]`, opError: true},
+		{doc: `{"foo":"bar"}`, patch: `[{"op":"replace","path":"/baz","value":"qux"}]`, opError: true},
+		{doc: `{"foo":["bar"]}`, patch: `[{"op":"add","path":"/foo/2","value":"qux"}]`, opError: true},
+		{doc: `{"foo":["bar"]}`, patch: `[{"op":"remove","path":"/foo/01"}]`, opError: true},
+		{doc: `{"foo":{"bar":1}}`, patch: `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`, opError: true},
+		{doc: `{"foo":"bar"}`, patch: `[{"op":"add","path":"/baz","value":"qux"},{"op":"remove","path":"/nope"}]`, opError: true},
+		{doc: `{"foo":"bar"}`, patch: `[{"op":"add","path":"/baz"}]`, invalid: true},
+		{doc: `{"foo":"bar"}`, patch: `[{"op":"frobnicate","path":"/foo"}]`, invalid: true},
+		{doc: `{"foo":"bar"}`, patch: `[{"op":"remove","path":"foo"}]`, invalid: true},
+		{doc: `{"foo":"bar"}`, patch: `{"op":"remove","path":"/foo"}`, invalid: true},
+	}
+	for _, testCase := range testCases {
+		patched, err := Apply([]byte(testCase.doc), []byte(testCase.patch))
+		switch {
+		case testCase.opError:
+			_, ok := err.(*OpError)
+			assert.True(t, ok, "%s: %v", testCase.patch, err)
+		case testCase.invalid:
+			require.Error(t, err, testCase.patch)
+			_, ok := err.(*OpError)
+			assert.False(t, ok, testCase.patch)
+		default:
+			require.NoError(t, err, testCase.patch)
+			assert.JSONEq(t, testCase.expected, string(patched), testCase.patch)
+		}
+	}
+}
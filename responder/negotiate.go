@@ -0,0 +1,97 @@
+package responder
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Media types the api can answer with
+const (
+	JSONType      = "application/json"
+	JSONLinesType = "application/x-ndjson"
+	CSVType       = "text/csv"
+	HTMLType      = "text/html"
+)
+
+// Negotiate picks the offer the request's Accept header prefers, offers being
+// media types in the order the server prefers them. A request without Accept
+// gets the first offer, and one that accepts none of them gets "".
+func Negotiate(r *http.Request, offers ...string) string {
+	header := r.Header.Get("Accept")
+	if strings.TrimSpace(header) == "" {
+		if len(offers) == 0 {
+			return ""
+		}
+		return offers[0]
+	}
+	ranges := parseAccept(header)
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(ranges, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// RespondNotAcceptable answers a request that accepts none of offers
+func RespondNotAcceptable(w http.ResponseWriter, offers []string) error {
+	return RespondError(w, CodeNotAcceptable, "must accept "+strings.Join(offers, ", "), "Accept", http.StatusNotAcceptable)
+}
+
+// mediaRange is one media range of an Accept header, like text/* or
+// application/json;q=0.5
+type mediaRange struct {
+	mediaType string
+	q         float64
+}
+
+func parseAccept(header string) []mediaRange {
+	var ranges []mediaRange
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		if mediaType == "" {
+			continue
+		}
+		if mediaType == "*" {
+			mediaType = "*/*"
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			var err error
+			if q, err = strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil || q < 0 || q > 1 {
+				q = 0
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType: mediaType, q: q})
+	}
+	return ranges
+}
+
+// acceptQuality is the quality of the most specific media range matching
+// offer, zero when there is none
+func acceptQuality(ranges []mediaRange, offer string) float64 {
+	offerType, _, _ := strings.Cut(offer, "/")
+	q, specificity := 0.0, 0
+	for _, r := range ranges {
+		s := 0
+		switch {
+		case r.mediaType == offer:
+			s = 3
+		case r.mediaType == offerType+"/*":
+			s = 2
+		case r.mediaType == "*/*":
+			s = 1
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
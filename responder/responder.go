@@ -4,24 +4,86 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"net/http"
+	"strconv"
 )
 
+// ProblemType is the media type of error responses
+const ProblemType = "application/problem+json"
+
+// RequestIDHeader carries the id of a request, which error responses repeat
+// so that a failure can be found in the server's logs
+const RequestIDHeader = "X-Request-ID"
+
+// Codes of error responses. They are stable, so clients can rely on them
+// where the messages may change.
+const (
+	CodeMalformedRequest     = "malformed_request"
+	CodeValidationFailed     = "validation_failed"
+	CodeNotFound             = "not_found"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeISBNConflict         = "isbn_conflict"
+	CodeNameConflict         = "name_conflict"
+	CodeDeleteRestricted     = "delete_restricted"
+	CodeVersionConflict      = "version_conflict"
+	CodePreconditionRequired = "precondition_required"
+	CodePatchFailed          = "patch_failed"
+	CodeNotAcceptable        = "not_acceptable"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeInvalidBackup        = "invalid_backup"
+	CodeNotEmpty             = "not_empty"
+	CodeBodyTooLarge         = "body_too_large"
+	CodeImportIncomplete     = "import_incomplete"
+	CodeInternal             = "internal_error"
+)
+
+// ErrorResponse is an RFC 7807 problem details document. Code says what went
+// wrong for machines and Detail for people, while Errors lists the problems
+// with individual fields of the request, if any.
 type ErrorResponse struct {
-	Errors []Error `json:"errors"`
+	Type      string  `json:"type"`
+	Title     string  `json:"title"`
+	Status    int     `json:"status"`
+	Code      string  `json:"code"`
+	Detail    string  `json:"detail,omitempty"`
+	RequestID string  `json:"request_id,omitempty"`
+	Errors    []Error `json:"errors,omitempty"`
 }
 
 func (e ErrorResponse) Error() string {
 	var b bytes.Buffer
+	b.WriteString(e.Code)
+	if e.Detail != "" {
+		b.WriteString(": " + e.Detail)
+	}
 	for _, err := range e.Errors {
-		b.WriteString(fmt.Sprintf("message: %v, field: %v", err.Message, err.Field))
+		b.WriteString(fmt.Sprintf(", message: %v, field: %v", err.Message, err.Field))
 	}
 	return b.String()
 }
 
+// Error is one problem with a request. Field is the path of the offending
+// field, such as metadata.genres[1], and Code identifies the problem for
+// machines. Pointer is the JSON pointer to the offending value of a JSON
+// body, such as /metadata/genres/1, when it is known.
 type Error struct {
 	Message string `json:"message"`
 	Field   string `json:"field,omitempty"`
+	Pointer string `json:"pointer,omitempty"`
+	Code    string `json:"code,omitempty"`
+}
+
+// NewProblem starts the problem document of an error response to be written
+// to w, with the id of the request if w carries one
+func NewProblem(w http.ResponseWriter, code string, httpStatus int) ErrorResponse {
+	return ErrorResponse{
+		Type:      "about:blank",
+		Title:     http.StatusText(httpStatus),
+		Status:    httpStatus,
+		Code:      code,
+		RequestID: w.Header().Get(RequestIDHeader),
+	}
 }
 
 func Respond(w http.ResponseWriter, httpStatus int) error {
@@ -29,25 +91,58 @@ func Respond(w http.ResponseWriter, httpStatus int) error {
 	return nil
 }
 
+// RespondResult responds with i as JSON
 func RespondResult(w http.ResponseWriter, i interface{}, httpStatus int) error {
-	w.WriteHeader(httpStatus)
-	return json.NewEncoder(w).Encode(i)
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(i); err != nil {
+		return err
+	}
+	return respondBody(w, JSONType, b.Bytes(), httpStatus)
 }
 
-func RespondError(w http.ResponseWriter, message, field string, httpStatus int) error {
-	w.WriteHeader(httpStatus)
-	return json.NewEncoder(w).Encode(&ErrorResponse{
-		Errors: []Error{
-			Error{
-				Message: message,
-				Field:   field,
-			},
-		}})
+// RespondHTML responds with the page t renders from data
+func RespondHTML(w http.ResponseWriter, t *template.Template, data interface{}, httpStatus int) error {
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return err
+	}
+	return respondBody(w, HTMLType+"; charset=utf-8", b.Bytes(), httpStatus)
+}
+
+// RespondProblem writes a problem document started by NewProblem, which may
+// be embedded in a struct with more members
+func RespondProblem(w http.ResponseWriter, problem interface{}, httpStatus int) error {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(problem); err != nil {
+		return err
+	}
+	return respondBody(w, ProblemType, b.Bytes(), httpStatus)
 }
 
-func RespondErrors(w http.ResponseWriter, errors []Error, httpStatus int) error {
+// respondBody sends a body whose length is known up front
+func respondBody(w http.ResponseWriter, contentType string, body []byte, httpStatus int) error {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
 	w.WriteHeader(httpStatus)
-	return json.NewEncoder(w).Encode(&ErrorResponse{
-		Errors: errors,
-	})
+	_, err := w.Write(body)
+	return err
+}
+
+// RespondError responds with a problem explained by message. When the
+// problem is with a field the message is also listed as that field's error.
+func RespondError(w http.ResponseWriter, code, message, field string, httpStatus int) error {
+	problem := NewProblem(w, code, httpStatus)
+	problem.Detail = message
+	if field != "" {
+		problem.Errors = []Error{{Message: message, Field: field}}
+	}
+	return RespondProblem(w, &problem, httpStatus)
+}
+
+// RespondErrors responds with a problem listing the errors of the request's
+// fields
+func RespondErrors(w http.ResponseWriter, code string, errors []Error, httpStatus int) error {
+	problem := NewProblem(w, code, httpStatus)
+	problem.Errors = errors
+	return RespondProblem(w, &problem, httpStatus)
 }
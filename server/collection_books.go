@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-pg/pg"
+	"github.com/labstack/gommon/log"
+
+	"github.com/john-cai/book-manager/models"
+	"github.com/john-cai/book-manager/responder"
+)
+
+// The handlers of /api/v2 that treat the books of a collection as resources
+// of their own, at /collections/{collection}/books
+
+// ViewCollectionBooks lists the books of a collection
+func (s *Server) ViewCollectionBooks(w http.ResponseWriter, r *http.Request) {
+	collection, ok := s.collectionParam(w, r)
+	if !ok {
+		return
+	}
+	books := &models.BookList{Total: len(collection.Books), Results: collection.Books}
+	if books.Results == nil {
+		books.Results = []models.Book{}
+	}
+	if err := respondBookList(w, r, books); err != nil {
+		log.Errorf("error when responding with 200 error: %v", err)
+	}
+}
+
+// CollectionBooksPayload lists the books to add to a collection
+type CollectionBooksPayload struct {
+	ISBNs []string `json:"isbns"`
+}
+
+// AddCollectionBooks adds books to a collection in bulk, like
+// AddBooksToCollection
+func (s *Server) AddCollectionBooks(w http.ResponseWriter, r *http.Request) {
+	var payload CollectionBooksPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		if err = responder.RespondError(w, responder.CodeMalformedRequest, "could not read request", "", http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
+	s.changeMemberships(w, r, "isbns", payload.ISBNs, s.database.AddBooksToCollection)
+}
+
+// AddCollectionBook puts a book in a collection, answering 201 when it was
+// not in it yet and 200 when it already was
+func (s *Server) AddCollectionBook(w http.ResponseWriter, r *http.Request) {
+	result, ok := s.changeMembership(w, r, s.database.AddBooksToCollection)
+	if !ok {
+		return
+	}
+	status := http.StatusOK
+	if result.Status == models.MembershipAdded {
+		status = http.StatusCreated
+	}
+	if err := respond(w, r, result, status); err != nil {
+		log.Errorf("error when responding with %d error: %v", status, err)
+	}
+}
+
+// RemoveCollectionBook takes a book out of a collection, answering 404 when
+// it is not in it
+func (s *Server) RemoveCollectionBook(w http.ResponseWriter, r *http.Request) {
+	result, ok := s.changeMembership(w, r, s.database.RemoveBooksFromCollection)
+	if !ok {
+		return
+	}
+	if err := respond(w, r, result, http.StatusOK); err != nil {
+		log.Errorf("error when responding with 200 error: %v", err)
+	}
+}
+
+// changeMembership adds or removes the book of the isbn route variable to or
+// from the collection of the collection route variable, responding itself
+// unless that succeeded
+func (s *Server) changeMembership(w http.ResponseWriter, r *http.Request, change func(*models.Collection, []string, bool) (*models.MembershipReport, error)) (models.MembershipResult, bool) {
+	isbn, ok := isbnParam(w, r)
+	if !ok {
+		return models.MembershipResult{}, false
+	}
+	collection, ok := s.collectionParam(w, r)
+	if !ok {
+		return models.MembershipResult{}, false
+	}
+	report, err := change(collection, []string{isbn}, true)
+	if err != nil {
+		if err == pg.ErrNoRows {
+			if err = responder.RespondError(w, responder.CodeNotFound, "this collection does not exist", "collection", http.StatusNotFound); err != nil {
+				log.Errorf("error when responding with 404 error: %v", err)
+			}
+			return models.MembershipResult{}, false
+		}
+		log.Errorf("error when changing the books of collection %d: %v", collection.ID, err)
+		if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
+			log.Errorf("error when responding with 500 error: %v", err)
+		}
+		return models.MembershipResult{}, false
+	}
+
+	result := report.Results[0]
+	message := ""
+	switch result.Status {
+	case models.MembershipNotFound:
+		message = "this book does not exist"
+	case models.MembershipNotMember:
+		message = "this book is not in the collection"
+	default:
+		return result, true
+	}
+	if err = responder.RespondError(w, responder.CodeNotFound, message, "isbn", http.StatusNotFound); err != nil {
+		log.Errorf("error when responding with 404 error: %v", err)
+	}
+	return result, false
+}
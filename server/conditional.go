@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/gommon/log"
+
+	"github.com/john-cai/book-manager/database"
+	"github.com/john-cai/book-manager/models"
+	"github.com/john-cai/book-manager/responder"
+)
+
+// etag is the entity tag of a version of a book or collection
+func etag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// representationTag is the entity tag of a version in the media type
+// negotiated for r. JSON, which edits are matched against, has the version's
+// own tag, and the other types a weak tag of their own, so a cached page is
+// never taken for the JSON of the same version.
+func representationTag(r *http.Request, version int) string {
+	mediaType := responseType(r)
+	if mediaType == responder.JSONType {
+		return etag(version)
+	}
+	return fmt.Sprintf(`W/"%d-%s"`, version, mediaType[strings.Index(mediaType, "/")+1:])
+}
+
+// matchesETag reports whether an If-Match or If-None-Match header lists tag,
+// or is *. Weak tags only match when weak is set, as If-None-Match allows.
+func matchesETag(header, tag string, weak bool) bool {
+	if weak {
+		tag = strings.TrimPrefix(tag, "W/")
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified answers 304 when the client's If-None-Match already has the
+// given version in the negotiated media type, and otherwise sets the ETag for
+// the response to come
+func notModified(w http.ResponseWriter, r *http.Request, version int) bool {
+	tag := representationTag(r, version)
+	w.Header().Set("ETag", tag)
+	if header := r.Header.Get("If-None-Match"); header != "" && matchesETag(header, tag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// ifMatch checks an edit's If-Match header against the version it is about
+// to overwrite, answering 412 when it does not match and 428 when it is
+// missing and the server requires it. It returns the version the edit has
+// to be saved over, zero when the edit is unconditional.
+func (s *Server) ifMatch(w http.ResponseWriter, r *http.Request, version int) (int, bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		if !s.requireIfMatch {
+			return 0, true
+		}
+		err := responder.RespondErrors(w, responder.CodePreconditionRequired, []responder.Error{{
+			Field:   "If-Match",
+			Code:    models.CodeIfMatch,
+			Message: "send the ETag of the version being edited",
+		}}, http.StatusPreconditionRequired)
+		if err != nil {
+			log.Errorf("error when responding with 428 error: %v", err)
+		}
+		return 0, false
+	}
+	if !matchesETag(header, etag(version), false) {
+		respondVersionConflict(w)
+		return 0, false
+	}
+	return version, true
+}
+
+// respondVersionConflict answers 412 to an edit of a stale version
+func respondVersionConflict(w http.ResponseWriter) {
+	err := responder.RespondErrors(w, responder.CodeVersionConflict, []responder.Error{{
+		Field:   "If-Match",
+		Code:    models.CodeConflict,
+		Message: database.ErrVersionConflict.Error(),
+	}}, http.StatusPreconditionFailed)
+	if err != nil {
+		log.Errorf("error when responding with 412 error: %v", err)
+	}
+}
@@ -0,0 +1,313 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/gommon/log"
+
+	"github.com/john-cai/book-manager/database"
+	"github.com/john-cai/book-manager/models"
+	"github.com/john-cai/book-manager/responder"
+)
+
+// exportPageSize is how many books an export reads from the store at a time
+const exportPageSize = 500
+
+// ExportBooks streams every book matching the filters of ViewBooks as CSV or
+// JSON Lines, a page at a time, as the format parameter or else the Accept
+// header says. The CSV columns are the ones ImportBooks reads, so an export
+// can be imported again.
+func (s *Server) ExportBooks(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var books bookWriter
+	format := r.FormValue("format")
+	if format == "" && responseType(r) == responder.CSVType {
+		format = "csv"
+	}
+	switch format {
+	case "", "jsonl":
+		format, books = "jsonl", newJSONLinesBookWriter(w)
+	case "csv":
+		books = newCSVBookWriter(w)
+	default:
+		if err = responder.RespondError(w, responder.CodeValidationFailed, `must be "csv" or "jsonl"`, "format", http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
+
+	filter, filterErrs := parseBookFilter(r)
+	if len(filterErrs) > 0 {
+		if err = responder.RespondErrors(w, responder.CodeValidationFailed, filterErrs, http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
+	sort, err := database.ParseBookSort(r.FormValue("sort"))
+	if err != nil {
+		if err = responder.RespondError(w, responder.CodeValidationFailed, err.Error(), "sort", http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
+	query := r.FormValue("q")
+	if query != "" && len(sort) > 0 {
+		if err = responder.RespondError(w, responder.CodeValidationFailed, "cannot be combined with q, search results are ordered by rank", "sort", http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
+
+	page := database.Page{Limit: exportPageSize, Sort: sort}
+	nextPage := func() (*models.BookList, error) {
+		if query != "" {
+			return s.database.SearchBooks(query, filter, page)
+		}
+		return s.database.GetBooks(filter, page)
+	}
+	// the first page is read before anything is sent, so that what is wrong
+	// with the request can still be reported
+	list, err := nextPage()
+	if err != nil {
+		if err == database.ErrEmptySearch {
+			if err = responder.RespondError(w, responder.CodeValidationFailed, "must contain at least one word", "q", http.StatusBadRequest); err != nil {
+				log.Errorf("error when responding with 400 error: %v", err)
+			}
+			return
+		}
+		log.Errorf("error when exporting books: %v", err)
+		if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
+			log.Errorf("error when responding with 500 error: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", exportTypes[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="books.%s"`, format))
+	for {
+		for i := range list.Results {
+			if err = books.write(&list.Results[i]); err != nil {
+				log.Errorf("error when exporting books: %v", err)
+				return
+			}
+		}
+		if err = books.flush(); err != nil {
+			log.Errorf("error when exporting books: %v", err)
+			return
+		}
+		if list.NextCursor == "" {
+			return
+		}
+		page.Cursor = list.NextCursor
+		if list, err = nextPage(); err != nil {
+			// the status has been sent, so the export is simply cut short
+			log.Errorf("error when exporting books: %v", err)
+			return
+		}
+	}
+}
+
+// exportTypes are the media types of the export formats
+var exportTypes = map[string]string{
+	"csv":   responder.CSVType,
+	"jsonl": responder.JSONLinesType,
+}
+
+// bookWriter writes the books of an export one at a time
+type bookWriter interface {
+	write(b *models.Book) error
+	// flush sends what has been written so far
+	flush() error
+}
+
+type csvBookWriter struct {
+	w      http.ResponseWriter
+	writer *csv.Writer
+	header bool
+}
+
+func newCSVBookWriter(w http.ResponseWriter) *csvBookWriter {
+	return &csvBookWriter{w: w, writer: csv.NewWriter(w)}
+}
+
+func (b *csvBookWriter) write(book *models.Book) error {
+	if err := b.writeHeader(); err != nil {
+		return err
+	}
+	return b.writer.Write([]string{
+		book.ISBN,
+		book.Title,
+		book.Author,
+		book.Description,
+		book.PublishedDate(),
+		strings.Join(book.Metadata.Genres, ","),
+	})
+}
+
+// writeHeader starts the export with its header, which even an empty export
+// has
+func (b *csvBookWriter) writeHeader() error {
+	if b.header {
+		return nil
+	}
+	b.header = true
+	return b.writer.Write(csvFields)
+}
+
+func (b *csvBookWriter) flush() error {
+	if err := b.writeHeader(); err != nil {
+		return err
+	}
+	b.writer.Flush()
+	if err := b.writer.Error(); err != nil {
+		return err
+	}
+	flushResponse(b.w)
+	return nil
+}
+
+type jsonLinesBookWriter struct {
+	w       http.ResponseWriter
+	encoder *json.Encoder
+}
+
+func newJSONLinesBookWriter(w http.ResponseWriter) *jsonLinesBookWriter {
+	return &jsonLinesBookWriter{w: w, encoder: json.NewEncoder(w)}
+}
+
+func (b *jsonLinesBookWriter) write(book *models.Book) error {
+	return b.encoder.Encode(book)
+}
+
+func (b *jsonLinesBookWriter) flush() error {
+	flushResponse(b.w)
+	return nil
+}
+
+// flushResponse sends what has been written to w so far, when w can do that
+func flushResponse(w http.ResponseWriter) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// ExportFull streams a full backup of the catalog, the trash included, as
+// JSON Lines: a models.BackupHeader, a models.BackupRecord for each row and
+// a closing record with the End of the backup
+func (s *Server) ExportFull(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", responder.JSONLinesType)
+	w.Header().Set("Content-Disposition", `attachment; filename="book-manager-backup.jsonl"`)
+	encoder := json.NewEncoder(w)
+	header := models.BackupHeader{Format: models.BackupFormat, Version: models.BackupVersion, CreatedAt: time.Now().UTC()}
+	if err := encoder.Encode(&header); err != nil {
+		log.Errorf("error when exporting backup: %v", err)
+		return
+	}
+	records := 0
+	err := s.database.Backup(func(record models.BackupRecord) error {
+		records++
+		return encoder.Encode(&record)
+	})
+	if err != nil {
+		// without its end the backup cannot be restored
+		log.Errorf("error when exporting backup: %v", err)
+		return
+	}
+	if err = encoder.Encode(&models.BackupRecord{End: &models.BackupEnd{Records: records}}); err != nil {
+		log.Errorf("error when exporting backup: %v", err)
+	}
+}
+
+// backupError is what is wrong with one record of a backup being restored
+type backupError struct {
+	record  int
+	message string
+}
+
+func (e *backupError) Error() string {
+	return fmt.Sprintf("record %d: %s", e.record, e.message)
+}
+
+// ImportFull restores a backup written by ExportFull into an empty catalog.
+// Nothing is kept unless the whole backup, up to its end, is restored.
+func (s *Server) ImportFull(w http.ResponseWriter, r *http.Request) {
+	var err error
+	decoder := json.NewDecoder(r.Body)
+	var header models.BackupHeader
+	if err = decoder.Decode(&header); err != nil || header.Format != models.BackupFormat {
+		if err = responder.RespondError(w, responder.CodeInvalidBackup, "not a book manager backup", "", http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
+	if header.Version < 1 || header.Version > models.BackupVersion {
+		if err = responder.RespondError(w, responder.CodeInvalidBackup, fmt.Sprintf("backup version %d is not supported, at most %d is", header.Version, models.BackupVersion), "version", http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
+
+	var summary models.BackupSummary
+	records := 0
+	next := func() (models.BackupRecord, error) {
+		var record models.BackupRecord
+		if err := decoder.Decode(&record); err != nil {
+			if err == io.EOF {
+				return record, &backupError{record: records + 1, message: "the backup ends before its end record, it is incomplete"}
+			}
+			return record, &backupError{record: records + 1, message: "is not a backup record: " + err.Error()}
+		}
+		if record.End != nil {
+			if record.End.Records != records {
+				return record, &backupError{record: records + 1, message: fmt.Sprintf("the backup says it has %d records but %d were read", record.End.Records, records)}
+			}
+			return record, io.EOF
+		}
+		records++
+		if backupRecordKinds(record) != 1 {
+			return record, &backupError{record: records, message: "must hold exactly one of book, collection, membership or event"}
+		}
+		summary.Add(record)
+		return record, nil
+	}
+
+	err = s.database.Restore(next)
+	if recordErr, ok := err.(*backupError); ok {
+		if err = responder.RespondError(w, responder.CodeInvalidBackup, recordErr.Error(), "", http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
+	if err == database.ErrNotEmpty {
+		if err = responder.RespondError(w, responder.CodeNotEmpty, "a backup can only be restored into an empty catalog", "", http.StatusConflict); err != nil {
+			log.Errorf("error when responding with 409 error: %v", err)
+		}
+		return
+	}
+	if err != nil {
+		log.Errorf("error when restoring backup: %v", err)
+		if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
+			log.Errorf("error when responding with 500 error: %v", err)
+		}
+		return
+	}
+	if err = respond(w, r, &summary, http.StatusOK); err != nil {
+		log.Errorf("error when responding with 200 error: %v", err)
+	}
+}
+
+func backupRecordKinds(record models.BackupRecord) int {
+	kinds := 0
+	for _, set := range []bool{record.Book != nil, record.Collection != nil, record.Membership != nil, record.Event != nil} {
+		if set {
+			kinds++
+		}
+	}
+	return kinds
+}
@@ -2,13 +2,18 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-pg/pg"
 	"github.com/gorilla/mux"
 	"github.com/labstack/gommon/log"
 
+	"github.com/john-cai/book-manager/database"
 	"github.com/john-cai/book-manager/models"
 	"github.com/john-cai/book-manager/responder"
 )
@@ -17,89 +22,265 @@ func (s *Server) AddBook(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var book models.Book
 	if err = json.NewDecoder(r.Body).Decode(&book); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("could not read request"))
+		if err = responder.RespondError(w, responder.CodeMalformedRequest, "could not read request", "", http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
 		return
 	}
+	book.ClearReadOnly()
 	var validationErrs []responder.Error
 	if validationErrs = models.ValidateBook(book); len(validationErrs) > 0 {
-		if err = responder.RespondErrors(w, validationErrs, http.StatusBadRequest); err != nil {
+		if err = responder.RespondErrors(w, responder.CodeValidationFailed, validationErrs, http.StatusBadRequest); err != nil {
 			log.Errorf("error when responding with 400 error: %v", err)
 		}
 		return
 	}
+	book.Normalize()
 	// check if the isbn is already in our system
 	if _, err := s.database.GetBookByISBN(book.ISBN); err == nil {
-		if err = responder.RespondErrors(w, []responder.Error{responder.Error{Message: "this isbn already exists", Field: "isbn"}}, http.StatusBadRequest); err != nil {
-			log.Errorf("error when responding with 400 error: %v", err)
+		if err = responder.RespondErrors(w, responder.CodeISBNConflict, []responder.Error{{Message: "this isbn already exists", Field: "isbn", Code: models.CodeDuplicate}}, http.StatusConflict); err != nil {
+			log.Errorf("error when responding with 409 error: %v", err)
 		}
 		return
 	}
 
 	if err = s.database.AddBook(&book); err != nil {
+		if err == database.ErrDuplicateISBN {
+			// the live books were checked above, so the isbn is held by a
+			// book in the trash
+			problem := responder.NewProblem(w, responder.CodeISBNConflict, http.StatusConflict)
+			problem.Detail = fmt.Sprintf("restore it with POST %s/%s/restore", strings.TrimSuffix(r.URL.Path, "/"), book.ISBN)
+			problem.Errors = []responder.Error{{Message: "a book with this isbn is in the trash", Field: "isbn", Code: models.CodeDuplicate}}
+			if err = responder.RespondProblem(w, &problem, http.StatusConflict); err != nil {
+				log.Errorf("error when responding with 409 error: %v", err)
+			}
+			return
+		}
 		log.Errorf("error when adding book: %v", err)
-		if err = responder.RespondError(w, "something went wrong", "", http.StatusInternalServerError); err != nil {
+		if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
 			log.Errorf("error when responding with 500 error %v", err)
 		}
 		return
 	}
 
-	if err = responder.RespondResult(w, &book, http.StatusCreated); err != nil {
+	w.Header().Set("ETag", etag(book.Version))
+	if err = respond(w, r, &book, http.StatusCreated); err != nil {
 		log.Errorf("error when responding with 201 error %v", err)
 	}
 }
 
-func (s *Server) ViewBook(w http.ResponseWriter, r *http.Request) {
-	var err error
-	vars := mux.Vars(r)
-	isbn := vars["isbn"]
+// isbnParam reads the isbn route variable as a canonical ISBN-13, responding
+// with a 400 when it is not a valid ISBN-10 or ISBN-13
+func isbnParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	isbn, err := models.NormalizeISBN(mux.Vars(r)["isbn"])
+	if err != nil {
+		if err = responder.RespondError(w, responder.CodeValidationFailed, err.Error(), "isbn", http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return "", false
+	}
+	return isbn, true
+}
 
-	var book *models.Book
-	if book, err = s.database.GetBookByISBN(isbn); err != nil {
+// bookParam looks up the book named by the isbn route variable, responding
+// 404 when there is none
+func (s *Server) bookParam(w http.ResponseWriter, r *http.Request) (*models.Book, bool) {
+	isbn, ok := isbnParam(w, r)
+	if !ok {
+		return nil, false
+	}
+	book, err := s.database.GetBookByISBN(isbn)
+	if err != nil {
 		if err == pg.ErrNoRows {
-			if err = responder.RespondError(w, "", "", http.StatusNotFound); err != nil {
-				log.Errorf("error when responding with 400 error: %v", err)
+			if err = responder.RespondError(w, responder.CodeNotFound, "", "", http.StatusNotFound); err != nil {
+				log.Errorf("error when responding with 404 error: %v", err)
 			}
-			return
+			return nil, false
 		}
-		if err = responder.RespondError(w, "something went wrong", "", http.StatusInternalServerError); err != nil {
+		if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
 			log.Errorf("error when responding with 500 error: %v", err)
 		}
+		return nil, false
+	}
+	return book, true
+}
+
+func (s *Server) ViewBook(w http.ResponseWriter, r *http.Request) {
+	var err error
+	book, ok := s.bookParam(w, r)
+	if !ok {
+		return
+	}
+	if notModified(w, r, book.Version) {
 		return
 	}
-	if err = responder.RespondResult(w, &book, http.StatusOK); err != nil {
-		log.Errorf("error when responding with 200 error: ", err)
+	if err = respond(w, r, book, http.StatusOK); err != nil {
+		log.Errorf("error when responding with 200 error: %v", err)
+	}
+}
+
+// parsePage reads the limit, cursor and sort query parameters, using
+// parseSort to check the sort against the listing's sortable fields
+func (s *Server) parsePage(r *http.Request, parseSort func(string) ([]database.SortField, error)) (database.Page, []responder.Error) {
+	page := database.Page{
+		Limit:  defaultPageSize,
+		Cursor: r.FormValue("cursor"),
+	}
+	if s.maxPageSize < page.Limit {
+		page.Limit = s.maxPageSize
+	}
+	if r.FormValue("limit") != "" {
+		limit, err := strconv.Atoi(r.FormValue("limit"))
+		if err != nil || limit < 1 {
+			return page, []responder.Error{responder.Error{Field: "limit", Code: models.CodeInvalid, Message: "must be a positive number"}}
+		}
+		if limit > s.maxPageSize {
+			return page, []responder.Error{responder.Error{Field: "limit", Code: models.CodeInvalid, Message: fmt.Sprintf("exceeds maximum of %d", s.maxPageSize)}}
+		}
+		page.Limit = limit
+	}
+	sort, err := parseSort(r.FormValue("sort"))
+	if err != nil {
+		return page, []responder.Error{responder.Error{Field: "sort", Code: models.CodeInvalid, Message: err.Error()}}
+	}
+	page.Sort = sort
+	return page, nil
+}
+
+// normalizeISBN canonicalizes isbn when it is valid, and otherwise returns
+// it untouched so it simply matches nothing
+func normalizeISBN(isbn string) string {
+	if normalized, err := models.NormalizeISBN(isbn); err == nil {
+		return normalized
 	}
+	return isbn
+}
+
+// parseList splits a comma separated parameter, dropping blanks and repeats
+func parseList(param string) []string {
+	var values []string
+	seen := make(map[string]bool)
+	for _, v := range strings.Split(param, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" || seen[v] {
+			continue
+		}
+		seen[v] = true
+		values = append(values, v)
+	}
+	return values
+}
+
+// parseBookFilter reads the filters of a book listing
+func parseBookFilter(r *http.Request) (database.BookFilter, []responder.Error) {
+	publishedFrom, publishedTo, errs := parsePublished(r)
+	if len(errs) > 0 {
+		return database.BookFilter{}, errs
+	}
+	genresMatch, err := database.ParseGenreMatch(r.FormValue("genres_match"))
+	if err != nil {
+		return database.BookFilter{}, []responder.Error{responder.Error{Field: "genres_match", Code: models.CodeInvalid, Message: err.Error()}}
+	}
+	return database.BookFilter{
+		ISBN:          normalizeISBN(r.FormValue("isbn")),
+		Title:         r.FormValue("title"),
+		Author:        r.FormValue("author"),
+		PublishedFrom: publishedFrom,
+		PublishedTo:   publishedTo,
+		Genres:        parseList(r.FormValue("genres")),
+		GenresMatch:   genresMatch,
+	}, nil
+}
+
+// parsePublished turns the published, published_from and published_to
+// parameters into a date range. Each takes a YYYY, YYYY-MM or YYYY-MM-DD
+// date, and published_to includes the whole year, month or day it names.
+// published is shorthand for both bounds.
+func parsePublished(r *http.Request) (from, to time.Time, errs []responder.Error) {
+	if v := r.FormValue("published"); v != "" {
+		if r.FormValue("published_from") != "" || r.FormValue("published_to") != "" {
+			return from, to, []responder.Error{responder.Error{Field: "published", Code: models.CodeInvalid, Message: "cannot be combined with published_from or published_to"}}
+		}
+		start, precision, err := models.ParsePartialDate(v)
+		if err != nil {
+			return from, to, []responder.Error{responder.Error{Field: "published", Code: models.CodeInvalid, Message: err.Error()}}
+		}
+		return start, precision.End(start), nil
+	}
+
+	if v := r.FormValue("published_from"); v != "" {
+		start, _, err := models.ParsePartialDate(v)
+		if err != nil {
+			errs = append(errs, responder.Error{Field: "published_from", Code: models.CodeInvalid, Message: err.Error()})
+		}
+		from = start
+	}
+	if v := r.FormValue("published_to"); v != "" {
+		start, precision, err := models.ParsePartialDate(v)
+		if err != nil {
+			errs = append(errs, responder.Error{Field: "published_to", Code: models.CodeInvalid, Message: err.Error()})
+		} else {
+			to = precision.End(start)
+		}
+	}
+	if len(errs) == 0 && !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		errs = append(errs, responder.Error{Field: "published_from", Code: models.CodeInvalid, Message: "must not be after published_to"})
+	}
+	return from, to, errs
 }
 
 func (s *Server) ViewBooks(w http.ResponseWriter, r *http.Request) {
 	var err error
 
-	var books []models.Book
-	var published int
-	if r.FormValue("published") != "" {
-		published, err = strconv.Atoi(r.FormValue("published"))
-		if err != nil {
-			if err = responder.RespondErrors(w, []responder.Error{responder.Error{Field: "published", Message: "not a valid year"}}, http.StatusBadRequest); err != nil {
+	filter, filterErrs := parseBookFilter(r)
+	if len(filterErrs) > 0 {
+		if err = responder.RespondErrors(w, responder.CodeValidationFailed, filterErrs, http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
+	page, pageErrs := s.parsePage(r, database.ParseBookSort)
+	if len(pageErrs) > 0 {
+		if err = responder.RespondErrors(w, responder.CodeValidationFailed, pageErrs, http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
+
+	query := r.FormValue("q")
+	if query != "" && len(page.Sort) > 0 {
+		if err = responder.RespondError(w, responder.CodeValidationFailed, "cannot be combined with q, search results are ordered by rank", "sort", http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
+
+	var books *models.BookList
+	if query != "" {
+		books, err = s.database.SearchBooks(query, filter, page)
+	} else {
+		books, err = s.database.GetBooks(filter, page)
+	}
+	if err != nil {
+		if err == database.ErrInvalidCursor {
+			if err = responder.RespondError(w, responder.CodeValidationFailed, "invalid cursor", "cursor", http.StatusBadRequest); err != nil {
 				log.Errorf("error when responding with 400 error: %v", err)
 			}
 			return
 		}
-	}
-	if books, err = s.database.GetBooks(
-		r.FormValue("isbn"),
-		r.FormValue("title"),
-		r.FormValue("author"),
-		published,
-		[]string{},
-	); err != nil {
-		if err = responder.RespondError(w, "something went wrong", "", http.StatusInternalServerError); err != nil {
+		if err == database.ErrEmptySearch {
+			if err = responder.RespondError(w, responder.CodeValidationFailed, "must contain at least one word", "q", http.StatusBadRequest); err != nil {
+				log.Errorf("error when responding with 400 error: %v", err)
+			}
+			return
+		}
+		if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
 			log.Errorf("error when responding with 500 error: %v", err)
 		}
 		return
 	}
-	if err = responder.RespondResult(w, &books, http.StatusOK); err != nil {
-		log.Errorf("error when responding with 200 error: ", err)
+	if err = respondBookList(w, r, books); err != nil {
+		log.Errorf("error when responding with 200 error: %v", err)
 	}
 }
 
@@ -108,62 +289,222 @@ func (s *Server) EditBook(w http.ResponseWriter, r *http.Request) {
 	var book models.Book
 
 	if err = json.NewDecoder(r.Body).Decode(&book); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("could not read request"))
+		if err = responder.RespondError(w, responder.CodeMalformedRequest, "could not read request", "", http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
+	existing, ok := s.bookParam(w, r)
+	if !ok {
 		return
 	}
-	vars := mux.Vars(r)
-	isbn := vars["isbn"]
-	book.ISBN = isbn
+	book.ISBN = existing.ISBN
+	book.ClearReadOnly()
 
 	var validationErrs []responder.Error
 	if validationErrs = models.ValidateBook(book); len(validationErrs) > 0 {
-		if err = responder.RespondErrors(w, validationErrs, http.StatusBadRequest); err != nil {
+		if err = responder.RespondErrors(w, responder.CodeValidationFailed, validationErrs, http.StatusBadRequest); err != nil {
 			log.Errorf("error when responding with 400 error: %v", err)
 		}
 		return
 	}
+	book.Normalize()
+	book.CreatedAt = existing.CreatedAt
+	if book.Version, ok = s.ifMatch(w, r, existing.Version); !ok {
+		return
+	}
 
 	if err = s.database.UpdateBook(&book); err != nil {
+		if err == database.ErrVersionConflict {
+			respondVersionConflict(w)
+			return
+		}
 		if err == pg.ErrNoRows {
-			if err = responder.RespondError(w, "", "", http.StatusNotFound); err != nil {
+			if err = responder.RespondError(w, responder.CodeNotFound, "", "", http.StatusNotFound); err != nil {
 				log.Errorf("error when responding with 400 error: %v", err)
 			}
 			return
 		}
 		log.Errorf("error when updating book: %v", err)
-		if err = responder.RespondError(w, "something went wrong", "", http.StatusInternalServerError); err != nil {
+		if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
 			log.Errorf("error when responding with 500 error %v", err)
 		}
 		return
 	}
 
-	if err = responder.RespondResult(w, &book, http.StatusOK); err != nil {
+	w.Header().Set("ETag", etag(book.Version))
+	if err = respond(w, r, &book, http.StatusOK); err != nil {
 		log.Errorf("error when responding with 201 error %v", err)
 	}
 }
 
-func (s *Server) RemoveBook(w http.ResponseWriter, r *http.Request) {
+// PatchBook changes only the fields of a book that the merge patch or json
+// patch in the body touches
+func (s *Server) PatchBook(w http.ResponseWriter, r *http.Request) {
 	var err error
-	vars := mux.Vars(r)
-	isbn := vars["isbn"]
+	existing, ok := s.bookParam(w, r)
+	if !ok {
+		return
+	}
+	version, ok := s.ifMatch(w, r, existing.Version)
+	if !ok {
+		return
+	}
+	var fields bookFields
+	if !patchFields(w, r, newBookFields(existing), &fields) {
+		return
+	}
+
+	book := *existing
+	fields.applyTo(&book)
+	var validationErrs []responder.Error
+	if validationErrs = models.ValidateBook(book); len(validationErrs) > 0 {
+		if err = responder.RespondErrors(w, responder.CodeValidationFailed, validationErrs, http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
+	book.Normalize()
 
-	if err = s.database.DeleteBookByISBN(isbn); err != nil {
+	columns, err := changedColumns(newBookFields(existing), newBookFields(&book))
+	if err == nil && len(columns) > 0 {
+		book.Version = version
+		err = s.database.PatchBook(&book, columns)
+	}
+	if err != nil {
+		if err == database.ErrVersionConflict {
+			respondVersionConflict(w)
+			return
+		}
 		if err == pg.ErrNoRows {
-			if err = responder.RespondError(w, "", "", http.StatusNotFound); err != nil {
-				log.Errorf("error when responding with 400 error: %v", err)
+			if err = responder.RespondError(w, responder.CodeNotFound, "", "", http.StatusNotFound); err != nil {
+				log.Errorf("error when responding with 404 error: %v", err)
 			}
 			return
 		}
+		log.Errorf("error when patching book: %v", err)
+		if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
+			log.Errorf("error when responding with 500 error %v", err)
+		}
+		return
+	}
 
-		if err = responder.RespondError(w, "something went wrong", "", http.StatusInternalServerError); err != nil {
-			log.Errorf("error when responding with 500 error: %v", err)
+	w.Header().Set("ETag", etag(book.Version))
+	if err = respond(w, r, &book, http.StatusOK); err != nil {
+		log.Errorf("error when responding with 200 error %v", err)
+	}
+}
+
+func (s *Server) RemoveBook(w http.ResponseWriter, r *http.Request) {
+	var err error
+	isbn, ok := isbnParam(w, r)
+	if !ok {
+		return
+	}
+	purge, ok := purgeParam(w, r)
+	if !ok {
+		return
+	}
+
+	if purge {
+		if err = s.database.PurgeBook(isbn); err != nil {
+			respondDeleteError(w, err)
+			return
+		}
+		if err = responder.Respond(w, http.StatusOK); err != nil {
+			log.Errorf("error when responding with 200 error: %v", err)
 		}
 		return
 	}
 
-	if err = responder.Respond(w, http.StatusOK); err != nil {
-		log.Errorf("error when responding with 200 error: ", err)
+	collections, err := s.database.DeleteBookByISBN(isbn, s.deletePolicy)
+	if err == database.ErrDeleteRestricted {
+		respondDeleteRestricted(w, "isbn", &models.DeleteReport{Policy: string(s.deletePolicy), Collections: collections})
+		return
+	}
+	if err != nil {
+		respondDeleteError(w, err)
+		return
+	}
+
+	report := &models.DeleteReport{Policy: string(s.deletePolicy), Collections: collections}
+	if err = respond(w, r, report, http.StatusOK); err != nil {
+		log.Errorf("error when responding with 200 error: %v", err)
+	}
+}
+
+// respondDeleteError answers a failed delete or purge: 404 when there was
+// nothing to delete
+func respondDeleteError(w http.ResponseWriter, err error) {
+	if err == pg.ErrNoRows {
+		if err = responder.RespondError(w, responder.CodeNotFound, "", "", http.StatusNotFound); err != nil {
+			log.Errorf("error when responding with 404 error: %v", err)
+		}
+		return
+	}
+	if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
+		log.Errorf("error when responding with 500 error: %v", err)
+	}
+}
+
+// respondDeleteRestricted answers a delete blocked by the restrict policy
+// with 409, listing the memberships in the way
+func respondDeleteRestricted(w http.ResponseWriter, field string, report *models.DeleteReport) {
+	problem := responder.NewProblem(w, responder.CodeDeleteRestricted, http.StatusConflict)
+	problem.Errors = []responder.Error{{
+		Field:   field,
+		Code:    models.CodeRestricted,
+		Message: database.ErrDeleteRestricted.Error(),
+	}}
+	err := responder.RespondProblem(w, struct {
+		responder.ErrorResponse
+		*models.DeleteReport
+	}{problem, report}, http.StatusConflict)
+	if err != nil {
+		log.Errorf("error when responding with 409 error: %v", err)
+	}
+}
+
+// collectionParam looks up the collection named by the collection route
+// variable, which is either its numeric id or its name or slug, responding
+// with a 404 when there is no such collection
+func (s *Server) collectionParam(w http.ResponseWriter, r *http.Request) (*models.Collection, bool) {
+	ref := mux.Vars(r)["collection"]
+	var collection *models.Collection
+	var err error
+	err = pg.ErrNoRows
+	if id, convErr := strconv.Atoi(ref); convErr == nil {
+		collection, err = s.database.GetCollectionByID(id)
+	}
+	// names can no longer be all digits, but collections named so before
+	// that are still found by name when no collection has that id
+	if err == pg.ErrNoRows {
+		collection, err = s.database.GetCollectionByName(ref)
+	}
+	if err != nil {
+		if err == pg.ErrNoRows {
+			if err = responder.RespondError(w, responder.CodeNotFound, "this collection does not exist", "collection", http.StatusNotFound); err != nil {
+				log.Errorf("error when responding with 404 error: %v", err)
+			}
+			return nil, false
+		}
+		if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
+			log.Errorf("error when responding with 500 error: %v", err)
+		}
+		return nil, false
+	}
+	return collection, true
+}
+
+// respondDuplicateName reports a collection name that is already taken
+func respondDuplicateName(w http.ResponseWriter) {
+	err := responder.RespondErrors(w, responder.CodeNameConflict, []responder.Error{{
+		Field:   "name",
+		Code:    models.CodeDuplicate,
+		Message: database.ErrDuplicateCollectionName.Error(),
+	}}, http.StatusConflict)
+	if err != nil {
+		log.Errorf("error when responding with 409 error: %v", err)
 	}
 }
 
@@ -171,26 +512,34 @@ func (s *Server) AddCollection(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var collection models.Collection
 	if err = json.NewDecoder(r.Body).Decode(&collection); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("could not read request"))
+		if err = responder.RespondError(w, responder.CodeMalformedRequest, "could not read request", "", http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
 		return
 	}
+	collection.ClearReadOnly()
 	var validationErrs []responder.Error
 	if validationErrs = models.ValidateCollection(collection); len(validationErrs) > 0 {
-		if err = responder.RespondErrors(w, validationErrs, http.StatusBadRequest); err != nil {
+		if err = responder.RespondErrors(w, responder.CodeValidationFailed, validationErrs, http.StatusBadRequest); err != nil {
 			log.Errorf("error when responding with 400 error: %v", err)
 		}
 		return
 	}
+	collection.Normalize()
 
 	if err = s.database.AddCollection(&collection); err != nil {
-		if err = responder.RespondError(w, "something went wrong", "", http.StatusInternalServerError); err != nil {
+		if err == database.ErrDuplicateCollectionName {
+			respondDuplicateName(w)
+			return
+		}
+		if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
 			log.Errorf("error when responding with 500 error %v", err)
 		}
 		return
 	}
 
-	if err = responder.RespondResult(w, &collection, http.StatusCreated); err != nil {
+	w.Header().Set("ETag", etag(collection.Version))
+	if err = respond(w, r, &collection, http.StatusCreated); err != nil {
 		log.Errorf("error when responding with 201 error %v", err)
 	}
 
@@ -198,46 +547,46 @@ func (s *Server) AddCollection(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) ViewCollection(w http.ResponseWriter, r *http.Request) {
 	var err error
-	vars := mux.Vars(r)
-	collectionID, err := strconv.Atoi(vars["collection_id"])
-	if err != nil {
-		responder.RespondError(w, "bad value", "collection_id", http.StatusBadRequest)
+	collection, ok := s.collectionParam(w, r)
+	if !ok {
 		return
 	}
-
-	var collection *models.Collection
-	if collection, err = s.database.GetCollectionByID(collectionID); err != nil {
-		if err == pg.ErrNoRows {
-			if err = responder.RespondError(w, "", "", http.StatusNotFound); err != nil {
-				log.Errorf("error when responding with 400 error: %v", err)
-			}
-			return
-		}
-
-		if err = responder.RespondError(w, "something went wrong", "", http.StatusInternalServerError); err != nil {
-			log.Errorf("error when responding with 500 error: %v", err)
-		}
+	if notModified(w, r, collection.Version) {
 		return
 	}
 
-	if err = responder.RespondResult(w, &collection, http.StatusOK); err != nil {
-		log.Errorf("error when responding with 200 error: ", err)
+	if err = respond(w, r, collection, http.StatusOK); err != nil {
+		log.Errorf("error when responding with 200 error: %v", err)
 	}
 }
 
 func (s *Server) ViewCollections(w http.ResponseWriter, r *http.Request) {
 	var err error
+	page, pageErrs := s.parsePage(r, database.ParseCollectionSort)
+	if len(pageErrs) > 0 {
+		if err = responder.RespondErrors(w, responder.CodeValidationFailed, pageErrs, http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
+
 	//TODO: support being able to filter by book criteria
-	var collections []models.Collection
-	if collections, err = s.database.GetAllCollections(); err != nil {
-		if err = responder.RespondError(w, "something went wrong", "", http.StatusInternalServerError); err != nil {
+	var collections *models.CollectionList
+	if collections, err = s.database.GetAllCollections(page); err != nil {
+		if err == database.ErrInvalidCursor {
+			if err = responder.RespondError(w, responder.CodeValidationFailed, "invalid cursor", "cursor", http.StatusBadRequest); err != nil {
+				log.Errorf("error when responding with 400 error: %v", err)
+			}
+			return
+		}
+		if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
 			log.Errorf("error when responding with 500 error: %v", err)
 		}
 		return
 	}
 
-	if err = responder.RespondResult(w, &collections, http.StatusOK); err != nil {
-		log.Errorf("error when responding with 200 error: ", err)
+	if err = respondCollectionList(w, r, collections); err != nil {
+		log.Errorf("error when responding with 200 error: %v", err)
 	}
 }
 
@@ -245,72 +594,163 @@ func (s *Server) EditCollection(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var collection models.Collection
 	if err = json.NewDecoder(r.Body).Decode(&collection); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("could not read request"))
+		if err = responder.RespondError(w, responder.CodeMalformedRequest, "could not read request", "", http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
 		return
 	}
-	vars := mux.Vars(r)
-	collectionName := vars["collection_name"]
-	collection.Name = collectionName
+	existing, ok := s.collectionParam(w, r)
+	if !ok {
+		return
+	}
+	collection.ID = existing.ID
+	collection.ClearReadOnly()
+	collection.CreatedAt = existing.CreatedAt
 
 	var validationErrs []responder.Error
 	if validationErrs = models.ValidateCollection(collection); len(validationErrs) > 0 {
-		if err = responder.RespondErrors(w, validationErrs, http.StatusBadRequest); err != nil {
+		if err = responder.RespondErrors(w, responder.CodeValidationFailed, validationErrs, http.StatusBadRequest); err != nil {
 			log.Errorf("error when responding with 400 error: %v", err)
 		}
 		return
 	}
+	collection.Normalize()
+	if collection.Version, ok = s.ifMatch(w, r, existing.Version); !ok {
+		return
+	}
 
 	if err = s.database.UpdateCollection(&collection); err != nil {
+		if err == database.ErrVersionConflict {
+			respondVersionConflict(w)
+			return
+		}
+		if err == database.ErrDuplicateCollectionName {
+			respondDuplicateName(w)
+			return
+		}
 		if err == pg.ErrNoRows {
-			if err = responder.RespondError(w, "", "", http.StatusNotFound); err != nil {
+			if err = responder.RespondError(w, responder.CodeNotFound, "", "", http.StatusNotFound); err != nil {
 				log.Errorf("error when responding with 400 error: %v", err)
 			}
 			return
 		}
 
-		if err = responder.RespondError(w, "something went wrong", "", http.StatusInternalServerError); err != nil {
+		if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
 			log.Errorf("error when responding with 500 error %v", err)
 		}
 		return
 	}
 
-	if err = responder.RespondResult(w, &collection, http.StatusCreated); err != nil {
+	w.Header().Set("ETag", etag(collection.Version))
+	if err = respond(w, r, &collection, http.StatusCreated); err != nil {
 		log.Errorf("error when responding with 201 error %v", err)
 	}
 }
 
-func (s *Server) RemoveCollection(w http.ResponseWriter, r *http.Request) {
+// PatchCollection changes only the name or description of a collection,
+// like PatchBook
+func (s *Server) PatchCollection(w http.ResponseWriter, r *http.Request) {
 	var err error
-	vars := mux.Vars(r)
-
-	collectionID, err := strconv.Atoi(vars["collection_id"])
-	if err != nil {
-		responder.RespondError(w, "bad value", "collection_id", http.StatusBadRequest)
+	existing, ok := s.collectionParam(w, r)
+	if !ok {
 		return
 	}
-	var collection models.Collection
-	if err = json.NewDecoder(r.Body).Decode(&collection); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("could not read request"))
+	version, ok := s.ifMatch(w, r, existing.Version)
+	if !ok {
+		return
+	}
+	var fields collectionFields
+	if !patchFields(w, r, newCollectionFields(existing), &fields) {
+		return
+	}
+
+	collection := *existing
+	fields.applyTo(&collection)
+	var validationErrs []responder.Error
+	if validationErrs = models.ValidateCollection(collection); len(validationErrs) > 0 {
+		if err = responder.RespondErrors(w, responder.CodeValidationFailed, validationErrs, http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
 		return
 	}
-	if err = s.database.DeleteCollectionByID(collectionID); err != nil {
+	collection.Normalize()
+
+	columns, err := changedColumns(newCollectionFields(existing), newCollectionFields(&collection))
+	if err == nil && len(columns) > 0 {
+		collection.Version = version
+		err = s.database.PatchCollection(&collection, columns)
+	}
+	if err != nil {
+		if err == database.ErrVersionConflict {
+			respondVersionConflict(w)
+			return
+		}
+		if err == database.ErrDuplicateCollectionName {
+			respondDuplicateName(w)
+			return
+		}
 		if err == pg.ErrNoRows {
-			if err = responder.RespondError(w, "", "", http.StatusNotFound); err != nil {
-				log.Errorf("error when responding with 400 error: %v", err)
+			if err = responder.RespondError(w, responder.CodeNotFound, "", "", http.StatusNotFound); err != nil {
+				log.Errorf("error when responding with 404 error: %v", err)
 			}
 			return
 		}
+		if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
+			log.Errorf("error when responding with 500 error %v", err)
+		}
+		return
+	}
 
-		if err = responder.RespondError(w, "something went wrong", "", http.StatusInternalServerError); err != nil {
-			log.Errorf("error when responding with 500 error: %v", err)
+	w.Header().Set("ETag", etag(collection.Version))
+	if err = respond(w, r, &collection, http.StatusOK); err != nil {
+		log.Errorf("error when responding with 200 error %v", err)
+	}
+}
+
+func (s *Server) RemoveCollection(w http.ResponseWriter, r *http.Request) {
+	var err error
+	purge, ok := purgeParam(w, r)
+	if !ok {
+		return
+	}
+
+	if purge {
+		// collections in the trash can only be purged by id
+		id, err := strconv.Atoi(mux.Vars(r)["collection"])
+		if err != nil {
+			collection, ok := s.collectionParam(w, r)
+			if !ok {
+				return
+			}
+			id = collection.ID
+		}
+		if err = s.database.PurgeCollection(id); err != nil {
+			respondDeleteError(w, err)
+			return
+		}
+		if err = responder.Respond(w, http.StatusOK); err != nil {
+			log.Errorf("error when responding with 200 error: %v", err)
 		}
 		return
 	}
 
-	if err = responder.Respond(w, http.StatusOK); err != nil {
-		log.Errorf("error when responding with 200 error: ", err)
+	collection, ok := s.collectionParam(w, r)
+	if !ok {
+		return
+	}
+	books, err := s.database.DeleteCollectionByID(collection.ID, s.deletePolicy)
+	if err == database.ErrDeleteRestricted {
+		respondDeleteRestricted(w, "collection", &models.DeleteReport{Policy: string(s.deletePolicy), Books: books})
+		return
+	}
+	if err != nil {
+		respondDeleteError(w, err)
+		return
+	}
+
+	report := &models.DeleteReport{Policy: string(s.deletePolicy), Books: books}
+	if err = respond(w, r, report, http.StatusOK); err != nil {
+		log.Errorf("error when responding with 200 error: %v", err)
 	}
 }
 
@@ -318,109 +758,233 @@ type AddBooksPayload struct {
 	BooksToAdd []string `json:"books_to_add"`
 }
 
-func sliceToMap(books []models.Book) map[string]struct{} {
-	m := make(map[string]struct{})
-	for _, book := range books {
-		m[book.ISBN] = struct{}{}
+func (s *Server) AddBooksToCollection(w http.ResponseWriter, r *http.Request) {
+	var payload AddBooksPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		if err = responder.RespondError(w, responder.CodeMalformedRequest, "could not read request", "", http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
 	}
-	return m
+	s.changeMemberships(w, r, "books_to_add", payload.BooksToAdd, s.database.AddBooksToCollection)
 }
 
-func (s *Server) AddBooksToCollection(w http.ResponseWriter, r *http.Request) {
+type RemoveBooksPayload struct {
+	BooksToRemove []string `json:"books_to_remove"`
+}
+
+func (s *Server) RemoveBooksFromCollection(w http.ResponseWriter, r *http.Request) {
+	var payload RemoveBooksPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		if err = responder.RespondError(w, responder.CodeMalformedRequest, "could not read request", "", http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
+	s.changeMemberships(w, r, "books_to_remove", payload.BooksToRemove, s.database.RemoveBooksFromCollection)
+}
+
+// changeMemberships validates every isbn of a bulk add or remove before
+// handing them to change, then responds with what happened to each of them:
+// 200 when they all succeeded and 422 when any was not found or (when
+// removing) not in the collection. Unless the atomic parameter is false,
+// nothing is changed when any isbn fails.
+func (s *Server) changeMemberships(w http.ResponseWriter, r *http.Request, field string, isbns []string, change func(*models.Collection, []string, bool) (*models.MembershipReport, error)) {
 	var err error
-	vars := mux.Vars(r)
-	collectionID, err := strconv.Atoi(vars["collection_id"])
+	atomic := true
+	if v := r.FormValue("atomic"); v != "" {
+		if atomic, err = strconv.ParseBool(v); err != nil {
+			if err = responder.RespondError(w, responder.CodeValidationFailed, "must be true or false", "atomic", http.StatusBadRequest); err != nil {
+				log.Errorf("error when responding with 400 error: %v", err)
+			}
+			return
+		}
+	}
+	if validationErrs := models.ValidateISBNs(field, isbns); len(validationErrs) > 0 {
+		if err = responder.RespondErrors(w, responder.CodeValidationFailed, validationErrs, http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
+	normalized := make([]string, len(isbns))
+	for i, isbn := range isbns {
+		normalized[i], _ = models.NormalizeISBN(isbn)
+	}
+
+	collection, ok := s.collectionParam(w, r)
+	if !ok {
+		return
+	}
+	report, err := change(collection, normalized, atomic)
 	if err != nil {
-		responder.RespondError(w, "bad value", "collection_id", http.StatusBadRequest)
+		if err == pg.ErrNoRows {
+			if err = responder.RespondError(w, responder.CodeNotFound, "this collection does not exist", "collection", http.StatusNotFound); err != nil {
+				log.Errorf("error when responding with 404 error: %v", err)
+			}
+			return
+		}
+		log.Errorf("error when changing the books of collection %d: %v", collection.ID, err)
+		if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
+			log.Errorf("error when responding with 500 error: %v", err)
+		}
 		return
 	}
 
-	var payload AddBooksPayload
-	if err = json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		responder.RespondError(w, "could not read request", "", http.StatusBadRequest)
+	status := http.StatusOK
+	if report.Failed() {
+		status = http.StatusUnprocessableEntity
+	}
+	if err = respond(w, r, report, status); err != nil {
+		log.Errorf("error when responding with %d error: %v", status, err)
+	}
+}
+
+func (s *Server) ViewCollectionHistory(w http.ResponseWriter, r *http.Request) {
+	var err error
+	collection, ok := s.collectionParam(w, r)
+	if !ok {
 		return
 	}
 
-	var collection *models.Collection
-	if collection, err = s.database.GetCollectionByID(collectionID); err != nil {
-		if err = responder.RespondError(w, "something went wrong", "", http.StatusInternalServerError); err != nil {
+	var history *models.CollectionHistory
+	if history, err = s.database.GetCollectionHistory(collection.ID); err != nil {
+		if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
 			log.Errorf("error when responding with 500 error: %v", err)
 		}
 		return
 	}
-	bookMap := sliceToMap(collection.Books)
+	if err = respond(w, r, history, http.StatusOK); err != nil {
+		log.Errorf("error when responding with 200 error: %v", err)
+	}
+}
 
-	for _, newBook := range payload.BooksToAdd {
-		if _, ok := bookMap[newBook]; !ok {
-			book, err := s.database.GetBookByISBN(newBook)
-			if err != nil {
-				if err = responder.RespondError(w, "something went wrong", "", http.StatusInternalServerError); err != nil {
-					log.Errorf("error when responding with 500 error: %v", err)
-				}
-				return
-			}
-			if err = s.database.AddBookToCollection(book, collection); err != nil {
-				log.Errorf("error when adding book to collection: %v", err)
-				if err = responder.RespondError(w, "something went wrong", "", http.StatusInternalServerError); err != nil {
-					log.Errorf("error when responding with 500 error: %v", err)
-				}
-				return
-			}
-		}
+// purgeParam reads the purge parameter of a delete, responding with a 400 when
+// it is not a boolean
+func purgeParam(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	v := r.FormValue("purge")
+	if v == "" {
+		return false, true
 	}
-	if err = responder.Respond(w, http.StatusOK); err != nil {
-		log.Errorf("error when responding with 500 error: %v", err)
+	purge, err := strconv.ParseBool(v)
+	if err != nil {
+		if err = responder.RespondError(w, responder.CodeValidationFailed, "must be true or false", "purge", http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return false, false
 	}
+	return purge, true
 }
 
-type RemoveBooksPayload struct {
-	BooksToRemove []string `json:"books_to_remove"`
+// parseDeletedBound reads a deleted_from or deleted_to parameter, either a
+// RFC3339 timestamp or a YYYY, YYYY-MM or YYYY-MM-DD date. A date as the
+// upper bound takes in all of it.
+func parseDeletedBound(v string, upper bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	start, precision, err := models.ParsePartialDate(v)
+	if err != nil {
+		return time.Time{}, errors.New("must be a RFC3339 timestamp or a YYYY, YYYY-MM or YYYY-MM-DD date")
+	}
+	if upper {
+		return precision.End(start), nil
+	}
+	return start, nil
 }
 
-func (s *Server) RemoveBooksFromCollection(w http.ResponseWriter, r *http.Request) {
+func (s *Server) ViewTrash(w http.ResponseWriter, r *http.Request) {
 	var err error
-	vars := mux.Vars(r)
-	collectionID, err := strconv.Atoi(vars["collection_id"])
+	var filter database.TrashFilter
+	var errs []responder.Error
+	if v := r.FormValue("deleted_from"); v != "" {
+		if filter.DeletedFrom, err = parseDeletedBound(v, false); err != nil {
+			errs = append(errs, responder.Error{Field: "deleted_from", Code: models.CodeInvalid, Message: err.Error()})
+		}
+	}
+	if v := r.FormValue("deleted_to"); v != "" {
+		if filter.DeletedTo, err = parseDeletedBound(v, true); err != nil {
+			errs = append(errs, responder.Error{Field: "deleted_to", Code: models.CodeInvalid, Message: err.Error()})
+		}
+	}
+	if len(errs) > 0 {
+		if err = responder.RespondErrors(w, responder.CodeValidationFailed, errs, http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
+
+	trash, err := s.database.GetTrash(filter)
 	if err != nil {
-		responder.RespondError(w, "bad value", "collection_id", http.StatusBadRequest)
+		if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
+			log.Errorf("error when responding with 500 error: %v", err)
+		}
 		return
 	}
+	if err = respond(w, r, trash, http.StatusOK); err != nil {
+		log.Errorf("error when responding with 200 error: %v", err)
+	}
+}
 
-	var payload RemoveBooksPayload
-	if err = json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		responder.RespondError(w, "could not read request", "", http.StatusBadRequest)
+func (s *Server) RestoreBook(w http.ResponseWriter, r *http.Request) {
+	var err error
+	isbn, ok := isbnParam(w, r)
+	if !ok {
 		return
 	}
 
-	var collection *models.Collection
-	if collection, err = s.database.GetCollectionByID(collectionID); err != nil {
-		if err = responder.RespondError(w, "something went wrong", "", http.StatusInternalServerError); err != nil {
+	var book *models.Book
+	if err = s.database.RestoreBook(isbn); err == nil {
+		book, err = s.database.GetBookByISBN(isbn)
+	}
+	if err != nil {
+		if err == pg.ErrNoRows {
+			if err = responder.RespondError(w, responder.CodeNotFound, "this book is not in the trash", "isbn", http.StatusNotFound); err != nil {
+				log.Errorf("error when responding with 404 error: %v", err)
+			}
+			return
+		}
+		if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
 			log.Errorf("error when responding with 500 error: %v", err)
 		}
 		return
 	}
+	if err = respond(w, r, book, http.StatusOK); err != nil {
+		log.Errorf("error when responding with 200 error: %v", err)
+	}
+}
 
-	bookMap := sliceToMap(collection.Books)
+func (s *Server) RestoreCollection(w http.ResponseWriter, r *http.Request) {
+	// a deleted collection's name may have been taken since, so only its id
+	// is certain to name it
+	id, err := strconv.Atoi(mux.Vars(r)["collection"])
+	if err != nil {
+		if err = responder.RespondError(w, responder.CodeValidationFailed, "must be a collection id", "collection", http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
 
-	for _, bookToRemove := range payload.BooksToRemove {
-		if _, ok := bookMap[bookToRemove]; ok {
-			book, err := s.database.GetBookByISBN(bookToRemove)
-			if err != nil {
-				if err = responder.RespondError(w, "something went wrong", "", http.StatusInternalServerError); err != nil {
-					log.Errorf("error when responding with 500 error: %v", err)
-				}
-				return
-			}
-			if err = s.database.RemoveBookFromCollection(book, collection); err != nil {
-				log.Errorf("error when adding book to collection: %v", err)
-				if err = responder.RespondError(w, "something went wrong", "", http.StatusInternalServerError); err != nil {
-					log.Errorf("error when responding with 500 error: %v", err)
-				}
-				return
+	var collection *models.Collection
+	if err = s.database.RestoreCollection(id); err == nil {
+		collection, err = s.database.GetCollectionByID(id)
+	}
+	if err != nil {
+		if err == database.ErrDuplicateCollectionName {
+			respondDuplicateName(w)
+			return
+		}
+		if err == pg.ErrNoRows {
+			if err = responder.RespondError(w, responder.CodeNotFound, "this collection is not in the trash", "collection", http.StatusNotFound); err != nil {
+				log.Errorf("error when responding with 404 error: %v", err)
 			}
+			return
+		}
+		if err = responder.RespondError(w, responder.CodeInternal, "something went wrong", "", http.StatusInternalServerError); err != nil {
+			log.Errorf("error when responding with 500 error: %v", err)
 		}
+		return
 	}
-	if err = responder.Respond(w, http.StatusOK); err != nil {
-		log.Errorf("error when responding with 500 error: %v", err)
+	if err = respond(w, r, collection, http.StatusOK); err != nil {
+		log.Errorf("error when responding with 200 error: %v", err)
 	}
 }
@@ -3,14 +3,16 @@ package server
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -19,12 +21,26 @@ import (
 	"github.com/john-cai/book-manager/responder"
 )
 
+var isbnCount int
+
+// newISBN returns a valid ISBN-13 that no other test has used
+func newISBN() string {
+	isbnCount++
+	prefix := fmt.Sprintf("978%09d", isbnCount)
+	for check := 0; check < 10; check++ {
+		if isbn, err := models.NormalizeISBN(fmt.Sprintf("%s%d", prefix, check)); err == nil {
+			return isbn
+		}
+	}
+	panic("no check digit fits " + prefix)
+}
+
 func setUpTestServer(t *testing.T) *Server {
-	db, err := database.NewTestDB()
-	require.NoError(t, err)
 	s := &Server{
-		database: db,
-		Router:   mux.NewRouter(),
+		database:     database.NewMemory(),
+		Router:       mux.NewRouter(),
+		maxPageSize:  defaultMaxPageSize,
+		deletePolicy: database.CascadeDelete,
 	}
 	s.configureRoutes()
 	return s
@@ -36,9 +52,9 @@ func TestAddBook(t *testing.T) {
 		input        models.Book
 		responseCode int
 	}{
-		{input: models.Book{ISBN: uuid.New(), Title: "Jungle Book", Author: "Rudyard Kipling", PublishedAt: time.Date(1894, 0, 0, 0, 0, 0, 0, time.UTC)}, responseCode: http.StatusCreated},
+		{input: models.Book{ISBN: newISBN(), Title: "Jungle Book", Author: "Rudyard Kipling", PublishedAt: time.Date(1894, 0, 0, 0, 0, 0, 0, time.UTC)}, responseCode: http.StatusCreated},
 		{input: models.Book{ISBN: "", Title: "2001: A Space Odyssey", Author: "abc", PublishedAt: time.Date(1994, 0, 0, 0, 0, 0, 0, time.UTC)}, responseCode: http.StatusBadRequest},
-		{input: models.Book{ISBN: uuid.New(), Title: "", Author: "Rudyard Kipling", PublishedAt: time.Date(1894, 0, 0, 0, 0, 0, 0, time.UTC)}, responseCode: http.StatusBadRequest},
+		{input: models.Book{ISBN: newISBN(), Title: "", Author: "Rudyard Kipling", PublishedAt: time.Date(1894, 0, 0, 0, 0, 0, 0, time.UTC)}, responseCode: http.StatusBadRequest},
 	}
 
 	for _, testCase := range testCases {
@@ -59,12 +75,12 @@ func TestEditBook(t *testing.T) {
 		responseCode int
 	}{
 		{
-			original:     models.Book{ISBN: uuid.New(), Title: "Jungle Book", Author: "Rudyard Kipling", PublishedAt: time.Date(1894, 0, 0, 0, 0, 0, 0, time.UTC), CreatedAt: time.Now()},
+			original:     models.Book{ISBN: newISBN(), Title: "Jungle Book", Author: "Rudyard Kipling", PublishedAt: time.Date(1894, 0, 0, 0, 0, 0, 0, time.UTC), CreatedAt: time.Now()},
 			edited:       models.Book{Title: "Jungle Book II", Author: "Rudyard Kipling", PublishedAt: time.Date(1899, 0, 0, 0, 0, 0, 0, time.UTC)},
 			responseCode: http.StatusOK,
 		},
 		{
-			original:     models.Book{ISBN: uuid.New(), Title: "2001: A Space Odyssey", Author: "abc", PublishedAt: time.Date(1994, 0, 0, 0, 0, 0, 0, time.UTC), CreatedAt: time.Now()},
+			original:     models.Book{ISBN: newISBN(), Title: "2001: A Space Odyssey", Author: "abc", PublishedAt: time.Date(1994, 0, 0, 0, 0, 0, 0, time.UTC), CreatedAt: time.Now()},
 			edited:       models.Book{Title: "2018: A Space Odyssey", Author: "abc", PublishedAt: time.Date(1994, 0, 0, 0, 0, 0, 0, time.UTC)},
 			responseCode: http.StatusOK,
 		},
@@ -112,8 +128,8 @@ func TestEditBook(t *testing.T) {
 func TestDeleteBook(t *testing.T) {
 	s := setUpTestServer(t)
 	books := []models.Book{
-		models.Book{ISBN: uuid.New(), Title: "Lord of the Rings", Author: "J.R.R. Tolkien", PublishedAt: time.Date(1944, 0, 0, 0, 0, 0, 0, time.UTC), CreatedAt: time.Now()},
-		models.Book{ISBN: uuid.New(), Title: "A Wrinkle in Time", Author: "Madeline L'engle", PublishedAt: time.Date(1989, 0, 0, 0, 0, 0, 0, time.UTC), CreatedAt: time.Now()},
+		models.Book{ISBN: newISBN(), Title: "Lord of the Rings", Author: "J.R.R. Tolkien", PublishedAt: time.Date(1944, 0, 0, 0, 0, 0, 0, time.UTC), CreatedAt: time.Now()},
+		models.Book{ISBN: newISBN(), Title: "A Wrinkle in Time", Author: "Madeline L'engle", PublishedAt: time.Date(1989, 0, 0, 0, 0, 0, 0, time.UTC), CreatedAt: time.Now()},
 	}
 
 	for _, book := range books {
@@ -139,7 +155,7 @@ func TestDeleteBook(t *testing.T) {
 			response: http.StatusOK,
 		},
 		{
-			isbn:     uuid.New(),
+			isbn:     newISBN(),
 			response: http.StatusNotFound,
 		},
 	}
@@ -161,6 +177,8 @@ func TestAddCollection(t *testing.T) {
 		{input: models.Collection{Name: "collection1", Description: "a great collection of books"}, responseCode: http.StatusCreated},
 		{input: models.Collection{Name: "collection2", Description: "another great collection of books"}, responseCode: http.StatusCreated},
 		{input: models.Collection{Name: "collection3", Description: "this one's just alright"}, responseCode: http.StatusCreated},
+		{input: models.Collection{Name: "   ", Description: "no name"}, responseCode: http.StatusBadRequest},
+		{input: models.Collection{Name: "collection4", Description: strings.Repeat("a", models.MaxDescriptionLength+1)}, responseCode: http.StatusBadRequest},
 	}
 
 	for _, testCase := range testCases {
@@ -187,8 +205,8 @@ func TestAddBooksToCollection(t *testing.T) {
 
 	// add some books
 	books := []models.Book{
-		models.Book{ISBN: uuid.New(), Title: "Lord of the Rings: Return of the King", Author: "J.R.R. Tolkien", PublishedAt: time.Date(1944, 0, 0, 0, 0, 0, 0, time.UTC), CreatedAt: time.Now()},
-		models.Book{ISBN: uuid.New(), Title: "A Wrinkle in Time II", Author: "Madeline L'engle", PublishedAt: time.Date(1989, 0, 0, 0, 0, 0, 0, time.UTC), CreatedAt: time.Now()},
+		models.Book{ISBN: newISBN(), Title: "Lord of the Rings: Return of the King", Author: "J.R.R. Tolkien", PublishedAt: time.Date(1944, 0, 0, 0, 0, 0, 0, time.UTC), CreatedAt: time.Now()},
+		models.Book{ISBN: newISBN(), Title: "A Wrinkle in Time II", Author: "Madeline L'engle", PublishedAt: time.Date(1989, 0, 0, 0, 0, 0, 0, time.UTC), CreatedAt: time.Now()},
 	}
 
 	var booksToAdd []string
@@ -242,3 +260,1550 @@ func TestAddBooksToCollection(t *testing.T) {
 	assert.Len(t, collection.Books, len(books)-1)
 
 }
+
+func TestBulkMembershipReport(t *testing.T) {
+	s := setUpTestServer(t)
+	collection := models.Collection{Name: "collection1"}
+	rec := httptest.NewRecorder()
+	var b bytes.Buffer
+	json.NewEncoder(&b).Encode(&collection)
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collections", &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&collection))
+
+	book := models.Book{ISBN: newISBN(), Title: "Kim", Author: "Rudyard Kipling"}
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(&book)
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	missing := newISBN()
+
+	testCases := []struct {
+		path         string
+		payload      interface{}
+		responseCode int
+		report       models.MembershipReport
+	}{
+		{
+			path:         "addbooks",
+			payload:      AddBooksPayload{BooksToAdd: []string{book.ISBN, missing}},
+			responseCode: http.StatusUnprocessableEntity,
+			report: models.MembershipReport{Applied: false, Results: []models.MembershipResult{
+				{ISBN: book.ISBN, Status: models.MembershipAdded},
+				{ISBN: missing, Status: models.MembershipNotFound},
+			}},
+		},
+		{
+			path:         "addbooks?atomic=false",
+			payload:      AddBooksPayload{BooksToAdd: []string{book.ISBN, missing}},
+			responseCode: http.StatusUnprocessableEntity,
+			report: models.MembershipReport{Applied: true, Results: []models.MembershipResult{
+				{ISBN: book.ISBN, Status: models.MembershipAdded},
+				{ISBN: missing, Status: models.MembershipNotFound},
+			}},
+		},
+		{
+			path:         "addbooks",
+			payload:      AddBooksPayload{BooksToAdd: []string{book.ISBN}},
+			responseCode: http.StatusOK,
+			report: models.MembershipReport{Applied: true, Results: []models.MembershipResult{
+				{ISBN: book.ISBN, Status: models.MembershipAlreadyPresent},
+			}},
+		},
+		{
+			path:         "removebooks",
+			payload:      RemoveBooksPayload{BooksToRemove: []string{book.ISBN}},
+			responseCode: http.StatusOK,
+			report: models.MembershipReport{Applied: true, Results: []models.MembershipResult{
+				{ISBN: book.ISBN, Status: models.MembershipRemoved},
+			}},
+		},
+		{
+			path:         "removebooks",
+			payload:      RemoveBooksPayload{BooksToRemove: []string{book.ISBN}},
+			responseCode: http.StatusUnprocessableEntity,
+			report: models.MembershipReport{Applied: false, Results: []models.MembershipResult{
+				{ISBN: book.ISBN, Status: models.MembershipNotMember},
+			}},
+		},
+	}
+	for _, testCase := range testCases {
+		rec = httptest.NewRecorder()
+		b.Reset()
+		json.NewEncoder(&b).Encode(testCase.payload)
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/collections/%d/%s", collection.ID, testCase.path), &b))
+		require.Equal(t, testCase.responseCode, rec.Result().StatusCode, testCase.path)
+		var report models.MembershipReport
+		require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&report))
+		assert.Equal(t, testCase.report, report, testCase.path)
+	}
+
+	// every isbn is checked before anything is looked up
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(AddBooksPayload{BooksToAdd: []string{book.ISBN, "not-an-isbn"}})
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/collections/%d/addbooks", collection.ID), &b))
+	require.Equal(t, http.StatusBadRequest, rec.Result().StatusCode)
+	var errResp responder.ErrorResponse
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&errResp))
+	require.Len(t, errResp.Errors, 1)
+	assert.Equal(t, "books_to_add[1]", errResp.Errors[0].Field)
+}
+
+func TestViewBooksPagination(t *testing.T) {
+	s := setUpTestServer(t)
+	s.maxPageSize = 2
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		var b bytes.Buffer
+		json.NewEncoder(&b).Encode(&models.Book{ISBN: newISBN(), Title: "Kim", Author: "Rudyard Kipling"})
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", &b))
+		require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	}
+
+	testCases := []struct {
+		query        string
+		responseCode int
+		count        int
+		errorCode    string
+	}{
+		{query: "", responseCode: http.StatusOK, count: 2},
+		{query: "limit=1", responseCode: http.StatusOK, count: 1},
+		{query: "limit=3", responseCode: http.StatusBadRequest, errorCode: models.CodeInvalid},
+		{query: "limit=0", responseCode: http.StatusBadRequest, errorCode: models.CodeInvalid},
+		{query: "cursor=garbage", responseCode: http.StatusBadRequest},
+		{query: "sort=-title,published_at", responseCode: http.StatusOK, count: 2},
+		{query: "sort=description", responseCode: http.StatusBadRequest, errorCode: models.CodeInvalid},
+		{query: "q=kim", responseCode: http.StatusOK, count: 2},
+		{query: "q=kim&sort=title", responseCode: http.StatusBadRequest},
+		{query: "q=%3F%21", responseCode: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/books?"+testCase.query, nil))
+		require.Equal(t, testCase.responseCode, rec.Result().StatusCode, testCase.query)
+		if testCase.errorCode != "" {
+			var errResp responder.ErrorResponse
+			require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&errResp))
+			require.Len(t, errResp.Errors, 1, testCase.query)
+			assert.Equal(t, testCase.errorCode, errResp.Errors[0].Code, testCase.query)
+		}
+		if testCase.responseCode != http.StatusOK {
+			continue
+		}
+		var list models.BookList
+		require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&list))
+		assert.Equal(t, 3, list.Total)
+		assert.Len(t, list.Results, testCase.count)
+		assert.NotEmpty(t, list.NextCursor)
+	}
+}
+
+func TestViewBooksGenres(t *testing.T) {
+	s := setUpTestServer(t)
+	books := []models.Book{
+		{ISBN: newISBN(), Title: "Jungle Book", Author: "Rudyard Kipling", Metadata: models.Metadata{Genres: []string{"adventure", "children"}}},
+		{ISBN: newISBN(), Title: "Treasure Island", Author: "Robert Louis Stevenson", Metadata: models.Metadata{Genres: []string{"adventure"}}},
+		{ISBN: newISBN(), Title: "A Wrinkle in Time", Author: "Madeline L'engle", Metadata: models.Metadata{Genres: []string{"fantasy", "children"}}},
+	}
+	for _, book := range books {
+		rec := httptest.NewRecorder()
+		var b bytes.Buffer
+		json.NewEncoder(&b).Encode(&book)
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", &b))
+		require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	}
+
+	testCases := []struct {
+		query        string
+		responseCode int
+		count        int
+	}{
+		{query: "genres=adventure", responseCode: http.StatusOK, count: 2},
+		{query: "genres=adventure,fantasy", responseCode: http.StatusOK, count: 3},
+		{query: "genres=adventure,children&genres_match=all", responseCode: http.StatusOK, count: 1},
+		{query: "genres=children,,children&genres_match=all", responseCode: http.StatusOK, count: 2},
+		{query: "genres=adventure&genres_match=any", responseCode: http.StatusOK, count: 2},
+		{query: "genres=adventure&genres_match=most", responseCode: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/books?"+testCase.query, nil))
+		require.Equal(t, testCase.responseCode, rec.Result().StatusCode, testCase.query)
+		if testCase.responseCode != http.StatusOK {
+			continue
+		}
+		var list models.BookList
+		require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&list))
+		assert.Len(t, list.Results, testCase.count, testCase.query)
+	}
+}
+
+func TestViewBooksPublished(t *testing.T) {
+	s := setUpTestServer(t)
+	books := []models.Book{
+		{ISBN: newISBN(), Title: "Jungle Book", Author: "Rudyard Kipling", PublishedAt: time.Date(1894, 6, 15, 0, 0, 0, 0, time.UTC), PublishedPrecision: models.PrecisionYear},
+		{ISBN: newISBN(), Title: "Kim", Author: "Rudyard Kipling", PublishedAt: time.Date(1901, 10, 1, 0, 0, 0, 0, time.UTC), PublishedPrecision: models.PrecisionMonth},
+		{ISBN: newISBN(), Title: "Captains Courageous", Author: "Rudyard Kipling", PublishedAt: time.Date(1897, 3, 20, 0, 0, 0, 0, time.UTC)},
+		{ISBN: newISBN(), Title: "Beowulf", Author: "Unknown"},
+	}
+	for _, book := range books {
+		rec := httptest.NewRecorder()
+		var b bytes.Buffer
+		json.NewEncoder(&b).Encode(&book)
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", &b))
+		require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	}
+
+	// a year only date round trips as January 1st
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/books/"+books[0].ISBN, nil))
+	require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+	var book models.Book
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&book))
+	assert.True(t, time.Date(1894, 1, 1, 0, 0, 0, 0, time.UTC).Equal(book.PublishedAt))
+	assert.Equal(t, models.PrecisionYear, book.PublishedPrecision)
+	assert.Equal(t, "1894", book.PublishedDate())
+
+	testCases := []struct {
+		query        string
+		responseCode int
+		count        int
+		errorCode    string
+	}{
+		{query: "published=1894", responseCode: http.StatusOK, count: 1},
+		{query: "published=1897-03", responseCode: http.StatusOK, count: 1},
+		{query: "published=1897-03-21", responseCode: http.StatusOK, count: 0},
+		{query: "published_from=1890&published_to=1900", responseCode: http.StatusOK, count: 2},
+		{query: "published_from=1895", responseCode: http.StatusOK, count: 2},
+		{query: "published_to=1901-10", responseCode: http.StatusOK, count: 3},
+		{query: "published_to=1901-09-30", responseCode: http.StatusOK, count: 2},
+		{query: "published=94", responseCode: http.StatusBadRequest, errorCode: models.CodeInvalid},
+		{query: "published_from=1900&published_to=1890", responseCode: http.StatusBadRequest, errorCode: models.CodeInvalid},
+		{query: "published=1894&published_to=1900", responseCode: http.StatusBadRequest, errorCode: models.CodeInvalid},
+	}
+	for _, testCase := range testCases {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/books?"+testCase.query, nil))
+		require.Equal(t, testCase.responseCode, rec.Result().StatusCode, testCase.query)
+		if testCase.errorCode != "" {
+			var errResp responder.ErrorResponse
+			require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&errResp))
+			require.Len(t, errResp.Errors, 1, testCase.query)
+			assert.Equal(t, testCase.errorCode, errResp.Errors[0].Code, testCase.query)
+		}
+		if testCase.responseCode != http.StatusOK {
+			continue
+		}
+		var list models.BookList
+		require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&list))
+		assert.Len(t, list.Results, testCase.count, testCase.query)
+	}
+}
+
+func TestBookISBNForms(t *testing.T) {
+	s := setUpTestServer(t)
+	rec := httptest.NewRecorder()
+	var b bytes.Buffer
+	json.NewEncoder(&b).Encode(&models.Book{ISBN: "0-14-118280-6", Title: "The Jungle Book", Author: "Rudyard Kipling"})
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	var created models.Book
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&created))
+	assert.Equal(t, "9780141182803", created.ISBN)
+
+	// the same book as an ISBN-13 is a duplicate
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(&models.Book{ISBN: "978-0-14-118280-3", Title: "The Jungle Book", Author: "Rudyard Kipling"})
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", &b))
+	require.Equal(t, http.StatusConflict, rec.Result().StatusCode)
+	var errResp responder.ErrorResponse
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&errResp))
+	assert.Equal(t, responder.CodeISBNConflict, errResp.Code)
+
+	testCases := []struct {
+		isbn         string
+		responseCode int
+	}{
+		{isbn: "9780141182803", responseCode: http.StatusOK},
+		{isbn: "978-0-14-118280-3", responseCode: http.StatusOK},
+		{isbn: "0141182806", responseCode: http.StatusOK},
+		{isbn: "0-14-118280-6", responseCode: http.StatusOK},
+		{isbn: "0-14-118280-1", responseCode: http.StatusBadRequest},
+		{isbn: "not-an-isbn", responseCode: http.StatusBadRequest},
+		{isbn: "978-0-8044-2957-3", responseCode: http.StatusNotFound},
+	}
+	for _, testCase := range testCases {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/books/"+testCase.isbn, nil))
+		require.Equal(t, testCase.responseCode, rec.Result().StatusCode, testCase.isbn)
+		if testCase.responseCode == http.StatusOK {
+			var book models.Book
+			require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&book))
+			assert.Equal(t, "9780141182803", book.ISBN)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/books?isbn=0-14-118280-6", nil))
+	require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+	var list models.BookList
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&list))
+	assert.Len(t, list.Results, 1)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/books/0141182806", nil))
+	assert.Equal(t, http.StatusOK, rec.Result().StatusCode)
+}
+
+func TestEditCollection(t *testing.T) {
+	s := setUpTestServer(t)
+	collection := models.Collection{Name: "collection1", Description: "a great collection of books"}
+	rec := httptest.NewRecorder()
+	var b bytes.Buffer
+	json.NewEncoder(&b).Encode(&collection)
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collections", &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&collection))
+
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(&models.Collection{Name: "  renamed  ", Description: "still great"})
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, fmt.Sprintf("/collections/%d", collection.ID), &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/collections/%d", collection.ID), nil))
+	require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&collection))
+	assert.Equal(t, "renamed", collection.Name)
+
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(&models.Collection{Name: ""})
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, fmt.Sprintf("/collections/%d", collection.ID), &b))
+	require.Equal(t, http.StatusBadRequest, rec.Result().StatusCode)
+	var errResp responder.ErrorResponse
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&errResp))
+	require.Len(t, errResp.Errors, 1)
+	assert.Equal(t, responder.Error{Message: "required", Field: "name", Code: models.CodeRequired}, errResp.Errors[0])
+}
+
+func TestCollectionNames(t *testing.T) {
+	s := setUpTestServer(t)
+	collection := models.Collection{Name: "Summer Reading"}
+	rec := httptest.NewRecorder()
+	var b bytes.Buffer
+	json.NewEncoder(&b).Encode(&collection)
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collections", &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&collection))
+
+	duplicate := responder.Error{Message: "a collection with this name already exists", Field: "name", Code: models.CodeDuplicate}
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(&models.Collection{Name: "summer reading"})
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collections", &b))
+	require.Equal(t, http.StatusConflict, rec.Result().StatusCode)
+	var errResp responder.ErrorResponse
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&errResp))
+	assert.Equal(t, []responder.Error{duplicate}, errResp.Errors)
+
+	other := models.Collection{Name: "Winter Reading"}
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(&other)
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collections", &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(&models.Collection{Name: "SUMMER READING"})
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/collections/winter-reading", &b))
+	require.Equal(t, http.StatusConflict, rec.Result().StatusCode)
+
+	for _, ref := range []string{strconv.Itoa(collection.ID), "Summer%20Reading", "summer-reading"} {
+		rec = httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/collections/"+ref, nil))
+		require.Equal(t, http.StatusOK, rec.Result().StatusCode, ref)
+		var c models.Collection
+		require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&c))
+		assert.Equal(t, collection.ID, c.ID, ref)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/collections/summer-reading", nil))
+	require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/collections/summer-reading", nil))
+	require.Equal(t, http.StatusNotFound, rec.Result().StatusCode)
+
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(&models.Collection{Name: "2024"})
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collections", &b))
+	require.Equal(t, http.StatusBadRequest, rec.Result().StatusCode)
+
+	// named before all digit names were refused, and found by name when no
+	// collection has that id
+	digits := models.Collection{Name: "1984"}
+	require.NoError(t, s.database.AddCollection(&digits))
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/collections/1984", nil))
+	require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+	var c models.Collection
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&c))
+	assert.Equal(t, digits.ID, c.ID)
+}
+
+func TestBookValidationErrors(t *testing.T) {
+	s := setUpTestServer(t)
+	rec := httptest.NewRecorder()
+	var b bytes.Buffer
+	json.NewEncoder(&b).Encode(&models.Book{
+		ISBN:        "978-0-14-118280-4",
+		Title:       " ",
+		Author:      "Rudyard Kipling",
+		PublishedAt: time.Now().AddDate(2, 0, 0),
+		Metadata:    models.Metadata{Genres: []string{"adventure", "jungle"}},
+	})
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", &b))
+	require.Equal(t, http.StatusBadRequest, rec.Result().StatusCode)
+	var errResp responder.ErrorResponse
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&errResp))
+	var fields []string
+	for _, e := range errResp.Errors {
+		fields = append(fields, e.Field+":"+e.Code)
+	}
+	assert.Equal(t, []string{
+		"isbn:" + models.CodeISBNCheck,
+		"title:" + models.CodeRequired,
+		"published_at:" + models.CodeFutureDate,
+		"metadata.genres[1]:" + models.CodeUnknownGenre,
+	}, fields)
+
+	// the same rules apply to bulk payloads
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(&models.Collection{Name: "collection1"})
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collections", &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	var collection models.Collection
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&collection))
+
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(&AddBooksPayload{BooksToAdd: []string{newISBN(), "12345"}})
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/collections/%d/addbooks", collection.ID), &b))
+	require.Equal(t, http.StatusBadRequest, rec.Result().StatusCode)
+	errResp = responder.ErrorResponse{}
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&errResp))
+	require.Len(t, errResp.Errors, 1)
+	assert.Equal(t, "books_to_add[1]", errResp.Errors[0].Field)
+	assert.Equal(t, models.CodeInvalidISBN, errResp.Errors[0].Code)
+}
+
+func TestTrash(t *testing.T) {
+	s := setUpTestServer(t)
+	book := models.Book{ISBN: newISBN(), Title: "Kim", Author: "Rudyard Kipling"}
+	collection := models.Collection{Name: "collection1"}
+	rec := httptest.NewRecorder()
+	var b bytes.Buffer
+	json.NewEncoder(&b).Encode(&book)
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(&collection)
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collections", &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&collection))
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(AddBooksPayload{BooksToAdd: []string{book.ISBN}})
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/collections/%d/addbooks", collection.ID), &b))
+	require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+
+	for _, path := range []string{"/books/" + book.ISBN, fmt.Sprintf("/collections/%d", collection.ID)} {
+		rec = httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, path, nil))
+		require.Equal(t, http.StatusOK, rec.Result().StatusCode, path)
+	}
+
+	testCases := []struct {
+		query        string
+		responseCode int
+		count        int
+	}{
+		{query: "", responseCode: http.StatusOK, count: 2},
+		{query: "?deleted_from=" + time.Now().Add(-time.Hour).Format(time.RFC3339), responseCode: http.StatusOK, count: 2},
+		{query: "?deleted_to=2000", responseCode: http.StatusOK, count: 0},
+		{query: "?deleted_to=yesterday", responseCode: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		rec = httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/trash"+testCase.query, nil))
+		require.Equal(t, testCase.responseCode, rec.Result().StatusCode, testCase.query)
+		if testCase.responseCode != http.StatusOK {
+			continue
+		}
+		var trash models.Trash
+		require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&trash))
+		assert.Equal(t, testCase.count, len(trash.Books)+len(trash.Collections), testCase.query)
+	}
+
+	// a book in the trash still holds its isbn
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(&book)
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", &b))
+	require.Equal(t, http.StatusConflict, rec.Result().StatusCode)
+	var errResp responder.ErrorResponse
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&errResp))
+	assert.Equal(t, responder.CodeISBNConflict, errResp.Code)
+	require.Len(t, errResp.Errors, 1)
+	assert.Equal(t, models.CodeDuplicate, errResp.Errors[0].Code)
+	assert.Equal(t, "restore it with POST /books/"+book.ISBN+"/restore", errResp.Detail)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collections/collection1/restore", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Result().StatusCode)
+	for _, path := range []string{"/books/" + book.ISBN + "/restore", fmt.Sprintf("/collections/%d/restore", collection.ID)} {
+		rec = httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		require.Equal(t, http.StatusOK, rec.Result().StatusCode, path)
+	}
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books/"+book.ISBN+"/restore", nil))
+	require.Equal(t, http.StatusNotFound, rec.Result().StatusCode)
+
+	// memberships come back with what they were deleted with
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/collections/collection1", nil))
+	require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&collection))
+	assert.Len(t, collection.Books, 1)
+
+	for _, path := range []string{"/books/" + book.ISBN + "?purge=true", "/collections/collection1?purge=true"} {
+		rec = httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, path, nil))
+		require.Equal(t, http.StatusOK, rec.Result().StatusCode, path)
+	}
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books/"+book.ISBN+"/restore", nil))
+	require.Equal(t, http.StatusNotFound, rec.Result().StatusCode)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/books/"+book.ISBN+"?purge=maybe", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Result().StatusCode)
+}
+
+func TestCollectionHistory(t *testing.T) {
+	s := setUpTestServer(t)
+	book := models.Book{ISBN: newISBN(), Title: "Kim", Author: "Rudyard Kipling"}
+	collection := models.Collection{Name: "collection1"}
+	rec := httptest.NewRecorder()
+	var b bytes.Buffer
+	json.NewEncoder(&b).Encode(&book)
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(&collection)
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collections", &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+
+	// a removed book can be added back
+	for _, change := range []struct {
+		path    string
+		payload interface{}
+	}{
+		{path: "addbooks", payload: AddBooksPayload{BooksToAdd: []string{book.ISBN}}},
+		{path: "removebooks", payload: RemoveBooksPayload{BooksToRemove: []string{book.ISBN}}},
+		{path: "addbooks", payload: AddBooksPayload{BooksToAdd: []string{book.ISBN}}},
+	} {
+		rec = httptest.NewRecorder()
+		b.Reset()
+		json.NewEncoder(&b).Encode(change.payload)
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collections/collection1/"+change.path, &b))
+		require.Equal(t, http.StatusOK, rec.Result().StatusCode, change.path)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/collections/collection1/history", nil))
+	require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+	var history models.CollectionHistory
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&history))
+	require.Len(t, history.Results, 3)
+	assert.Equal(t, models.MembershipAdded, history.Results[0].Action)
+	assert.Equal(t, models.MembershipRemoved, history.Results[1].Action)
+	assert.Equal(t, models.MembershipAdded, history.Results[2].Action)
+	assert.Equal(t, book.ISBN, history.Results[2].BookISBN)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/collections/collection2/history", nil))
+	require.Equal(t, http.StatusNotFound, rec.Result().StatusCode)
+}
+
+func TestDeletePolicies(t *testing.T) {
+	s := setUpTestServer(t)
+	book := models.Book{ISBN: newISBN(), Title: "Kim", Author: "Rudyard Kipling"}
+	collection := models.Collection{Name: "collection1"}
+	rec := httptest.NewRecorder()
+	var b bytes.Buffer
+	json.NewEncoder(&b).Encode(&book)
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(&collection)
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collections", &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&collection))
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(AddBooksPayload{BooksToAdd: []string{book.ISBN}})
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/collections/%d/addbooks", collection.ID), &b))
+	require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+
+	s.deletePolicy = database.RestrictDelete
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/books/"+book.ISBN, nil))
+	require.Equal(t, http.StatusConflict, rec.Result().StatusCode)
+	var conflict struct {
+		responder.ErrorResponse
+		models.DeleteReport
+	}
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&conflict))
+	require.Len(t, conflict.Errors, 1)
+	assert.Equal(t, models.CodeRestricted, conflict.Errors[0].Code)
+	require.Len(t, conflict.Collections, 1)
+	assert.Equal(t, collection.ID, conflict.Collections[0].ID)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/collections/%d", collection.ID), nil))
+	require.Equal(t, http.StatusConflict, rec.Result().StatusCode)
+
+	s.deletePolicy = database.CascadeDelete
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/books/"+book.ISBN, nil))
+	require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+	var report models.DeleteReport
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&report))
+	assert.Equal(t, string(database.CascadeDelete), report.Policy)
+	require.Len(t, report.Collections, 1)
+	assert.Equal(t, collection.Name, report.Collections[0].Name)
+
+	// the book's membership went to the trash with it
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/collections/%d", collection.ID), nil))
+	require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+	report = models.DeleteReport{}
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&report))
+	assert.Empty(t, report.Books)
+}
+
+func TestConditionalEdits(t *testing.T) {
+	s := setUpTestServer(t)
+	book := models.Book{ISBN: newISBN(), Title: "Kim", Author: "Rudyard Kipling"}
+	rec := httptest.NewRecorder()
+	var b bytes.Buffer
+	json.NewEncoder(&b).Encode(&book)
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	assert.Equal(t, `"1"`, rec.Result().Header.Get("ETag"))
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/books/"+book.ISBN, nil))
+	require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+	tag := rec.Result().Header.Get("ETag")
+	assert.Equal(t, `"1"`, tag)
+
+	req := httptest.NewRequest(http.MethodGet, "/books/"+book.ISBN, nil)
+	req.Header.Set("If-None-Match", tag)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNotModified, rec.Result().StatusCode)
+	assert.Empty(t, rec.Body.Bytes())
+
+	edit := func(ifMatch string) *http.Response {
+		book.Title = "Kim, again"
+		var b bytes.Buffer
+		json.NewEncoder(&b).Encode(&book)
+		req := httptest.NewRequest(http.MethodPut, "/books/"+book.ISBN, &b)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+	resp := edit(tag)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"2"`, resp.Header.Get("ETag"))
+
+	// the second librarian still has version 1
+	resp = edit(tag)
+	require.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	var errResp responder.ErrorResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+	require.Len(t, errResp.Errors, 1)
+	assert.Equal(t, models.CodeConflict, errResp.Errors[0].Code)
+
+	assert.Equal(t, http.StatusOK, edit(`"7", "2"`).StatusCode)
+	assert.Equal(t, http.StatusOK, edit("*").StatusCode)
+	assert.Equal(t, http.StatusOK, edit("").StatusCode)
+	s.requireIfMatch = true
+	assert.Equal(t, http.StatusPreconditionRequired, edit("").StatusCode)
+
+	collection := models.Collection{Name: "collection1"}
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(&collection)
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collections", &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&collection))
+	for _, testCase := range []struct {
+		ifMatch      string
+		responseCode int
+	}{
+		{ifMatch: `"1"`, responseCode: http.StatusCreated},
+		{ifMatch: `"1"`, responseCode: http.StatusPreconditionFailed},
+		{ifMatch: `W/"2"`, responseCode: http.StatusPreconditionFailed},
+		{ifMatch: `"2"`, responseCode: http.StatusCreated},
+	} {
+		b.Reset()
+		json.NewEncoder(&b).Encode(&collection)
+		req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/collections/%d", collection.ID), &b)
+		req.Header.Set("If-Match", testCase.ifMatch)
+		rec = httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		assert.Equal(t, testCase.responseCode, rec.Result().StatusCode, testCase.ifMatch)
+	}
+	req = httptest.NewRequest(http.MethodGet, fmt.Sprintf("/collections/%d", collection.ID), nil)
+	req.Header.Set("If-None-Match", `W/"3"`)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotModified, rec.Result().StatusCode)
+}
+
+func TestConditionalMemberships(t *testing.T) {
+	s := setUpTestServer(t)
+	collection := models.Collection{Name: "collection1"}
+	rec := httptest.NewRecorder()
+	var b bytes.Buffer
+	json.NewEncoder(&b).Encode(&collection)
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collections", &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&collection))
+
+	book := models.Book{ISBN: newISBN(), Title: "Kim", Author: "Rudyard Kipling"}
+	rec = httptest.NewRecorder()
+	b.Reset()
+	json.NewEncoder(&b).Encode(&book)
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+
+	paths := []string{"/books/" + book.ISBN, fmt.Sprintf("/collections/%d", collection.ID)}
+	get := func(path, accept, ifNoneMatch string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+	for _, path := range paths {
+		resp := get(path, "text/html", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode, path)
+		assert.Equal(t, `W/"1-html"`, resp.Header.Get("ETag"), path)
+		// the JSON's tag is not the page's
+		assert.Equal(t, http.StatusOK, get(path, "text/html", `"1"`).StatusCode, path)
+		assert.Equal(t, http.StatusNotModified, get(path, "text/html", `W/"1-html"`).StatusCode, path)
+		assert.Equal(t, http.StatusNotModified, get(path, "", `"1"`).StatusCode, path)
+	}
+
+	changes := []struct {
+		path    string
+		payload interface{}
+	}{
+		{path: "addbooks", payload: AddBooksPayload{BooksToAdd: []string{book.ISBN}}},
+		{path: "removebooks", payload: RemoveBooksPayload{BooksToRemove: []string{book.ISBN}}},
+	}
+	for i, change := range changes {
+		rec = httptest.NewRecorder()
+		b.Reset()
+		json.NewEncoder(&b).Encode(change.payload)
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/collections/%d/%s", collection.ID, change.path), &b))
+		require.Equal(t, http.StatusOK, rec.Result().StatusCode, change.path)
+
+		// both the book and the collection list the change
+		for _, path := range paths {
+			resp := get(path, "", fmt.Sprintf(`"%d"`, i+1))
+			require.Equal(t, http.StatusOK, resp.StatusCode, path)
+			assert.Equal(t, fmt.Sprintf(`"%d"`, i+2), resp.Header.Get("ETag"), path)
+		}
+	}
+}
+
+func TestPatchBook(t *testing.T) {
+	s := setUpTestServer(t)
+	book := models.Book{
+		ISBN:        newISBN(),
+		Title:       "Kim",
+		Author:      "Rudyard Kipling",
+		Description: "a spy novel",
+		PublishedAt: time.Date(1901, 10, 1, 0, 0, 0, 0, time.UTC),
+		Metadata:    models.Metadata{Genres: []string{"adventure"}},
+	}
+	rec := httptest.NewRecorder()
+	var b bytes.Buffer
+	json.NewEncoder(&b).Encode(&book)
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", &b))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	var added models.Book
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&added))
+
+	testCases := []struct {
+		contentType  string
+		ifMatch      string
+		body         string
+		responseCode int
+	}{
+		{contentType: "application/merge-patch+json", body: `{"title":"Kim (Penguin Classics)"}`, responseCode: http.StatusOK},
+		{contentType: "application/json-patch+json", body: `[{"op":"add","path":"/metadata/genres/-","value":"classic"}]`, responseCode: http.StatusOK},
+		{contentType: "application/merge-patch+json; charset=utf-8", ifMatch: `"3"`, body: `{"description":null}`, responseCode: http.StatusOK},
+		{contentType: "application/merge-patch+json", ifMatch: `"3"`, body: `{"description":"stale"}`, responseCode: http.StatusPreconditionFailed},
+		{contentType: "application/json", body: `{"title":"Kim"}`, responseCode: http.StatusUnsupportedMediaType},
+		{contentType: "application/merge-patch+json", body: `{"title":`, responseCode: http.StatusBadRequest},
+		{contentType: "application/merge-patch+json", body: `{"author":null}`, responseCode: http.StatusBadRequest},
+		{contentType: "application/merge-patch+json", body: `{"isbn":"9780141182803"}`, responseCode: http.StatusBadRequest},
+		{contentType: "application/merge-patch+json", body: `{"created_at":"2000-01-01T00:00:00Z"}`, responseCode: http.StatusBadRequest},
+		{contentType: "application/merge-patch+json", body: `{"title":5}`, responseCode: http.StatusBadRequest},
+		{contentType: "application/json-patch+json", body: `[{"op":"test","path":"/title","value":"Kim"}]`, responseCode: http.StatusConflict},
+		{contentType: "application/json-patch+json", body: `[{"op":"jump","path":"/title"}]`, responseCode: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		req := httptest.NewRequest(http.MethodPatch, "/books/"+book.ISBN, strings.NewReader(testCase.body))
+		req.Header.Set("Content-Type", testCase.contentType)
+		if testCase.ifMatch != "" {
+			req.Header.Set("If-Match", testCase.ifMatch)
+		}
+		rec = httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		require.Equal(t, testCase.responseCode, rec.Result().StatusCode, testCase.body)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/books/"+book.ISBN, nil))
+	var patched models.Book
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&patched))
+	assert.Equal(t, "Kim (Penguin Classics)", patched.Title)
+	assert.Equal(t, book.Author, patched.Author)
+	assert.Empty(t, patched.Description)
+	assert.Equal(t, []string{"adventure", "classic"}, patched.Metadata.Genres)
+	assert.True(t, book.PublishedAt.Equal(patched.PublishedAt))
+	assert.True(t, added.CreatedAt.Equal(patched.CreatedAt))
+	assert.False(t, patched.UpdatedAt.IsZero())
+	assert.Equal(t, 4, patched.Version)
+
+	req := httptest.NewRequest(http.MethodPatch, "/books/"+newISBN(), strings.NewReader(`{"title":"Kim"}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Result().StatusCode)
+}
+
+func TestPatchCollection(t *testing.T) {
+	s := setUpTestServer(t)
+	for _, name := range []string{"collection1", "collection2"} {
+		var b bytes.Buffer
+		json.NewEncoder(&b).Encode(&models.Collection{Name: name, Description: "great books"})
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collections", &b))
+		require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	}
+
+	testCases := []struct {
+		body         string
+		responseCode int
+	}{
+		{body: `{"name":"Summer Reading"}`, responseCode: http.StatusOK},
+		{body: `{"name":"collection2"}`, responseCode: http.StatusConflict},
+		{body: `{"name":"  "}`, responseCode: http.StatusBadRequest},
+		{body: `{"books":[]}`, responseCode: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		req := httptest.NewRequest(http.MethodPatch, "/collections/collection1", strings.NewReader(testCase.body))
+		if testCase.responseCode != http.StatusOK {
+			req = httptest.NewRequest(http.MethodPatch, "/collections/summer-reading", strings.NewReader(testCase.body))
+		}
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		require.Equal(t, testCase.responseCode, rec.Result().StatusCode, testCase.body)
+	}
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/collections/summer-reading", nil))
+	require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+	var collection models.Collection
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&collection))
+	assert.Equal(t, "Summer Reading", collection.Name)
+	assert.Equal(t, "great books", collection.Description)
+}
+
+func TestTimestamps(t *testing.T) {
+	s := setUpTestServer(t)
+	isbn := newISBN()
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", strings.NewReader(`{
+		"isbn":"`+isbn+`","title":"Kim","author":"Rudyard Kipling",
+		"created_at":"1999-01-01T00:00:00Z","updated_at":"1999-01-02T00:00:00Z","version":7}`)))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+
+	view := func() map[string]interface{} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/books/"+isbn, nil))
+		require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+		var book map[string]interface{}
+		require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&book))
+		return book
+	}
+	book := view()
+	created, ok := book["created_at"].(string)
+	require.True(t, ok, book["created_at"])
+	assert.NotEqual(t, "1999-01-01T00:00:00Z", created)
+	_, err := time.Parse(time.RFC3339, created)
+	assert.NoError(t, err)
+	assert.Nil(t, book["updated_at"])
+	assert.Nil(t, book["deleted_at"])
+	assert.Nil(t, book["published_at"])
+	assert.EqualValues(t, 1, book["version"])
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/books/"+isbn, strings.NewReader(`{
+		"title":"Kim, edited","author":"Rudyard Kipling","created_at":"1999-01-01T00:00:00Z","updated_at":null}`)))
+	require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+	book = view()
+	assert.Equal(t, created, book["created_at"])
+	updated, ok := book["updated_at"].(string)
+	require.True(t, ok, book["updated_at"])
+	_, err = time.Parse(time.RFC3339, updated)
+	assert.NoError(t, err)
+}
+
+func TestImportBooks(t *testing.T) {
+	s := setUpTestServer(t)
+	existing := newISBN()
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", strings.NewReader(`{"isbn":"`+existing+`","title":"Kim","author":"Rudyard Kipling"}`)))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+
+	upload := func(contentType, query, body string) (*http.Response, models.ImportReport) {
+		req := httptest.NewRequest(http.MethodPost, "/books/import"+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		var report models.ImportReport
+		if rec.Result().StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&report))
+		}
+		return rec.Result(), report
+	}
+
+	created := newISBN()
+	csvUpload := "\ufeffISBN,Book Title,Author,Published,Genres\n" +
+		existing + ",Kim,Rudyard Kipling,1901,\"adventure, classic\"\n" +
+		created + ",Nostromo,Joseph Conrad,1904-10,\n" +
+		"not-an-isbn,Lord Jim,Joseph Conrad,,\n" +
+		newISBN() + ",The Secret Agent,Joseph Conrad,someday,\n" +
+		newISBN() + ",Too,Many,Fields,,\n"
+	resp, report := upload("text/csv", "?on_conflict=update&map=Book+Title:title", csvUpload)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, report.Created)
+	assert.Equal(t, 1, report.Updated)
+	assert.Equal(t, 3, report.Failed)
+	require.Len(t, report.Results, 5)
+	assert.Equal(t, 2, report.Results[0].Line)
+	assert.Equal(t, models.ImportUpdated, report.Results[0].Status)
+	assert.Equal(t, models.ImportCreated, report.Results[1].Status)
+	assert.Equal(t, "isbn", report.Results[2].Errors[0].Field)
+	assert.Equal(t, "published", report.Results[3].Errors[0].Field)
+	assert.Equal(t, 6, report.Results[4].Line)
+
+	book, err := s.database.GetBookByISBN(existing)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"adventure", "classic"}, book.Metadata.Genres)
+	assert.Equal(t, models.PrecisionYear, book.PublishedPrecision)
+	book, err = s.database.GetBookByISBN(created)
+	require.NoError(t, err)
+	assert.Equal(t, "Nostromo", book.Title)
+
+	// a dry run keeps nothing
+	dryRun := newISBN()
+	jsonLines := `{"isbn":"` + dryRun + `","title":"Victory","author":"Joseph Conrad"}` + "\n\n" +
+		`{"isbn":"` + created + `","title":"Nostromo","author":"Joseph Conrad"}` + "\n" +
+		`{"isbn":` + "\n"
+	resp, report = upload("application/x-ndjson", "?dry_run=true&on_conflict=fail", jsonLines)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, report.DryRun)
+	require.Len(t, report.Results, 3)
+	assert.Equal(t, models.ImportCreated, report.Results[0].Status)
+	assert.Equal(t, 3, report.Results[1].Line)
+	assert.Equal(t, models.ImportFailed, report.Results[1].Status)
+	assert.Equal(t, models.CodeDuplicate, report.Results[1].Errors[0].Code)
+	assert.Equal(t, models.ImportFailed, report.Results[2].Status)
+	_, err = s.database.GetBookByISBN(dryRun)
+	assert.Error(t, err)
+
+	// lines are checked against the schema, so a misspelled field fails the
+	// line instead of leaving the book without a title
+	misspelled := newISBN()
+	resp, report = upload("application/x-ndjson", "", `{"isbn":"`+misspelled+`","titel":"Victory","author":"Joseph Conrad","version":"2"}`+"\n")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, report.Results, 1)
+	assert.Equal(t, models.ImportFailed, report.Results[0].Status)
+	assert.Equal(t, []responder.Error{
+		{Field: "titel", Pointer: "/titel", Code: models.CodeUnknownField, Message: "unknown field"},
+		{Field: "version", Pointer: "/version", Code: models.CodeInvalidType, Message: "must be an integer"},
+	}, report.Results[0].Errors)
+	_, err = s.database.GetBookByISBN(misspelled)
+	assert.Error(t, err)
+
+	resp, _ = upload("text/csv", "", "isbn,title,author,pages\n")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = upload("text/csv", "", "isbn,title\n")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = upload("application/json", "", "{}")
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	resp, _ = upload("text/csv", "?on_conflict=overwrite", "isbn,title,author\n")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// failingImportStore fails the import of every batch after the first ok
+type failingImportStore struct {
+	database.Store
+	ok int
+}
+
+func (f *failingImportStore) ImportBooks(books []models.Book, onConflict database.ImportConflict, dryRun bool) ([]models.ImportResult, error) {
+	if f.ok == 0 {
+		return nil, errors.New("connection lost")
+	}
+	f.ok--
+	return f.Store.ImportBooks(books, onConflict, dryRun)
+}
+
+func TestImportBooksBatches(t *testing.T) {
+	s := setUpTestServer(t)
+	first := newISBN()
+	var body strings.Builder
+	for i := 0; i < importBatchSize; i++ {
+		isbn := first
+		if i > 0 {
+			isbn = newISBN()
+		}
+		fmt.Fprintf(&body, `{"isbn":"%s","title":"Kim","author":"Rudyard Kipling"}`+"\n", isbn)
+	}
+	// the second batch repeats the first line's isbn
+	fmt.Fprintf(&body, `{"isbn":"%s","title":"Kim","author":"Rudyard Kipling"}`+"\n", first)
+	fmt.Fprintf(&body, `{"isbn":"%s","title":"Kim","author":"Rudyard Kipling"}`+"\n", newISBN())
+	upload := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/books/import"+query, strings.NewReader(body.String()))
+		req.Header.Set("Content-Type", responder.JSONLinesType)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// a dry run sees the books of earlier batches like a real import does
+	rec := upload("?dry_run=true&on_conflict=fail")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var report models.ImportReport
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&report))
+	assert.Equal(t, importBatchSize+1, report.Created)
+	assert.Equal(t, 1, report.Failed)
+	assert.Equal(t, models.ImportFailed, report.Results[importBatchSize].Status)
+
+	// a batch that fails reports what the earlier ones saved
+	s.database = &failingImportStore{Store: s.database, ok: 1}
+	rec = upload("")
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+	var problem struct {
+		responder.ErrorResponse
+		models.ImportReport
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&problem))
+	assert.Equal(t, responder.CodeImportIncomplete, problem.Code)
+	assert.Equal(t, importBatchSize, problem.Created)
+	assert.Len(t, problem.Results, importBatchSize)
+	assert.Equal(t, fmt.Sprintf("the import stopped at line %d, the %d books created or updated before it are saved", importBatchSize+1, importBatchSize), problem.Detail)
+}
+
+func TestExportBooks(t *testing.T) {
+	s := setUpTestServer(t)
+	// more than a page, so that the export has to follow the cursor
+	for i := 0; i < exportPageSize+1; i++ {
+		author := "Joseph Conrad"
+		if i%2 == 1 {
+			author = "Rudyard Kipling"
+		}
+		book := &models.Book{ISBN: newISBN(), Title: fmt.Sprintf("Book %d", i), Author: author}
+		book.Metadata.Genres = []string{"adventure", "classic"}
+		require.NoError(t, s.database.AddBook(book))
+	}
+	export := func(query string) *http.Response {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/books/export"+query, nil))
+		return rec.Result()
+	}
+
+	resp := export("")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, responder.JSONLinesType, resp.Header.Get("Content-Type"))
+	decoder := json.NewDecoder(resp.Body)
+	lines := 0
+	for decoder.More() {
+		var book models.Book
+		require.NoError(t, decoder.Decode(&book))
+		lines++
+	}
+	assert.Equal(t, exportPageSize+1, lines)
+
+	resp = export("?format=csv&author=Joseph+Conrad")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, responder.CSVType, resp.Header.Get("Content-Type"))
+	var body bytes.Buffer
+	_, err := body.ReadFrom(resp.Body)
+	require.NoError(t, err)
+	rows := strings.Split(strings.TrimSpace(body.String()), "\n")
+	assert.Equal(t, "isbn,title,author,description,published,genres", rows[0])
+	assert.Len(t, rows, 1+exportPageSize/2+1)
+	assert.Contains(t, rows[1], `Joseph Conrad,,,"adventure,classic"`)
+
+	// the export can be imported again
+	other := setUpTestServer(t)
+	req := httptest.NewRequest(http.MethodPost, "/books/import", strings.NewReader(body.String()))
+	req.Header.Set("Content-Type", responder.CSVType)
+	rec := httptest.NewRecorder()
+	other.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+	var report models.ImportReport
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&report))
+	assert.Equal(t, exportPageSize/2+1, report.Created)
+	assert.Zero(t, report.Failed)
+
+	// an export of nothing still has its header
+	resp = export("?format=csv&author=Tolstoy")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body.Reset()
+	_, err = body.ReadFrom(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "isbn,title,author,description,published,genres\n", body.String())
+
+	assert.Equal(t, http.StatusBadRequest, export("?format=xml").StatusCode)
+	assert.Equal(t, http.StatusBadRequest, export("?published=someday").StatusCode)
+}
+
+func TestFullBackup(t *testing.T) {
+	s := setUpTestServer(t)
+	kept, trashed := newISBN(), newISBN()
+	for _, isbn := range []string{kept, trashed} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", strings.NewReader(`{"isbn":"`+isbn+`","title":"Kim","author":"Rudyard Kipling"}`)))
+		require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/collections", strings.NewReader(`{"name":"Kipling"}`)))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	var collection models.Collection
+	require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&collection))
+	book, err := s.database.GetBookByISBN(kept)
+	require.NoError(t, err)
+	require.NoError(t, s.database.AddBookToCollection(book, &collection))
+	_, err = s.database.DeleteBookByISBN(trashed, database.DetachDelete)
+	require.NoError(t, err)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/export/full", nil))
+	require.Equal(t, http.StatusOK, rec.Result().StatusCode)
+	backup := rec.Body.String()
+	lines := strings.Split(strings.TrimSpace(backup), "\n")
+	assert.Contains(t, lines[0], `"format":"book-manager-backup"`)
+	assert.Contains(t, lines[len(lines)-1], `"end":{"records":`)
+
+	restore := func(s *Server, body string) (*http.Response, models.BackupSummary) {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/import/full", strings.NewReader(body)))
+		var summary models.BackupSummary
+		if rec.Result().StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&summary))
+		}
+		return rec.Result(), summary
+	}
+
+	restored := setUpTestServer(t)
+	resp, summary := restore(restored, backup)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, models.BackupSummary{Books: 2, Collections: 1, Memberships: 1, Events: summary.Events}, summary)
+	book, err = restored.database.GetBookByISBN(kept)
+	require.NoError(t, err)
+	assert.Equal(t, "Kim", book.Title)
+	_, err = restored.database.GetBookByISBN(trashed)
+	assert.Error(t, err)
+	restoredCollection, err := restored.database.GetCollectionByID(collection.ID)
+	require.NoError(t, err)
+	assert.Len(t, restoredCollection.Books, 1)
+
+	// only an empty catalog can be restored into
+	resp, _ = restore(restored, backup)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	// a backup cut short is not restored at all
+	empty := setUpTestServer(t)
+	resp, _ = restore(empty, strings.Join(lines[:len(lines)-1], "\n"))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	_, err = empty.database.GetBookByISBN(kept)
+	assert.Error(t, err)
+
+	resp, _ = restore(empty, `{"format":"book-manager-backup","version":99}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = restore(empty, `{"isbn":"`+kept+`"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestProblemDetails(t *testing.T) {
+	s := setUpTestServer(t)
+	problem := func(method, path, body string, header http.Header) (*http.Response, responder.ErrorResponse) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		assert.Equal(t, responder.ProblemType, rec.Result().Header.Get("Content-Type"))
+		var errResp responder.ErrorResponse
+		require.NoError(t, json.NewDecoder(rec.Result().Body).Decode(&errResp))
+		assert.Equal(t, rec.Result().StatusCode, errResp.Status)
+		assert.Equal(t, rec.Result().Header.Get(responder.RequestIDHeader), errResp.RequestID)
+		return rec.Result(), errResp
+	}
+
+	resp, errResp := problem(http.MethodPost, "/books", "{", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, responder.CodeMalformedRequest, errResp.Code)
+	assert.Equal(t, "Bad Request", errResp.Title)
+	assert.NotEmpty(t, errResp.RequestID)
+
+	resp, errResp = problem(http.MethodPost, "/books", `{"isbn":"9780141182803"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, responder.CodeValidationFailed, errResp.Code)
+	assert.NotEmpty(t, errResp.Errors)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", strings.NewReader(`{"isbn":"9780141182803","title":"Kim","author":"Rudyard Kipling"}`)))
+	require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	_, errResp = problem(http.MethodPost, "/books", `{"isbn":"978-0-14-118280-3","title":"Kim","author":"Rudyard Kipling"}`, nil)
+	assert.Equal(t, responder.CodeISBNConflict, errResp.Code)
+
+	// the client's request id is kept
+	resp, errResp = problem(http.MethodGet, "/books/9780099578079", "", http.Header{"X-Request-Id": {"trace-42"}})
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, responder.CodeNotFound, errResp.Code)
+	assert.Equal(t, "trace-42", errResp.RequestID)
+
+	resp, errResp = problem(http.MethodGet, "/nowhere", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, responder.CodeNotFound, errResp.Code)
+	resp, errResp = problem(http.MethodDelete, "/trash", "", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, responder.CodeMethodNotAllowed, errResp.Code)
+}
+
+func TestContentNegotiation(t *testing.T) {
+	s := setUpTestServer(t)
+	isbns := []string{newISBN(), newISBN()}
+	for _, isbn := range isbns {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books", strings.NewReader(`{"isbn":"`+isbn+`","title":"Kim <1901>","author":"Rudyard Kipling","metadata":{"genres":["classic"]}}`)))
+		require.Equal(t, http.StatusCreated, rec.Result().StatusCode)
+	}
+	get := func(path, accept string) (*http.Response, string) {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec.Result(), rec.Body.String()
+	}
+
+	resp, body := get("/books", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, responder.JSONType, resp.Header.Get("Content-Type"))
+	assert.Equal(t, strconv.Itoa(len(body)), resp.Header.Get("Content-Length"))
+
+	resp, body = get("/books?limit=1", "text/csv;q=0.5, application/x-ndjson")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, responder.JSONLinesType, resp.Header.Get("Content-Type"))
+	assert.Equal(t, "2", resp.Header.Get("X-Total-Count"))
+	assert.Contains(t, strings.Join(resp.Header.Values("Link"), ", "), `rel="next"`)
+	var book models.Book
+	require.NoError(t, json.Unmarshal([]byte(body), &book))
+	assert.Equal(t, isbns[0], book.ISBN)
+
+	resp, body = get("/books", "text/csv")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, responder.CSVType, resp.Header.Get("Content-Type"))
+	assert.Equal(t, "isbn,title,author,description,published,genres\n"+
+		isbns[0]+",Kim <1901>,Rudyard Kipling,,,classic\n"+
+		isbns[1]+",Kim <1901>,Rudyard Kipling,,,classic\n", body)
+
+	resp, body = get("/books", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Contains(t, body, `<a href="books/`+isbns[0]+`">`)
+	assert.Contains(t, body, "Kim &lt;1901&gt;")
+
+	resp, body = get("/books/"+isbns[0], "text/html")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "<title>Kim &lt;1901&gt;</title>")
+
+	resp, body = get("/collections", "application/x-ndjson")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "0", resp.Header.Get("X-Total-Count"))
+	assert.Empty(t, body)
+
+	resp, body = get("/books/export", "text/csv")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, responder.CSVType, resp.Header.Get("Content-Type"))
+
+	for _, c := range []struct{ path, accept string }{
+		{"/books", "image/png"},
+		{"/books/" + isbns[0], "text/csv"},
+		{"/books/export", "application/json"},
+		{"/books", "application/json;q=0, text/*;q=0"},
+	} {
+		resp, body = get(c.path, c.accept)
+		assert.Equal(t, http.StatusNotAcceptable, resp.StatusCode, c)
+		assert.Equal(t, responder.ProblemType, resp.Header.Get("Content-Type"))
+		assert.Contains(t, body, `"code":"not_acceptable"`)
+	}
+}
+
+func TestAPIVersions(t *testing.T) {
+	s := setUpTestServer(t)
+	do := func(method, path, body string) *http.Response {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec.Result()
+	}
+	isbn, other := newISBN(), newISBN()
+	for _, i := range []string{isbn, other} {
+		require.Equal(t, http.StatusCreated, do(http.MethodPost, "/api/v1/books", `{"isbn":"`+i+`","title":"Kim","author":"Rudyard Kipling"}`).StatusCode)
+	}
+	resp := do(http.MethodPost, "/api/v2/collections", `{"name":"Kipling"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var collection models.Collection
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&collection))
+	books := fmt.Sprintf("/api/v2/collections/%d/books", collection.ID)
+
+	// the routes from before versioning still work, but are deprecated
+	resp = do(http.MethodGet, "/books/"+isbn, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf("@%d", legacyDeprecatedAt.Unix()), resp.Header.Get("Deprecation"))
+	assert.Equal(t, legacySunset.Format(http.TimeFormat), resp.Header.Get("Sunset"))
+	assert.Equal(t, `</api/v1/books/`+isbn+`>; rel="successor-version"`, resp.Header.Get("Link"))
+	resp = do(http.MethodGet, "/api/v1/books/"+isbn, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Deprecation"))
+
+	// v2 has membership resources in place of addbooks and removebooks
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPost, fmt.Sprintf("/api/v2/collections/%d/addbooks", collection.ID), `{"books_to_add":[]}`).StatusCode)
+	assert.Equal(t, http.StatusCreated, do(http.MethodPut, books+"/"+isbn, "").StatusCode)
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, books+"/"+isbn, "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodPut, books+"/"+newISBN(), "").StatusCode)
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, books, `{"isbns":["`+other+`"]}`).StatusCode)
+
+	resp = do(http.MethodGet, books, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var list models.BookList
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&list))
+	assert.Equal(t, 2, list.Total)
+
+	assert.Equal(t, http.StatusOK, do(http.MethodDelete, books+"/"+isbn, "").StatusCode)
+	resp = do(http.MethodDelete, books+"/"+isbn, "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	var errResp responder.ErrorResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+	assert.Equal(t, responder.CodeNotFound, errResp.Code)
+
+	// v1 still speaks addbooks
+	resp = do(http.MethodPost, fmt.Sprintf("/api/v1/collections/%d/addbooks", collection.ID), `{"books_to_add":["`+isbn+`"]}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do(http.MethodGet, "/api/v1/nowhere", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, responder.ProblemType, resp.Header.Get("Content-Type"))
+	resp = do(http.MethodDelete, "/api/v1/trash", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, responder.ProblemType, resp.Header.Get("Content-Type"))
+}
+
+func TestOpenAPI(t *testing.T) {
+	s := setUpTestServer(t)
+
+	specs := map[string]map[string]interface{}{}
+	for _, prefix := range []string{v1Prefix, v2Prefix} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, prefix+"/openapi.json", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var spec map[string]interface{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&spec))
+		assert.Equal(t, "3.0.3", spec["openapi"])
+		specs[prefix] = spec
+	}
+
+	// every route is described by the spec of its version, the unversioned
+	// ones by that of v1
+	err := s.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		path, err := route.GetPathTemplate()
+		require.NoError(t, err)
+		prefix := v1Prefix
+		if strings.HasPrefix(path, v2Prefix) {
+			prefix = v2Prefix
+		}
+		path = strings.TrimPrefix(path, prefix)
+		paths := specs[prefix]["paths"].(map[string]interface{})
+		for _, method := range methods {
+			operations, _ := paths[path].(map[string]interface{})
+			assert.Contains(t, operations, strings.ToLower(method), "%s %s%s is missing from the spec", method, prefix, path)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	paths := specs[v2Prefix]["paths"].(map[string]interface{})
+	assert.NotContains(t, paths, "/collections/{collection}/addbooks")
+	get := paths["/books/{isbn}"].(map[string]interface{})["get"].(map[string]interface{})
+	ok := get["responses"].(map[string]interface{})["200"].(map[string]interface{})
+	schema := ok["content"].(map[string]interface{})[responder.JSONType].(map[string]interface{})["schema"]
+	assert.Equal(t, map[string]interface{}{"$ref": "#/components/schemas/Book"}, schema)
+
+	book := specs[v2Prefix]["components"].(map[string]interface{})["schemas"].(map[string]interface{})["Book"].(map[string]interface{})
+	properties := book["properties"].(map[string]interface{})
+	for _, name := range []string{"isbn", "title", "author", "published_at", "published_precision", "metadata", "version"} {
+		assert.Contains(t, properties, name)
+	}
+	assert.NotContains(t, properties, "published_date")
+	assert.Contains(t, properties, "collections")
+	collection := specs[v2Prefix]["components"].(map[string]interface{})["schemas"].(map[string]interface{})["Collection"].(map[string]interface{})
+	assert.Contains(t, collection["properties"], "books")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/docs", nil)
+	r.Header.Set("Accept", "text/html")
+	s.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `url: "openapi.json"`)
+	assert.Contains(t, w.Body.String(), `src="docs/swagger-ui-bundle.js"`)
+
+	// the page loads the embedded copy of Swagger UI unless told otherwise
+	version, err := swaggerUI.ReadFile("swaggerui/VERSION")
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/docs/VERSION", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, string(version), w.Body.String())
+	for asset, contentType := range map[string]string{"swagger-ui-bundle.js": "javascript", "swagger-ui.css": "text/css"} {
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/docs/"+asset, nil))
+		require.Equal(t, http.StatusOK, w.Code, asset)
+		assert.Contains(t, w.Header().Get("Content-Type"), contentType, asset)
+		assert.NotEmpty(t, w.Body.Len(), asset)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/docs/swagger-ui-bundle.js", nil))
+	assert.Contains(t, w.Body.String(), "SwaggerUIBundle")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/docs/missing.js", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	s.swaggerUIURL = "https://assets.example.com/swagger-ui/"
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/api/v2/docs", nil)
+	r.Header.Set("Accept", "text/html")
+	s.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `src="https://assets.example.com/swagger-ui/swagger-ui-bundle.js"`)
+}
+
+func TestRequestValidation(t *testing.T) {
+	s := setUpTestServer(t)
+	s.Router, s.maxBodySize = mux.NewRouter(), 1024
+	s.configureRoutes()
+	do := func(method, path, body string) *http.Response {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w.Result()
+	}
+	problem := func(resp *http.Response) responder.ErrorResponse {
+		var errResp responder.ErrorResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+		return errResp
+	}
+
+	resp := do(http.MethodPost, "/api/v1/books", `{"isbn":"`+newISBN()+`","titel":"Typhoon","author":"Joseph Conrad","version":"1","metadata":{"genres":["classic",3]},"published_at":"1902"}`)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	errResp := problem(resp)
+	assert.Equal(t, responder.CodeValidationFailed, errResp.Code)
+	assert.Equal(t, []responder.Error{
+		{Field: "metadata.genres[1]", Pointer: "/metadata/genres/1", Code: models.CodeInvalidType, Message: "must be a string"},
+		{Field: "published_at", Pointer: "/published_at", Code: models.CodeInvalid, Message: "must be a date and time such as 1894-05-01T00:00:00Z"},
+		{Field: "titel", Pointer: "/titel", Code: models.CodeUnknownField, Message: "unknown field"},
+		{Field: "version", Pointer: "/version", Code: models.CodeInvalidType, Message: "must be an integer"},
+	}, errResp.Errors)
+
+	// a book as the api returns it can be sent back as it is
+	isbn := newISBN()
+	resp = do(http.MethodPost, "/api/v1/books", `{"isbn":"`+isbn+`","title":"Typhoon","author":"Joseph Conrad","published_at":null,"metadata":{"genres":null}}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = do(http.MethodGet, "/api/v1/books/"+isbn, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var book bytes.Buffer
+	_, err := book.ReadFrom(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "/api/v1/books/"+isbn, book.String()).StatusCode)
+
+	resp = do(http.MethodGet, "/api/v1/books?limit=ten&purge=true", "")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, []responder.Error{
+		{Field: "limit", Code: models.CodeInvalidType, Message: "must be an integer"},
+		{Field: "purge", Code: models.CodeUnknownField, Message: "unknown query parameter"},
+	}, problem(resp).Errors)
+
+	resp = do(http.MethodPost, "/api/v1/books", `{"title":`)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, responder.CodeMalformedRequest, problem(resp).Code)
+
+	resp = do(http.MethodPost, "/api/v1/books", `{"description":"`+strings.Repeat("a", 1024)+`"}`)
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Equal(t, responder.CodeBodyTooLarge, problem(resp).Code)
+
+	// imports are streamed, and not limited
+	lines := strings.Repeat(`{"isbn":"`+isbn+`","title":"Typhoon","author":"Joseph Conrad"}`+"\n", 20)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/books/import", strings.NewReader(lines))
+	r.Header.Set("Content-Type", responder.JSONLinesType)
+	s.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
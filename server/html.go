@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/john-cai/book-manager/models"
+)
+
+// page is what pageTemplate renders: a listing of books or collections, one
+// book or collection, or any other result as indented JSON
+type page struct {
+	Title       string
+	Books       *models.BookList
+	Book        *models.Book
+	Collections *models.CollectionList
+	Collection  *models.Collection
+	JSON        string
+	// Next and Prev link to the pages around a listing's page
+	Next, Prev string
+}
+
+func newPage(r *http.Request, result interface{}) page {
+	p := page{Title: "Book Manager"}
+	switch result := result.(type) {
+	case *models.BookList:
+		p.Title, p.Books = "Books", result
+		p.Next, p.Prev = pageURL(r, result.NextCursor), pageURL(r, result.PrevCursor)
+	case *models.Book:
+		p.Title, p.Book = result.Title, result
+	case *models.CollectionList:
+		p.Title, p.Collections = "Collections", result
+		p.Next, p.Prev = pageURL(r, result.NextCursor), pageURL(r, result.PrevCursor)
+	case *models.Collection:
+		p.Title, p.Collection = result.Name, result
+	default:
+		doc, err := json.MarshalIndent(result, "", "    ")
+		if err != nil {
+			doc = []byte(err.Error())
+		}
+		p.JSON = string(doc)
+	}
+	return p
+}
+
+// pageURL is the url of the page of a listing at cursor, relative to the
+// listing so that it works behind a path prefix
+func pageURL(r *http.Request, cursor string) string {
+	if cursor == "" {
+		return ""
+	}
+	url := cursorURL(r, cursor)
+	return url[strings.Index(url, "?"):]
+}
+
+var pageTemplate = template.Must(template.New("page").Funcs(template.FuncMap{
+	"join": strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border-bottom: 1px solid #ddd; padding: 0.3em 0.8em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{with .Books}}
+<p>{{.Total}} books</p>
+<table>
+<tr><th>ISBN</th><th>Title</th><th>Author</th><th>Published</th><th>Genres</th></tr>
+{{range .Results}}<tr><td><a href="books/{{.ISBN}}">{{.ISBN}}</a></td><td>{{.Title}}</td><td>{{.Author}}</td><td>{{.PublishedDate}}</td><td>{{join .Metadata.Genres ", "}}</td></tr>
+{{end}}</table>
+{{end}}
+{{with .Collections}}
+<p>{{.Total}} collections</p>
+<table>
+<tr><th>Name</th><th>Description</th><th>Books</th></tr>
+{{range .Results}}<tr><td><a href="collections/{{.ID}}">{{.Name}}</a></td><td>{{.Description}}</td><td>{{len .Books}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if or .Prev .Next}}<p>{{with .Prev}}<a href="{{.}}">previous page</a> {{end}}{{with .Next}}<a href="{{.}}">next page</a>{{end}}</p>{{end}}
+{{with .Book}}
+<dl>
+<dt>ISBN</dt><dd>{{.ISBN}}</dd>
+<dt>Author</dt><dd>{{.Author}}</dd>
+<dt>Published</dt><dd>{{.PublishedDate}}</dd>
+<dt>Genres</dt><dd>{{join .Metadata.Genres ", "}}</dd>
+<dt>Description</dt><dd>{{.Description}}</dd>
+</dl>
+{{end}}
+{{with .Collection}}
+<p>{{.Description}}</p>
+<table>
+<tr><th>ISBN</th><th>Title</th><th>Author</th></tr>
+{{range .Books}}<tr><td><a href="../books/{{.ISBN}}">{{.ISBN}}</a></td><td>{{.Title}}</td><td>{{.Author}}</td></tr>
+{{end}}</table>
+{{end}}
+{{with .JSON}}<pre>{{.}}</pre>{{end}}
+</body>
+</html>
+`))
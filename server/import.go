@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/gommon/log"
+
+	"github.com/john-cai/book-manager/database"
+	"github.com/john-cai/book-manager/models"
+	"github.com/john-cai/book-manager/responder"
+)
+
+// importBatchSize is how many books are imported in each transaction
+const importBatchSize = 500
+
+// ImportBooks adds the books in a CSV or JSON Lines upload, reading it a line
+// at a time and saving the books in batches, and reports what happened to
+// each line. When a batch fails the lines before it stay saved, and are
+// reported along with the error.
+func (s *Server) ImportBooks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	onConflict, err := database.ParseImportConflict(query.Get("on_conflict"))
+	if err != nil {
+		if err = responder.RespondError(w, responder.CodeValidationFailed, err.Error(), "on_conflict", http.StatusBadRequest); err != nil {
+			log.Errorf("error when responding with 400 error: %v", err)
+		}
+		return
+	}
+	dryRun := false
+	if query.Get("dry_run") != "" {
+		if dryRun, err = strconv.ParseBool(query.Get("dry_run")); err != nil {
+			if err = responder.RespondError(w, responder.CodeValidationFailed, "must be true or false", "dry_run", http.StatusBadRequest); err != nil {
+				log.Errorf("error when responding with 400 error: %v", err)
+			}
+			return
+		}
+	}
+
+	var rows bookRows
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case responder.CSVType:
+		columns, err := parseColumnMap(query.Get("map"))
+		if err != nil {
+			if err = responder.RespondError(w, responder.CodeValidationFailed, err.Error(), "map", http.StatusBadRequest); err != nil {
+				log.Errorf("error when responding with 400 error: %v", err)
+			}
+			return
+		}
+		if rows, err = newCSVBookRows(r.Body, columns); err != nil {
+			if err = responder.RespondError(w, responder.CodeValidationFailed, err.Error(), "", http.StatusBadRequest); err != nil {
+				log.Errorf("error when responding with 400 error: %v", err)
+			}
+			return
+		}
+	case responder.JSONLinesType, "application/jsonl":
+		rows = &jsonLinesBookRows{reader: bufio.NewReader(r.Body)}
+	default:
+		if err = responder.RespondError(w, responder.CodeUnsupportedMediaType, "must be "+responder.CSVType+" or "+responder.JSONLinesType, "Content-Type", http.StatusUnsupportedMediaType); err != nil {
+			log.Errorf("error when responding with 415 error: %v", err)
+		}
+		return
+	}
+
+	report := &models.ImportReport{DryRun: dryRun, Results: []models.ImportResult{}}
+	var batch []models.Book
+	var lines []int
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		results, err := s.database.ImportBooks(batch, onConflict, dryRun)
+		if err != nil {
+			return err
+		}
+		for i, result := range results {
+			result.Line = lines[i]
+			report.Add(result)
+		}
+		batch, lines = batch[:0], lines[:0]
+		return nil
+	}
+	for {
+		row, readErr := rows.next()
+		if readErr == io.EOF {
+			err = flush()
+			break
+		}
+		if readErr != nil {
+			if err = responder.RespondError(w, responder.CodeMalformedRequest, "could not read request", "", http.StatusBadRequest); err != nil {
+				log.Errorf("error when responding with 400 error: %v", err)
+			}
+			return
+		}
+		if len(row.errs) == 0 {
+			row.book.ClearReadOnly()
+			row.errs = models.ValidateBook(row.book)
+		}
+		if len(row.errs) > 0 {
+			report.Add(models.ImportResult{Line: row.line, ISBN: row.book.ISBN, Status: models.ImportFailed, Errors: row.errs})
+			continue
+		}
+		row.book.Normalize()
+		batch, lines = append(batch, row.book), append(lines, row.line)
+		// a dry run checks every book in one transaction, so that each is
+		// checked with the ones before it in place as in a real import
+		if len(batch) == importBatchSize && !dryRun {
+			if err = flush(); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Errorf("error when importing books: %v", err)
+		respondImportIncomplete(w, report, lines[0])
+		return
+	}
+
+	sort.SliceStable(report.Results, func(i, j int) bool { return report.Results[i].Line < report.Results[j].Line })
+	if err = respond(w, r, report, http.StatusOK); err != nil {
+		log.Errorf("error when responding with 200 error %v", err)
+	}
+}
+
+// respondImportIncomplete answers an import whose batch starting at line
+// stop failed with a 500 problem reporting the lines before it. Those the
+// report says were created or updated have been saved by earlier batches.
+func respondImportIncomplete(w http.ResponseWriter, report *models.ImportReport, stop int) {
+	partial := &models.ImportReport{DryRun: report.DryRun, Results: []models.ImportResult{}}
+	for _, result := range report.Results {
+		if result.Line < stop {
+			partial.Add(result)
+		}
+	}
+	sort.SliceStable(partial.Results, func(i, j int) bool { return partial.Results[i].Line < partial.Results[j].Line })
+	problem := responder.NewProblem(w, responder.CodeImportIncomplete, http.StatusInternalServerError)
+	problem.Detail = fmt.Sprintf("the import stopped at line %d, the %d books created or updated before it are saved", stop, partial.Created+partial.Updated)
+	err := responder.RespondProblem(w, struct {
+		responder.ErrorResponse
+		*models.ImportReport
+	}{problem, partial}, http.StatusInternalServerError)
+	if err != nil {
+		log.Errorf("error when responding with 500 error: %v", err)
+	}
+}
+
+// bookRow is a line of an upload: a book, or what is wrong with the line
+type bookRow struct {
+	line int
+	book models.Book
+	errs []responder.Error
+}
+
+// bookRows reads the books of an upload one line at a time, returning io.EOF
+// after the last one. Lines that cannot be read are returned with their
+// errors; other errors mean the rest of the upload cannot be read.
+type bookRows interface {
+	next() (bookRow, error)
+}
+
+// csvFields are the fields CSV columns can hold. published is a YYYY,
+// YYYY-MM or YYYY-MM-DD date and genres is a comma separated list.
+var csvFields = []string{"isbn", "title", "author", "description", "published", "genres"}
+
+// parseColumnMap parses a map parameter, which maps CSV headers to fields as
+// comma separated header:field pairs (Book Title:title,Writer:author).
+// Headers are matched ignoring case.
+func parseColumnMap(s string) (map[string]string, error) {
+	columns := make(map[string]string)
+	if s == "" {
+		return columns, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		header, field, ok := strings.Cut(pair, ":")
+		if !ok || strings.TrimSpace(header) == "" {
+			return nil, fmt.Errorf("%q is not a header:field pair", pair)
+		}
+		columns[strings.ToLower(strings.TrimSpace(header))] = strings.TrimSpace(field)
+	}
+	return columns, nil
+}
+
+type csvBookRows struct {
+	reader *csv.Reader
+	// fields is the field of each column
+	fields []string
+}
+
+// newCSVBookRows reads the header of a CSV upload. Every column has to be
+// one of csvFields, by its name or through columns, and isbn, title and
+// author are required.
+func newCSVBookRows(r io.Reader, columns map[string]string) (*csvBookRows, error) {
+	rows := &csvBookRows{reader: csv.NewReader(r)}
+	rows.reader.FieldsPerRecord = -1
+	header, err := rows.reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("the upload is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read the header: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	for i, name := range header {
+		if i == 0 {
+			// spreadsheets like to start with a byte order mark
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		field := strings.ToLower(strings.TrimSpace(name))
+		if mapped, ok := columns[field]; ok {
+			field = mapped
+		}
+		known := false
+		for _, f := range csvFields {
+			known = known || f == field
+		}
+		if !known {
+			return nil, fmt.Errorf("column %q is not one of %s, map it to one with the map parameter", name, strings.Join(csvFields, ", "))
+		}
+		if seen[field] {
+			return nil, fmt.Errorf("more than one column holds %s", field)
+		}
+		seen[field] = true
+		rows.fields = append(rows.fields, field)
+	}
+	for _, field := range []string{"isbn", "title", "author"} {
+		if !seen[field] {
+			return nil, fmt.Errorf("a %s column is required", field)
+		}
+	}
+	return rows, nil
+}
+
+func (rows *csvBookRows) next() (bookRow, error) {
+	record, err := rows.reader.Read()
+	if parseErr, ok := err.(*csv.ParseError); ok {
+		return bookRow{
+			line: parseErr.StartLine,
+			errs: []responder.Error{{Code: models.CodeInvalid, Message: parseErr.Err.Error()}},
+		}, nil
+	}
+	if err != nil {
+		return bookRow{}, err
+	}
+
+	row := bookRow{}
+	row.line, _ = rows.reader.FieldPos(0)
+	if len(record) != len(rows.fields) {
+		row.errs = []responder.Error{{
+			Code:    models.CodeInvalid,
+			Message: fmt.Sprintf("has %d fields but the header has %d", len(record), len(rows.fields)),
+		}}
+		return row, nil
+	}
+	for i, value := range record {
+		value = strings.TrimSpace(value)
+		switch rows.fields[i] {
+		case "isbn":
+			row.book.ISBN = value
+		case "title":
+			row.book.Title = value
+		case "author":
+			row.book.Author = value
+		case "description":
+			row.book.Description = value
+		case "published":
+			if value == "" {
+				continue
+			}
+			if row.book.PublishedAt, row.book.PublishedPrecision, err = models.ParsePartialDate(value); err != nil {
+				row.errs = append(row.errs, responder.Error{Field: "published", Code: models.CodeInvalid, Message: "must be a YYYY, YYYY-MM or YYYY-MM-DD date"})
+			}
+		case "genres":
+			for _, genre := range strings.Split(value, ",") {
+				if genre = strings.TrimSpace(genre); genre != "" {
+					row.book.Metadata.Genres = append(row.book.Metadata.Genres, genre)
+				}
+			}
+		}
+	}
+	return row, nil
+}
+
+// bookRowValidator checks the lines of a JSON Lines upload
+var bookRowValidator = newValidator(operations["POST /books"], 0)
+
+// jsonLinesBookRows reads an upload with a book, as it is sent to POST
+// /books, on each line. Blank lines are skipped.
+type jsonLinesBookRows struct {
+	reader *bufio.Reader
+	line   int
+}
+
+func (rows *jsonLinesBookRows) next() (bookRow, error) {
+	for {
+		data, err := rows.reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return bookRow{}, err
+		}
+		if len(data) == 0 && err == io.EOF {
+			return bookRow{}, io.EOF
+		}
+		rows.line++
+		if data = bytes.TrimSpace(data); len(data) == 0 {
+			continue
+		}
+
+		// each line is checked against the schema like the body of POST
+		// /books, so that misspelled fields fail rather than go missing
+		row := bookRow{line: rows.line}
+		if row.errs, err = bookRowValidator.json(data); err == nil && len(row.errs) == 0 {
+			err = json.Unmarshal(data, &row.book)
+		}
+		if err != nil {
+			row.errs = []responder.Error{{Code: models.CodeInvalid, Message: "is not a book: " + err.Error()}}
+		}
+		return row, nil
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/gommon/log"
+
+	"github.com/john-cai/book-manager/models"
+	"github.com/john-cai/book-manager/responder"
+)
+
+// Media types routes answer with
+var (
+	// defaultTypes are those of most routes: JSON, and an HTML page for
+	// browsers
+	defaultTypes        = []string{responder.JSONType, responder.HTMLType}
+	bookListTypes       = []string{responder.JSONType, responder.JSONLinesType, responder.CSVType, responder.HTMLType}
+	collectionListTypes = []string{responder.JSONType, responder.JSONLinesType, responder.HTMLType}
+	bookExportTypes     = []string{responder.JSONLinesType, responder.CSVType}
+	backupTypes         = []string{responder.JSONLinesType}
+)
+
+type responseTypeKey struct{}
+
+// negotiate picks the media type of the response, out of the offers of a
+// route, from the request's Accept header before the route runs, answering
+// 406 when the route cannot answer with any type the request accepts
+func negotiate(offers []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType := responder.Negotiate(r, offers...)
+		if mediaType == "" {
+			if err := responder.RespondNotAcceptable(w, offers); err != nil {
+				log.Errorf("error when responding with 406 error: %v", err)
+			}
+			return
+		}
+		w.Header().Add("Vary", "Accept")
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), responseTypeKey{}, mediaType)))
+	})
+}
+
+// responseType is the media type negotiated for the response to r
+func responseType(r *http.Request) string {
+	if mediaType, ok := r.Context().Value(responseTypeKey{}).(string); ok {
+		return mediaType
+	}
+	return responder.JSONType
+}
+
+// respond answers with result as JSON, or as an HTML page when that is what
+// the request prefers
+func respond(w http.ResponseWriter, r *http.Request, result interface{}, httpStatus int) error {
+	if responseType(r) == responder.HTMLType {
+		return responder.RespondHTML(w, pageTemplate, newPage(r, result), httpStatus)
+	}
+	return responder.RespondResult(w, result, httpStatus)
+}
+
+// setPageLinks points to the pages around a page of a listing in the Link
+// header, and gives the listing's total in X-Total-Count, for the media
+// types that have no room for them in the body
+func setPageLinks(w http.ResponseWriter, r *http.Request, total int, nextCursor, prevCursor string) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	var links []string
+	for _, link := range []struct{ rel, cursor string }{{"next", nextCursor}, {"prev", prevCursor}} {
+		if link.cursor != "" {
+			links = append(links, fmt.Sprintf(`<%s>; rel="%s"`, cursorURL(r, link.cursor), link.rel))
+		}
+	}
+	if len(links) > 0 {
+		w.Header().Add("Link", strings.Join(links, ", "))
+	}
+}
+
+// cursorURL is the url of the page of r's listing at cursor
+func cursorURL(r *http.Request, cursor string) string {
+	query := r.URL.Query()
+	query.Set("cursor", cursor)
+	return r.URL.Path + "?" + query.Encode()
+}
+
+// respondBookList answers with a page of books in the negotiated media type.
+// JSON Lines and CSV are streamed a book at a time.
+func respondBookList(w http.ResponseWriter, r *http.Request, books *models.BookList) error {
+	var writer bookWriter
+	switch responseType(r) {
+	case responder.JSONLinesType:
+		writer = newJSONLinesBookWriter(w)
+	case responder.CSVType:
+		writer = newCSVBookWriter(w)
+	default:
+		return respond(w, r, books, http.StatusOK)
+	}
+	w.Header().Set("Content-Type", responseType(r))
+	setPageLinks(w, r, books.Total, books.NextCursor, books.PrevCursor)
+	for i := range books.Results {
+		if err := writer.write(&books.Results[i]); err != nil {
+			return err
+		}
+	}
+	return writer.flush()
+}
+
+// respondCollectionList answers with a page of collections in the negotiated
+// media type
+func respondCollectionList(w http.ResponseWriter, r *http.Request, collections *models.CollectionList) error {
+	if responseType(r) != responder.JSONLinesType {
+		return respond(w, r, collections, http.StatusOK)
+	}
+	w.Header().Set("Content-Type", responder.JSONLinesType)
+	setPageLinks(w, r, collections.Total, collections.NextCursor, collections.PrevCursor)
+	encoder := json.NewEncoder(w)
+	for i := range collections.Results {
+		if err := encoder.Encode(&collections.Results[i]); err != nil {
+			return err
+		}
+	}
+	flushResponse(w)
+	return nil
+}
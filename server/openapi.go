@@ -0,0 +1,497 @@
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"html/template"
+	"mime"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/labstack/gommon/log"
+
+	"github.com/john-cai/book-manager/models"
+	"github.com/john-cai/book-manager/patch"
+	"github.com/john-cai/book-manager/responder"
+)
+
+// operation documents a route in the OpenAPI spec
+type operation struct {
+	summary string
+	// params are the names of the route's query parameters, as described in
+	// queryParams, and headers those of its request headers
+	params  []string
+	headers []string
+	// body is a value of the type of the request's JSON body, nil when it
+	// has none. bodyTypes are the media types of a body that is not JSON.
+	body      interface{}
+	bodyTypes []string
+	// responses are values of the type of the result at each status. Those
+	// left nil are problem documents.
+	responses map[int]interface{}
+}
+
+// queryParams describe the query parameters of the api
+var queryParams = map[string]struct {
+	kind, description string
+}{
+	"isbn":           {"string", "only books with this isbn, as an ISBN-10 or ISBN-13"},
+	"title":          {"string", "only books with this title"},
+	"author":         {"string", "only books by this author"},
+	"published":      {"string", "only books published on this YYYY, YYYY-MM or YYYY-MM-DD date"},
+	"published_from": {"string", "only books published on or after this YYYY, YYYY-MM or YYYY-MM-DD date"},
+	"published_to":   {"string", "only books published on or before this YYYY, YYYY-MM or YYYY-MM-DD date"},
+	"genres":         {"string", "comma separated genres the books need"},
+	"genres_match":   {"string", "any (the default) or all: whether books need any or all of genres"},
+	"q":              {"string", "words to search titles, authors and descriptions for, best match first"},
+	"limit":          {"integer", "number of results per page"},
+	"cursor":         {"string", "cursor of the page to list, from the next_cursor or prev_cursor of another page"},
+	"sort":           {"string", "comma separated fields to sort by, prefixed with - for descending"},
+	"purge":          {"boolean", "delete permanently rather than move to the trash"},
+	"atomic":         {"boolean", "change nothing when any isbn fails, true by default"},
+	"format":         {"string", "csv or jsonl, taking precedence over Accept"},
+	"on_conflict":    {"string", "skip (the default), update or fail the books whose isbn already exists"},
+	"dry_run":        {"boolean", "report what the import would do without saving anything"},
+	"map":            {"string", "maps CSV headers to fields as header:field pairs"},
+	"deleted_from":   {"string", "only what was deleted on or after this date or time"},
+	"deleted_to":     {"string", "only what was deleted on or before this date or time"},
+}
+
+var bookFilterParams = []string{"isbn", "title", "author", "published", "published_from", "published_to", "genres", "genres_match", "q"}
+
+// operations document the routes of every version of the api, by method and
+// path. A route missing from here is missing from the spec.
+var operations = map[string]operation{
+	"POST /books": {
+		summary:   "Add a book",
+		body:      models.Book{},
+		responses: map[int]interface{}{201: models.Book{}, 400: nil, 409: nil},
+	},
+	"GET /books": {
+		summary:   "List or search books, a page at a time",
+		params:    append(bookFilterParams, "limit", "cursor", "sort"),
+		responses: map[int]interface{}{200: models.BookList{}, 400: nil},
+	},
+	"GET /books/export": {
+		summary:   "Export every book matching the filters",
+		params:    append(bookFilterParams, "sort", "format"),
+		responses: map[int]interface{}{200: nil, 400: nil},
+	},
+	"POST /books/import": {
+		summary:   "Add books in bulk from CSV or JSON Lines",
+		params:    []string{"on_conflict", "dry_run", "map"},
+		bodyTypes: []string{responder.CSVType, responder.JSONLinesType},
+		responses: map[int]interface{}{200: models.ImportReport{}, 400: nil, 415: nil},
+	},
+	"GET /books/{isbn}": {
+		summary:   "View a book",
+		headers:   []string{"If-None-Match"},
+		responses: map[int]interface{}{200: models.Book{}, 304: nil, 400: nil, 404: nil},
+	},
+	"PUT /books/{isbn}": {
+		summary:   "Edit a book",
+		headers:   []string{"If-Match"},
+		body:      models.Book{},
+		responses: map[int]interface{}{200: models.Book{}, 400: nil, 404: nil, 412: nil, 428: nil},
+	},
+	"PATCH /books/{isbn}": {
+		summary:   "Patch a book with a merge patch or JSON patch",
+		headers:   []string{"If-Match"},
+		bodyTypes: []string{patch.MergePatchType, patch.JSONPatchType},
+		responses: map[int]interface{}{200: models.Book{}, 400: nil, 404: nil, 409: nil, 412: nil, 415: nil, 428: nil},
+	},
+	"DELETE /books/{isbn}": {
+		summary:   "Move a book to the trash, or purge it",
+		params:    []string{"purge"},
+		responses: map[int]interface{}{200: models.DeleteReport{}, 400: nil, 404: nil, 409: nil},
+	},
+	"POST /books/{isbn}/restore": {
+		summary:   "Take a book out of the trash",
+		responses: map[int]interface{}{200: models.Book{}, 400: nil, 404: nil},
+	},
+
+	"POST /collections": {
+		summary:   "Add a collection",
+		body:      models.Collection{},
+		responses: map[int]interface{}{201: models.Collection{}, 400: nil, 409: nil},
+	},
+	"GET /collections": {
+		summary:   "List collections, a page at a time",
+		params:    []string{"limit", "cursor", "sort"},
+		responses: map[int]interface{}{200: models.CollectionList{}, 400: nil},
+	},
+	"GET /collections/{collection}": {
+		summary:   "View a collection by its id, name or slug",
+		headers:   []string{"If-None-Match"},
+		responses: map[int]interface{}{200: models.Collection{}, 304: nil, 404: nil},
+	},
+	"PUT /collections/{collection}": {
+		summary:   "Edit a collection",
+		headers:   []string{"If-Match"},
+		body:      models.Collection{},
+		responses: map[int]interface{}{200: models.Collection{}, 400: nil, 404: nil, 409: nil, 412: nil, 428: nil},
+	},
+	"PATCH /collections/{collection}": {
+		summary:   "Patch a collection with a merge patch or JSON patch",
+		headers:   []string{"If-Match"},
+		bodyTypes: []string{patch.MergePatchType, patch.JSONPatchType},
+		responses: map[int]interface{}{200: models.Collection{}, 400: nil, 404: nil, 409: nil, 412: nil, 415: nil, 428: nil},
+	},
+	"DELETE /collections/{collection}": {
+		summary:   "Move a collection to the trash, or purge it",
+		params:    []string{"purge"},
+		responses: map[int]interface{}{200: models.DeleteReport{}, 400: nil, 404: nil, 409: nil},
+	},
+	"POST /collections/{collection}/addbooks": {
+		summary:   "Add books to a collection in bulk",
+		params:    []string{"atomic"},
+		body:      AddBooksPayload{},
+		responses: map[int]interface{}{200: models.MembershipReport{}, 400: nil, 404: nil, 422: models.MembershipReport{}},
+	},
+	"POST /collections/{collection}/removebooks": {
+		summary:   "Remove books from a collection in bulk",
+		params:    []string{"atomic"},
+		body:      RemoveBooksPayload{},
+		responses: map[int]interface{}{200: models.MembershipReport{}, 400: nil, 404: nil, 422: models.MembershipReport{}},
+	},
+	"POST /collections/{collection}/restore": {
+		summary:   "Take a collection out of the trash",
+		responses: map[int]interface{}{200: models.Collection{}, 400: nil, 404: nil},
+	},
+	"GET /collections/{collection}/history": {
+		summary:   "List the books added to and removed from a collection, oldest first",
+		responses: map[int]interface{}{200: models.CollectionHistory{}, 404: nil},
+	},
+	"GET /collections/{collection}/books": {
+		summary:   "List the books of a collection",
+		responses: map[int]interface{}{200: models.BookList{}, 404: nil},
+	},
+	"POST /collections/{collection}/books": {
+		summary:   "Add books to a collection in bulk",
+		params:    []string{"atomic"},
+		body:      CollectionBooksPayload{},
+		responses: map[int]interface{}{200: models.MembershipReport{}, 400: nil, 404: nil, 422: models.MembershipReport{}},
+	},
+	"PUT /collections/{collection}/books/{isbn}": {
+		summary:   "Add a book to a collection",
+		responses: map[int]interface{}{200: models.MembershipResult{}, 201: models.MembershipResult{}, 400: nil, 404: nil},
+	},
+	"DELETE /collections/{collection}/books/{isbn}": {
+		summary:   "Remove a book from a collection",
+		responses: map[int]interface{}{200: models.MembershipResult{}, 400: nil, 404: nil},
+	},
+
+	"GET /trash": {
+		summary:   "List the books and collections in the trash",
+		params:    []string{"deleted_from", "deleted_to"},
+		responses: map[int]interface{}{200: models.Trash{}, 400: nil},
+	},
+
+	"GET /export/full": {
+		summary:   "Stream a full backup of the catalog",
+		responses: map[int]interface{}{200: nil},
+	},
+	"POST /import/full": {
+		summary:   "Restore a full backup into an empty catalog",
+		bodyTypes: []string{responder.JSONLinesType},
+		responses: map[int]interface{}{200: models.BackupSummary{}, 400: nil, 409: nil},
+	},
+
+	"GET /openapi.json": {
+		summary:   "This OpenAPI document",
+		responses: map[int]interface{}{200: map[string]interface{}{}},
+	},
+	"GET /docs": {
+		summary:   "Browse this OpenAPI document with Swagger UI",
+		responses: map[int]interface{}{200: nil},
+	},
+	"GET /docs/{asset}": {
+		summary:   "A file of the Swagger UI the docs page uses",
+		responses: map[int]interface{}{200: nil, 404: nil},
+	},
+}
+
+var pathParam = regexp.MustCompile(`{([^}]+)}`)
+
+// newOpenAPI builds the OpenAPI 3 document of a version of the api, served
+// under prefix, from its routes and the operations describing them.
+// Schemas are derived from the types of the bodies and results.
+func newOpenAPI(version, prefix string, routes []route) map[string]interface{} {
+	schemas := schemas{}
+	problem := schemas.of(reflect.TypeOf(responder.ErrorResponse{}))
+	paths := map[string]map[string]interface{}{}
+	for _, r := range routes {
+		op, ok := operations[r.method+" "+r.path]
+		if !ok {
+			continue
+		}
+		var params []interface{}
+		for _, match := range pathParam.FindAllStringSubmatch(r.path, -1) {
+			params = append(params, map[string]interface{}{
+				"name": match[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, name := range op.params {
+			param := queryParams[name]
+			params = append(params, map[string]interface{}{
+				"name": name, "in": "query", "description": param.description, "schema": map[string]interface{}{"type": param.kind},
+			})
+		}
+		for _, name := range op.headers {
+			params = append(params, map[string]interface{}{
+				"name": name, "in": "header", "description": "an ETag, as returned by the route", "schema": map[string]interface{}{"type": "string"},
+			})
+		}
+
+		types := r.types
+		if len(types) == 0 {
+			types = defaultTypes
+		}
+		responses := map[string]interface{}{}
+		for status, result := range op.responses {
+			response := map[string]interface{}{"description": http.StatusText(status)}
+			content := map[string]interface{}{}
+			switch {
+			case status == http.StatusNotModified:
+			case status >= http.StatusBadRequest && result == nil:
+				content[responder.ProblemType] = map[string]interface{}{"schema": problem}
+			default:
+				for _, mediaType := range types {
+					schema := map[string]interface{}{"type": "string"}
+					if mediaType == responder.JSONType && result != nil {
+						schema = schemas.of(reflect.TypeOf(result))
+					}
+					content[mediaType] = map[string]interface{}{"schema": schema}
+				}
+			}
+			if len(content) > 0 {
+				response["content"] = content
+			}
+			responses[strconv.Itoa(status)] = response
+		}
+		for _, status := range []int{http.StatusNotAcceptable, http.StatusInternalServerError} {
+			responses[strconv.Itoa(status)] = map[string]interface{}{
+				"description": http.StatusText(status),
+				"content":     map[string]interface{}{responder.ProblemType: map[string]interface{}{"schema": problem}},
+			}
+		}
+
+		operation := map[string]interface{}{
+			"summary":   op.summary,
+			"responses": responses,
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if op.body != nil || len(op.bodyTypes) > 0 {
+			content := map[string]interface{}{}
+			if op.body != nil {
+				content[responder.JSONType] = map[string]interface{}{"schema": schemas.of(reflect.TypeOf(op.body))}
+			}
+			for _, mediaType := range op.bodyTypes {
+				content[mediaType] = map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}
+			}
+			operation["requestBody"] = map[string]interface{}{"required": true, "content": content}
+		}
+		if paths[r.path] == nil {
+			paths[r.path] = map[string]interface{}{}
+		}
+		paths[r.path][strings.ToLower(r.method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Book Manager",
+			"version": version,
+		},
+		"servers":    []interface{}{map[string]interface{}{"url": prefix}},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+}
+
+// schemas are the named schemas of a spec, built up from the types it meets
+type schemas map[string]interface{}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// of is the schema of t as encoding/json writes it, nil slices, maps and
+// pointers as null. Named structs are added to the schemas and referred to.
+func (s schemas) of(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		return nullable(s.of(t.Elem()))
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": s.of(t.Elem()), "nullable": true}
+	case reflect.Array:
+		return map[string]interface{}{"type": "array", "items": s.of(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.of(t.Elem()), "nullable": true}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		if _, ok := s[t.Name()]; !ok {
+			// claimed before it is built, for the types that refer to
+			// themselves
+			s[t.Name()] = nil
+			s[t.Name()] = s.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// nullable is schema, also allowing null. A reference cannot have siblings,
+// so it is wrapped.
+func nullable(schema map[string]interface{}) map[string]interface{} {
+	if _, ok := schema["$ref"]; ok {
+		return map[string]interface{}{"allOf": []interface{}{schema}, "nullable": true}
+	}
+	schema["nullable"] = true
+	return schema
+}
+
+// object is the schema of a struct, which has no fields but its own. The
+// timestamps of the models that write unset ones as null are nullable.
+func (s schemas) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	s.addFields(properties, t, t.Implements(marshalerType))
+	return map[string]interface{}{"type": "object", "properties": properties, "additionalProperties": false}
+}
+
+// addFields adds the fields of a struct to properties under the names
+// encoding/json gives them, embedded structs' included
+func (s schemas) addFields(properties map[string]interface{}, t reflect.Type, nullableTimes bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				s.addFields(properties, embedded, nullableTimes)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema := s.of(field.Type)
+		if nullableTimes && field.Type == timeType {
+			schema = nullable(schema)
+		}
+		properties[name] = schema
+	}
+}
+
+// docRoutes are the routes that document a version of the api, served under
+// prefix along with its routes: the OpenAPI document and a Swagger UI page
+// to browse it, with the assets of the page
+func (s *Server) docRoutes(version, prefix string, routes []route) []route {
+	docs := []route{
+		{"GET", "/openapi.json", nil, []string{responder.JSONType}},
+		{"GET", "/docs", s.ViewDocs, []string{responder.HTMLType}},
+		{"GET", "/docs/{asset}", s.ViewDocsAsset, docsTypes},
+	}
+	spec := newOpenAPI(version, prefix, append(append([]route{}, routes...), docs...))
+	docs[0].handler = func(w http.ResponseWriter, r *http.Request) {
+		if err := responder.RespondResult(w, spec, http.StatusOK); err != nil {
+			log.Errorf("error when responding with 200 error: %v", err)
+		}
+	}
+	return docs
+}
+
+// swaggerUI is the copy of swagger-ui-dist the docs pages use, at the
+// version in swaggerui/VERSION. make swagger-ui fetches it.
+//
+//go:embed swaggerui
+var swaggerUI embed.FS
+
+// docsTypes are the media types of the docs page's assets
+var docsTypes = []string{"text/css", "text/javascript", "image/png"}
+
+// ViewDocs serves a Swagger UI page browsing the OpenAPI document next to it.
+// Swagger UI itself is the embedded copy served by ViewDocsAsset, unless
+// swaggerUIURL points elsewhere.
+func (s *Server) ViewDocs(w http.ResponseWriter, r *http.Request) {
+	swaggerUIURL := "docs"
+	if s.swaggerUIURL != "" {
+		swaggerUIURL = strings.TrimSuffix(s.swaggerUIURL, "/")
+	}
+	if err := responder.RespondHTML(w, docsTemplate, swaggerUIURL, http.StatusOK); err != nil {
+		log.Errorf("error when responding with 200 error: %v", err)
+	}
+}
+
+// ViewDocsAsset serves a file of the embedded copy of Swagger UI
+func (s *Server) ViewDocsAsset(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["asset"]
+	data, err := swaggerUI.ReadFile(path.Join("swaggerui", name))
+	if err != nil {
+		if err = responder.RespondError(w, responder.CodeNotFound, "", "", http.StatusNotFound); err != nil {
+			log.Errorf("error when responding with 404 error: %v", err)
+		}
+		return
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if _, err = w.Write(data); err != nil {
+		log.Errorf("error when responding with 200 error: %v", err)
+	}
+}
+
+var docsTemplate = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Book Manager API</title>
+<link rel="stylesheet" href="{{.}}/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="{{.}}/swagger-ui-bundle.js"></script>
+<script>
+window.ui = SwaggerUIBundle({ url: "openapi.json", dom_id: "#swagger-ui" });
+</script>
+</body>
+</html>
+`))
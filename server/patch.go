@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/gommon/log"
+
+	"github.com/john-cai/book-manager/models"
+	"github.com/john-cai/book-manager/patch"
+	"github.com/john-cai/book-manager/responder"
+)
+
+// bookFields is the part of a book that a PATCH can change, named after its
+// columns
+type bookFields struct {
+	Title              string               `json:"title"`
+	Author             string               `json:"author"`
+	Description        string               `json:"description"`
+	PublishedAt        time.Time            `json:"published_at"`
+	PublishedPrecision models.DatePrecision `json:"published_precision"`
+	Metadata           models.Metadata      `json:"metadata"`
+}
+
+func newBookFields(b *models.Book) *bookFields {
+	fields := &bookFields{
+		Title:              b.Title,
+		Author:             b.Author,
+		Description:        b.Description,
+		PublishedAt:        b.PublishedAt,
+		PublishedPrecision: b.PublishedPrecision,
+		Metadata:           b.Metadata,
+	}
+	// so that a json patch can append to it
+	if fields.Metadata.Genres == nil {
+		fields.Metadata.Genres = []string{}
+	}
+	return fields
+}
+
+func (f *bookFields) applyTo(b *models.Book) {
+	b.Title = f.Title
+	b.Author = f.Author
+	b.Description = f.Description
+	b.PublishedAt = f.PublishedAt
+	b.PublishedPrecision = f.PublishedPrecision
+	b.Metadata = f.Metadata
+}
+
+// collectionFields is the part of a collection that a PATCH can change
+type collectionFields struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+func newCollectionFields(c *models.Collection) *collectionFields {
+	return &collectionFields{Name: c.Name, Description: c.Description}
+}
+
+func (f *collectionFields) applyTo(c *models.Collection) {
+	c.Name = f.Name
+	c.Description = f.Description
+}
+
+// patchFields applies the patch in the request body to current and decodes
+// the result into patched, responding with what is wrong when it cannot.
+// The body is a merge patch or a json patch depending on its Content-Type.
+// Members that current does not have cannot be patched in.
+func patchFields(w http.ResponseWriter, r *http.Request, current, patched interface{}) bool {
+	var apply func(doc, p []byte) ([]byte, error)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case patch.MergePatchType:
+		apply = patch.Merge
+	case patch.JSONPatchType:
+		apply = patch.Apply
+	default:
+		respondPatchErrors(w, responder.CodeUnsupportedMediaType, []responder.Error{{
+			Field:   "Content-Type",
+			Message: "must be " + patch.MergePatchType + " or " + patch.JSONPatchType,
+		}}, http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondPatchErrors(w, responder.CodeMalformedRequest, []responder.Error{{Message: "could not read request"}}, http.StatusBadRequest)
+		return false
+	}
+	doc, err := json.Marshal(current)
+	if err != nil {
+		respondPatchErrors(w, responder.CodeInternal, []responder.Error{{Message: "something went wrong"}}, http.StatusInternalServerError)
+		return false
+	}
+	result, err := apply(doc, body)
+	if err != nil {
+		if opErr, ok := err.(*patch.OpError); ok {
+			respondPatchErrors(w, responder.CodePatchFailed, []responder.Error{{
+				Field:   opErr.Op.Path,
+				Code:    models.CodePatchFailed,
+				Message: opErr.Error(),
+			}}, http.StatusConflict)
+			return false
+		}
+		respondPatchErrors(w, responder.CodeMalformedRequest, []responder.Error{{Message: err.Error()}}, http.StatusBadRequest)
+		return false
+	}
+
+	before, err := fieldColumns(current)
+	if err != nil {
+		respondPatchErrors(w, responder.CodeInternal, []responder.Error{{Message: "something went wrong"}}, http.StatusInternalServerError)
+		return false
+	}
+	var after map[string]json.RawMessage
+	if err = json.Unmarshal(result, &after); err != nil {
+		respondPatchErrors(w, responder.CodeValidationFailed, []responder.Error{{Message: "the patched document must be an object"}}, http.StatusBadRequest)
+		return false
+	}
+	var errs []responder.Error
+	for _, field := range sortedKeys(after) {
+		if _, ok := before[field]; !ok {
+			errs = append(errs, responder.Error{Field: field, Code: models.CodeInvalid, Message: "cannot be patched"})
+		}
+	}
+	if len(errs) > 0 {
+		respondPatchErrors(w, responder.CodeValidationFailed, errs, http.StatusBadRequest)
+		return false
+	}
+	if err = json.NewDecoder(bytes.NewReader(result)).Decode(patched); err != nil {
+		field := ""
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			field = typeErr.Field
+		}
+		respondPatchErrors(w, responder.CodeValidationFailed, []responder.Error{{Field: field, Code: models.CodeInvalid, Message: "has the wrong type"}}, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// changedColumns lists the members of two versions of the same fields whose
+// values differ
+func changedColumns(before, after interface{}) ([]string, error) {
+	beforeColumns, err := fieldColumns(before)
+	if err != nil {
+		return nil, err
+	}
+	afterColumns, err := fieldColumns(after)
+	if err != nil {
+		return nil, err
+	}
+	var columns []string
+	for _, column := range sortedKeys(afterColumns) {
+		if !bytes.Equal(beforeColumns[column], afterColumns[column]) {
+			columns = append(columns, column)
+		}
+	}
+	return columns, nil
+}
+
+func fieldColumns(fields interface{}) (map[string]json.RawMessage, error) {
+	doc, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	var columns map[string]json.RawMessage
+	if err = json.Unmarshal(doc, &columns); err != nil {
+		return nil, err
+	}
+	return columns, nil
+}
+
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func respondPatchErrors(w http.ResponseWriter, code string, errs []responder.Error, httpStatus int) {
+	if err := responder.RespondErrors(w, code, errs, httpStatus); err != nil {
+		log.Errorf("error when responding with %d error: %v", httpStatus, err)
+	}
+}
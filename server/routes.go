@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Path prefixes of the versions of the api
+const (
+	v1Prefix = "/api/v1"
+	v2Prefix = "/api/v2"
+)
+
+// legacyDeprecatedAt is when the routes outside /api/v1 were deprecated, and
+// legacySunset when they are to be removed
+var (
+	legacyDeprecatedAt = time.Date(2026, time.October, 17, 0, 0, 0, 0, time.UTC)
+	legacySunset       = time.Date(2027, time.October, 17, 0, 0, 0, 0, time.UTC)
+)
+
+// route is one endpoint of a version of the api
+type route struct {
+	method  string
+	path    string
+	handler http.HandlerFunc
+	// types are the media types the route answers with, the first being the
+	// one a request without Accept gets. Empty means defaultTypes.
+	types []string
+}
+
+// v1Routes are the routes of /api/v1, which are also served, deprecated, at
+// the root
+func (s *Server) v1Routes() []route {
+	return []route{
+		{"POST", "/books", s.AddBook, nil},
+		{"GET", "/books", s.ViewBooks, bookListTypes},
+		{"GET", "/books/export", s.ExportBooks, bookExportTypes},
+		{"POST", "/books/import", s.ImportBooks, nil},
+		{"GET", "/books/{isbn}", s.ViewBook, nil},
+		{"PUT", "/books/{isbn}", s.EditBook, nil},
+		{"PATCH", "/books/{isbn}", s.PatchBook, nil},
+		{"DELETE", "/books/{isbn}", s.RemoveBook, nil},
+		{"POST", "/books/{isbn}/restore", s.RestoreBook, nil},
+
+		{"POST", "/collections", s.AddCollection, nil},
+		{"GET", "/collections", s.ViewCollections, collectionListTypes},
+		{"GET", "/collections/{collection}", s.ViewCollection, nil},
+		{"PUT", "/collections/{collection}", s.EditCollection, nil},
+		{"PATCH", "/collections/{collection}", s.PatchCollection, nil},
+		{"DELETE", "/collections/{collection}", s.RemoveCollection, nil},
+		{"POST", "/collections/{collection}/addbooks", s.AddBooksToCollection, nil},
+		{"POST", "/collections/{collection}/removebooks", s.RemoveBooksFromCollection, nil},
+		{"POST", "/collections/{collection}/restore", s.RestoreCollection, nil},
+		{"GET", "/collections/{collection}/history", s.ViewCollectionHistory, nil},
+
+		{"GET", "/trash", s.ViewTrash, nil},
+
+		{"GET", "/export/full", s.ExportFull, backupTypes},
+		{"POST", "/import/full", s.ImportFull, nil},
+	}
+}
+
+// v2Routes are the routes of /api/v2: those of v1, with the books of a
+// collection as resources of their own in place of the addbooks and
+// removebooks actions
+func (s *Server) v2Routes() []route {
+	var routes []route
+	for _, r := range s.v1Routes() {
+		if strings.HasSuffix(r.path, "/addbooks") || strings.HasSuffix(r.path, "/removebooks") {
+			continue
+		}
+		routes = append(routes, r)
+	}
+	return append(routes,
+		route{"GET", "/collections/{collection}/books", s.ViewCollectionBooks, bookListTypes},
+		route{"POST", "/collections/{collection}/books", s.AddCollectionBooks, nil},
+		route{"PUT", "/collections/{collection}/books/{isbn}", s.AddCollectionBook, nil},
+		route{"DELETE", "/collections/{collection}/books/{isbn}", s.RemoveCollectionBook, nil},
+	)
+}
+
+// mount serves routes on router, each through wrap when it is not nil. The
+// requests to routes the OpenAPI spec describes are validated against it.
+func (s *Server) mount(router *mux.Router, routes []route, wrap func(http.Handler) http.Handler) {
+	maxBodySize := s.maxBodySize
+	if maxBodySize == 0 {
+		maxBodySize = defaultMaxBodySize
+	}
+	for _, r := range routes {
+		types := r.types
+		if len(types) == 0 {
+			types = defaultTypes
+		}
+		var handler http.Handler = r.handler
+		if op, ok := operations[r.method+" "+r.path]; ok {
+			handler = validate(op, maxBodySize, handler)
+		}
+		handler = negotiate(types, handler)
+		if wrap != nil {
+			handler = wrap(handler)
+		}
+		router.Handle(r.path, handler).Methods(r.method)
+	}
+}
+
+// deprecated marks the responses of the routes outside /api/v1 as deprecated
+// (RFC 9745), says when the routes go away (RFC 8594) and links to the same
+// resource under /api/v1
+func deprecated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", legacyDeprecatedAt.Unix()))
+		w.Header().Set("Sunset", legacySunset.Format(http.TimeFormat))
+		w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, v1Prefix+r.URL.RequestURI()))
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,18 +1,97 @@
 package server
 
 import (
+	"fmt"
+	"net/http"
 	"os"
+	"strconv"
 
 	"github.com/gorilla/mux"
+	"github.com/labstack/gommon/log"
+	"github.com/pborman/uuid"
+
 	"github.com/john-cai/book-manager/database"
+	"github.com/john-cai/book-manager/responder"
+)
+
+const (
+	defaultPageSize    = 20
+	defaultMaxPageSize = 100
 )
 
 type Server struct {
 	*mux.Router
-	database *database.Database
+	database     database.Store
+	maxPageSize  int
+	deletePolicy database.CascadePolicy
+	// requireIfMatch makes edits without an If-Match header fail with 428
+	requireIfMatch bool
+	// maxBodySize limits the size of request bodies, streamed imports
+	// aside
+	maxBodySize int64
+	// swaggerUIURL is where the docs pages load Swagger UI from, when not
+	// from the embedded copy
+	swaggerUIURL string
+}
+
+// NewServer creates a server on top of the store configured in the
+// environment. It refuses to start when the schema has pending migrations,
+// unless AUTO_MIGRATE=true in which case they are applied first.
+// MAX_PAGE_SIZE caps the limit accepted by listing endpoints, and
+// CASCADE_POLICY (restrict, cascade or detach, cascade by default) decides
+// what deleting a book or collection does to its memberships.
+// REQUIRE_IF_MATCH=true refuses edits that do not say which version they
+// are based on. SWAGGER_UI_URL serves the docs pages with a copy of
+// swagger-ui-dist other than the embedded one. MAX_BODY_SIZE is the
+// largest request body in bytes accepted by any route but the imports.
+func NewServer() (*Server, error) {
+	store, err := OpenStore()
+	if err != nil {
+		return nil, err
+	}
+	if err = checkSchema(store, os.Getenv("AUTO_MIGRATE") == "true"); err != nil {
+		return nil, err
+	}
+
+	maxPageSize := defaultMaxPageSize
+	if os.Getenv("MAX_PAGE_SIZE") != "" {
+		if maxPageSize, err = strconv.Atoi(os.Getenv("MAX_PAGE_SIZE")); err != nil || maxPageSize < 1 {
+			return nil, fmt.Errorf("MAX_PAGE_SIZE must be a positive number")
+		}
+	}
+
+	var maxBodySize int64 = defaultMaxBodySize
+	if os.Getenv("MAX_BODY_SIZE") != "" {
+		if maxBodySize, err = strconv.ParseInt(os.Getenv("MAX_BODY_SIZE"), 10, 64); err != nil || maxBodySize < 1 {
+			return nil, fmt.Errorf("MAX_BODY_SIZE must be a positive number")
+		}
+	}
+
+	deletePolicy, err := database.ParseCascadePolicy(os.Getenv("CASCADE_POLICY"))
+	if err != nil {
+		return nil, fmt.Errorf("CASCADE_POLICY %v", err)
+	}
+
+	s := &Server{
+		Router:         mux.NewRouter(),
+		database:       store,
+		maxPageSize:    maxPageSize,
+		deletePolicy:   deletePolicy,
+		requireIfMatch: os.Getenv("REQUIRE_IF_MATCH") == "true",
+		maxBodySize:    maxBodySize,
+		swaggerUIURL:   os.Getenv("SWAGGER_UI_URL"),
+	}
+	s.configureRoutes()
+
+	return s, nil
 }
 
-func NewServer() *Server {
+// OpenStore opens the store described by DATABASE_URL, falling back to the
+// POSTGRES_* variables
+func OpenStore() (database.Store, error) {
+	if databaseURL := os.Getenv("DATABASE_URL"); databaseURL != "" {
+		return database.Open(databaseURL)
+	}
 	postgresUser := os.Getenv("POSTGRES_USER")
 	postgresAddr := os.Getenv("POSTGRES_ADDR")
 	postgresDB := os.Getenv("POSTGRES_DB")
@@ -22,30 +101,81 @@ func NewServer() *Server {
 		postgresDB,
 	)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	return database, nil
+}
 
-	s := &Server{
-		Router:   mux.NewRouter(),
-		database: database,
+func checkSchema(store database.Store, autoMigrate bool) error {
+	migratable, ok := store.(database.Migratable)
+	if !ok {
+		return nil
 	}
-	s.configureRoutes()
+	migrator, err := migratable.Migrator()
+	if err != nil {
+		return err
+	}
+	if autoMigrate {
+		_, err = migrator.Up()
+		return err
+	}
+	pending, err := migrator.Pending()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("database schema is behind by %d migration(s), run `bookmanager migrate up` first", len(pending))
+	}
+	return nil
+}
 
-	return s
+// ServeHTTP gives every request an id, the one in its X-Request-ID header
+// when the client sent a usable one, and sends it back in the response
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(responder.RequestIDHeader)
+	if !validRequestID(id) {
+		id = uuid.New()
+	}
+	w.Header().Set(responder.RequestIDHeader, id)
+	s.Router.ServeHTTP(w, r)
+}
+
+// validRequestID reports whether a client's request id can be repeated in
+// responses and logs: up to 128 visible ASCII characters
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// notFound answers requests for routes that do not exist
+func notFound(w http.ResponseWriter, r *http.Request) {
+	if err := responder.RespondError(w, responder.CodeNotFound, "there is nothing at "+r.URL.Path, "", http.StatusNotFound); err != nil {
+		log.Errorf("error when responding with 404 error: %v", err)
+	}
+}
+
+// methodNotAllowed answers requests for routes that exist, but not with the
+// request's method
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	if err := responder.RespondError(w, responder.CodeMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path, "", http.StatusMethodNotAllowed); err != nil {
+		log.Errorf("error when responding with 405 error: %v", err)
+	}
 }
 
 func (s *Server) configureRoutes() {
-	s.HandleFunc("/books", s.AddBook).Methods("POST")
-	s.HandleFunc("/books", s.ViewBooks).Methods("GET")
-	s.HandleFunc("/books/{isbn}", s.ViewBook).Methods("GET")
-	s.HandleFunc("/books/{isbn}", s.EditBook).Methods("PUT")
-	s.HandleFunc("/books/{isbn}", s.RemoveBook).Methods("DELETE")
-
-	s.HandleFunc("/collections", s.AddCollection).Methods("POST")
-	s.HandleFunc("/collections", s.ViewCollections).Methods("GET")
-	s.HandleFunc("/collections/{collection_id}", s.ViewCollection).Methods("GET")
-	s.HandleFunc("/collections/{collection_id}", s.EditCollection).Methods("PUT")
-	s.HandleFunc("/collections/{collection_id}", s.RemoveCollection).Methods("DELETE")
-	s.HandleFunc("/collections/{collection_id}/addbooks", s.AddBooksToCollection).Methods("POST")
-	s.HandleFunc("/collections/{collection_id}/removebooks", s.RemoveBooksFromCollection).Methods("POST")
+	s.NotFoundHandler = http.HandlerFunc(notFound)
+	s.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+
+	v1, v2 := s.v1Routes(), s.v2Routes()
+	s.mount(s.PathPrefix(v1Prefix).Subrouter(), append(v1, s.docRoutes("v1", v1Prefix, v1)...), nil)
+	s.mount(s.PathPrefix(v2Prefix).Subrouter(), append(v2, s.docRoutes("v2", v2Prefix, v2)...), nil)
+	// the routes from before the api was versioned
+	s.mount(s.Router, v1, deprecated)
 }
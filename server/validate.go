@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/gommon/log"
+
+	"github.com/john-cai/book-manager/models"
+	"github.com/john-cai/book-manager/responder"
+)
+
+// defaultMaxBodySize is the largest request body accepted, streamed imports
+// aside, unless MAX_BODY_SIZE says otherwise
+const defaultMaxBodySize = 1 << 20
+
+// validator checks requests against the OpenAPI schema of their route
+// before they reach its handler
+type validator struct {
+	op      operation
+	schemas schemas
+	// body is the schema of a JSON body, nil when the route takes none
+	body map[string]interface{}
+	// maxBodySize limits bodies, 0 when they are streamed and unlimited
+	maxBodySize int64
+}
+
+// validate answers 400 for the requests to a route whose query parameters
+// or JSON body do not match its schema, listing every problem found, and
+// 413 for those whose body is larger than maxBodySize
+func validate(op operation, maxBodySize int64, next http.Handler) http.Handler {
+	v := newValidator(op, maxBodySize)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		errs := v.query(r)
+		if v.maxBodySize > 0 && r.Body != nil {
+			body, err := ioutil.ReadAll(io.LimitReader(r.Body, v.maxBodySize+1))
+			if err != nil {
+				if err = responder.RespondError(w, responder.CodeMalformedRequest, "could not read request", "", http.StatusBadRequest); err != nil {
+					log.Errorf("error when responding with 400 error: %v", err)
+				}
+				return
+			}
+			if int64(len(body)) > v.maxBodySize {
+				message := fmt.Sprintf("the body exceeds the maximum of %d bytes", v.maxBodySize)
+				if err = responder.RespondError(w, responder.CodeBodyTooLarge, message, "", http.StatusRequestEntityTooLarge); err != nil {
+					log.Errorf("error when responding with 413 error: %v", err)
+				}
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			if v.body != nil && len(bytes.TrimSpace(body)) > 0 {
+				bodyErrs, err := v.json(body)
+				if err != nil {
+					if err = responder.RespondError(w, responder.CodeMalformedRequest, "the body is not valid JSON: "+err.Error(), "", http.StatusBadRequest); err != nil {
+						log.Errorf("error when responding with 400 error: %v", err)
+					}
+					return
+				}
+				errs = append(errs, bodyErrs...)
+			}
+		}
+		if len(errs) > 0 {
+			if err := responder.RespondErrors(w, responder.CodeValidationFailed, errs, http.StatusBadRequest); err != nil {
+				log.Errorf("error when responding with 400 error: %v", err)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newValidator prepares the checks of the requests to the route op
+// describes. Bodies of routes that stream them are not limited.
+func newValidator(op operation, maxBodySize int64) *validator {
+	v := &validator{op: op, schemas: schemas{}, maxBodySize: maxBodySize}
+	if op.body != nil {
+		v.body = v.schemas.of(reflect.TypeOf(op.body))
+	}
+	for _, mediaType := range op.bodyTypes {
+		if mediaType == responder.CSVType || mediaType == responder.JSONLinesType {
+			v.maxBodySize = 0
+		}
+	}
+	return v
+}
+
+// json checks a JSON document against the schema of the route's body,
+// failing when it is not valid JSON
+func (v *validator) json(data []byte) ([]responder.Error, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return v.value(v.body, value, "", ""), nil
+}
+
+// query checks the query parameters of r are those of the route, of the
+// types they are described with
+func (v *validator) query(r *http.Request) []responder.Error {
+	known := map[string]bool{}
+	for _, name := range v.op.params {
+		known[name] = true
+	}
+	query := r.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []responder.Error
+	for _, name := range names {
+		if !known[name] {
+			errs = append(errs, responder.Error{Field: name, Code: models.CodeUnknownField, Message: "unknown query parameter"})
+			continue
+		}
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		var err error
+		switch queryParams[name].kind {
+		case "integer":
+			_, err = strconv.Atoi(value)
+		case "boolean":
+			_, err = strconv.ParseBool(value)
+		}
+		if err != nil {
+			errs = append(errs, responder.Error{Field: name, Code: models.CodeInvalidType, Message: "must be " + article(queryParams[name].kind)})
+		}
+	}
+	return errs
+}
+
+// value checks a value decoded from a JSON body against schema, returning
+// a problem for each part of it that does not match. pointer and field are
+// where the value is in the body, as a JSON pointer and as a field path.
+func (v *validator) value(schema map[string]interface{}, value interface{}, pointer, field string) []responder.Error {
+	if ref, ok := schema["$ref"].(string); ok {
+		schema = v.schemas[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]interface{})
+	}
+	invalid := func(code, message string) []responder.Error {
+		return []responder.Error{{Field: field, Pointer: pointer, Code: code, Message: message}}
+	}
+	if value == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		return invalid(models.CodeInvalidType, "must not be null")
+	}
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		return v.value(allOf[0].(map[string]interface{}), value, pointer, field)
+	}
+
+	kind, _ := schema["type"].(string)
+	switch kind {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return invalid(models.CodeInvalidType, "must be an object")
+		}
+		return v.object(schema, object, pointer, field)
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return invalid(models.CodeInvalidType, "must be an array")
+		}
+		var errs []responder.Error
+		for i, item := range array {
+			errs = append(errs, v.value(schema["items"].(map[string]interface{}), item, pointer+"/"+strconv.Itoa(i), fmt.Sprintf("%s[%d]", field, i))...)
+		}
+		return errs
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return invalid(models.CodeInvalidType, "must be a string")
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				return invalid(models.CodeInvalid, "must be a date and time such as 1894-05-01T00:00:00Z")
+			}
+		}
+	case "integer":
+		number, ok := value.(json.Number)
+		if _, err := number.Int64(); !ok || err != nil {
+			return invalid(models.CodeInvalidType, "must be an integer")
+		}
+	case "number":
+		if _, ok := value.(json.Number); !ok {
+			return invalid(models.CodeInvalidType, "must be a number")
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return invalid(models.CodeInvalidType, "must be a boolean")
+		}
+	}
+	return nil
+}
+
+// object checks the members of a JSON object against the properties of
+// schema. Like encoding/json, it matches their names regardless of case.
+func (v *validator) object(schema map[string]interface{}, object map[string]interface{}, pointer, field string) []responder.Error {
+	properties, _ := schema["properties"].(map[string]interface{})
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []responder.Error
+	for _, name := range names {
+		memberPointer := pointer + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+		memberField := name
+		if field != "" {
+			memberField = field + "." + name
+		}
+		property, ok := properties[name].(map[string]interface{})
+		if !ok {
+			for known := range properties {
+				if strings.EqualFold(known, name) {
+					property, ok = properties[known].(map[string]interface{})
+				}
+			}
+		}
+		if !ok {
+			property, ok = schema["additionalProperties"].(map[string]interface{})
+		}
+		if !ok {
+			if schema["additionalProperties"] == false {
+				errs = append(errs, responder.Error{Field: memberField, Pointer: memberPointer, Code: models.CodeUnknownField, Message: "unknown field"})
+			}
+			continue
+		}
+		errs = append(errs, v.value(property, object[name], memberPointer, memberField)...)
+	}
+	return errs
+}
+
+// article is kind, a type of the schema, with its indefinite article
+func article(kind string) string {
+	if strings.IndexAny(kind[:1], "aeiou") == 0 {
+		return "an " + kind
+	}
+	return "a " + kind
+}